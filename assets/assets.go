@@ -72,7 +72,7 @@ func (fi bindataFileInfo) Sys() interface{} {
 	return nil
 }
 
-var _bakeLua = []byte("\x1f\x8b\x08\x00\x00\x09\x6e\x88\x00\xff\x4a\x4a\xcc\x4e\x55\xb0\x55\xa8\xae\xe5\xe2\x4a\x2b\xcd\x4b\x2e\xc9\xcc\xcf\x53\x00\x89\xe9\x25\xe7\x17\x54\x6a\x14\x17\x25\xeb\x28\xa4\x14\x97\x68\x72\x29\x28\xe8\xea\x2a\x84\xf8\xbb\xf8\x5b\x29\x38\xa6\xa4\x28\x24\xe7\xe7\xe6\x26\xe6\xa5\x28\x94\xe4\x2b\x80\x14\x2a\xa4\x65\xe6\xa4\xea\x71\xa5\xe6\xa5\x20\x19\x93\x96\x5f\x94\x9a\x98\x9c\xa1\x91\x96\x87\xa1\x1d\x2a\x85\x6c\x4c\x49\x62\x51\x7a\x6a\x09\xc4\x0c\x40\x00\x00\x00\xff\xff\x32\x5f\x50\x7f\x95\x00\x00\x00")
+var _bakeLua = []byte("\x1f\x8b\x08\x00\x00\x00\x00\x00\x02\xff\x6d\x92\x41\x4e\xc3\x30\x10\x45\xf7\x39\xc5\x57\x36\x34\x28\xcd\x01\x90\xba\x01\x6e\x81\x50\x35\x89\x27\xcd\x08\xd7\x8e\x3c\x4e\xa1\x42\xdc\x1d\x3b\x69\x83\x5a\xb1\xf0\xca\xf3\xdf\xcc\xff\x33\x2d\x7d\x30\x76\xf8\xfe\x29\x8a\xed\x16\x2f\x64\xad\xa2\x77\x9b\x91\xe2\x50\xc3\xd1\x91\x2b\xf4\x3e\x80\xa9\x1b\xd0\x8b\x65\x1c\x29\x76\x83\xb8\x03\x08\x07\xeb\x5b\xa4\xca\xc8\xc1\x21\xb0\xa5\x28\x27\x46\xf4\x88\x03\x67\xda\x73\x62\x67\xcd\x83\xc2\x48\xe0\x2e\xfa\x70\xae\x21\x2e\x6b\x06\xf8\x60\x38\x34\x28\x1f\x1f\xcb\x05\xca\x0a\x72\x67\xb8\xe9\xd8\x72\x80\xef\x57\x91\xb0\x66\x1c\x39\x33\x4f\x04\xd1\xdc\x61\xa1\x7c\x4a\x1c\xfc\x14\x21\x51\xc1\x5f\x91\x9d\x8a\x77\x0d\x5e\xff\xa4\x50\xa6\x90\xe8\x06\x14\xe6\xb1\xd2\x4f\xee\x6d\xa0\x1e\x64\x4c\xf6\x92\x1c\x06\x3e\xfa\xd3\xe2\x6b\xb5\x38\x1b\xee\x68\xd2\x3c\x5a\xaa\x18\x29\x28\x37\x45\x3f\xb9\x2e\xa6\x36\x39\x99\x1c\xcc\xe6\x92\x41\x9d\x92\xab\x0a\x80\x54\x39\xc4\x4d\x3c\x8f\x7c\xfd\xaa\xb0\xdb\xa1\xd4\x18\x12\xb6\xac\x51\x8a\x3b\x91\x15\x73\x25\xac\x29\x66\xcd\x13\x4a\x34\x0d\x6e\xe4\xf7\xd8\xfe\x42\xbc\x8e\xf2\x1f\x73\x1d\xf3\x1e\xda\x67\x5e\x02\x5a\xdf\x91\x9d\x63\xd4\x65\xd7\x9a\x2e\x61\xbf\x6f\xd3\xda\xf6\x79\xb7\x6b\xf7\x54\x9b\x8f\x40\xea\x25\xf3\xb4\x41\x19\x49\x82\xce\x67\xa2\x15\x8c\x4f\x15\xb8\xbd\x1b\x7d\x93\xf7\x2c\x64\x67\x8a\xfc\x7e\x01\x89\xcc\xee\xda\x69\x02\x00\x00")
 
 func bakeLuaBytes() ([]byte, error) {
 	return bindataRead(
@@ -87,12 +87,12 @@ func bakeLua() (*asset, error) {
 		return nil, err
 	}
 
-	info := bindataFileInfo{name: "bake.lua", size: 149, mode: os.FileMode(420), modTime: time.Unix(1445379615, 0)}
+	info := bindataFileInfo{name: "bake.lua", size: 617, mode: os.FileMode(420), modTime: time.Unix(1792335376, 0)}
 	a := &asset{bytes: bytes, info:  info}
 	return a, nil
 }
 
-var _dockerLua = []byte("\x1f\x8b\x08\x00\x00\x09\x6e\x88\x00\xff\x6c\x90\x41\x6a\xc3\x30\x10\x45\xf7\x3e\xc5\x47\xdd\xd8\xe0\x04\x7a\x00\x9f\xa4\x74\x21\x4b\xe3\x44\xc4\x1e\x09\x79\x04\x2d\xa5\x77\xaf\x46\xca\xa6\x90\x8d\x17\x33\x6f\xde\xff\x96\x8f\xee\x41\x19\x0b\x7e\x7e\x87\x61\x2b\xec\x24\x44\x46\x9f\x5e\xd7\x12\x76\x3f\x26\x2b\xf7\x19\x36\xdf\xce\x69\x00\x2e\x17\xb8\xc8\xa7\xe4\xe2\x04\x81\x83\x04\xbb\xc3\x3c\x35\xed\xc0\x54\xe0\x38\x2c\xfb\x4a\xbb\xc3\xab\xfb\xb9\x37\x33\x4c\x47\x6a\x58\x53\xd9\x94\x88\xbd\xca\xcb\x41\x2c\x67\x9d\x86\x0d\xf2\x9d\x68\x6c\x81\x58\x16\x18\xb1\xeb\x4e\x06\x72\x27\xae\x7b\x60\x8b\x19\x61\x79\x9f\xdf\x14\xa9\x5d\xdb\x10\x68\xd8\x35\xf0\x49\x59\xc6\x1a\xdc\x3b\x7f\x84\xcf\xa9\x01\xd4\x0a\xe9\xf7\x5f\x74\xb2\xee\x61\x6f\x04\x89\x58\xa9\xff\xc0\xf0\xca\xa5\xaf\xa0\x22\x75\x7c\x91\x1b\x3b\x51\x58\xef\x95\x98\xa6\x41\xdd\x7f\x01\x00\x00\xff\xff\x28\x97\xba\xb9\x50\x01\x00\x00")
+var _dockerLua = []byte("\x1f\x8b\x08\x00\x00\x00\x00\x00\x02\x03\x6d\x50\x4b\x6a\xc3\x30\x10\xdd\xfb\x14\x0f\x75\x63\x43\x12\xe8\x01\x7c\x92\xd2\x85\x2c\x8d\x13\x11\x7b\x2c\xa4\x11\xa4\x94\xde\xbd\x1a\xc9\x9b\x42\x37\x12\xcc\xbc\xdf\x3c\x7f\xb8\x27\x25\xcc\xf8\xfe\x19\x86\xb5\xb0\x93\x70\x30\x7c\x9b\xde\x96\x12\x36\x3f\x46\x2b\x8f\x0b\x6c\xba\xe7\x69\x00\xae\x57\xb8\x83\xb3\xa4\xe2\x04\x81\x83\x04\xbb\xc1\x74\x02\x1a\xc1\x54\xc0\xbe\x5b\xf6\x15\xed\x76\xaf\xda\xe7\xde\x5c\x60\x3a\xa4\x9a\x35\x29\x1b\x23\xb1\x57\xf1\xb2\x13\x4b\xae\xd3\xb0\x42\xbe\x22\x8d\xcd\x10\xf3\x0c\x23\x76\xd9\xc8\x40\x1e\xc4\x75\x0f\xac\x47\x42\x98\xdf\x2f\x6f\x0a\xa9\x59\xdb\x10\x68\xb0\x5b\xe0\x4c\x49\xc6\x6a\xdc\x33\x7f\x84\xcf\xa9\x01\xa8\x05\xd2\xf7\x8f\x75\xb4\xee\x69\xef\x04\x39\xb0\x50\x3f\x60\xf8\x4f\x4b\x5b\x98\x4e\xaa\xa4\x4a\xd2\x3c\x55\x4e\x42\x3a\x69\xda\x8b\xd0\x4b\x60\x33\x2c\xd7\x6e\x62\x11\xbd\x47\xff\x3c\x76\x3e\xa0\x19\x5e\xe4\xc6\xee\x50\x58\xfd\xd5\x61\x9a\x06\xcd\xf6\x0b\xd5\x5e\xf8\xcc\x90\x01\x00\x00")
 
 func dockerLuaBytes() ([]byte, error) {
 	return bindataRead(
@@ -107,7 +107,7 @@ func dockerLua() (*asset, error) {
 		return nil, err
 	}
 
-	info := bindataFileInfo{name: "docker.lua", size: 336, mode: os.FileMode(420), modTime: time.Unix(1445895446, 0)}
+	info := bindataFileInfo{name: "docker.lua", size: 400, mode: os.FileMode(420), modTime: time.Unix(1792331586, 0)}
 	a := &asset{bytes: bytes, info:  info}
 	return a, nil
 }
@@ -152,7 +152,7 @@ func goLua() (*asset, error) {
 	return a, nil
 }
 
-var _shimLua = []byte("\x1f\x8b\x08\x00\x00\x09\x6e\x88\x00\xff\x74\x90\x51\x4e\xc4\x30\x0c\x44\xff\x7b\x8a\x51\xbe\x1a\xa9\xdb\x03\x20\xf5\x2c\x51\xda\xb8\xc5\x62\xf1\x56\x8d\x41\x20\xc4\xdd\x71\xba\x0b\x0d\x1f\xfd\xcc\x64\xe6\xcd\xc8\xf3\x9b\x4c\xca\x37\x81\xc6\x6d\x21\x6d\x25\xbe\x52\x87\x44\x2b\x49\x22\x99\x98\x72\x87\x59\x7c\x03\xc4\x9c\x69\xd3\x56\x3f\x57\xda\x5d\x1e\xc3\x00\x97\x75\x63\x59\x5c\x07\xc7\xf2\x1e\xaf\x9c\x1e\x20\x14\x0b\x8a\xf9\x09\x0e\x7d\x8f\x23\xe7\x1b\xa3\x5d\x2e\x86\xc5\x14\x05\x23\x61\x2d\xec\x04\x16\x2b\x41\xa6\xe9\x26\x09\x46\xe9\xcd\xc7\xf3\x3d\x59\x2f\xba\x37\xff\x2e\x77\xd0\x67\x12\xb3\xa2\x10\x87\x7f\xdb\x77\xb5\x16\xec\xff\xeb\xdb\x54\x13\xca\x8a\x10\xc6\xf8\x42\x61\xa4\x85\x25\x9c\x5e\xc0\x57\x3b\xec\x16\xe7\xed\xad\x7f\xa0\xff\xc8\xf6\xa8\xb9\xbe\xd9\x8b\x8f\xa3\xb3\x5e\xa9\x55\xfa\x50\x7f\x64\x32\x69\xa8\x3f\xf6\xc8\x4f\x00\x00\x00\xff\xff\xdf\x82\x47\xc1\xa8\x01\x00\x00")
+var _shimLua = []byte("\x1f\x8b\x08\x00\x00\x00\x00\x00\x02\xff\x75\x92\x51\x6e\x84\x30\x0c\x44\xff\x39\xc5\x28\x52\x25\x22\xed\x72\x80\x4a\x5c\xa1\x57\x40\x81\x38\x10\x15\xbc\x88\x98\x6e\xab\xaa\x77\xaf\x61\xe9\x42\x3f\xf8\x64\x32\x33\x7e\x71\x08\x33\x37\x12\x6f\x0c\x71\x53\x4b\x92\xb3\x1b\xe8\x02\x4f\x23\xb1\x27\x6e\x22\xa5\x0b\x02\xdb\x0c\x70\x29\xd1\x24\xb9\x7c\x8d\xb4\xba\x2c\xca\x12\x26\xc9\x14\xb9\x35\x17\x98\xc8\x1f\xae\x8f\x7e\x2b\xc2\x62\xc1\x62\x7e\x85\x41\x51\x60\xcf\xd9\x4c\xdb\xae\x57\xad\x45\xe3\x18\x35\x61\x5c\xba\x3d\x22\xeb\x10\x24\x6a\x6e\xec\xa1\x2d\x85\xfa\x62\x78\x24\x8f\x44\x8f\xc9\x61\x23\x37\x90\x8e\x58\xad\x58\x1a\xcb\x7f\xec\xab\x7a\x14\xf4\xfc\xfb\x47\x55\x15\x36\x8a\x37\x45\x4a\xb8\x47\xe9\xe0\x60\x5e\x0c\x92\xd0\xa0\x99\x10\x99\x54\x99\xe6\x9e\x14\xb3\xef\x95\xef\xae\x73\x54\x1a\x9c\x34\x9d\x5e\xfa\xef\xa6\x31\x81\x89\x3c\xf9\x8d\xb7\xaa\x6a\xf7\x4e\x95\xf3\xbe\x5a\xd2\x67\x2b\xdd\xb1\x27\x92\x79\xe2\x9d\x6a\x2b\xa8\xa9\x8d\x5c\x9d\xbe\x8b\x3d\x6c\x67\xa9\x3b\xdd\x49\x6e\xb7\xea\x67\xb3\x7e\x1c\x7b\x6d\xb6\x0e\x0e\xcf\x5f\x21\x8a\x62\x0b\x7d\x8a\xdd\x33\x89\xa4\x3a\x1e\xac\x91\x5f\x5c\x25\x40\x9d\x3e\x02\x00\x00")
 
 func shimLuaBytes() ([]byte, error) {
 	return bindataRead(
@@ -167,7 +167,7 @@ func shimLua() (*asset, error) {
 		return nil, err
 	}
 
-	info := bindataFileInfo{name: "shim.lua", size: 424, mode: os.FileMode(420), modTime: time.Unix(1445712746, 0)}
+	info := bindataFileInfo{name: "shim.lua", size: 574, mode: os.FileMode(420), modTime: time.Unix(1792335099, 0)}
 	a := &asset{bytes: bytes, info:  info}
 	return a, nil
 }
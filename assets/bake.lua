@@ -1,9 +1,15 @@
 bake = {}
 
-function bake.copy(src, dst)
-  -- TODO: Add command to copy file.
-end
+-- Calls fn(path, name) for each file matching a glob pattern relative to the
+-- Bakefile's directory, in path order. "**" matches any number of directories
+-- and name is the path without its extension. Directories searched are
+-- recorded so adding or removing a matching file causes a reparse.
+function foreach(pattern, fn)
+  assert(type(pattern) == "string", "invalid foreach pattern type: " .. type(pattern))
+  assert(type(fn) == "function", "invalid foreach function type: " .. type(fn))
 
-function foreach(fn)
-  -- TODO: Add foreach command to target.
+  local paths, names = __bake_glob(pattern)
+  for i, path in ipairs(paths) do
+    fn(path, names[i])
+  end
 end
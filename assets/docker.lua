@@ -13,6 +13,9 @@ function docker.build(path, args)
 
   -- append package to be build
   table.insert(cmd, path)
+
+  -- track the entire build context as an input
+  inputs(path)
   
   exec(table.unpack(cmd))
 end
@@ -7,6 +7,11 @@ function target(name, dependencies, fn)
     dependencies = {}
   end
 
+  -- Names with a "%" stem define a rule called when a matching target is needed.
+  if __bake_add_rule(name, dependencies, fn) then
+    return
+  end
+
   __bake_begin_target(name, dependencies)
   if type(fn) == "function" then
     fn()
@@ -2,11 +2,13 @@ package bake
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"os"
 	"path"
 	"regexp"
 	"sort"
+	"strings"
 	"sync"
 )
 
@@ -16,6 +18,15 @@ import (
 type Package struct {
 	Name    string
 	Targets []*Target
+
+	// Pattern rules used to create targets on demand.
+	Rules []*Rule
+
+	// Files read while parsing each Bakefile, keyed by the Bakefile's path.
+	// Includes the Bakefile itself, the project config file and every module
+	// or file it loaded, directly or indirectly. Paths are relative to the
+	// project root.
+	Sources map[string][]string
 }
 
 // TargetNames returns a sorted list of all target names.
@@ -45,6 +56,86 @@ func (p *Package) Target(name string) *Target {
 	return nil
 }
 
+// AddTarget adds t to the package. Returns an error if another target has
+// the same name or produces one of the same files.
+func (p *Package) AddTarget(t *Target) error {
+	for _, other := range p.Targets {
+		if other.Name == t.Name {
+			return &DuplicateTargetError{Target: t, Other: other}
+		}
+
+		for _, output := range t.OutputFiles() {
+			for _, otherOutput := range other.OutputFiles() {
+				if output == otherOutput {
+					return &DuplicateTargetError{Target: t, Other: other, Output: output}
+				}
+			}
+		}
+	}
+
+	p.Targets = append(p.Targets, t)
+	return nil
+}
+
+// DuplicateTargetError is returned when a target is defined more than once
+// or when two targets produce the same file.
+type DuplicateTargetError struct {
+	Target *Target // target being added
+	Other  *Target // target previously defined
+	Output string  // file produced by both targets, if names differ
+}
+
+// Error returns the error message.
+func (e *DuplicateTargetError) Error() string {
+	if e.Output == "" {
+		return fmt.Sprintf("%s: duplicate target %q, previously defined at %s",
+			e.Target.Location, e.Target.Name, e.Other.Location)
+	}
+	return fmt.Sprintf("%s: target %q produces %q, also produced by target %q at %s",
+		e.Target.Location, e.Target.Name, e.Output, e.Other.Name, e.Other.Location)
+}
+
+// OutputTarget returns the target that produces the file at path.
+// Files within a directory output are produced by the directory's target.
+// Returns nil if no target produces path.
+func (p *Package) OutputTarget(path string) *Target {
+	for _, t := range p.Targets {
+		for _, output := range t.OutputFiles() {
+			if path == output || strings.HasPrefix(path, output+"/") {
+				return t
+			}
+		}
+	}
+	return nil
+}
+
+// DependsOn returns true if t depends on other, either directly or through
+// one of its dependencies.
+func (p *Package) DependsOn(t, other *Target) bool {
+	return p.dependsOn(t, other, make(map[*Target]struct{}))
+}
+
+func (p *Package) dependsOn(t, other *Target, seen map[*Target]struct{}) bool {
+	if _, ok := seen[t]; ok {
+		return false
+	}
+	seen[t] = struct{}{}
+
+	for _, pattern := range t.Dependencies {
+		targets, err := p.MatchTargets(pattern)
+		if err != nil {
+			continue
+		}
+
+		for _, dep := range targets {
+			if dep == other || p.dependsOn(dep, other, seen) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // MatchTargets returns a list of targets matching a glob pattern.
 // Matches pattern against target name or output files.
 func (p *Package) MatchTargets(pattern string) ([]*Target, error) {
@@ -83,6 +174,127 @@ type Target struct {
 	// Files to be retained after build.
 	// Any files written that are not declared here are assumed to be temporary files.
 	Outputs []string
+
+	// Files and directories the target depends on, in addition to files it reads.
+	// Directories are hashed recursively so changes anywhere in the tree are found.
+	Inputs []string
+
+	// Glob patterns for files excluded from directory input hashing.
+	// Patterns without a slash match a file's base name at any depth.
+	Ignore []string
+
+	// Position in the Bakefile where the target is defined.
+	Location Location
+}
+
+// Rule represents a pattern rule that creates targets on demand. The rule's
+// name contains a single "%" which matches a non-empty stem. For example, a
+// rule named "%.pb.go" creates a target named "foo.pb.go" when a dependency
+// or the user asks for "foo.pb.go" and no other target produces it.
+type Rule struct {
+	// Name of the targets created by the rule, containing a "%" stem.
+	Name string
+
+	// Indicates that targets created by the rule do not produce a file.
+	Phony bool
+
+	// Dependent target names. Each "%" is replaced by the stem.
+	Dependencies []string
+
+	// Position in the Bakefile where the rule is defined.
+	Location Location
+
+	// Returns a new target for a stem.
+	Instantiate func(stem string) (*Target, error)
+}
+
+// Match returns the stem if name matches the rule's name.
+func (r *Rule) Match(name string) (stem string, ok bool) {
+	i := strings.Index(r.Name, "%")
+	if i == -1 {
+		return "", false
+	}
+
+	prefix, suffix := r.Name[:i], r.Name[i+1:]
+	if len(name) <= len(prefix)+len(suffix) || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+		return "", false
+	}
+	return name[len(prefix) : len(name)-len(suffix)], true
+}
+
+// matchRule returns true if any rule in the package can create a target named name.
+func (p *Package) matchRule(name string) bool {
+	for _, r := range p.Rules {
+		if _, ok := r.Match(name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// InstantiateRule creates a target named name from the matching rule with
+// the shortest stem and adds it to the package. Rules defined first are used
+// if stems are the same length. Returns nil if no rule matches.
+func (p *Package) InstantiateRule(name string) (*Target, error) {
+	var rule *Rule
+	var stem string
+	for _, r := range p.Rules {
+		if s, ok := r.Match(name); ok && (rule == nil || len(s) < len(stem)) {
+			rule, stem = r, s
+		}
+	}
+	if rule == nil {
+		return nil, nil
+	}
+
+	t, err := rule.Instantiate(stem)
+	if err != nil {
+		return nil, err
+	} else if err := p.AddTarget(t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// ResolveTargets returns the targets matching pattern. If none match and
+// pattern is a name rather than a glob then a target is created from a
+// matching rule, if any.
+func (p *Package) ResolveTargets(pattern string) ([]*Target, error) {
+	targets, err := p.MatchTargets(pattern)
+	if err != nil || len(targets) > 0 || strings.ContainsAny(pattern, `*?[\`) {
+		return targets, err
+	}
+
+	t, err := p.InstantiateRule(pattern)
+	if err != nil || t == nil {
+		return nil, err
+	}
+	return []*Target{t}, nil
+}
+
+// Location represents a position in a Bakefile.
+type Location struct {
+	File string // path relative to the project root
+	Line int
+}
+
+// String returns the location as "file:line". Returns "-" if the location is unknown.
+func (l Location) String() string {
+	if l.File == "" {
+		return "-"
+	} else if l.Line <= 0 {
+		return l.File
+	}
+	return fmt.Sprintf("%s:%d", l.File, l.Line)
+}
+
+// OutputFiles returns the files produced by the target.
+// Non-phony targets without declared outputs produce a file named after the target.
+func (t *Target) OutputFiles() []string {
+	if len(t.Outputs) > 0 || t.Phony {
+		return t.Outputs
+	}
+	return []string{t.Name}
 }
 
 // MatchTarget returns true if t's name or outputs match pattern.
@@ -174,6 +386,9 @@ type Build struct {
 	err  error
 	done chan struct{}
 
+	// Net changes made by the target, set once it has run.
+	writes []*Write
+
 	dependencies []*Build
 }
 
@@ -243,15 +458,45 @@ func (b *Build) RootErr() error {
 }
 
 // Done marks the build as complete and sets the error, if any.
+// An error set by fail is kept if err is nil.
 // Calling this method twice on a build will cause it to panic.
 func (b *Build) Done(err error) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
-	b.err = err
+	if err != nil {
+		b.err = err
+	}
 	close(b.done)
 }
 
+// fail sets the error of the build unless it already failed. Builds that have
+// already finished are failed too since their committed outputs can't be
+// trusted, so results should be read once the whole build tree has finished.
+func (b *Build) fail(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.err == nil {
+		b.err = err
+	}
+}
+
+// Writes returns the net change made by the build's target to each path,
+// sorted by path. Returns nil until the target has run.
+func (b *Build) Writes() []*Write {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.writes
+}
+
+// setWrites sets the changes made by the build's target.
+func (b *Build) setWrites(a []*Write) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.writes = a
+}
+
 // Stdout returns the standard output stream.
 func (b *Build) Stdout() io.ReadCloser {
 	return b.stdout.reader
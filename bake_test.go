@@ -35,3 +35,54 @@ func TestParseLabel(t *testing.T) {
 		}
 	}
 }
+
+// Ensure targets producing the same file cannot be added to a package.
+func TestPackage_AddTarget_ErrDuplicateOutput(t *testing.T) {
+	pkg := &bake.Package{}
+	if err := pkg.AddTarget(&bake.Target{Name: "a", Outputs: []string{"bin/x"}, Location: bake.Location{File: "Bakefile.lua", Line: 1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	err := pkg.AddTarget(&bake.Target{Name: "b", Outputs: []string{"bin/y", "bin/x"}, Location: bake.Location{File: "Bakefile.lua", Line: 5}})
+	if err == nil || err.Error() != `Bakefile.lua:5: target "b" produces "bin/x", also produced by target "a" at Bakefile.lua:1` {
+		t.Fatalf("unexpected error: %v", err)
+	} else if len(pkg.Targets) != 1 {
+		t.Fatalf("unexpected targets: %d", len(pkg.Targets))
+	}
+}
+
+// Ensure rules match names with a non-empty stem.
+func TestRule_Match(t *testing.T) {
+	r := &bake.Rule{Name: "gen/%.pb.go"}
+	for i, tt := range []struct {
+		name string
+		stem string
+		ok   bool
+	}{
+		{"gen/a.pb.go", "a", true},
+		{"gen/sub/a.pb.go", "sub/a", true},
+		{"gen/.pb.go", "", false},
+		{"a.pb.go", "", false},
+		{"gen/a.go", "", false},
+	} {
+		if stem, ok := r.Match(tt.name); stem != tt.stem || ok != tt.ok {
+			t.Errorf("%d. %s: unexpected match: %q, %v", i, tt.name, stem, ok)
+		}
+	}
+}
+
+// Ensure the rule with the shortest stem is used to create a target.
+func TestPackage_InstantiateRule_ShortestStem(t *testing.T) {
+	newRule := func(name string) *bake.Rule {
+		return &bake.Rule{Name: name, Instantiate: func(stem string) (*bake.Target, error) {
+			return &bake.Target{Name: name + ":" + stem}, nil
+		}}
+	}
+
+	pkg := &bake.Package{Rules: []*bake.Rule{newRule("%.go"), newRule("%.pb.go"), newRule("x%.go")}}
+	if target, err := pkg.InstantiateRule("api.pb.go"); err != nil {
+		t.Fatal(err)
+	} else if target.Name != "%.pb.go:api" {
+		t.Fatalf("unexpected target: %s", target.Name)
+	}
+}
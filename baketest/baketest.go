@@ -0,0 +1,254 @@
+// Package baketest provides helpers for testing Bakefiles and Lua rule libraries.
+//
+// Fixture trees are parsed with the same parser used for builds. The
+// resulting package can be checked target by target or compared against a
+// golden file containing a canonical text dump of the package. Golden files
+// are rewritten instead of compared when the BAKETEST_UPDATE environment
+// variable is set to a non-blank value.
+package baketest
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/flynn/bake"
+	"github.com/flynn/bake/fstest"
+)
+
+// UpdateEnv is the environment variable that enables rewriting golden files.
+const UpdateEnv = "BAKETEST_UPDATE"
+
+// Package represents a parsed package with helpers for checking its targets.
+// Failed checks stop the test.
+type Package struct {
+	*bake.Package
+	tb testing.TB
+}
+
+// ParseDir parses the Bakefile tree at path.
+// Stops the test if the tree cannot be parsed.
+func ParseDir(tb testing.TB, path string) *Package {
+	p := bake.NewParser()
+	if err := p.ParseDir(path); err != nil {
+		tb.Fatalf("parse %s: %s", path, err)
+	}
+	return &Package{Package: p.Package, tb: tb}
+}
+
+// ParseFiles writes files to a temporary directory and parses it.
+// Files are keyed by path relative to the project root, such as "cmd/Bakefile.lua".
+// Stops the test if the tree cannot be written or parsed.
+func ParseFiles(tb testing.TB, files map[string]string) *Package {
+	path, err := ioutil.TempDir("", "baketest-")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	for name, data := range files {
+		filename := filepath.Join(path, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filename), 0777); err != nil {
+			tb.Fatal(err)
+		} else if err := ioutil.WriteFile(filename, []byte(data), 0666); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return ParseDir(tb, path)
+}
+
+// AssertValid checks that every dependency resolves to a target and that
+// the package produces no validation warnings.
+func (p *Package) AssertValid() {
+	warnings, err := p.Validate()
+	if err != nil {
+		p.tb.Fatalf("invalid package:\n%s", err)
+	} else if len(warnings) > 0 {
+		p.tb.Fatalf("package warnings:\n%s", strings.Join(warnings, "\n"))
+	}
+}
+
+// MustTarget returns a target by name. Stops the test if it doesn't exist.
+func (p *Package) MustTarget(name string) *bake.Target {
+	for _, t := range p.Targets {
+		if t.Name == name {
+			return t
+		}
+	}
+	p.tb.Fatalf("target not found: %s", name)
+	return nil
+}
+
+// AssertTargets checks that the package contains exactly the named targets, in any order.
+func (p *Package) AssertTargets(names ...string) {
+	p.assertStrings("targets", p.TargetNames(), sortedStrings(names))
+}
+
+// AssertCommands checks the commands of a target. Exec commands are given
+// as their arguments joined by spaces and shell commands by their source.
+func (p *Package) AssertCommands(name string, commands ...string) {
+	t := p.MustTarget(name)
+	a := make([]string, len(t.Commands))
+	for i, cmd := range t.Commands {
+		a[i] = fstest.CommandString(cmd)
+	}
+	p.assertStrings(name+": commands", a, commands)
+}
+
+// AssertDependencies checks the declared dependencies of a target.
+func (p *Package) AssertDependencies(name string, dependencies ...string) {
+	p.assertStrings(name+": dependencies", p.MustTarget(name).Dependencies, dependencies)
+}
+
+// AssertOutputs checks the files produced by a target.
+func (p *Package) AssertOutputs(name string, outputs ...string) {
+	p.assertStrings(name+": outputs", p.MustTarget(name).OutputFiles(), outputs)
+}
+
+// AssertGolden compares the dump of the package against the golden file at filename.
+// The golden file is written instead if the BAKETEST_UPDATE environment variable is set.
+func (p *Package) AssertGolden(filename string) {
+	dump := Dump(p.Package)
+
+	if os.Getenv(UpdateEnv) != "" {
+		if err := ioutil.WriteFile(filename, []byte(dump), 0666); err != nil {
+			p.tb.Fatal(err)
+		}
+		return
+	}
+
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		p.tb.Fatalf("read golden file: %s (set %s=1 to create it)", err, UpdateEnv)
+	} else if string(buf) != dump {
+		p.tb.Fatalf("package does not match %s (set %s=1 to update it):\n%s", filename, UpdateEnv, diff(string(buf), dump))
+	}
+}
+
+func (p *Package) assertStrings(name string, got, exp []string) {
+	if len(got) == 0 && len(exp) == 0 {
+		return
+	} else if !reflect.DeepEqual(got, exp) {
+		p.tb.Fatalf("unexpected %s:\n\tgot: %q\n\texp: %q", name, got, exp)
+	}
+}
+
+// Dump returns a canonical text representation of a package.
+// Targets are sorted by name, followed by rules in the order they're defined.
+// Each field is written on its own line and fields without values are omitted.
+func Dump(pkg *bake.Package) string {
+	targets := make([]*bake.Target, len(pkg.Targets))
+	copy(targets, pkg.Targets)
+	sort.Sort(targetsByName(targets))
+
+	var buf bytes.Buffer
+	for i, t := range targets {
+		if i > 0 {
+			buf.WriteByte('\n')
+		}
+
+		fmt.Fprintf(&buf, "target %q\n", t.Name)
+		if t.Phony {
+			buf.WriteString("\tphony\n")
+		}
+		if t.Title != "" {
+			fmt.Fprintf(&buf, "\ttitle %q\n", t.Title)
+		}
+		if t.WorkDir != "" && t.WorkDir != "." {
+			fmt.Fprintf(&buf, "\tworkdir %q\n", t.WorkDir)
+		}
+		dumpStrings(&buf, "depends", t.Dependencies)
+		dumpStrings(&buf, "inputs", t.Inputs)
+		dumpStrings(&buf, "ignore", t.Ignore)
+		dumpStrings(&buf, "outputs", t.OutputFiles())
+
+		for _, cmd := range t.Commands {
+			switch cmd := cmd.(type) {
+			case *bake.ExecCommand:
+				dumpStrings(&buf, "exec", cmd.Args)
+			case *bake.ShellCommand:
+				fmt.Fprintf(&buf, "\tsh %q\n", cmd.Source)
+			case bake.NativeCommand:
+				fmt.Fprintf(&buf, "\t%s\n", cmd)
+			default:
+				fmt.Fprintf(&buf, "\t%T\n", cmd)
+			}
+		}
+	}
+
+	for _, r := range pkg.Rules {
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+
+		fmt.Fprintf(&buf, "rule %q\n", r.Name)
+		if r.Phony {
+			buf.WriteString("\tphony\n")
+		}
+		dumpStrings(&buf, "depends", r.Dependencies)
+	}
+	return buf.String()
+}
+
+// dumpStrings writes a field followed by its quoted values. Empty fields are skipped.
+func dumpStrings(buf *bytes.Buffer, field string, a []string) {
+	if len(a) == 0 {
+		return
+	}
+
+	buf.WriteString("\t" + field)
+	for _, s := range a {
+		fmt.Fprintf(buf, " %q", s)
+	}
+	buf.WriteByte('\n')
+}
+
+// diff returns the lines that differ between two dumps, prefixed by "-" for
+// expected lines and "+" for actual lines.
+func diff(exp, got string) string {
+	a, b := strings.Split(exp, "\n"), strings.Split(got, "\n")
+
+	var buf bytes.Buffer
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y string
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+
+		if x == y {
+			continue
+		}
+		fmt.Fprintf(&buf, "line %d:\n", i+1)
+		if i < len(a) {
+			fmt.Fprintf(&buf, "-%s\n", x)
+		}
+		if i < len(b) {
+			fmt.Fprintf(&buf, "+%s\n", y)
+		}
+	}
+	return buf.String()
+}
+
+// sortedStrings returns a sorted copy of a.
+func sortedStrings(a []string) []string {
+	other := make([]string, len(a))
+	copy(other, a)
+	sort.Strings(other)
+	return other
+}
+
+// targetsByName represents a list of targets sortable by name.
+type targetsByName []*bake.Target
+
+func (a targetsByName) Len() int           { return len(a) }
+func (a targetsByName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a targetsByName) Less(i, j int) bool { return a[i].Name < a[j].Name }
@@ -0,0 +1,108 @@
+package baketest_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/flynn/bake/baketest"
+)
+
+// Ensure a fixture tree can be parsed and its targets checked.
+func TestParseDir(t *testing.T) {
+	pkg := baketest.ParseDir(t, "testdata/project")
+	pkg.AssertTargets("test", "cmd/bin/app")
+	pkg.AssertDependencies("test", "cmd/bin/app")
+	pkg.AssertCommands("test", "go test ./...")
+	pkg.AssertOutputs("test")
+	pkg.AssertCommands("cmd/bin/app", "go build -o bin/app ./src", "cp bin/app /tmp/app\n")
+	pkg.AssertOutputs("cmd/bin/app", "cmd/bin/app")
+	pkg.AssertValid()
+	pkg.AssertGolden("testdata/project.golden")
+}
+
+// Ensure Lua rule helpers can be tested with inline files.
+func TestParseFiles(t *testing.T) {
+	pkg := baketest.ParseFiles(t, map[string]string{
+		"lib/Bakefile.lua": `
+function protoc(name)
+  target(name .. ".pb.go", depends(name .. ".proto"), function()
+    exec("protoc", "--go_out=.", name .. ".proto")
+  end)
+end
+
+protoc("a")
+`,
+	})
+	pkg.AssertTargets("lib/a.pb.go")
+	pkg.AssertDependencies("lib/a.pb.go", "lib/a.proto")
+	pkg.AssertCommands("lib/a.pb.go", "protoc --go_out=. a.proto")
+}
+
+// Ensure failed checks stop the test with a description of the mismatch.
+func TestPackage_Assert_Fail(t *testing.T) {
+	for _, tt := range []struct {
+		fn  func(pkg *baketest.Package)
+		msg string
+	}{
+		{fn: func(pkg *baketest.Package) { pkg.AssertTargets("a") }, msg: "unexpected targets:"},
+		{fn: func(pkg *baketest.Package) { pkg.MustTarget("a") }, msg: "target not found: a"},
+		{fn: func(pkg *baketest.Package) { pkg.AssertCommands("test", "go vet") }, msg: "unexpected test: commands:"},
+		{fn: func(pkg *baketest.Package) { pkg.AssertGolden("testdata/missing.golden") }, msg: "read golden file:"},
+		{fn: func(pkg *baketest.Package) {
+			pkg.MustTarget("test").Dependencies = []string{"cmd/bin/ap"}
+			pkg.AssertValid()
+		}, msg: "invalid package:"},
+	} {
+		tb := &TB{TB: t}
+		func() {
+			defer func() { recover() }()
+			tt.fn(baketest.ParseDir(tb, "testdata/project"))
+		}()
+		if !strings.HasPrefix(tb.msg, tt.msg) {
+			t.Errorf("unexpected message: %q", tb.msg)
+		}
+	}
+}
+
+// Ensure a golden file is rewritten when updates are enabled.
+func TestPackage_AssertGolden_Update(t *testing.T) {
+	path, err := ioutil.TempDir("", "baketest-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	os.Setenv(baketest.UpdateEnv, "1")
+	defer os.Setenv(baketest.UpdateEnv, "")
+
+	filename := filepath.Join(path, "project.golden")
+	pkg := baketest.ParseDir(t, "testdata/project")
+	pkg.AssertGolden(filename)
+
+	if buf, err := ioutil.ReadFile(filename); err != nil {
+		t.Fatal(err)
+	} else if string(buf) != baketest.Dump(pkg.Package) {
+		t.Fatalf("unexpected golden file: %s", buf)
+	}
+}
+
+// TB represents a test that records the failure message instead of failing.
+// Fatal calls panic to stop the caller.
+type TB struct {
+	testing.TB
+	msg string
+}
+
+func (tb *TB) Fatal(args ...interface{}) {
+	tb.msg = fmt.Sprint(args...)
+	panic(tb.msg)
+}
+
+func (tb *TB) Fatalf(format string, args ...interface{}) {
+	tb.msg = fmt.Sprintf(format, args...)
+	panic(tb.msg)
+}
@@ -0,0 +1,4 @@
+target("@test", depends("cmd/bin/app"), function()
+  title("Run tests")
+  exec("go", "test", "./...")
+end)
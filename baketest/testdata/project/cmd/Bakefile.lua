@@ -0,0 +1,8 @@
+target("bin/app", function()
+  inputs("src")
+  ignore("*.tmp")
+  go.build("./src", {"-o", "bin/app"})
+  sh [[
+cp bin/app /tmp/app
+]]
+end)
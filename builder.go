@@ -6,6 +6,7 @@ import (
 	"io"
 	"io/ioutil"
 	"math/rand"
+	"os"
 	"os/exec"
 	"path/filepath"
 	"sort"
@@ -36,16 +37,34 @@ type Builder struct {
 	// Used for persisting the last state of the file system.
 	Snapshot *Snapshot
 
+	// Used for executing target commands. Defaults to running processes on the host.
+	Execer Execer
+
+	// Package containing the targets being built. Used to find targets that
+	// read the outputs of other targets without depending on them.
+	Package *Package
+
+	// If true, undeclared dependencies fail the build instead of warning.
+	StrictDependencies bool
+
+	// Undeclared dependencies found during the build.
+	undeclared []*UndeclaredDependency
+
+	// Targets that wrote to each conflicting path.
+	conflicts map[string][]string
+
 	Output io.Writer
 }
 
 // NewBuilder returns a new instance of Builder.
 func NewBuilder() *Builder {
 	return &Builder{
-		builds:  make(map[*Build]struct{}),
-		closing: make(chan struct{}),
+		builds:    make(map[*Build]struct{}),
+		closing:   make(chan struct{}),
+		conflicts: make(map[string][]string),
 
 		FileSystem: &nopFileSystem{},
+		Execer:     &osExecer{},
 		Output:     ioutil.Discard,
 	}
 }
@@ -114,33 +133,92 @@ func (b *Builder) build(build *Build) {
 	time.Sleep(time.Duration(rand.Intn(int(1 * time.Second))))
 
 	// Execute build after dependencies are finished.
-	target := build.Target()
-	if target != nil {
-		// Create a root for file tracking.
-		root := b.FileSystem.CreateRoot()
-
-		fmt.Printf("BUILD: %s\n", target.Name)
-		for _, cmd := range target.Commands {
-			if err := b.run(build, cmd, filepath.Join(root.Path(), build.Target().WorkDir)); err != nil {
-				build.Done(err)
-				return
-			}
-		}
-		fmt.Println("")
-
-		// Persist snapshot.
-		if err := b.Snapshot.AddTarget(target, stringSetSlice(root.Readset())); err != nil {
-			build.Done(err)
+	// Errors are annotated with the location of the target's definition.
+	if target := build.Target(); target != nil {
+		if err := b.buildTarget(build, target); err != nil {
+			build.Done(&TargetError{Target: target, Err: err})
 			return
 		}
-
-		// TODO: Remove outputs not listed by the target.
 	}
 
 	// Mark build as finished with no error.
 	build.Done(nil)
 }
 
+// buildTarget executes the commands of a target and applies its outputs.
+func (b *Builder) buildTarget(build *Build, target *Target) error {
+	// Create a root for file tracking that can only write to the target's outputs.
+	// The root is released once the build is finished, whether or not it succeeds.
+	root := b.FileSystem.CreateRoot(target.Name, NewWritePolicy(target))
+	defer root.Release()
+
+	// Record the changes made by the target on the build, even if it fails.
+	defer func() { build.setWrites(root.Writes()) }()
+
+	// Point TMPDIR to a private scratch directory outside the project so
+	// temporary files aren't tracked or seen by other targets.
+	scratch, err := ioutil.TempDir("", "bake-tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(scratch)
+	env := append(os.Environ(), "TMPDIR="+scratch)
+
+	fmt.Printf("BUILD: %s\n", target.Name)
+	for _, cmd := range target.Commands {
+		if err := b.run(build, root, cmd, filepath.Join(root.Path(), target.WorkDir), env); err != nil {
+			// Report denied or conflicting writes since they're the likely cause of the failure.
+			if werr := b.checkWrites(target, root); werr != nil {
+				return werr
+			}
+			return err
+		}
+	}
+	fmt.Println("")
+
+	// Fail the build if any writes were denied or conflict with another
+	// target, even if commands ignored the error.
+	if err := b.checkWrites(target, root); err != nil {
+		return err
+	}
+
+	// Check for outputs of other targets accessed without a dependency.
+	readset := NewReadset(root)
+	if err := b.checkDependencies(target, readset); err != nil {
+		return err
+	}
+
+	// Apply the target's outputs to the project. Temporary files and
+	// changes from failed targets are never applied.
+	if err := root.Commit(target.OutputFiles()); err != nil {
+		return err
+	}
+
+	// Persist snapshot. Drop it again if a conflicting target failed this
+	// build in the meantime so the target is rebuilt on the next run.
+	if err := b.Snapshot.AddTarget(target, readset); err != nil {
+		return err
+	} else if build.Err() != nil {
+		return b.removeSnapshotTarget(target.Name)
+	}
+
+	return nil
+}
+
+// TargetError wraps an error that occurred while building a target.
+type TargetError struct {
+	Target *Target
+	Err    error
+}
+
+// Error returns the error message prefixed by the target's location, if known.
+func (e *TargetError) Error() string {
+	if e.Target.Location.File == "" {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s: %s", e.Target.Location, e.Err)
+}
+
 // reserve obtains the exclusive right to execute a build.
 // Returns true if the caller should then process the build.
 // Returns false if another caller has already obtained the right to build.
@@ -158,41 +236,223 @@ func (b *Builder) reserve(build *Build) (reserved bool) {
 	return true
 }
 
-// runs executes a command.
-func (b *Builder) run(build *Build, cmd Command, workDir string) error {
-	switch cmd := cmd.(type) {
+// UndeclaredDependencies returns the undeclared dependencies found during the build.
+func (b *Builder) UndeclaredDependencies() []*UndeclaredDependency {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.undeclared
+}
+
+// WriteConflicts returns the paths written by more than one target running
+// at the same time, sorted by path.
+func (b *Builder) WriteConflicts() []*WriteConflict {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	a := make([]*WriteConflict, 0, len(b.conflicts))
+	for path, targets := range b.conflicts {
+		targets = append([]string(nil), targets...)
+		sort.Strings(targets)
+		a = append(a, &WriteConflict{Path: path, Targets: targets})
+	}
+	sort.Sort(writeConflicts(a))
+	return a
+}
+
+// checkWrites returns an error if target wrote to paths outside its write
+// policy or to paths also written by another target running at the same time.
+// Temporary files left behind instead of being renamed over an output are
+// also outside the policy.
+func (b *Builder) checkWrites(target *Target, root FileSystemRoot) error {
+	denied := make(map[string]struct{})
+	for path := range root.Deniedset() {
+		denied[path] = struct{}{}
+	}
+	for _, path := range NewWritePolicy(target).Unallowed(root.Writes()) {
+		denied[path] = struct{}{}
+	}
+	if len(denied) > 0 {
+		return &WriteDeniedError{Target: target.Name, Paths: stringSetSlice(denied)}
+	}
+
+	conflicts := root.Conflictset()
+	if len(conflicts) == 0 {
+		return nil
+	}
+
+	// Record the other targets that wrote each path and fail them as well,
+	// even if they finished before the conflict was found. Their snapshot
+	// records are removed so they're rebuilt on the next run.
+	paths := stringSetSlice(conflicts)
+	others := make(map[string][]string)
+	for path, names := range root.ConflictTargets() {
+		for _, name := range names {
+			others[name] = append(others[name], path)
+		}
+	}
+
+	b.mu.Lock()
+	for _, path := range paths {
+		b.conflicts[path] = appendUnique(b.conflicts[path], target.Name)
+	}
+	var failed []string
+	for name, a := range others {
+		sort.Strings(a)
+		for _, path := range a {
+			b.conflicts[path] = appendUnique(b.conflicts[path], name)
+		}
+		for build := range b.builds {
+			if other := build.Target(); other != nil && other.Name == name {
+				build.fail(&TargetError{Target: other, Err: &WriteConflictError{Target: name, Paths: a}})
+				failed = append(failed, name)
+			}
+		}
+	}
+	b.mu.Unlock()
+
+	for _, name := range failed {
+		if err := b.removeSnapshotTarget(name); err != nil {
+			return err
+		}
+	}
+
+	return &WriteConflictError{Target: target.Name, Paths: paths}
+}
+
+// removeSnapshotTarget removes a target's snapshot record, if one exists.
+func (b *Builder) removeSnapshotTarget(name string) error {
+	if err := b.Snapshot.RemoveTarget(name); err != nil && err != ErrSnapshotTargetNotFound {
+		return err
+	}
+	return nil
+}
+
+// checkDependencies reports targets whose outputs were accessed by target
+// without a declared dependency. Returns an error in strict mode.
+func (b *Builder) checkDependencies(target *Target, rs *Readset) error {
+	if b.Package == nil {
+		return nil
+	}
+
+	a := FindUndeclaredDependencies(b.Package, target, rs)
+	if len(a) == 0 {
+		return nil
+	}
+
+	b.mu.Lock()
+	b.undeclared = append(b.undeclared, a...)
+	b.mu.Unlock()
+
+	if b.StrictDependencies {
+		return &UndeclaredDependencyError{Dependencies: a}
+	}
+	for _, d := range a {
+		fmt.Fprintf(b.Output, "warning: %s\n", d)
+	}
+	return nil
+}
+
+// run executes a command through the builder's execer.
+func (b *Builder) run(build *Build, root FileSystemRoot, cmd Command, workDir string, env []string) error {
+	return b.Execer.Exec(&ExecRequest{
+		Target:  build.Target(),
+		Command: cmd,
+		Root:    root,
+		WorkDir: workDir,
+		Env:     env,
+		Stdout:  build.stdout.writer,
+		Stderr:  build.stderr.writer,
+	})
+}
+
+// Execer represents an object that executes the commands of a target.
+type Execer interface {
+	Exec(req *ExecRequest) error
+}
+
+// ExecRequest represents a single command to execute for a target.
+type ExecRequest struct {
+	Target  *Target
+	Command Command
+
+	// Root that the command's file access is tracked through.
+	Root FileSystemRoot
+
+	// Working directory, within the root, and environment to run with.
+	WorkDir string
+	Env     []string
+
+	// Output streams for the command.
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// osExecer executes commands as processes on the host.
+type osExecer struct{}
+
+// Exec runs a command as a process.
+func (e *osExecer) Exec(req *ExecRequest) error {
+	switch cmd := req.Command.(type) {
 	case *ExecCommand:
-		return b.runExec(build, cmd, workDir)
+		return e.runExec(req, cmd)
 	case *ShellCommand:
-		return b.runShell(build, cmd, workDir)
+		return e.runShell(req, cmd)
+	case NativeCommand:
+		return e.runNative(req, cmd)
 	default:
 		panic(fmt.Sprintf("invalid command type: %T", cmd))
 	}
 }
 
 // runExec runs an "exec" command against the shell.
-func (b *Builder) runExec(build *Build, cmd *ExecCommand, workDir string) error {
+func (e *osExecer) runExec(req *ExecRequest, cmd *ExecCommand) error {
 	fmt.Printf("  %s\n", strings.Join(cmd.Args, " "))
 
 	c := exec.Command(cmd.Args[0], cmd.Args[1:]...)
-	c.Dir = workDir
-	c.Stdout = build.stdout.writer
-	c.Stderr = build.stderr.writer
+	c.Dir = req.WorkDir
+	c.Env = req.Env
+	c.Stdout = req.Stdout
+	c.Stderr = req.Stderr
 	return c.Run()
 }
 
 // runShell runs an "sh" command against the shell.
-func (b *Builder) runShell(build *Build, cmd *ShellCommand, workDir string) error {
+func (e *osExecer) runShell(req *ExecRequest, cmd *ShellCommand) error {
 	fmt.Printf("  %s\n", cmd.Source)
 
 	c := exec.Command("/bin/sh")
-	c.Dir = workDir
+	c.Dir = req.WorkDir
+	c.Env = req.Env
 	c.Stdin = strings.NewReader(cmd.Source)
-	c.Stdout = build.stdout.writer
-	c.Stderr = build.stderr.writer
+	c.Stdout = req.Stdout
+	c.Stderr = req.Stderr
 	return c.Run()
 }
 
+// runNative runs a built-in command in-process against the root.
+func (e *osExecer) runNative(req *ExecRequest, cmd NativeCommand) error {
+	fmt.Printf("  %s\n", cmd)
+	return cmd.Run(req.WorkDir)
+}
+
+// WriteConflict represents a path written by more than one target running at the same time.
+type WriteConflict struct {
+	Path    string
+	Targets []string
+}
+
+// String returns a description of the conflict.
+func (c *WriteConflict) String() string {
+	return fmt.Sprintf("%s written by %s", c.Path, strings.Join(c.Targets, ", "))
+}
+
+// writeConflicts represents a list of conflicts sortable by path.
+type writeConflicts []*WriteConflict
+
+func (a writeConflicts) Len() int           { return len(a) }
+func (a writeConflicts) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a writeConflicts) Less(i, j int) bool { return a[i].Path < a[j].Path }
+
 // stringSetSlice returns a string of all keys in a string set.
 func stringSetSlice(m map[string]struct{}) []string {
 	a := make([]string, 0, len(m))
@@ -113,3 +113,409 @@ func (b *Builder) Close() error {
 	return nil
 }
 */
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/flynn/bake"
+	"github.com/flynn/bake/fstest"
+)
+
+// Ensure the builder records the files read by each target in the snapshot
+// and that changes to them are propagated to dependent targets.
+func TestBuilder_Build_Snapshot(t *testing.T) {
+	ss := NewSnapshot()
+	defer ss.Close()
+	fs := fstest.NewFileSystem(ss.Root())
+
+	MustWriteFile(filepath.Join(ss.Root(), "src"), []byte("0"))
+
+	// "gen" copies src to out and "link" copies out to app.
+	fs.Commands["gen"] = func(r *fstest.Root) error {
+		buf, err := r.ReadFile("src")
+		if err != nil {
+			return err
+		}
+		return r.WriteFile("out", buf)
+	}
+	fs.Commands["link"] = func(r *fstest.Root) error {
+		buf, err := r.ReadFile("out")
+		if err != nil {
+			return err
+		}
+		return r.WriteFile("app", buf)
+	}
+
+	pkg := &bake.Package{
+		Targets: []*bake.Target{
+			{Name: "out", Commands: []bake.Command{&bake.ExecCommand{Args: []string{"gen"}}}},
+			{Name: "app", Dependencies: []string{"out"}, Commands: []bake.Command{&bake.ExecCommand{Args: []string{"link"}}}},
+		},
+	}
+
+	// Build everything and verify outputs are committed.
+	MustBuild(pkg, fs, ss.Snapshot, "app")
+	if buf, err := ioutil.ReadFile(filepath.Join(ss.Root(), "app")); err != nil {
+		t.Fatal(err)
+	} else if string(buf) != "0" {
+		t.Fatalf("unexpected output: %q", buf)
+	}
+
+	// Verify the readsets were recorded.
+	if info, err := ss.Target("out"); err != nil {
+		t.Fatal(err)
+	} else if len(info.Inputs) != 1 || info.Inputs[0].Name != "/src" || info.Inputs[0].Kind != "content" {
+		t.Fatalf("unexpected inputs: %#v", info.Inputs)
+	}
+	if info, err := ss.Target("app"); err != nil {
+		t.Fatal(err)
+	} else if len(info.Inputs) != 1 || info.Inputs[0].Name != "/out" {
+		t.Fatalf("unexpected inputs: %#v", info.Inputs)
+	}
+
+	// Nothing is planned while the inputs are unchanged.
+	p := bake.NewPlanner(pkg)
+	p.Snapshot = ss.Snapshot
+	if b, err := p.Plan([]string{"app"}); err != nil {
+		t.Fatal(err)
+	} else if len(b.Dependencies()) != 0 {
+		t.Fatalf("unexpected builds: %d", len(b.Dependencies()))
+	}
+
+	// Changing the input of the dependency rebuilds both targets.
+	MustWriteFile(filepath.Join(ss.Root(), "src"), []byte("10"))
+	if b, err := p.Plan([]string{"app"}); err != nil {
+		t.Fatal(err)
+	} else if len(b.Dependencies()) != 1 || b.Dependencies()[0].Name() != "app" {
+		t.Fatalf("unexpected builds: %#v", b.Dependencies())
+	} else if deps := b.Dependencies()[0].Dependencies(); len(deps) != 1 || deps[0].Name() != "out" {
+		t.Fatalf("unexpected dependencies: %#v", deps)
+	}
+
+	MustBuild(pkg, fs, ss.Snapshot, "app")
+	if buf, err := ioutil.ReadFile(filepath.Join(ss.Root(), "app")); err != nil {
+		t.Fatal(err)
+	} else if string(buf) != "10" {
+		t.Fatalf("unexpected output: %q", buf)
+	}
+}
+
+// Ensure the net changes made by a target are recorded on its build and that
+// phony targets apply both sides of a rename between declared outputs.
+func TestBuilder_Build_Writes(t *testing.T) {
+	ss := NewSnapshot()
+	defer ss.Close()
+	fs := fstest.NewFileSystem(ss.Root())
+
+	MustWriteFile(filepath.Join(ss.Root(), "a"), []byte("0"))
+
+	fs.Commands["mv"] = func(r *fstest.Root) error {
+		return r.Rename("a", "b")
+	}
+
+	pkg := &bake.Package{
+		Targets: []*bake.Target{
+			{Name: "mv", Phony: true, Outputs: []string{"a", "b"}, Commands: []bake.Command{&bake.ExecCommand{Args: []string{"mv"}}}},
+		},
+	}
+
+	build := MustBuild(pkg, fs, ss.Snapshot, "mv")
+	if err := build.RootErr(); err != nil {
+		t.Fatal(err)
+	} else if a := build.Dependencies()[0].Writes(); len(a) != 2 {
+		t.Fatalf("unexpected writes: %#v", a)
+	} else if a[0].Path != "/a" || a[0].Op != bake.WriteRemove {
+		t.Fatalf("unexpected write: %#v", a[0])
+	} else if a[1].Path != "/b" || a[1].Op != bake.WriteRename || a[1].From != "/a" {
+		t.Fatalf("unexpected write: %#v", a[1])
+	}
+
+	if _, err := os.Stat(filepath.Join(ss.Root(), "a")); !os.IsNotExist(err) {
+		t.Fatalf("expected rename source removed: %v", err)
+	} else if buf, err := ioutil.ReadFile(filepath.Join(ss.Root(), "b")); err != nil {
+		t.Fatal(err)
+	} else if string(buf) != "0" {
+		t.Fatalf("unexpected data: %q", buf)
+	}
+}
+
+// Ensure a target fails if it writes outside of its outputs and nothing is committed.
+func TestBuilder_Build_WriteDenied(t *testing.T) {
+	ss := NewSnapshot()
+	defer ss.Close()
+	fs := fstest.NewFileSystem(ss.Root())
+
+	fs.Commands["gen"] = func(r *fstest.Root) error {
+		r.WriteFile("other", []byte("x"))
+		return r.WriteFile("out", []byte("x"))
+	}
+
+	pkg := &bake.Package{
+		Targets: []*bake.Target{
+			{
+				Name:     "out",
+				Commands: []bake.Command{&bake.ExecCommand{Args: []string{"gen"}}},
+				Location: bake.Location{File: "Bakefile.lua", Line: 3},
+			},
+		},
+	}
+
+	build := MustBuild(pkg, fs, ss.Snapshot, "out")
+	if err, ok := build.RootErr().(*bake.TargetError); !ok {
+		t.Fatalf("unexpected error: %#v", build.RootErr())
+	} else if err.Error() != "Bakefile.lua:3: out: write denied: /other" {
+		t.Fatalf("unexpected error message: %s", err)
+	} else if err, ok := err.Err.(*bake.WriteDeniedError); !ok {
+		t.Fatalf("unexpected error: %#v", err)
+	} else if !reflect.DeepEqual(err.Paths, []string{"/other"}) {
+		t.Fatalf("unexpected paths: %#v", err.Paths)
+	} else if _, err := os.Stat(filepath.Join(ss.Root(), "out")); !os.IsNotExist(err) {
+		t.Fatalf("expected output to not be committed: %v", err)
+	}
+}
+
+// Ensure a phony target can't change files it doesn't declare as outputs.
+func TestBuilder_Build_WriteDenied_Phony(t *testing.T) {
+	ss := NewSnapshot()
+	defer ss.Close()
+	fs := fstest.NewFileSystem(ss.Root())
+
+	MustWriteFile(filepath.Join(ss.Root(), "src"), []byte("0"))
+
+	fs.Commands["clean"] = func(r *fstest.Root) error {
+		r.WriteFile("src", []byte("x"))
+		return r.WriteFile("bin/app", []byte("x"))
+	}
+
+	pkg := &bake.Package{
+		Targets: []*bake.Target{
+			{Name: "clean", Phony: true, Outputs: []string{"bin"}, Commands: []bake.Command{&bake.ExecCommand{Args: []string{"clean"}}}},
+		},
+	}
+
+	build := MustBuild(pkg, fs, ss.Snapshot, "clean")
+	if err, ok := build.RootErr().(*bake.TargetError); !ok {
+		t.Fatalf("unexpected error: %#v", build.RootErr())
+	} else if err.Error() != "clean: write denied: /src" {
+		t.Fatalf("unexpected error message: %s", err)
+	} else if buf := MustReadFile(filepath.Join(ss.Root(), "src")); string(buf) != "0" {
+		t.Fatalf("unexpected data: %q", buf)
+	} else if _, err := os.Stat(filepath.Join(ss.Root(), "bin", "app")); !os.IsNotExist(err) {
+		t.Fatalf("expected output to not be committed: %v", err)
+	}
+}
+
+// Ensure a target can write a temporary file next to its output and rename it
+// into place, but fails if the temporary file is left behind.
+func TestBuilder_Build_TempRename(t *testing.T) {
+	ss := NewSnapshot()
+	defer ss.Close()
+	fs := fstest.NewFileSystem(ss.Root())
+
+	MustWriteFile(filepath.Join(ss.Root(), "bin", "src"), []byte("0"))
+
+	fs.Commands["gen"] = func(r *fstest.Root) error {
+		if err := r.WriteFile("bin/.out.tmp", []byte("x")); err != nil {
+			return err
+		}
+		return r.Rename("bin/.out.tmp", "bin/out")
+	}
+	fs.Commands["leak"] = func(r *fstest.Root) error {
+		if err := r.WriteFile("bin/.leak.tmp", []byte("x")); err != nil {
+			return err
+		}
+		return r.WriteFile("bin/leak", []byte("x"))
+	}
+	fs.Commands["clobber"] = func(r *fstest.Root) error {
+		return r.WriteFile("bin/src", []byte("x"))
+	}
+
+	pkg := &bake.Package{
+		Targets: []*bake.Target{
+			{Name: "bin/out", Commands: []bake.Command{&bake.ExecCommand{Args: []string{"gen"}}}},
+			{Name: "bin/leak", Commands: []bake.Command{&bake.ExecCommand{Args: []string{"leak"}}}},
+			{Name: "bin/clobber", Commands: []bake.Command{&bake.ExecCommand{Args: []string{"clobber"}}}},
+		},
+	}
+
+	// The renamed output is committed.
+	if build := MustBuild(pkg, fs, ss.Snapshot, "bin/out"); build.RootErr() != nil {
+		t.Fatal(build.RootErr())
+	} else if buf, err := ioutil.ReadFile(filepath.Join(ss.Root(), "bin", "out")); err != nil {
+		t.Fatal(err)
+	} else if string(buf) != "x" {
+		t.Fatalf("unexpected output: %q", buf)
+	} else if _, err := os.Stat(filepath.Join(ss.Root(), "bin", ".out.tmp")); !os.IsNotExist(err) {
+		t.Fatalf("unexpected temporary file: %v", err)
+	}
+
+	// Temporary files left behind are denied.
+	build := MustBuild(pkg, fs, ss.Snapshot, "bin/leak")
+	if err, ok := build.RootErr().(*bake.TargetError); !ok {
+		t.Fatalf("unexpected error: %#v", build.RootErr())
+	} else if err, ok := err.Err.(*bake.WriteDeniedError); !ok {
+		t.Fatalf("unexpected error: %#v", err)
+	} else if !reflect.DeepEqual(err.Paths, []string{"/bin/.leak.tmp"}) {
+		t.Fatalf("unexpected paths: %#v", err.Paths)
+	}
+
+	// Existing files next to an output cannot be changed.
+	build = MustBuild(pkg, fs, ss.Snapshot, "bin/clobber")
+	if err, ok := build.RootErr().(*bake.TargetError); !ok {
+		t.Fatalf("unexpected error: %#v", build.RootErr())
+	} else if err.Error() != "bin/clobber: write denied: /bin/src" {
+		t.Fatalf("unexpected error message: %s", err)
+	}
+}
+
+// Ensure targets that write the same files at the same time both fail.
+func TestBuilder_Build_WriteConflict(t *testing.T) {
+	ss := NewSnapshot()
+	defer ss.Close()
+	fs := fstest.NewFileSystem(ss.Root())
+
+	// Each script writes the shared file and waits for the other to do the same.
+	a, b := make(chan struct{}), make(chan struct{})
+	fs.Commands["a"] = func(r *fstest.Root) error {
+		r.WriteFile("bin/out", []byte("a"))
+		close(a)
+		<-b
+		return nil
+	}
+	fs.Commands["b"] = func(r *fstest.Root) error {
+		<-a
+		r.WriteFile("bin/out", []byte("b"))
+		close(b)
+		return nil
+	}
+
+	pkg := &bake.Package{
+		Targets: []*bake.Target{
+			{Name: "A", Outputs: []string{"bin/out"}, Commands: []bake.Command{&bake.ExecCommand{Args: []string{"a"}}}},
+			{Name: "B", Outputs: []string{"bin/out"}, Commands: []bake.Command{&bake.ExecCommand{Args: []string{"b"}}}},
+		},
+	}
+
+	build, err := bake.NewPlanner(pkg).Plan([]string{"A", "B"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer build.Close()
+
+	builder := bake.NewBuilder()
+	builder.FileSystem = fs
+	builder.Execer = fs
+	builder.Snapshot = ss.Snapshot
+	builder.Build(build)
+	for _, subbuild := range build.Dependencies() {
+		subbuild.Wait()
+	}
+
+	for _, subbuild := range build.Dependencies() {
+		if err, ok := subbuild.Err().(*bake.TargetError); !ok {
+			t.Fatalf("unexpected error: %s: %#v", subbuild.Name(), subbuild.Err())
+		} else if err, ok := err.Err.(*bake.WriteConflictError); !ok {
+			t.Fatalf("unexpected error: %s: %#v", subbuild.Name(), subbuild.Err())
+		} else if err.Error() != subbuild.Name()+": write conflict: /bin/out" {
+			t.Fatalf("unexpected error message: %s", err)
+		}
+	}
+
+	if a := builder.WriteConflicts(); len(a) != 1 || a[0].String() != "/bin/out written by A, B" {
+		t.Fatalf("unexpected conflicts: %#v", a)
+	} else if !reflect.DeepEqual(a[0].Targets, []string{"A", "B"}) {
+		t.Fatalf("unexpected targets: %#v", a[0].Targets)
+	}
+}
+
+// Ensure a target that finished before a conflicting write is also failed and
+// its snapshot record is removed so it is rebuilt.
+func TestBuilder_Build_WriteConflict_Released(t *testing.T) {
+	ss := NewSnapshot()
+	defer ss.Close()
+	fs := fstest.NewFileSystem(ss.Root())
+
+	pkg := &bake.Package{
+		Targets: []*bake.Target{
+			{Name: "A", Outputs: []string{"bin/out"}, Commands: []bake.Command{&bake.ExecCommand{Args: []string{"a"}}}},
+			{Name: "B", Outputs: []string{"bin/out"}, Commands: []bake.Command{&bake.ExecCommand{Args: []string{"b"}}}},
+		},
+	}
+
+	build, err := bake.NewPlanner(pkg).Plan([]string{"A", "B"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer build.Close()
+
+	// B writes the shared file only once A has finished and released its root.
+	started := make(chan struct{})
+	fs.Commands["a"] = func(r *fstest.Root) error {
+		<-started
+		return r.WriteFile("bin/out", []byte("a"))
+	}
+	fs.Commands["b"] = func(r *fstest.Root) error {
+		close(started)
+		for _, subbuild := range build.Dependencies() {
+			if subbuild.Name() == "A" {
+				subbuild.Wait()
+			}
+		}
+		return r.WriteFile("bin/out", []byte("b"))
+	}
+
+	builder := bake.NewBuilder()
+	builder.FileSystem = fs
+	builder.Execer = fs
+	builder.Snapshot = ss.Snapshot
+	builder.Build(build)
+	waitBuilds(build)
+
+	for _, subbuild := range build.Dependencies() {
+		if err, ok := subbuild.Err().(*bake.TargetError); !ok {
+			t.Fatalf("unexpected error: %s: %#v", subbuild.Name(), subbuild.Err())
+		} else if err.Error() != subbuild.Name()+": write conflict: /bin/out" {
+			t.Fatalf("unexpected error message: %s", err)
+		} else if _, err := ss.Target(subbuild.Name()); err != bake.ErrSnapshotTargetNotFound {
+			t.Fatalf("expected no snapshot record: %s: %v", subbuild.Name(), err)
+		}
+	}
+
+	if a := builder.WriteConflicts(); len(a) != 1 || a[0].String() != "/bin/out written by A, B" {
+		t.Fatalf("unexpected conflicts: %#v", a)
+	}
+}
+
+// MustBuild plans and builds targets in pkg using a test file system.
+// Panic on planning error. Waits for all target builds to finish.
+func MustBuild(pkg *bake.Package, fs *fstest.FileSystem, ss *bake.Snapshot, targets ...string) *bake.Build {
+	p := bake.NewPlanner(pkg)
+	p.Snapshot = ss
+	build, err := p.Plan(targets)
+	if err != nil {
+		panic(err)
+	}
+	defer build.Close()
+
+	b := bake.NewBuilder()
+	b.FileSystem = fs
+	b.Execer = fs
+	b.Snapshot = ss
+	b.Build(build)
+	waitBuilds(build)
+	return build
+}
+
+// waitBuilds waits for build and all of its dependencies to finish.
+func waitBuilds(build *bake.Build) {
+	for _, subbuild := range build.Dependencies() {
+		waitBuilds(subbuild)
+	}
+	if build.Target() != nil {
+		build.Wait()
+	}
+}
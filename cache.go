@@ -0,0 +1,276 @@
+package bake
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/flynn/bake/assets"
+	"github.com/flynn/bake/internal"
+	"github.com/gogo/protobuf/proto"
+)
+
+// ParseCache stores the targets defined by each Bakefile along with hashes of
+// the files read while parsing it. The parser reuses a Bakefile's targets
+// instead of evaluating it again when none of those files have changed.
+//
+// Cached Bakefiles are not executed, so a Bakefile that sets global variables
+// is never cached and neither is any Bakefile evaluated after it.
+type ParseCache struct {
+	path    string
+	entries map[string]*internal.BakefileCache // read from the cache file
+	next    map[string]*internal.BakefileCache // Bakefiles seen by the last parse
+}
+
+// NewParseCache returns a new instance of ParseCache stored at path.
+func NewParseCache(path string) *ParseCache {
+	return &ParseCache{
+		path:    path,
+		entries: make(map[string]*internal.BakefileCache),
+		next:    make(map[string]*internal.BakefileCache),
+	}
+}
+
+// Path returns the path that the cache was initialized with.
+func (c *ParseCache) Path() string { return c.path }
+
+// Load reads the cache file. A missing cache file, or one written by a
+// different version of the bake libraries, leaves the cache empty.
+func (c *ParseCache) Load() error {
+	buf, err := ioutil.ReadFile(c.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var pb internal.ParseCache
+	if err := proto.Unmarshal(buf, &pb); err != nil {
+		return err
+	} else if pb.GetVersion() != parseCacheVersion() {
+		return nil
+	}
+
+	for _, e := range pb.GetBakefiles() {
+		c.entries[e.GetPath()] = e
+	}
+	return nil
+}
+
+// Save writes the entries of every Bakefile seen by the last parse to the
+// cache file. Bakefiles that no longer exist are dropped.
+func (c *ParseCache) Save() error {
+	files := make([]string, 0, len(c.next))
+	for file := range c.next {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+
+	pb := &internal.ParseCache{Version: proto.String(parseCacheVersion())}
+	for _, file := range files {
+		pb.Bakefiles = append(pb.Bakefiles, c.next[file])
+	}
+
+	buf, err := proto.Marshal(pb)
+	if err != nil {
+		return err
+	} else if err := os.MkdirAll(filepath.Dir(c.path), 0777); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(c.path, buf, 0666)
+}
+
+// lookup returns the entry for the Bakefile at file, relative to base.
+// Returns nil if there is no entry or if any of its sources have changed.
+func (c *ParseCache) lookup(base, file string) (*internal.BakefileCache, error) {
+	e := c.entries[file]
+	if e == nil {
+		return nil, nil
+	}
+
+	for _, src := range e.GetSources() {
+		hash, err := hashSource(filepath.Join(base, filepath.FromSlash(src.GetName())))
+		if err != nil {
+			return nil, err
+		} else if hash != src.GetHash() {
+			return nil, nil
+		}
+	}
+	return e, nil
+}
+
+// put sets the entry for a Bakefile seen by the current parse.
+func (c *ParseCache) put(file string, e *internal.BakefileCache) {
+	c.entries[file], c.next[file] = e, e
+}
+
+// newBakefileCache returns a cache entry for the Bakefile at file.
+// sources are hashed relative to base.
+func newBakefileCache(base, file string, sources []string, targets []*Target) (*internal.BakefileCache, error) {
+	e := &internal.BakefileCache{Path: proto.String(file)}
+	for _, src := range sources {
+		hash, err := hashSource(filepath.Join(base, filepath.FromSlash(src)))
+		if err != nil {
+			return nil, err
+		}
+		e.Sources = append(e.Sources, &internal.SourceHash{Name: proto.String(src), Hash: proto.String(hash)})
+	}
+
+	for _, t := range targets {
+		pb, err := encodeTarget(t)
+		if err != nil {
+			return nil, err
+		}
+		e.Targets = append(e.Targets, pb)
+	}
+	return e, nil
+}
+
+// sourceNames returns the paths of the files read while parsing the entry's Bakefile.
+func sourceNames(e *internal.BakefileCache) []string {
+	a := make([]string, len(e.GetSources()))
+	for i, src := range e.GetSources() {
+		a[i] = src.GetName()
+	}
+	return a
+}
+
+// parseCacheVersion returns a hash of the embedded bake libraries.
+// Entries are only valid for the libraries they were parsed with.
+func parseCacheVersion() string {
+	names := assets.AssetNames()
+	sort.Strings(names)
+
+	h := sha256.New()
+	for _, name := range names {
+		writeStrings(h, []string{name, string(assets.MustAsset(name))})
+	}
+	return fmt.Sprintf("%64x", h.Sum(nil))
+}
+
+// hashSource generates a hash of a file read while parsing.
+// Directories are hashed by their list of files and missing files return a blank hash.
+func hashSource(path string) (string, error) {
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	} else if fi.IsDir() {
+		return hashDirInfo(path)
+	}
+	return hashFileContent(path)
+}
+
+// UnsupportedCommandError is returned when a command cannot be stored in the parse cache.
+type UnsupportedCommandError struct {
+	Command Command
+}
+
+// Error returns the error message.
+func (e *UnsupportedCommandError) Error() string {
+	return fmt.Sprintf("unsupported command type: %T", e.Command)
+}
+
+// encodeTarget encodes a target into a protobuf object.
+func encodeTarget(t *Target) (*internal.Target, error) {
+	pb := &internal.Target{
+		Name:         proto.String(t.Name),
+		Phony:        proto.Bool(t.Phony),
+		Title:        proto.String(t.Title),
+		WorkDir:      proto.String(t.WorkDir),
+		Dependencies: t.Dependencies,
+		Outputs:      t.Outputs,
+		Inputs:       t.Inputs,
+		Ignore:       t.Ignore,
+		File:         proto.String(t.Location.File),
+		Line:         proto.Int64(int64(t.Location.Line)),
+	}
+
+	for _, cmd := range t.Commands {
+		switch cmd := cmd.(type) {
+		case *ExecCommand:
+			pb.Commands = append(pb.Commands, &internal.Command{Type: proto.String("exec"), Args: cmd.Args})
+		case *ShellCommand:
+			pb.Commands = append(pb.Commands, &internal.Command{Type: proto.String("shell"), Source: proto.String(cmd.Source)})
+		case *CopyCommand:
+			pb.Commands = append(pb.Commands, &internal.Command{Type: proto.String("copy"), Args: []string{cmd.Source, cmd.Dest}})
+		case *WriteCommand:
+			if cmd.Vars == nil {
+				pb.Commands = append(pb.Commands, &internal.Command{Type: proto.String("write"), Args: []string{cmd.Path}, Source: proto.String(cmd.Content)})
+			} else {
+				pb.Commands = append(pb.Commands, &internal.Command{Type: proto.String("template"), Args: append([]string{cmd.Path}, varsSlice(cmd.Vars)...), Source: proto.String(cmd.Content)})
+			}
+		case *MkdirCommand:
+			pb.Commands = append(pb.Commands, &internal.Command{Type: proto.String("mkdir"), Args: []string{cmd.Path}})
+		case *SymlinkCommand:
+			pb.Commands = append(pb.Commands, &internal.Command{Type: proto.String("symlink"), Args: []string{cmd.Target, cmd.Path}})
+		case *RemoveCommand:
+			pb.Commands = append(pb.Commands, &internal.Command{Type: proto.String("remove"), Args: []string{cmd.Path}})
+		default:
+			return nil, &UnsupportedCommandError{Command: cmd}
+		}
+	}
+	return pb, nil
+}
+
+// decodeTarget decodes a target from a protobuf object.
+func decodeTarget(pb *internal.Target) (*Target, error) {
+	t := &Target{
+		Name:         pb.GetName(),
+		Phony:        pb.GetPhony(),
+		Title:        pb.GetTitle(),
+		WorkDir:      pb.GetWorkDir(),
+		Dependencies: pb.GetDependencies(),
+		Outputs:      pb.GetOutputs(),
+		Inputs:       pb.GetInputs(),
+		Ignore:       pb.GetIgnore(),
+		Location:     Location{File: pb.GetFile(), Line: int(pb.GetLine())},
+	}
+
+	for _, cmd := range pb.GetCommands() {
+		args := cmd.GetArgs()
+		switch cmd.GetType() {
+		case "exec":
+			t.Commands = append(t.Commands, &ExecCommand{Args: args})
+		case "shell":
+			t.Commands = append(t.Commands, &ShellCommand{Source: cmd.GetSource()})
+		case "copy":
+			if len(args) != 2 {
+				return nil, fmt.Errorf("invalid copy command args: %d", len(args))
+			}
+			t.Commands = append(t.Commands, &CopyCommand{Source: args[0], Dest: args[1]})
+		case "write":
+			if len(args) != 1 {
+				return nil, fmt.Errorf("invalid write command args: %d", len(args))
+			}
+			t.Commands = append(t.Commands, &WriteCommand{Path: args[0], Content: cmd.GetSource()})
+		case "template":
+			if len(args)%2 != 1 {
+				return nil, fmt.Errorf("invalid template command args: %d", len(args))
+			}
+			t.Commands = append(t.Commands, &WriteCommand{Path: args[0], Content: cmd.GetSource(), Vars: varsMap(args[1:])})
+		case "mkdir":
+			if len(args) != 1 {
+				return nil, fmt.Errorf("invalid mkdir command args: %d", len(args))
+			}
+			t.Commands = append(t.Commands, &MkdirCommand{Path: args[0]})
+		case "symlink":
+			if len(args) != 2 {
+				return nil, fmt.Errorf("invalid symlink command args: %d", len(args))
+			}
+			t.Commands = append(t.Commands, &SymlinkCommand{Target: args[0], Path: args[1]})
+		case "remove":
+			if len(args) != 1 {
+				return nil, fmt.Errorf("invalid remove command args: %d", len(args))
+			}
+			t.Commands = append(t.Commands, &RemoveCommand{Path: args[0]})
+		default:
+			return nil, fmt.Errorf("unknown command type: %q", cmd.GetType())
+		}
+	}
+	return t, nil
+}
@@ -0,0 +1,136 @@
+package bake_test
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/flynn/bake"
+)
+
+// Ensure only Bakefiles with changed sources are evaluated when a cache is used.
+func TestParser_Parse_Cache(t *testing.T) {
+	path := MustTempDir()
+	defer MustRemoveAll(path)
+	cachePath := filepath.Join(MustTempDir(), "cache")
+	defer MustRemoveAll(filepath.Dir(cachePath))
+
+	MustWriteFile(filepath.Join(path, ".bake", "util.lua"), []byte(`return { name = "bin/a" }`))
+	MustWriteFile(filepath.Join(path, "a", "Bakefile.lua"), []byte(`
+target(require("util").name, function()
+	exec("go", "build")
+	sh "echo done"
+end)
+`))
+	MustWriteFile(filepath.Join(path, "b", "Bakefile.lua"), []byte(`target("@test", depends("x"))`))
+	MustWriteFile(filepath.Join(path, "c", "Bakefile.lua"), []byte(`target("c")`))
+
+	// The first parse evaluates every Bakefile.
+	p := MustParseCached(path, cachePath)
+	if sort.Strings(p.Evaluated); !reflect.DeepEqual(p.Evaluated, []string{"a/Bakefile.lua", "b/Bakefile.lua", "c/Bakefile.lua"}) {
+		t.Fatalf("unexpected evaluated: %#v", p.Evaluated)
+	}
+	exp := p.Package
+
+	// Nothing changed so the package is read entirely from the cache.
+	p = MustParseCached(path, cachePath)
+	if len(p.Evaluated) != 0 {
+		t.Fatalf("unexpected evaluated: %#v", p.Evaluated)
+	} else if !reflect.DeepEqual(p.Package.TargetNames(), exp.TargetNames()) {
+		t.Fatalf("unexpected targets: %#v", p.Package.TargetNames())
+	} else if !reflect.DeepEqual(p.Package.Sources, exp.Sources) {
+		t.Fatalf("unexpected sources: %#v", p.Package.Sources)
+	} else if target := p.Package.Target("a/bin/a"); !reflect.DeepEqual(target.Commands, exp.Target("a/bin/a").Commands) {
+		t.Fatalf("unexpected commands: %#v", target.Commands)
+	} else if target.Location != (bake.Location{File: "a/Bakefile.lua", Line: 2}) {
+		t.Fatalf("unexpected location: %s", target.Location)
+	} else if target := p.Package.Target("b/test"); !target.Phony || !reflect.DeepEqual(target.Dependencies, []string{"b/x"}) {
+		t.Fatalf("unexpected target: %#v", target)
+	}
+
+	// Changing a required module re-evaluates only the Bakefiles that loaded it.
+	MustWriteFile(filepath.Join(path, ".bake", "util.lua"), []byte(`return { name = "bin/b" }`))
+	MustWriteFile(filepath.Join(path, "c", "Bakefile.lua"), []byte(`target("d")`))
+	p = MustParseCached(path, cachePath)
+	if sort.Strings(p.Evaluated); !reflect.DeepEqual(p.Evaluated, []string{"a/Bakefile.lua", "c/Bakefile.lua"}) {
+		t.Fatalf("unexpected evaluated: %#v", p.Evaluated)
+	} else if a := p.Package.TargetNames(); !reflect.DeepEqual(a, []string{"a/bin/b", "b/test", "c/d"}) {
+		t.Fatalf("unexpected targets: %#v", a)
+	}
+
+	// Removed Bakefiles are dropped from the cache.
+	MustRemoveAll(filepath.Join(path, "c"))
+	p = MustParseCached(path, cachePath)
+	if len(p.Evaluated) != 0 {
+		t.Fatalf("unexpected evaluated: %#v", p.Evaluated)
+	} else if a := p.Package.TargetNames(); !reflect.DeepEqual(a, []string{"a/bin/b", "b/test"}) {
+		t.Fatalf("unexpected targets: %#v", a)
+	}
+}
+
+// Ensure Bakefiles are always evaluated when the project isn't hermetic.
+func TestParser_Parse_Cache_Unrestricted(t *testing.T) {
+	path := MustTempDir()
+	defer MustRemoveAll(path)
+	cachePath := filepath.Join(MustTempDir(), "cache")
+	defer MustRemoveAll(filepath.Dir(cachePath))
+
+	MustWriteFile(filepath.Join(path, ".bake", "config"), []byte("hermetic = false\n"))
+	MustWriteFile(filepath.Join(path, "Bakefile.lua"), []byte(`target(os.getenv("BAKE_TEST_TARGET"))`))
+
+	os.Setenv("BAKE_TEST_TARGET", "a")
+	defer os.Unsetenv("BAKE_TEST_TARGET")
+	if p := MustParseCached(path, cachePath); !reflect.DeepEqual(p.Package.TargetNames(), []string{"a"}) {
+		t.Fatalf("unexpected targets: %#v", p.Package.TargetNames())
+	}
+
+	// The environment isn't tracked so the Bakefile is evaluated again.
+	os.Setenv("BAKE_TEST_TARGET", "b")
+	if p := MustParseCached(path, cachePath); !reflect.DeepEqual(p.Evaluated, []string{"Bakefile.lua"}) {
+		t.Fatalf("unexpected evaluated: %#v", p.Evaluated)
+	} else if !reflect.DeepEqual(p.Package.TargetNames(), []string{"b"}) {
+		t.Fatalf("unexpected targets: %#v", p.Package.TargetNames())
+	}
+}
+
+// Ensure a Bakefile that sets globals, and every Bakefile after it, is
+// evaluated on each parse so later Bakefiles can still read the globals.
+func TestParser_Parse_Cache_Globals(t *testing.T) {
+	path := MustTempDir()
+	defer MustRemoveAll(path)
+	cachePath := filepath.Join(MustTempDir(), "cache")
+	defer MustRemoveAll(filepath.Dir(cachePath))
+
+	MustWriteFile(filepath.Join(path, "a", "Bakefile.lua"), []byte(`target("a")`))
+	MustWriteFile(filepath.Join(path, "b", "Bakefile.lua"), []byte(`name = "global"`))
+	MustWriteFile(filepath.Join(path, "c", "Bakefile.lua"), []byte(`target(name)`))
+
+	for i := 0; i < 2; i++ {
+		p := MustParseCached(path, cachePath)
+		if i > 0 && !reflect.DeepEqual(p.Evaluated, []string{"b/Bakefile.lua", "c/Bakefile.lua"}) {
+			t.Fatalf("%d. unexpected evaluated: %#v", i, p.Evaluated)
+		} else if a := p.Package.TargetNames(); !reflect.DeepEqual(a, []string{"a/a", "c/global"}) {
+			t.Fatalf("%d. unexpected targets: %#v", i, a)
+		}
+	}
+}
+
+// MustParseCached parses path using the parse cache at cachePath and saves the cache.
+// Panic on error.
+func MustParseCached(path, cachePath string) *bake.Parser {
+	c := bake.NewParseCache(cachePath)
+	if err := c.Load(); err != nil {
+		panic(err)
+	}
+
+	p := bake.NewParser()
+	p.Cache = c
+	if err := p.ParseDir(path); err != nil {
+		panic(err)
+	} else if err := c.Save(); err != nil {
+		panic(err)
+	}
+	return p
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/flynn/bake"
+)
+
+// GCCommand represents a command for removing stale snapshot data.
+type GCCommand struct {
+	// Directory to start parsing from.
+	Root string
+
+	// Directory to store snapshot data.
+	DataDir string
+
+	// Deletes the declared outputs of orphaned targets when true.
+	// Directories are only deleted when confirmed on Stdin.
+	RemoveOutputs bool
+
+	// Deletes data for projects whose root no longer exists when true.
+	// Otherwise these projects are only reported.
+	PruneData bool
+
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+
+	stdinReader *bufio.Reader
+}
+
+// NewGCCommand returns a new instance of GCCommand.
+func NewGCCommand() *GCCommand {
+	return &GCCommand{
+		Root: DefaultRoot,
+
+		Stdin:  os.Stdin,
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
+}
+
+// ParseFlags parses the command line flags into fields on the command.
+func (cmd *GCCommand) ParseFlags(args []string) error {
+	fs := flag.NewFlagSet("bake-gc", flag.ContinueOnError)
+	fs.SetOutput(cmd.Stderr)
+	fs.StringVar(&cmd.Root, "root", DefaultRoot, "project root")
+	fs.StringVar(&cmd.DataDir, "data", "", "data directory")
+	fs.BoolVar(&cmd.RemoveOutputs, "outputs", false, "remove declared outputs of orphaned targets")
+	fs.BoolVar(&cmd.PruneData, "prune", false, "remove data for projects that no longer exist")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	// If no data directory is specified then use ~/.bake
+	if cmd.DataDir == "" {
+		dir, err := defaultDataDir()
+		if err != nil {
+			return err
+		}
+		cmd.DataDir = dir
+	}
+
+	return nil
+}
+
+// Run executes the command.
+func (cmd *GCCommand) Run() error {
+	// Validate arguments.
+	if cmd.Root == "" {
+		return errors.New("project root required")
+	} else if cmd.DataDir == "" {
+		return errors.New("data directory required")
+	}
+
+	// Ensure root is an absolute, non-symlinked path.
+	root, err := resolveRoot(cmd.Root)
+	if err != nil {
+		return err
+	}
+	cmd.Root = root
+
+	// Parse build rules.
+	parser := bake.NewParser()
+	if err := parser.ParseDir(cmd.Root); err != nil {
+		return err
+	}
+
+	// Remove snapshot records for targets that no longer exist.
+	ss := bake.NewSnapshot(filepath.Join(cmd.DataDir, cmd.Root, SnapshotFile), cmd.Root)
+	if err := cmd.removeOrphanedTargets(ss, parser.Package); err != nil {
+		return err
+	}
+
+	// Report or remove data for projects that no longer exist.
+	if err := cmd.pruneDataDirs(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// removeOrphanedTargets removes snapshot records that do not exist in pkg.
+// Recorded outputs are also removed if RemoveOutputs is set.
+func (cmd *GCCommand) removeOrphanedTargets(ss *bake.Snapshot, pkg *bake.Package) error {
+	names, err := ss.OrphanedTargets(pkg)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if cmd.RemoveOutputs {
+			if err := cmd.removeOutputs(ss, pkg, name); err != nil {
+				return err
+			}
+		}
+
+		if err := ss.RemoveTarget(name); err != nil {
+			return err
+		}
+		fmt.Fprintf(cmd.Stdout, "removed target: %s\n", name)
+	}
+
+	return nil
+}
+
+// removeOutputs deletes the outputs declared by a target from the project root.
+// Outputs produced by a target in pkg are kept. Targets without declared
+// outputs are only recorded by name so nothing is removed for them.
+func (cmd *GCCommand) removeOutputs(ss *bake.Snapshot, pkg *bake.Package, name string) error {
+	info, err := ss.Target(name)
+	if err != nil {
+		return err
+	}
+
+	for _, output := range info.Declared {
+		// Ignore outputs that resolve outside of the project root.
+		path := filepath.Join(cmd.Root, output)
+		if !strings.HasPrefix(path, cmd.Root+string(filepath.Separator)) {
+			continue
+		}
+
+		// Ignore outputs still produced by a current target.
+		if producer := outputProducer(pkg, output); producer != "" {
+			fmt.Fprintf(cmd.Stdout, "kept output: %s (produced by %s)\n", output, producer)
+			continue
+		}
+
+		fi, err := os.Lstat(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		// Directories may contain source files so they require confirmation.
+		if fi.IsDir() && !cmd.confirm(fmt.Sprintf("remove directory %s?", output)) {
+			fmt.Fprintf(cmd.Stdout, "kept output: %s (directory)\n", output)
+			continue
+		}
+
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+		fmt.Fprintf(cmd.Stdout, "removed output: %s\n", output)
+	}
+
+	return nil
+}
+
+// outputProducer returns the name of a target or pattern rule in pkg that
+// produces path or a file within it. Returns a blank string if none do.
+func outputProducer(pkg *bake.Package, path string) string {
+	if t := pkg.OutputTarget(path); t != nil {
+		return t.Name
+	}
+	for _, t := range pkg.Targets {
+		for _, output := range t.OutputFiles() {
+			if strings.HasPrefix(output, path+"/") {
+				return t.Name
+			}
+		}
+	}
+	for _, r := range pkg.Rules {
+		if _, ok := r.Match(path); ok {
+			return r.Name
+		}
+	}
+	return ""
+}
+
+// confirm prompts on stderr and returns true if a "y" line is read from stdin.
+func (cmd *GCCommand) confirm(prompt string) bool {
+	if cmd.Stdin == nil {
+		return false
+	}
+	fmt.Fprintf(cmd.Stderr, "%s [y/N] ", prompt)
+
+	line, _ := cmd.stdin().ReadString('\n')
+	answer := strings.ToLower(strings.TrimSpace(line))
+	return answer == "y" || answer == "yes"
+}
+
+// stdin returns a buffered reader for Stdin so prompts can share its input.
+func (cmd *GCCommand) stdin() *bufio.Reader {
+	if cmd.stdinReader == nil {
+		cmd.stdinReader = bufio.NewReader(cmd.Stdin)
+	}
+	return cmd.stdinReader
+}
+
+// pruneDataDirs finds snapshots in the data directory whose project root no longer exists.
+func (cmd *GCCommand) pruneDataDirs() error {
+	roots, err := staleProjectRoots(cmd.DataDir)
+	if err != nil {
+		return err
+	}
+
+	for _, root := range roots {
+		if !cmd.PruneData {
+			fmt.Fprintf(cmd.Stdout, "stale project: %s\n", root)
+			continue
+		}
+
+		if err := removeDataDir(cmd.DataDir, root); err != nil {
+			return err
+		}
+		fmt.Fprintf(cmd.Stdout, "removed project: %s\n", root)
+	}
+
+	return nil
+}
+
+// staleProjectRoots returns the project roots with data in dataDir that no longer exist.
+// A directory holding a snapshot or a parse cache is treated as a project's data directory.
+func staleProjectRoots(dataDir string) ([]string, error) {
+	var roots []string
+	if err := filepath.Walk(dataDir, func(path string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		} else if !fi.IsDir() {
+			return nil
+		} else if fi.Name() == SnapshotFile {
+			return filepath.SkipDir
+		}
+
+		// Ignore directories that don't hold project data.
+		if ok, err := hasProjectData(path); err != nil {
+			return err
+		} else if !ok {
+			return nil
+		}
+
+		// The data directory mirrors the absolute project root.
+		rel, err := filepath.Rel(dataDir, path)
+		if err != nil {
+			return err
+		}
+		root := string(filepath.Separator) + rel
+
+		if _, err := os.Stat(root); os.IsNotExist(err) {
+			roots = append(roots, root)
+		} else if err != nil {
+			return err
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return roots, nil
+}
+
+// hasProjectData returns true if dir contains a snapshot or a parse cache.
+func hasProjectData(dir string) (bool, error) {
+	for _, name := range []string{SnapshotFile, ParseCacheFile} {
+		if _, err := os.Lstat(filepath.Join(dir, name)); err == nil {
+			return true, nil
+		} else if !os.IsNotExist(err) {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// removeDataDir deletes the snapshot and parse cache for root from dataDir.
+// Parent directories left empty by the removal are also deleted.
+func removeDataDir(dataDir, root string) error {
+	dir := filepath.Join(dataDir, root)
+	if err := os.RemoveAll(filepath.Join(dir, SnapshotFile)); err != nil {
+		return err
+	} else if err := os.RemoveAll(filepath.Join(dir, ParseCacheFile)); err != nil {
+		return err
+	}
+
+	dataDir = filepath.Clean(dataDir)
+	for ; dir != dataDir && strings.HasPrefix(dir, dataDir); dir = filepath.Dir(dir) {
+		if err := os.Remove(dir); err != nil {
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+package main_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/flynn/bake"
+	main "github.com/flynn/bake/cmd/bake"
+)
+
+// Ensure orphaned targets and their declared outputs are removed.
+func TestGCCommand_Run(t *testing.T) {
+	root, dataDir := MustTempDir(), MustTempDir()
+	defer os.RemoveAll(root)
+	defer os.RemoveAll(dataDir)
+
+	// Only target "a" exists in the project. Targets "b" and "c" were removed.
+	MustWriteFile(filepath.Join(root, "Bakefile.lua"), []byte(`target("a")`))
+	MustWriteFile(filepath.Join(root, "bin", "b"), []byte("0"))
+	MustWriteFile(filepath.Join(root, "c"), []byte("0"))
+
+	// Record the targets in the snapshot. Only "b" declared its output.
+	root, _ = filepath.EvalSymlinks(root)
+	ss := bake.NewSnapshot(filepath.Join(dataDir, root, main.SnapshotFile), root)
+	for _, target := range []*bake.Target{{Name: "a"}, {Name: "b", Outputs: []string{"bin/b"}}, {Name: "c"}} {
+		if err := ss.AddTarget(target, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cmd := NewGCCommand()
+	if err := cmd.ParseFlags([]string{"-root", root, "-data", dataDir, "-outputs"}); err != nil {
+		t.Fatal(err)
+	} else if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Verify "b" and its output were removed but "c" kept its file.
+	if names, err := ss.TargetNames(); err != nil {
+		t.Fatal(err)
+	} else if len(names) != 1 || names[0] != "a" {
+		t.Fatalf("unexpected targets: %v", names)
+	} else if _, err := os.Stat(filepath.Join(root, "bin", "b")); !os.IsNotExist(err) {
+		t.Fatalf("expected output removed: %v", err)
+	} else if _, err := os.Stat(filepath.Join(root, "c")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure outputs produced by current targets and unconfirmed directories are kept.
+func TestGCCommand_Run_KeepOutputs(t *testing.T) {
+	root, dataDir := MustTempDir(), MustTempDir()
+	defer os.RemoveAll(root)
+	defer os.RemoveAll(dataDir)
+
+	// Target "old" was renamed to "new" and "docs" generated a directory.
+	MustWriteFile(filepath.Join(root, "Bakefile.lua"), []byte(`target("new")`))
+	MustWriteFile(filepath.Join(root, "new"), []byte("0"))
+	MustWriteFile(filepath.Join(root, "docs", "index.md"), []byte("0"))
+
+	root, _ = filepath.EvalSymlinks(root)
+	ss := bake.NewSnapshot(filepath.Join(dataDir, root, main.SnapshotFile), root)
+	for _, target := range []*bake.Target{{Name: "old", Outputs: []string{"new"}}, {Name: "gen", Outputs: []string{"docs"}}} {
+		if err := ss.AddTarget(target, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cmd := NewGCCommand()
+	cmd.Stdin.WriteString("n\n")
+	if err := cmd.ParseFlags([]string{"-root", root, "-data", dataDir, "-outputs"}); err != nil {
+		t.Fatal(err)
+	} else if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	} else if _, err := os.Stat(filepath.Join(root, "new")); err != nil {
+		t.Fatal(err)
+	} else if _, err := os.Stat(filepath.Join(root, "docs", "index.md")); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Contains(cmd.Stderr.Bytes(), []byte("remove directory docs? [y/N]")) {
+		t.Fatalf("unexpected stderr: %s", cmd.Stderr.String())
+	}
+
+	// Confirming removes the directory.
+	if err := ss.AddTarget(&bake.Target{Name: "gen", Outputs: []string{"docs"}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	cmd = NewGCCommand()
+	cmd.Stdin.WriteString("y\n")
+	if err := cmd.ParseFlags([]string{"-root", root, "-data", dataDir, "-outputs"}); err != nil {
+		t.Fatal(err)
+	} else if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	} else if _, err := os.Stat(filepath.Join(root, "docs")); !os.IsNotExist(err) {
+		t.Fatalf("expected directory removed: %v", err)
+	}
+}
+
+// Ensure targets created by pattern rules are not treated as orphaned.
+func TestGCCommand_Run_Rules(t *testing.T) {
+	root, dataDir := MustTempDir(), MustTempDir()
+	defer os.RemoveAll(root)
+	defer os.RemoveAll(dataDir)
+
+	MustWriteFile(filepath.Join(root, "Bakefile.lua"), []byte(`target("gen/%.txt", function(stem) end)`))
+	MustWriteFile(filepath.Join(root, "gen", "a.txt"), []byte("0"))
+
+	root, _ = filepath.EvalSymlinks(root)
+	ss := bake.NewSnapshot(filepath.Join(dataDir, root, main.SnapshotFile), root)
+	if err := ss.AddTarget(&bake.Target{Name: "gen/a.txt", Outputs: []string{"gen/a.txt"}}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := NewGCCommand()
+	if err := cmd.ParseFlags([]string{"-root", root, "-data", dataDir, "-outputs"}); err != nil {
+		t.Fatal(err)
+	} else if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	} else if names, err := ss.TargetNames(); err != nil {
+		t.Fatal(err)
+	} else if len(names) != 1 || names[0] != "gen/a.txt" {
+		t.Fatalf("unexpected targets: %v", names)
+	} else if _, err := os.Stat(filepath.Join(root, "gen", "a.txt")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure snapshots for deleted projects are reported and pruned.
+func TestGCCommand_Run_PruneData(t *testing.T) {
+	root, dataDir := MustTempDir(), MustTempDir()
+	defer os.RemoveAll(root)
+	defer os.RemoveAll(dataDir)
+	root, _ = filepath.EvalSymlinks(root)
+
+	// Create snapshot data for a project that doesn't exist.
+	MustWriteFile(filepath.Join(dataDir, root, "deleted", main.SnapshotFile, "a"), []byte{})
+	MustWriteFile(filepath.Join(dataDir, root, "deleted", main.ParseCacheFile), []byte{})
+
+	// Run without pruning and verify it's only reported.
+	cmd := NewGCCommand()
+	if err := cmd.ParseFlags([]string{"-root", root, "-data", dataDir}); err != nil {
+		t.Fatal(err)
+	} else if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Contains(cmd.Stdout.Bytes(), []byte("stale project: "+filepath.Join(root, "deleted"))) {
+		t.Fatalf("unexpected stdout: %s", cmd.Stdout.String())
+	} else if _, err := os.Stat(filepath.Join(dataDir, root, "deleted")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Run with pruning and verify the data is removed.
+	cmd = NewGCCommand()
+	if err := cmd.ParseFlags([]string{"-root", root, "-data", dataDir, "-prune"}); err != nil {
+		t.Fatal(err)
+	} else if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	} else if _, err := os.Stat(filepath.Join(dataDir, root, "deleted")); !os.IsNotExist(err) {
+		t.Fatalf("expected data removed: %v", err)
+	}
+}
+
+// Ensure data for deleted projects that only have a parse cache is reported and pruned.
+func TestGCCommand_Run_PruneData_ParseCache(t *testing.T) {
+	root, dataDir := MustTempDir(), MustTempDir()
+	defer os.RemoveAll(root)
+	defer os.RemoveAll(dataDir)
+	root, _ = filepath.EvalSymlinks(root)
+
+	MustWriteFile(filepath.Join(dataDir, root, "deleted", main.ParseCacheFile), []byte{})
+
+	cmd := NewGCCommand()
+	if err := cmd.ParseFlags([]string{"-root", root, "-data", dataDir}); err != nil {
+		t.Fatal(err)
+	} else if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Contains(cmd.Stdout.Bytes(), []byte("stale project: "+filepath.Join(root, "deleted"))) {
+		t.Fatalf("unexpected stdout: %s", cmd.Stdout.String())
+	}
+
+	// Pruning removes the cache and the emptied project data directory.
+	cmd = NewGCCommand()
+	if err := cmd.ParseFlags([]string{"-root", root, "-data", dataDir, "-prune"}); err != nil {
+		t.Fatal(err)
+	} else if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	} else if _, err := os.Stat(filepath.Join(dataDir, root, "deleted")); !os.IsNotExist(err) {
+		t.Fatalf("expected data removed: %v", err)
+	}
+}
+
+// GCCommand represents a test wrapper for main.GCCommand.
+type GCCommand struct {
+	*main.GCCommand
+	Stdin  bytes.Buffer
+	Stdout bytes.Buffer
+	Stderr bytes.Buffer
+}
+
+// NewGCCommand returns a new instance of GCCommand.
+func NewGCCommand() *GCCommand {
+	cmd := &GCCommand{GCCommand: main.NewGCCommand()}
+	cmd.GCCommand.Stdin = &cmd.Stdin
+	cmd.GCCommand.Stdout = &cmd.Stdout
+	cmd.GCCommand.Stderr = &cmd.Stderr
+	return cmd
+}
+
+// MustTempDir returns a path to a temporary directory. Panic on error.
+func MustTempDir() string {
+	path, err := ioutil.TempDir("", "bake-")
+	if err != nil {
+		panic(err)
+	}
+	return path
+}
+
+// MustWriteFile writes data to filename. Panic on error.
+func MustWriteFile(filename string, data []byte) {
+	if err := os.MkdirAll(filepath.Dir(filename), 0777); err != nil {
+		panic(err)
+	}
+	if err := ioutil.WriteFile(filename, data, 0666); err != nil {
+		panic(err)
+	}
+}
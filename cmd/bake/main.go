@@ -25,21 +25,44 @@ const (
 	// SnapshotFile is the directory a snapshot is store in within the data directory.
 	// It's used to avoid issues with overlapping project paths.
 	SnapshotFile = "__SNAPSHOT__"
+
+	// ParseCacheFile is the file parsed Bakefiles are cached in within the data directory.
+	ParseCacheFile = "__PARSE_CACHE__"
 )
 
 func main() {
-	m := NewMain()
-	if err := m.ParseFlags(os.Args[1:]); err != nil {
-		fmt.Fprintln(m.Stderr, err)
+	cmd, args := newCommand(os.Args[1:])
+	if err := cmd.ParseFlags(args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 
-	if err := m.Run(); err != nil {
-		fmt.Fprintln(m.Stderr, err)
+	if err := cmd.Run(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 }
 
+// Command represents an executable subcommand.
+type Command interface {
+	ParseFlags(args []string) error
+	Run() error
+}
+
+// newCommand returns the command named by the first argument and its remaining arguments.
+// Arguments that do not begin with a subcommand name are passed to the build command.
+func newCommand(args []string) (Command, []string) {
+	if len(args) > 0 {
+		switch args[0] {
+		case "gc":
+			return NewGCCommand(), args[1:]
+		case "snapshot":
+			return NewSnapshotCommand(), args[1:]
+		}
+	}
+	return NewMain(), args
+}
+
 // Main represents the main program execution.
 type Main struct {
 	fs *bake.FileSystem
@@ -50,6 +73,29 @@ type Main struct {
 	// Forces all listed targets to be rebuilt when true.
 	Force bool
 
+	// Fails the build if a target reads another target's outputs without depending on it.
+	Strict bool
+
+	// Orders targets after targets whose outputs they read in their last build.
+	Infer bool
+
+	// Prints the depends() entries needed to declare missing dependencies.
+	Fix bool
+
+	// Number of Bakefiles evaluated concurrently.
+	ParseParallelism int
+
+	// Evaluates every Bakefile instead of reading unchanged ones from the parse cache.
+	NoParseCache bool
+
+	// Protocol version served by the 9p file system, such as "9P2000.L".
+	// Uses the file system's default if blank.
+	Protocol string
+
+	// Transport used to mount the 9p file system: "tcp", "unix" or "fd".
+	// Uses the file system's default if blank.
+	Transport string
+
 	// Directory to start parsing from.
 	Root string
 
@@ -77,6 +123,13 @@ func (m *Main) ParseFlags(args []string) error {
 	fs := flag.NewFlagSet("bake", flag.ContinueOnError)
 	fs.SetOutput(m.Stderr)
 	fs.BoolVar(&m.Force, "f", false, "force rebuild")
+	fs.BoolVar(&m.Strict, "strict", false, "fail on undeclared dependencies")
+	fs.BoolVar(&m.Infer, "infer", false, "infer dependencies from previous builds")
+	fs.BoolVar(&m.Fix, "fix", false, "suggest depends() entries for undeclared dependencies")
+	fs.IntVar(&m.ParseParallelism, "parse-parallelism", 1, "number of Bakefiles to evaluate concurrently")
+	fs.BoolVar(&m.NoParseCache, "no-parse-cache", false, "evaluate every Bakefile without reading or updating the parse cache")
+	fs.StringVar(&m.Protocol, "9p-protocol", "", "9p protocol version to serve (9P2000.u or 9P2000.L)")
+	fs.StringVar(&m.Transport, "9p-transport", "", "9p mount transport (tcp, unix or fd)")
 	fs.StringVar(&m.Root, "root", DefaultRoot, "project root")
 	fs.StringVar(&m.DataDir, "data", "", "data directory")
 	if err := fs.Parse(args); err != nil {
@@ -88,13 +141,11 @@ func (m *Main) ParseFlags(args []string) error {
 
 	// If no data directory is specified then use ~/.bake
 	if m.DataDir == "" {
-		u, err := user.Current()
+		dir, err := defaultDataDir()
 		if err != nil {
-			return errors.New("data directory not specified and current user unknown")
-		} else if u.HomeDir == "" {
-			return errors.New("data directory must be specified if no home directory exists")
+			return err
 		}
-		m.DataDir = filepath.Join(u.HomeDir, ".bake")
+		m.DataDir = dir
 	}
 
 	return nil
@@ -109,40 +160,58 @@ func (m *Main) Run() error {
 		return errors.New("data directory required")
 	}
 
-	// Ensure root is an absolute path.
-	root, err := filepath.Abs(m.Root)
-	if err != nil {
-		return fmt.Errorf("abs path: %s", err)
-	}
-
-	// Ensure root is not a symbolic link.
-	// This causes issues with the 9p filesystem otherwise.
-	root, err = filepath.EvalSymlinks(root)
+	// Ensure root is an absolute, non-symlinked path.
+	root, err := resolveRoot(m.Root)
 	if err != nil {
-		return fmt.Errorf("eval symlinks: %s", err)
+		return err
 	}
 	m.Root = root
 
 	// Initialize snapshot.
 	ss := bake.NewSnapshot(filepath.Join(m.DataDir, m.Root, SnapshotFile), m.Root)
 
-	// Parse build rules.
+	// Load targets of previously parsed Bakefiles, unless disabled.
+	var cache *bake.ParseCache
+	if !m.NoParseCache {
+		cache = bake.NewParseCache(filepath.Join(m.DataDir, m.Root, ParseCacheFile))
+		if err := cache.Load(); err != nil {
+			return err
+		}
+	}
+
+	// Parse build rules. Only Bakefiles that have changed are evaluated.
 	parser := bake.NewParser()
+	parser.Cache = cache
+	parser.Parallelism = m.ParseParallelism
 	if err := parser.ParseDir(m.Root); err != nil {
 		return err
+	} else if cache != nil {
+		if err := cache.Save(); err != nil {
+			return err
+		}
 	}
 	pkg := parser.Package
 
+	// Ensure all dependencies resolve to targets.
+	warnings, err := pkg.Validate()
+	for _, w := range append(parser.Warnings, warnings...) {
+		fmt.Fprintf(m.Stderr, "warning: %s\n", w)
+	}
+	if err != nil {
+		return err
+	}
+
 	// If no targets are specified then build all targets.
 	if len(m.Targets) == 0 {
 		m.Targets = pkg.TargetNames()
 	}
 
-	// Create planner. Only use snapshot if not force building.
+	// Create planner. The snapshot determines which targets are dirty and,
+	// with -infer, the dependencies recorded from previous builds.
 	p := bake.NewPlanner(pkg)
-	if !m.Force {
-		p.Snapshot = ss
-	}
+	p.Snapshot = ss
+	p.Force = m.Force
+	p.InferDependencies = m.Infer
 
 	// Create build plan.
 	build, err := p.Plan(m.Targets)
@@ -172,7 +241,7 @@ func (m *Main) Run() error {
 	defer m.closeFileSystem(fs)
 
 	// Execute the build.
-	if err := m.build(build, fs, ss); err != nil {
+	if err := m.build(build, pkg, fs, ss); err != nil {
 		return err
 	}
 
@@ -185,6 +254,8 @@ func (m *Main) openFileSystem(mountPath string) (bake.FileSystem, error) {
 	fs, err := bake.NewFileSystem(DefaultFileSystem, bake.FileSystemOptions{
 		Path:      m.Root,
 		MountPath: mountPath,
+		Protocol:  m.Protocol,
+		Transport: m.Transport,
 	})
 	if err != nil {
 		return nil, fmt.Errorf("new file system: %s", err)
@@ -208,14 +279,28 @@ func (m *Main) closeFileSystem(fs bake.FileSystem) error {
 }
 
 // build executes a build against a file system.
-func (m *Main) build(build *bake.Build, fs bake.FileSystem, ss *bake.Snapshot) error {
+func (m *Main) build(build *bake.Build, pkg *bake.Package, fs bake.FileSystem, ss *bake.Snapshot) error {
 	// Execute build.
 	b := bake.NewBuilder()
 	b.FileSystem = fs
 	b.Snapshot = ss
+	b.Package = pkg
+	b.StrictDependencies = m.Strict
 	b.Output = m.Stderr
 	b.Build(build)
 
+	// Suggest fixes for undeclared dependencies, even if the build failed because of them.
+	if m.Fix {
+		for _, d := range b.UndeclaredDependencies() {
+			fmt.Fprintf(m.Stderr, "fix: %s\n", d.Fix())
+		}
+	}
+
+	// Summarize files written by more than one target at the same time.
+	for _, c := range b.WriteConflicts() {
+		fmt.Fprintf(m.Stderr, "conflict: %s\n", c)
+	}
+
 	if err := build.RootErr(); err != nil {
 		return err
 	}
@@ -240,3 +325,29 @@ func (m *Main) pipeReaders(build *bake.Build, set map[*bake.Build]struct{}) {
 		m.pipeReaders(subbuild, set)
 	}
 }
+
+// defaultDataDir returns the default data directory, ~/.bake.
+func defaultDataDir() (string, error) {
+	u, err := user.Current()
+	if err != nil {
+		return "", errors.New("data directory not specified and current user unknown")
+	} else if u.HomeDir == "" {
+		return "", errors.New("data directory must be specified if no home directory exists")
+	}
+	return filepath.Join(u.HomeDir, ".bake"), nil
+}
+
+// resolveRoot returns path as an absolute path with symbolic links evaluated.
+// Symbolic links cause issues with the 9p filesystem otherwise.
+func resolveRoot(path string) (string, error) {
+	root, err := filepath.Abs(path)
+	if err != nil {
+		return "", fmt.Errorf("abs path: %s", err)
+	}
+
+	root, err = filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", fmt.Errorf("eval symlinks: %s", err)
+	}
+	return root, nil
+}
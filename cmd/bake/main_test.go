@@ -19,6 +19,42 @@ func TestMain_ParseFlags_Target(t *testing.T) {
 	}
 }
 
+func TestMain_ParseFlags_StrictFix(t *testing.T) {
+	m := NewMain()
+	if err := m.ParseFlags([]string{"-strict", "-fix", "foo"}); err != nil {
+		t.Fatal(err)
+	} else if !m.Strict || !m.Fix {
+		t.Fatalf("unexpected flags: strict=%v fix=%v", m.Strict, m.Fix)
+	}
+}
+
+func TestMain_ParseFlags_NoParseCache(t *testing.T) {
+	m := NewMain()
+	if err := m.ParseFlags([]string{"-no-parse-cache"}); err != nil {
+		t.Fatal(err)
+	} else if !m.NoParseCache {
+		t.Fatal("expected parse cache to be disabled")
+	}
+}
+
+func TestMain_ParseFlags_Protocol(t *testing.T) {
+	m := NewMain()
+	if err := m.ParseFlags([]string{"-9p-protocol", "9P2000.L"}); err != nil {
+		t.Fatal(err)
+	} else if m.Protocol != "9P2000.L" {
+		t.Fatalf("unexpected protocol: %q", m.Protocol)
+	}
+}
+
+func TestMain_ParseFlags_Transport(t *testing.T) {
+	m := NewMain()
+	if err := m.ParseFlags([]string{"-9p-transport", "unix"}); err != nil {
+		t.Fatal(err)
+	} else if m.Transport != "unix" {
+		t.Fatalf("unexpected transport: %q", m.Transport)
+	}
+}
+
 // Main represents a test wrapper for main.Main.
 type Main struct {
 	*main.Main
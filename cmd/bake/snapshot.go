@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/flynn/bake"
+)
+
+// SnapshotCommand represents a command for inspecting snapshot data.
+type SnapshotCommand struct {
+	// Subcommand to execute. Either "ls" or "show".
+	Command string
+
+	// Target to inspect when using "show".
+	Target string
+
+	// Directory the project is located in.
+	Root string
+
+	// Directory to store snapshot data.
+	DataDir string
+
+	// Writes output as JSON when true.
+	JSON bool
+
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// NewSnapshotCommand returns a new instance of SnapshotCommand.
+func NewSnapshotCommand() *SnapshotCommand {
+	return &SnapshotCommand{
+		Root: DefaultRoot,
+
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
+}
+
+// ParseFlags parses the command line flags into fields on the command.
+func (cmd *SnapshotCommand) ParseFlags(args []string) error {
+	// Retrieve subcommand name.
+	if len(args) == 0 {
+		return errors.New("usage: bake snapshot ls|show [arguments]")
+	}
+	cmd.Command, args = args[0], args[1:]
+
+	fs := flag.NewFlagSet("bake-snapshot-"+cmd.Command, flag.ContinueOnError)
+	fs.SetOutput(cmd.Stderr)
+	fs.StringVar(&cmd.Root, "root", DefaultRoot, "project root")
+	fs.StringVar(&cmd.DataDir, "data", "", "data directory")
+	fs.BoolVar(&cmd.JSON, "json", false, "write output as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	// Validate remaining arguments against the subcommand.
+	switch cmd.Command {
+	case "ls":
+		if fs.NArg() != 0 {
+			return errors.New("usage: bake snapshot ls [-json]")
+		}
+	case "show":
+		if fs.NArg() != 1 {
+			return errors.New("usage: bake snapshot show [-json] TARGET")
+		}
+		cmd.Target = fs.Arg(0)
+	default:
+		return fmt.Errorf("unknown snapshot command: %s", cmd.Command)
+	}
+
+	// If no data directory is specified then use ~/.bake
+	if cmd.DataDir == "" {
+		dir, err := defaultDataDir()
+		if err != nil {
+			return err
+		}
+		cmd.DataDir = dir
+	}
+
+	return nil
+}
+
+// Run executes the command.
+func (cmd *SnapshotCommand) Run() error {
+	// Validate arguments.
+	if cmd.Root == "" {
+		return errors.New("project root required")
+	} else if cmd.DataDir == "" {
+		return errors.New("data directory required")
+	}
+
+	// Ensure root is an absolute, non-symlinked path.
+	root, err := resolveRoot(cmd.Root)
+	if err != nil {
+		return err
+	}
+	cmd.Root = root
+
+	ss := bake.NewSnapshot(filepath.Join(cmd.DataDir, cmd.Root, SnapshotFile), cmd.Root)
+
+	switch cmd.Command {
+	case "ls":
+		return cmd.runList(ss)
+	case "show":
+		return cmd.runShow(ss)
+	default:
+		return fmt.Errorf("unknown snapshot command: %s", cmd.Command)
+	}
+}
+
+// runList writes all recorded targets and their last build time.
+func (cmd *SnapshotCommand) runList(ss *bake.Snapshot) error {
+	names, err := ss.TargetNames()
+	if err != nil {
+		return err
+	}
+
+	// Read all targets.
+	targets := make([]*bake.TargetInfo, 0, len(names))
+	for _, name := range names {
+		info, err := ss.Target(name)
+		if err != nil {
+			return err
+		}
+		targets = append(targets, info)
+	}
+
+	if cmd.JSON {
+		type target struct {
+			Name      string    `json:"name"`
+			BuildTime time.Time `json:"buildTime"`
+		}
+
+		a := make([]target, len(targets))
+		for i, info := range targets {
+			a[i] = target{Name: info.Name, BuildTime: info.BuildTime}
+		}
+		return json.NewEncoder(cmd.Stdout).Encode(a)
+	}
+
+	w := tabwriter.NewWriter(cmd.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "TARGET\tBUILT")
+	for _, info := range targets {
+		fmt.Fprintf(w, "%s\t%s\n", info.Name, formatBuildTime(info.BuildTime))
+	}
+	return w.Flush()
+}
+
+// runShow writes the recorded state of a single target and its inputs.
+func (cmd *SnapshotCommand) runShow(ss *bake.Snapshot) error {
+	info, err := ss.Target(cmd.Target)
+	if err == bake.ErrSnapshotTargetNotFound {
+		return fmt.Errorf("target not found in snapshot: %s", cmd.Target)
+	} else if err != nil {
+		return err
+	}
+
+	// Determine which inputs have changed since the last build.
+	dirty := make([]bool, len(info.Inputs))
+	for i, in := range info.Inputs {
+		if dirty[i], err = ss.IsInputDirty(info, in); err != nil {
+			return err
+		}
+	}
+
+	if cmd.JSON {
+		type input struct {
+			*bake.InputInfo
+			Dirty bool `json:"dirty"`
+		}
+		type target struct {
+			*bake.TargetInfo
+			Inputs []input `json:"inputs"`
+		}
+
+		other := target{TargetInfo: info, Inputs: make([]input, len(info.Inputs))}
+		for i, in := range info.Inputs {
+			other.Inputs[i] = input{InputInfo: in, Dirty: dirty[i]}
+		}
+		return json.NewEncoder(cmd.Stdout).Encode(other)
+	}
+
+	fmt.Fprintf(cmd.Stdout, "Target:  %s\n", info.Name)
+	fmt.Fprintf(cmd.Stdout, "Hash:    %s\n", info.Hash)
+	fmt.Fprintf(cmd.Stdout, "Built:   %s\n", formatBuildTime(info.BuildTime))
+	fmt.Fprintf(cmd.Stdout, "Outputs: %s\n", strings.Join(info.Outputs, " "))
+	if len(info.Ignore) > 0 {
+		fmt.Fprintf(cmd.Stdout, "Ignore:  %s\n", strings.Join(info.Ignore, " "))
+	}
+	fmt.Fprintln(cmd.Stdout, "")
+
+	w := tabwriter.NewWriter(cmd.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "INPUT\tKIND\tHASH\tCONTENT\tSTATUS")
+	for i, in := range info.Inputs {
+		status := "clean"
+		if dirty[i] {
+			status = "dirty"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", in.Name, in.Kind, in.Hash, formatHash(in.Content), status)
+	}
+	return w.Flush()
+}
+
+// formatBuildTime returns t as a string or "-" if t is unset.
+func formatBuildTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+// formatHash returns h or "-" if h is blank.
+func formatHash(h string) string {
+	if h == "" {
+		return "-"
+	}
+	return h
+}
@@ -0,0 +1,116 @@
+package main_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/flynn/bake"
+	main "github.com/flynn/bake/cmd/bake"
+)
+
+// Ensure recorded targets can be listed as JSON.
+func TestSnapshotCommand_Run_List(t *testing.T) {
+	root, dataDir, ss := MustOpenProjectSnapshot()
+	defer os.RemoveAll(root)
+	defer os.RemoveAll(dataDir)
+
+	for _, name := range []string{"b", "a"} {
+		if err := ss.AddTarget(&bake.Target{Name: name}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cmd := NewSnapshotCommand()
+	if err := cmd.ParseFlags([]string{"ls", "-root", root, "-data", dataDir, "-json"}); err != nil {
+		t.Fatal(err)
+	} else if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	var a []struct{ Name string }
+	if err := json.Unmarshal(cmd.Stdout.Bytes(), &a); err != nil {
+		t.Fatal(err)
+	} else if len(a) != 2 || a[0].Name != "a" || a[1].Name != "b" {
+		t.Fatalf("unexpected targets: %s", cmd.Stdout.String())
+	}
+}
+
+// Ensure a target's inputs are shown with their dirty status.
+func TestSnapshotCommand_Run_Show(t *testing.T) {
+	root, dataDir, ss := MustOpenProjectSnapshot()
+	defer os.RemoveAll(root)
+	defer os.RemoveAll(dataDir)
+
+	MustWriteFile(filepath.Join(root, "x"), []byte("0"))
+	MustWriteFile(filepath.Join(root, "y"), []byte("0"))
+	if err := ss.AddTarget(&bake.Target{Name: "T"}, &bake.Readset{Contents: []string{"x", "y"}}); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(filepath.Join(root, "y"))
+
+	cmd := NewSnapshotCommand()
+	if err := cmd.ParseFlags([]string{"show", "-root", root, "-data", dataDir, "T"}); err != nil {
+		t.Fatal(err)
+	} else if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	out := cmd.Stdout.String()
+	if !strings.Contains(out, "Target:  T\n") {
+		t.Fatalf("expected target name: %s", out)
+	} else if !regexpMatch(`(?m)^x\s.*\sclean$`, out) {
+		t.Fatalf("expected clean input: %s", out)
+	} else if !regexpMatch(`(?m)^y\s.*\sdirty$`, out) {
+		t.Fatalf("expected dirty input: %s", out)
+	}
+}
+
+// Ensure showing a target that was never built returns an error.
+func TestSnapshotCommand_Run_Show_NotFound(t *testing.T) {
+	root, dataDir, _ := MustOpenProjectSnapshot()
+	defer os.RemoveAll(root)
+	defer os.RemoveAll(dataDir)
+
+	cmd := NewSnapshotCommand()
+	if err := cmd.ParseFlags([]string{"show", "-root", root, "-data", dataDir, "T"}); err != nil {
+		t.Fatal(err)
+	} else if err := cmd.Run(); err == nil || err.Error() != "target not found in snapshot: T" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// SnapshotCommand represents a test wrapper for main.SnapshotCommand.
+type SnapshotCommand struct {
+	*main.SnapshotCommand
+	Stdout bytes.Buffer
+	Stderr bytes.Buffer
+}
+
+// NewSnapshotCommand returns a new instance of SnapshotCommand.
+func NewSnapshotCommand() *SnapshotCommand {
+	cmd := &SnapshotCommand{SnapshotCommand: main.NewSnapshotCommand()}
+	cmd.SnapshotCommand.Stdout = &cmd.Stdout
+	cmd.SnapshotCommand.Stderr = &cmd.Stderr
+	return cmd
+}
+
+// MustOpenProjectSnapshot returns a temporary project root, data directory,
+// and the snapshot the commands use for that project.
+func MustOpenProjectSnapshot() (root, dataDir string, ss *bake.Snapshot) {
+	root, dataDir = MustTempDir(), MustTempDir()
+	root, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		panic(err)
+	}
+	return root, dataDir, bake.NewSnapshot(filepath.Join(dataDir, root, main.SnapshotFile), root)
+}
+
+// regexpMatch returns true if s matches pattern.
+func regexpMatch(pattern, s string) bool {
+	return regexp.MustCompile(pattern).MatchString(s)
+}
@@ -0,0 +1,70 @@
+package bake
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ConfigFile is the project settings file, relative to the project root.
+//
+// Each line sets a value using "name = value". Blank lines and lines
+// beginning with "#" are ignored.
+const ConfigFile = LibraryDir + "/config"
+
+// Config represents the settings of a project.
+type Config struct {
+	// Restricts Bakefiles to standard libraries that can't run commands or
+	// read files without the parser tracking them. Enabled by default.
+	// Disabled with "hermetic = false".
+	Hermetic bool
+}
+
+// DefaultConfig returns the settings used when a project has no config file.
+func DefaultConfig() *Config {
+	return &Config{Hermetic: true}
+}
+
+// ReadConfig reads the config file of the project at root.
+// Returns the default settings if the project has no config file.
+func ReadConfig(root string) (*Config, error) {
+	c := DefaultConfig()
+
+	f, err := os.Open(filepath.Join(root, filepath.FromSlash(ConfigFile)))
+	if os.IsNotExist(err) {
+		return c, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for i := 1; scanner.Scan(); i++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected name = value", ConfigFile, i)
+		}
+		name, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+
+		switch name {
+		case "hermetic":
+			if c.Hermetic, err = strconv.ParseBool(value); err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid hermetic value: %q", ConfigFile, i, value)
+			}
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown setting: %q", ConfigFile, i, name)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
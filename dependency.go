@@ -0,0 +1,121 @@
+package bake
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// UndeclaredDependency represents a target that accessed the outputs of
+// another target without declaring a dependency on it. The target can then
+// run before its dependency and read missing or stale files.
+type UndeclaredDependency struct {
+	Target     *Target  // target that accessed the outputs
+	Dependency *Target  // target that declares the outputs
+	Paths      []string // outputs accessed, relative to the project root
+}
+
+// String returns a description of the undeclared dependency.
+func (d *UndeclaredDependency) String() string {
+	return fmt.Sprintf("%s reads %s, an output of %s, without depending on it",
+		d.Target.Name, strings.Join(d.Paths, ", "), d.Dependency.Name)
+}
+
+// Fix returns a suggestion for declaring the dependency in the target's Bakefile.
+func (d *UndeclaredDependency) Fix() string {
+	loc := d.Target.Location.String()
+	if d.Target.Location.File == "" {
+		loc = path.Join(d.Target.WorkDir, "Bakefile.lua")
+	}
+
+	return fmt.Sprintf("%s: add depends(%q) to target %q",
+		loc,
+		relativeTargetName(d.Target.WorkDir, d.Dependency.Name),
+		relativeTargetName(d.Target.WorkDir, d.Target.Name),
+	)
+}
+
+// relativeTargetName returns name relative to the working directory of a Bakefile.
+func relativeTargetName(workDir, name string) string {
+	if workDir == "" || workDir == "." {
+		return name
+	}
+
+	// Walk up from the working directory until it contains name.
+	var prefix string
+	for dir := path.Clean(workDir); dir != "."; dir = path.Dir(dir) {
+		if strings.HasPrefix(name, dir+"/") {
+			return prefix + strings.TrimPrefix(name, dir+"/")
+		}
+		prefix += "../"
+	}
+	return prefix + name
+}
+
+// UndeclaredDependencyError is returned when a target accesses the outputs
+// of targets it does not depend on and strict dependency checking is enabled.
+type UndeclaredDependencyError struct {
+	Dependencies []*UndeclaredDependency
+}
+
+// Error returns the error message.
+func (e *UndeclaredDependencyError) Error() string {
+	a := make([]string, len(e.Dependencies))
+	for i, d := range e.Dependencies {
+		a[i] = d.String()
+	}
+	return "undeclared dependency: " + strings.Join(a, "; ")
+}
+
+// FindUndeclaredDependencies returns the targets in pkg whose outputs were
+// accessed by t, according to rs, but which t does not depend on.
+// Reads of a file, its metadata and lookups of a missing file all count as access.
+func FindUndeclaredDependencies(pkg *Package, t *Target, rs *Readset) []*UndeclaredDependency {
+	m := make(map[*Target]*UndeclaredDependency)
+	for _, names := range [][]string{rs.Contents, rs.Stats, rs.Misses} {
+		for _, name := range names {
+			name = strings.TrimPrefix(path.Clean("/"+name), "/")
+
+			// Ignore files that aren't outputs and targets that read their own outputs.
+			other := pkg.OutputTarget(name)
+			if other == nil || other == t || pkg.DependsOn(t, other) {
+				continue
+			}
+
+			d := m[other]
+			if d == nil {
+				d = &UndeclaredDependency{Target: t, Dependency: other}
+				m[other] = d
+			}
+			d.Paths = appendUnique(d.Paths, name)
+		}
+	}
+
+	a := make([]*UndeclaredDependency, 0, len(m))
+	for _, d := range m {
+		sort.Strings(d.Paths)
+		a = append(a, d)
+	}
+	sort.Sort(undeclaredDependencies(a))
+	return a
+}
+
+// appendUnique appends s to a if it doesn't already exist.
+func appendUnique(a []string, s string) []string {
+	for _, v := range a {
+		if v == s {
+			return a
+		}
+	}
+	return append(a, s)
+}
+
+// undeclaredDependencies represents a list sortable by dependency name.
+type undeclaredDependencies []*UndeclaredDependency
+
+func (a undeclaredDependencies) Len() int      { return len(a) }
+func (a undeclaredDependencies) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a undeclaredDependencies) Less(i, j int) bool {
+	return a[i].Dependency.Name < a[j].Dependency.Name
+}
@@ -0,0 +1,64 @@
+package bake_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/flynn/bake"
+)
+
+// Ensure reads of another target's outputs without a dependency are found.
+func TestFindUndeclaredDependencies(t *testing.T) {
+	pkg := &bake.Package{
+		Targets: []*bake.Target{
+			{Name: "app/bin/app", WorkDir: "app", Dependencies: []string{"lib/gen"}},
+			{Name: "lib/gen", WorkDir: "lib", Dependencies: []string{"lib/proto"}},
+			{Name: "lib/proto", WorkDir: "lib", Outputs: []string{"lib/proto"}},
+			{Name: "web/assets", WorkDir: "web"},
+			{Name: "test", Phony: true},
+		},
+	}
+
+	a := bake.FindUndeclaredDependencies(pkg, pkg.Targets[0], &bake.Readset{
+		Contents: []string{"/app/main.go", "/app/bin/app", "/lib/gen", "/lib/proto/a.pb", "/web/assets/x.css"},
+		Stats:    []string{"/web/assets"},
+		Misses:   []string{"/test"},
+	})
+	if len(a) != 1 {
+		t.Fatalf("unexpected dependencies: %#v", a)
+	} else if a[0].Dependency.Name != "web/assets" {
+		t.Fatalf("unexpected dependency: %s", a[0].Dependency.Name)
+	} else if !reflect.DeepEqual(a[0].Paths, []string{"web/assets", "web/assets/x.css"}) {
+		t.Fatalf("unexpected paths: %#v", a[0].Paths)
+	} else if s := a[0].String(); s != "app/bin/app reads web/assets, web/assets/x.css, an output of web/assets, without depending on it" {
+		t.Fatalf("unexpected string: %s", s)
+	} else if s := a[0].Fix(); s != `app/Bakefile.lua: add depends("../web/assets") to target "bin/app"` {
+		t.Fatalf("unexpected fix: %s", s)
+	}
+}
+
+// Ensure a target without undeclared dependencies returns nothing.
+func TestFindUndeclaredDependencies_None(t *testing.T) {
+	pkg := &bake.Package{
+		Targets: []*bake.Target{
+			{Name: "a", Dependencies: []string{"b*"}},
+			{Name: "b1"},
+		},
+	}
+	if a := bake.FindUndeclaredDependencies(pkg, pkg.Targets[0], &bake.Readset{Contents: []string{"/b1", "/c"}}); len(a) != 0 {
+		t.Fatalf("unexpected dependencies: %#v", a)
+	}
+}
+
+// Ensure strict mode errors include every undeclared dependency.
+func TestUndeclaredDependencyError_Error(t *testing.T) {
+	err := &bake.UndeclaredDependencyError{
+		Dependencies: []*bake.UndeclaredDependency{
+			{Target: &bake.Target{Name: "a"}, Dependency: &bake.Target{Name: "b"}, Paths: []string{"b"}},
+			{Target: &bake.Target{Name: "a"}, Dependency: &bake.Target{Name: "c"}, Paths: []string{"c/x"}},
+		},
+	}
+	if s := err.Error(); s != "undeclared dependency: a reads b, an output of b, without depending on it; a reads c/x, an output of c, without depending on it" {
+		t.Fatalf("unexpected error: %s", s)
+	}
+}
@@ -2,6 +2,11 @@ package bake
 
 import (
 	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
 )
 
 // ErrUnregisteredFileSystem is returned when a file system has not been registered.
@@ -16,15 +21,388 @@ type FileSystem interface {
 	Path() string
 
 	// Creates a new root path for the file system where changes can be tracked.
-	CreateRoot() FileSystemRoot
+	// Writes outside of policy are denied. A nil policy allows all writes.
+	// The target name is used to report writes that conflict with other roots.
+	CreateRoot(target string, policy *WritePolicy) FileSystemRoot
 }
 
 // FileSystemRoot represents a copy of the file system root.
 // It can be used for tracking reads & writes.
 type FileSystemRoot interface {
 	Path() string
+
+	// Files whose contents were read.
 	Readset() map[string]struct{}
+
+	// Files whose metadata was read, such as by stat or readlink.
+	Statset() map[string]struct{}
+
+	// Directories whose entries were listed.
+	Listset() map[string]struct{}
+
+	// Paths that were looked up but did not exist.
+	Missset() map[string]struct{}
+
+	// Files that were written.
 	Writeset() map[string]struct{}
+
+	// The net change made to each file in the writeset, sorted by path.
+	Writes() []*Write
+
+	// Files that could not be written because of the root's write policy.
+	Deniedset() map[string]struct{}
+
+	// Files that were also written by another root while both were in use.
+	Conflictset() map[string]struct{}
+
+	// Targets of the other roots that wrote each file in the conflictset,
+	// including roots that have since been released.
+	ConflictTargets() map[string][]string
+
+	// Applies changes made through the root to paths, relative to the project root.
+	// Changes to other paths are not applied to the project. Paths are applied
+	// in order and those applied before a failure are not rolled back.
+	Commit(paths []string) error
+
+	// Removes the root from the file system and frees its server-side state.
+	// Handles open on the root are closed and uncommitted changes are discarded.
+	Release()
+}
+
+// Readset represents the files accessed by a build without modification,
+// grouped by the type of access. Each group is checked differently for changes.
+type Readset struct {
+	Contents []string // files whose contents were read
+	Stats    []string // files whose metadata was read
+	Listings []string // directories whose entries were listed
+	Misses   []string // paths looked up that did not exist
+}
+
+// NewReadset returns a readset from the files accessed through root.
+func NewReadset(root FileSystemRoot) *Readset {
+	return &Readset{
+		Contents: stringSetSlice(root.Readset()),
+		Stats:    stringSetSlice(root.Statset()),
+		Listings: stringSetSlice(root.Listset()),
+		Misses:   stringSetSlice(root.Missset()),
+	}
+}
+
+// Write represents the net change made to a single path.
+type Write struct {
+	Path string
+	Op   WriteOp
+
+	// The path the file was originally located at, if renamed.
+	From string
+}
+
+// writes represents a list of writes sortable by path.
+type writes []*Write
+
+func (a writes) Len() int           { return len(a) }
+func (a writes) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a writes) Less(i, j int) bool { return a[i].Path < a[j].Path }
+
+// WriteOp represents a bitmask of changes made to a path.
+type WriteOp int
+
+const (
+	// The path did not exist before.
+	WriteCreate WriteOp = 1 << iota
+
+	// The contents of an existing file were changed.
+	WriteModify
+
+	// An existing path was deleted.
+	WriteRemove
+
+	// The path was moved from the location in Write.From.
+	WriteRename
+
+	// The mode, owner or times were changed.
+	WriteChmod
+)
+
+// String returns a pipe-delimited list of the operations in op.
+func (op WriteOp) String() string {
+	var a []string
+	for _, o := range []struct {
+		op   WriteOp
+		name string
+	}{
+		{WriteCreate, "create"},
+		{WriteModify, "modify"},
+		{WriteRemove, "remove"},
+		{WriteRename, "rename"},
+		{WriteChmod, "chmod"},
+	} {
+		if op&o.op != 0 {
+			a = append(a, o.name)
+		}
+	}
+	return strings.Join(a, "|")
+}
+
+// Writeset tracks the net change made to each path written through a root.
+// Changes to a path are merged with earlier changes so only the final
+// effect is kept. It is not safe for concurrent use.
+type Writeset struct {
+	m map[string]*writesetEntry
+}
+
+// writesetEntry represents a write and whether its path existed before any changes.
+type writesetEntry struct {
+	Write
+	existed bool
+}
+
+// NewWriteset returns a new, empty writeset.
+func NewWriteset() *Writeset {
+	return &Writeset{m: make(map[string]*writesetEntry)}
+}
+
+// Len returns the number of paths in the writeset.
+func (ws *Writeset) Len() int { return len(ws.m) }
+
+// Contains returns true if s has been changed.
+func (ws *Writeset) Contains(s string) bool {
+	_, ok := ws.m[s]
+	return ok
+}
+
+// Created returns true if s, or one of its parent directories, did not exist
+// before it was written.
+func (ws *Writeset) Created(s string) bool {
+	for ; s != "/" && s != "."; s = path.Dir(s) {
+		if e := ws.m[s]; e != nil && e.Op&WriteCreate != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Paths returns the set of changed paths.
+// This includes paths that have been removed or renamed away.
+func (ws *Writeset) Paths() map[string]struct{} {
+	other := make(map[string]struct{}, len(ws.m))
+	for k := range ws.m {
+		other[k] = struct{}{}
+	}
+	return other
+}
+
+// Writes returns a copy of the net change to each path, sorted by path.
+func (ws *Writeset) Writes() []*Write {
+	a := make([]*Write, 0, len(ws.m))
+	for _, e := range ws.m {
+		other := e.Write
+		a = append(a, &other)
+	}
+	sort.Sort(writes(a))
+	return a
+}
+
+// Add records a change of type op to s.
+// Renames must be recorded with AddRename().
+func (ws *Writeset) Add(s string, op WriteOp) {
+	// Paths seen for the first time existed before unless they're being created.
+	e := ws.m[s]
+	if e == nil {
+		e = &writesetEntry{Write: Write{Path: s}, existed: op != WriteCreate}
+		ws.m[s] = e
+	}
+
+	switch op {
+	case WriteCreate:
+		// Replacing a file that existed before is a modification of that file.
+		if e.existed {
+			e.Op, e.From = WriteModify, ""
+		} else {
+			e.Op = WriteCreate
+		}
+	case WriteRemove:
+		// Removing a file that didn't exist before has no net effect.
+		if !e.existed {
+			delete(ws.m, s)
+			return
+		}
+		e.Op, e.From = WriteRemove, ""
+	default:
+		// Further changes to a created file are implied by its creation.
+		if e.Op&WriteCreate == 0 {
+			e.Op |= op
+		}
+	}
+}
+
+// AddRename records a move from oldpath to newpath.
+// replaced should be true if newpath existed before the rename.
+//
+// Files created during the build and then moved are recorded as created at
+// their final path. Changes recorded beneath a renamed directory move with it.
+func (ws *Writeset) AddRename(oldpath, newpath string, replaced bool) {
+	src := ws.m[oldpath]
+	if src == nil {
+		src = &writesetEntry{Write: Write{Path: oldpath}, existed: true}
+	}
+
+	// Determine if the destination existed before any changes were made to it.
+	existed := replaced
+	if dst := ws.m[newpath]; dst != nil {
+		existed = dst.existed
+	}
+
+	// The old path no longer exists.
+	if src.existed {
+		ws.m[oldpath] = &writesetEntry{Write: Write{Path: oldpath, Op: WriteRemove}, existed: true}
+	} else {
+		delete(ws.m, oldpath)
+	}
+
+	// Move changes recorded under the old path if it was a directory.
+	prefix := oldpath + "/"
+	for k, e := range ws.m {
+		if strings.HasPrefix(k, prefix) {
+			delete(ws.m, k)
+			e.Path = newpath + "/" + strings.TrimPrefix(k, prefix)
+			ws.m[e.Path] = e
+		}
+	}
+
+	// Determine the net change to the new path.
+	// Files created during the build are moved without tracking their old path.
+	e := &writesetEntry{Write: Write{Path: newpath}, existed: existed}
+	switch {
+	case src.Op&WriteCreate != 0 && existed:
+		e.Op = WriteModify
+	case src.Op&WriteCreate != 0:
+		e.Op = WriteCreate
+	default:
+		// Track the original path across multiple renames.
+		e.From = oldpath
+		if src.From != "" {
+			e.From = src.From
+		}
+		e.Op = src.Op&(WriteModify|WriteChmod) | WriteRename
+
+		// Moving a file back to its original path is not a rename.
+		if e.From == newpath {
+			e.Op, e.From = e.Op&^WriteRename, ""
+			if e.Op == 0 {
+				delete(ws.m, newpath)
+				return
+			}
+		}
+	}
+	ws.m[newpath] = e
+}
+
+// WritePolicy represents the set of paths a file system root can write to.
+type WritePolicy struct {
+	// Paths relative to the project root. Directories allow writes beneath them.
+	Paths []string
+}
+
+// NewWritePolicy returns a policy allowing writes to t's outputs.
+// Temporary files may also be created next to an output and renamed over it.
+// Phony targets can only write to the outputs they explicitly declare. Other
+// scratch files belong in TMPDIR, which is outside of the project.
+func NewWritePolicy(t *Target) *WritePolicy {
+	return &WritePolicy{Paths: t.OutputFiles()}
+}
+
+// Allowed returns true if path, or a parent directory, is writable.
+// A nil policy allows all paths.
+func (p *WritePolicy) Allowed(path string) bool {
+	if p == nil {
+		return true
+	}
+
+	path = cleanPolicyPath(path)
+	for _, allowed := range p.Paths {
+		allowed = cleanPolicyPath(allowed)
+		if path == allowed || allowed == "." || strings.HasPrefix(path, allowed+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowedTemp returns true if a temporary file can be created at path so
+// that it can be renamed over an allowed path. Temporary files must be in the
+// same directory as an allowed path and must not remain once the target
+// has finished.
+func (p *WritePolicy) AllowedTemp(path string) bool {
+	if p.Allowed(path) {
+		return true
+	}
+
+	dir := filepath.Dir(cleanPolicyPath(path))
+	for _, allowed := range p.Paths {
+		if filepath.Dir(cleanPolicyPath(allowed)) == dir {
+			return true
+		}
+	}
+	return false
+}
+
+// Unallowed returns the sorted paths changed by writes that are not allowed
+// by the policy, such as temporary files that were never renamed into place.
+func (p *WritePolicy) Unallowed(writes []*Write) []string {
+	var a []string
+	for _, w := range writes {
+		if p.Allowed(w.Path) || (w.Op&WriteCreate != 0 && p.AllowedDir(w.Path)) {
+			continue
+		}
+		a = append(a, w.Path)
+	}
+	sort.Strings(a)
+	return a
+}
+
+// AllowedDir returns true if a directory can be created at path.
+// This includes any parent directories of writable paths.
+func (p *WritePolicy) AllowedDir(path string) bool {
+	if p.Allowed(path) {
+		return true
+	}
+
+	path = cleanPolicyPath(path)
+	for _, allowed := range p.Paths {
+		if path == "." || strings.HasPrefix(cleanPolicyPath(allowed), path+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanPolicyPath returns path relative to the project root in canonical form.
+func cleanPolicyPath(path string) string {
+	return filepath.Clean(strings.TrimPrefix(filepath.Clean("/"+path), "/"))
+}
+
+// WriteDeniedError is returned when a target writes to paths outside its write policy.
+type WriteDeniedError struct {
+	Target string
+	Paths  []string
+}
+
+// Error returns the error message.
+func (e *WriteDeniedError) Error() string {
+	return fmt.Sprintf("%s: write denied: %s", e.Target, strings.Join(e.Paths, ", "))
+}
+
+// WriteConflictError is returned when a target writes to paths that were
+// also written by another target running at the same time.
+type WriteConflictError struct {
+	Target string
+	Paths  []string
+}
+
+// Error returns the error message.
+func (e *WriteConflictError) Error() string {
+	return fmt.Sprintf("%s: write conflict: %s", e.Target, strings.Join(e.Paths, ", "))
 }
 
 // lookup of file system constructors by type.
@@ -57,19 +435,36 @@ type FileSystemOptions struct {
 
 	// Directory to mount to.
 	MountPath string
+
+	// Protocol version to serve, for file systems that support more than one.
+	// Uses the file system's default if blank.
+	Protocol string
+
+	// Transport used to connect the mount to the file system, such as "tcp" or "unix".
+	// Uses the file system's default if blank.
+	Transport string
 }
 
 // nopFileSystem is a file system that does nothing.
 type nopFileSystem struct{}
 
-func (*nopFileSystem) Open() error                { return nil }
-func (*nopFileSystem) Close() error               { return nil }
-func (*nopFileSystem) Path() string               { return "" }
-func (*nopFileSystem) CreateRoot() FileSystemRoot { return &nopFileSystemRoot{} }
+func (*nopFileSystem) Open() error                                    { return nil }
+func (*nopFileSystem) Close() error                                   { return nil }
+func (*nopFileSystem) Path() string                                   { return "" }
+func (*nopFileSystem) CreateRoot(string, *WritePolicy) FileSystemRoot { return &nopFileSystemRoot{} }
 
 // nopFileSystemRoot is a file system root that does nothing.
 type nopFileSystemRoot struct{}
 
-func (*nopFileSystemRoot) Path() string                  { return "" }
-func (*nopFileSystemRoot) Readset() map[string]struct{}  { return nil }
-func (*nopFileSystemRoot) Writeset() map[string]struct{} { return nil }
+func (*nopFileSystemRoot) Path() string                         { return "" }
+func (*nopFileSystemRoot) Readset() map[string]struct{}         { return nil }
+func (*nopFileSystemRoot) Statset() map[string]struct{}         { return nil }
+func (*nopFileSystemRoot) Listset() map[string]struct{}         { return nil }
+func (*nopFileSystemRoot) Missset() map[string]struct{}         { return nil }
+func (*nopFileSystemRoot) Writeset() map[string]struct{}        { return nil }
+func (*nopFileSystemRoot) Writes() []*Write                     { return nil }
+func (*nopFileSystemRoot) Deniedset() map[string]struct{}       { return nil }
+func (*nopFileSystemRoot) Conflictset() map[string]struct{}     { return nil }
+func (*nopFileSystemRoot) ConflictTargets() map[string][]string { return nil }
+func (*nopFileSystemRoot) Commit([]string) error                { return nil }
+func (*nopFileSystemRoot) Release()                             {}
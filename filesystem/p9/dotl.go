@@ -0,0 +1,1738 @@
+package p9
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/flynn/bake"
+	"github.com/rminnich/go9p"
+)
+
+// 9P2000.L message types. Each response type is its request type plus one.
+const (
+	msgTlerror      = 6
+	msgRlerror      = 7
+	msgTstatfs      = 8
+	msgTlopen       = 12
+	msgTlcreate     = 14
+	msgTsymlink     = 16
+	msgTmknod       = 18
+	msgTrename      = 20
+	msgTreadlink    = 22
+	msgTgetattr     = 24
+	msgTsetattr     = 26
+	msgTxattrwalk   = 30
+	msgTxattrcreate = 32
+	msgTreaddir     = 40
+	msgTfsync       = 50
+	msgTlock        = 52
+	msgTgetlock     = 54
+	msgTlink        = 70
+	msgTmkdir       = 72
+	msgTrenameat    = 74
+	msgTunlinkat    = 76
+	msgTversion     = 100
+	msgTauth        = 102
+	msgTattach      = 104
+	msgTflush       = 108
+	msgTwalk        = 110
+	msgTread        = 116
+	msgTwrite       = 118
+	msgTclunk       = 120
+	msgTremove      = 122
+)
+
+// Linux open flags as sent by 9P2000.L clients.
+const (
+	dotlOWronly    = 01
+	dotlORdwr      = 02
+	dotlOAccmode   = 03
+	dotlOCreat     = 0100
+	dotlOExcl      = 0200
+	dotlOTrunc     = 01000
+	dotlOAppend    = 02000
+	dotlODirectory = 0200000
+	dotlOSync      = 04000000
+)
+
+// Attribute flags used by Tgetattr & Tsetattr.
+const (
+	dotlGetattrBasic = 0x000007ff
+
+	dotlSetattrMode     = 0x00000001
+	dotlSetattrUID      = 0x00000002
+	dotlSetattrGID      = 0x00000004
+	dotlSetattrSize     = 0x00000008
+	dotlSetattrAtime    = 0x00000010
+	dotlSetattrMtime    = 0x00000020
+	dotlSetattrAtimeSet = 0x00000080
+	dotlSetattrMtimeSet = 0x00000100
+)
+
+// Lock types & statuses used by Tlock & Tgetlock.
+const (
+	dotlLockRead   = 0
+	dotlLockWrite  = 1
+	dotlLockUnlock = 2
+
+	dotlLockSuccess = 0
+	dotlLockBlocked = 1
+)
+
+// dotlAtRemoveDir is the Tunlinkat flag for removing directories.
+const dotlAtRemoveDir = 0x200
+
+// dotlMaxMsize is the largest message size negotiated with clients.
+const dotlMaxMsize = 1 << 20
+
+// dotlIOHdrSize is the size of the header on Rread & Twrite messages.
+const dotlIOHdrSize = 4 + 1 + 2 + 4 + 8 + 4
+
+// errShortMessage is returned when a message ends before all its fields are read.
+var errShortMessage = errors.New("short message")
+
+// dotlConn serves 9P2000.L requests from a single client connection.
+// Each request is handled in its own goroutine so a slow request doesn't
+// block others. Requests on the same handle are serialized by its lock.
+type dotlConn struct {
+	mu    sync.Mutex // protects fids, reqs & renames
+	wmu   sync.Mutex // serializes responses
+	fs    *fileSystem
+	conn  net.Conn
+	msize uint32
+	fids  map[uint32]*dotlFid
+	reqs  map[uint16]*dotlReq // in-flight requests by tag
+	wg    sync.WaitGroup      // in-flight requests
+
+	// Renames are logged and applied to other handles when they are next
+	// used so that a rename doesn't wait for requests on unrelated handles.
+	renameMu   sync.Mutex // serializes renames with their log entries
+	renames    []dotlRename
+	renameBase uint64 // sequence number of renames[0]
+}
+
+// newDotlConn returns a new connection handler for c.
+func newDotlConn(fs *fileSystem, c net.Conn) *dotlConn {
+	return &dotlConn{
+		fs:    fs,
+		conn:  c,
+		msize: dotlMaxMsize,
+		fids:  make(map[uint32]*dotlFid),
+		reqs:  make(map[uint16]*dotlReq),
+	}
+}
+
+// dotlFid represents a file handle on a 9P2000.L connection.
+// Fields other than rootID & seq are protected by mu.
+type dotlFid struct {
+	mu sync.Mutex
+	Aux
+
+	// Open flags, if the file is open.
+	flags uint32
+
+	// Extended attribute read or written through this handle, if any.
+	xattr *dotlXattr
+
+	// Sequence number of the next rename to apply to path. Protected by the connection.
+	seq uint64
+
+	// Set once the handle is clunked so waiting requests fail.
+	clunked bool
+}
+
+// unlock releases the handle after a request.
+func (f *dotlFid) unlock() { f.mu.Unlock() }
+
+// dotlXattr represents an extended attribute being read or written.
+type dotlXattr struct {
+	name   string
+	data   []byte
+	size   uint64
+	flags  int
+	create bool
+}
+
+// dotlReq represents an in-flight request.
+type dotlReq struct {
+	tag     uint16
+	file    *os.File // file being read or written, if any
+	flushed bool     // set by Tflush, the response is not sent
+	done    chan struct{}
+}
+
+// dotlRename represents a rename within a root that is applied to handles.
+type dotlRename struct {
+	rootID           string
+	oldpath, newpath string
+}
+
+// serve reads requests and handles them until the connection is closed.
+func (c *dotlConn) serve() {
+	defer c.close()
+
+	r := bufio.NewReader(c.conn)
+	for {
+		// Read message size & body.
+		var hdr [4]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return
+		}
+		size := binary.LittleEndian.Uint32(hdr[:])
+		if size < 7 || size > c.msize {
+			return
+		}
+
+		buf := make([]byte, size-4)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return
+		}
+		typ, tag := buf[0], binary.LittleEndian.Uint16(buf[1:3])
+
+		// Version resets the session so it waits for all other requests.
+		if typ == msgTversion {
+			c.wg.Wait()
+			c.dispatch(&dotlReq{tag: tag, done: make(chan struct{})}, typ, buf[3:])
+			continue
+		}
+
+		// Reject tags that are already in use.
+		req := &dotlReq{tag: tag, done: make(chan struct{})}
+		c.mu.Lock()
+		if c.reqs[tag] != nil {
+			c.mu.Unlock()
+			return
+		}
+		c.reqs[tag] = req
+		c.mu.Unlock()
+
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			c.dispatch(req, typ, buf[3:])
+		}()
+	}
+}
+
+// dispatch handles a request and writes its response unless it was flushed.
+func (c *dotlConn) dispatch(req *dotlReq, typ uint8, body []byte) {
+	defer close(req.done)
+
+	// Handle request and replace the response with an error, if one occurred.
+	rtyp := typ + 1
+	e := &dotlEncoder{}
+	err := c.handle(req, typ, &dotlDecoder{buf: body}, e)
+	if err != nil {
+		rtyp, e.buf = msgRlerror, nil
+		e.u32(uint32(toErrno(err)))
+	}
+
+	c.mu.Lock()
+	delete(c.reqs, req.tag)
+	flushed := req.flushed
+	c.mu.Unlock()
+
+	// The client forgets handles created by a flushed request.
+	if flushed {
+		if fid, ok := createdFid(typ, body); ok && err == nil {
+			c.clunk(fid)
+		}
+		return
+	}
+
+	// Write response.
+	msg := make([]byte, 7, 7+len(e.buf))
+	binary.LittleEndian.PutUint32(msg[0:4], uint32(7+len(e.buf)))
+	msg[4] = rtyp
+	binary.LittleEndian.PutUint16(msg[5:7], req.tag)
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.conn.Write(append(msg, e.buf...))
+}
+
+// createdFid returns the new handle of a request that creates one.
+func createdFid(typ uint8, body []byte) (uint32, bool) {
+	d := &dotlDecoder{buf: body}
+	switch typ {
+	case msgTattach:
+		return d.u32(), d.err == nil
+	case msgTwalk, msgTxattrwalk:
+		fid, newfid := d.u32(), d.u32()
+		return newfid, d.err == nil && newfid != fid
+	default:
+		return 0, false
+	}
+}
+
+// close closes all open handles and the underlying connection.
+func (c *dotlConn) close() {
+	c.fs.mu.Lock()
+	delete(c.fs.conns, c)
+	c.fs.mu.Unlock()
+
+	c.conn.Close()
+	c.clunkAll(func(*dotlFid) bool { return true })
+}
+
+// releaseRoot closes all handles belonging to a root.
+func (c *dotlConn) releaseRoot(id string) {
+	c.clunkAll(func(f *dotlFid) bool { return f.rootID == id })
+}
+
+// clunk removes and closes a handle by number, if it exists.
+func (c *dotlConn) clunk(fid uint32) {
+	if f := c.detach(fid); f != nil {
+		f.mu.Lock()
+		defer f.unlock()
+		c.closeFid(f)
+	}
+}
+
+// clunkAll closes and removes the handles matched by fn.
+// Each handle is closed once in-flight requests on it are complete.
+func (c *dotlConn) clunkAll(fn func(f *dotlFid) bool) {
+	c.mu.Lock()
+	var a []*dotlFid
+	for fid, f := range c.fids {
+		if fn(f) {
+			a = append(a, f)
+			delete(c.fids, fid)
+		}
+	}
+	c.mu.Unlock()
+
+	for _, f := range a {
+		f.mu.Lock()
+		c.mu.Lock()
+		c.applyRenames(f)
+		c.mu.Unlock()
+		c.closeFid(f)
+		f.mu.Unlock()
+	}
+}
+
+// handle decodes a request of type typ from d and encodes the response to e.
+func (c *dotlConn) handle(req *dotlReq, typ uint8, d *dotlDecoder, e *dotlEncoder) error {
+	switch typ {
+	case msgTversion:
+		return c.version(d, e)
+	case msgTauth:
+		return syscall.EOPNOTSUPP
+	case msgTattach:
+		return c.attach(d, e)
+	case msgTflush:
+		return c.flush(req, d)
+	case msgTwalk:
+		return c.walk(d, e)
+	case msgTlopen:
+		return c.lopen(d, e)
+	case msgTlcreate:
+		return c.lcreate(d, e)
+	case msgTread:
+		return c.read(req, d, e)
+	case msgTwrite:
+		return c.write(req, d, e)
+	case msgTclunk:
+		return c.handleClunk(d)
+	case msgTremove:
+		return c.remove(d)
+	case msgTstatfs:
+		return c.statfs(d, e)
+	case msgTgetattr:
+		return c.getattr(d, e)
+	case msgTsetattr:
+		return c.setattr(d)
+	case msgTreaddir:
+		return c.readdir(d, e)
+	case msgTreadlink:
+		return c.readlink(d, e)
+	case msgTsymlink:
+		return c.symlink(d, e)
+	case msgTmknod:
+		return c.mknod(d, e)
+	case msgTmkdir:
+		return c.mkdir(d, e)
+	case msgTlink:
+		return c.link(d)
+	case msgTrename:
+		return c.rename(d)
+	case msgTrenameat:
+		return c.renameat(d)
+	case msgTunlinkat:
+		return c.unlinkat(d)
+	case msgTfsync:
+		return c.fsync(d)
+	case msgTlock:
+		return c.lock(d, e)
+	case msgTgetlock:
+		return c.getlock(d, e)
+	case msgTxattrwalk:
+		return c.xattrwalk(d, e)
+	case msgTxattrcreate:
+		return c.xattrcreate(d)
+	default:
+		return syscall.ENOSYS
+	}
+}
+
+// fid returns an open handle by number, locked for the request.
+// The caller must unlock the handle. Returns EBADF if it doesn't exist.
+func (c *dotlConn) fid(fid uint32) (*dotlFid, error) {
+	a, err := c.lockFids(fid)
+	if err != nil {
+		return nil, err
+	}
+	return a[0], nil
+}
+
+// fidPair returns two open handles locked for the request. The handles are
+// the same if the numbers are equal. The caller must call unlock.
+func (c *dotlConn) fidPair(x, y uint32) (fx, fy *dotlFid, unlock func(), err error) {
+	if x == y {
+		f, err := c.fid(x)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return f, f, f.unlock, nil
+	}
+
+	a, err := c.lockFids(x, y)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return a[0], a[1], func() { a[0].unlock(); a[1].unlock() }, nil
+}
+
+// lockFids looks up and locks distinct handles in number order so requests
+// using several handles can't deadlock. Pending renames are applied to each.
+func (c *dotlConn) lockFids(nums ...uint32) ([]*dotlFid, error) {
+	c.mu.Lock()
+	a := make([]*dotlFid, len(nums))
+	for i, n := range nums {
+		if a[i] = c.fids[n]; a[i] == nil {
+			c.mu.Unlock()
+			return nil, syscall.EBADF
+		}
+	}
+	c.mu.Unlock()
+
+	order := make([]int, len(nums))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool { return nums[order[i]] < nums[order[j]] })
+
+	for i, idx := range order {
+		f := a[idx]
+		f.mu.Lock()
+		if f.clunked {
+			for _, prev := range order[:i+1] {
+				a[prev].unlock()
+			}
+			return nil, syscall.EBADF
+		}
+	}
+
+	c.mu.Lock()
+	for _, f := range a {
+		c.applyRenames(f)
+	}
+	c.mu.Unlock()
+	return a, nil
+}
+
+// addFid adds a handle by number. Returns EBADF if the number is in use.
+// The handle starts with the renames already applied to from, if set.
+func (c *dotlConn) addFid(fid uint32, f *dotlFid, from *dotlFid) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.fids[fid] != nil {
+		return syscall.EBADF
+	}
+	if from != nil {
+		f.seq = from.seq
+	} else {
+		f.seq = c.renameBase + uint64(len(c.renames))
+	}
+	c.fids[fid] = f
+	return nil
+}
+
+// inUse returns true if a handle exists with the number.
+func (c *dotlConn) inUse(fid uint32) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.fids[fid] != nil
+}
+
+// detach removes a handle by number and returns it. Returns nil if it doesn't exist.
+func (c *dotlConn) detach(fid uint32) *dotlFid {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f := c.fids[fid]
+	delete(c.fids, fid)
+	return f
+}
+
+// applyRenames updates the path of a locked handle with renames logged since
+// it was last used. The connection must be locked by the caller. Handles
+// removed from the connection may have missed renames dropped from the log.
+func (c *dotlConn) applyRenames(f *dotlFid) {
+	if f.seq < c.renameBase {
+		f.seq = c.renameBase
+	}
+	for ; f.seq < c.renameBase+uint64(len(c.renames)); f.seq++ {
+		r := c.renames[f.seq-c.renameBase]
+		if f.rootID != r.rootID {
+			continue
+		} else if f.path == r.oldpath {
+			f.path = r.newpath
+		} else if len(f.path) > len(r.oldpath) && f.path[:len(r.oldpath)+1] == r.oldpath+"/" {
+			f.path = r.newpath + f.path[len(r.oldpath):]
+		}
+	}
+}
+
+// logRename adds a rename to the log and drops entries applied to every handle.
+// The connection must be locked by the caller.
+func (c *dotlConn) logRename(r dotlRename) {
+	c.renames = append(c.renames, r)
+
+	min := c.renameBase + uint64(len(c.renames))
+	for _, f := range c.fids {
+		if f.seq < min {
+			min = f.seq
+		}
+	}
+	c.renames = append([]dotlRename(nil), c.renames[min-c.renameBase:]...)
+	c.renameBase = min
+}
+
+// setFile records the file a request is reading or writing so Tflush can
+// interrupt it. Clearing the file resets a deadline set by Tflush.
+func (c *dotlConn) setFile(req *dotlReq, file *os.File) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if file == nil && req.flushed && req.file != nil {
+		req.file.SetDeadline(time.Time{})
+	}
+	req.file = file
+}
+
+// version negotiates the protocol version & message size and resets the session.
+func (c *dotlConn) version(d *dotlDecoder, e *dotlEncoder) error {
+	msize, version := d.u32(), d.str()
+	if d.err != nil {
+		return d.err
+	}
+
+	c.clunkAll(func(*dotlFid) bool { return true })
+
+	if msize < c.msize {
+		c.msize = msize
+	}
+	if version != ProtocolDotL {
+		version = "unknown"
+	}
+
+	e.u32(c.msize)
+	e.str(version)
+	return nil
+}
+
+func (c *dotlConn) attach(d *dotlDecoder, e *dotlEncoder) error {
+	fid, _, _, aname, _ := d.u32(), d.u32(), d.str(), d.str(), d.u32()
+	if d.err != nil {
+		return d.err
+	} else if c.inUse(fid) {
+		return syscall.EBADF
+	}
+
+	rootID, filename := split(aname)
+	f := &dotlFid{Aux: Aux{rootID: rootID, path: path.Join(c.fs.path, filename)}}
+	if err := c.fs.stat(&f.Aux); err != nil {
+		return err
+	} else if err := c.addFid(fid, f, nil); err != nil {
+		return err
+	}
+
+	e.qid(f.qid())
+	return nil
+}
+
+// flush cancels an in-flight request. Its response is not sent and any file
+// I/O it's blocked on is interrupted. Responds once the request has finished.
+func (c *dotlConn) flush(req *dotlReq, d *dotlDecoder) error {
+	oldtag := d.u16()
+	if d.err != nil {
+		return d.err
+	} else if oldtag == req.tag {
+		return nil
+	}
+
+	c.mu.Lock()
+	old := c.reqs[oldtag]
+	if old != nil {
+		old.flushed = true
+		if old.file != nil {
+			old.file.SetDeadline(time.Now())
+		}
+	}
+	c.mu.Unlock()
+
+	if old != nil {
+		<-old.done
+	}
+	return nil
+}
+
+func (c *dotlConn) walk(d *dotlDecoder, e *dotlEncoder) error {
+	fid, newfid, n := d.u32(), d.u32(), d.u16()
+	names := make([]string, n)
+	for i := range names {
+		names[i] = d.str()
+	}
+	if d.err != nil {
+		return d.err
+	}
+
+	f, err := c.fid(fid)
+	if err != nil {
+		return err
+	}
+	defer f.unlock()
+	if newfid != fid && c.inUse(newfid) {
+		return syscall.EBADF
+	} else if err := c.fs.stat(&f.Aux); err != nil {
+		return err
+	}
+
+	aux, wqids, err := c.fs.walk(&f.Aux, names)
+	if err != nil {
+		return err
+	}
+
+	// Only assign the new handle if the entire path was walked.
+	// Walking to the same handle moves it.
+	if len(wqids) == len(names) {
+		if newfid == fid {
+			f.Aux = *aux
+		} else if err := c.addFid(newfid, &dotlFid{Aux: *aux}, f); err != nil {
+			return err
+		}
+	}
+
+	e.u16(uint16(len(wqids)))
+	for i := range wqids {
+		e.qid(&wqids[i])
+	}
+	return nil
+}
+
+func (c *dotlConn) lopen(d *dotlDecoder, e *dotlEncoder) error {
+	fid, flags := d.u32(), d.u32()
+	if d.err != nil {
+		return d.err
+	}
+
+	f, err := c.fid(fid)
+	if err != nil {
+		return err
+	}
+	defer f.unlock()
+	if err := c.fs.stat(&f.Aux); err != nil {
+		return err
+	} else if flags&dotlODirectory != 0 && !f.st.IsDir() {
+		return syscall.ENOTDIR
+	}
+
+	// Ensure the file can be changed if opening for write.
+	if flags&dotlOAccmode != 0 || flags&dotlOTrunc != 0 {
+		if err := c.fs.checkWrite(f.rootID, f.path); err != nil {
+			return err
+		}
+	}
+
+	file, err := c.fs.openFile(f.rootID, f.path, dotlOpenFlags(flags&^dotlOCreat), 0)
+	if err != nil {
+		return err
+	}
+	f.file, f.flags = file, flags
+
+	// Directory listings are tracked when read.
+	if flags&dotlOAccmode != dotlOWronly && !f.st.IsDir() {
+		c.fs.addToReadset(f.rootID, f.path)
+	}
+	if flags&dotlOTrunc != 0 {
+		c.fs.addToWriteset(f.rootID, f.path, bake.WriteModify)
+	}
+
+	e.qid(f.qid())
+	e.u32(0)
+	return nil
+}
+
+func (c *dotlConn) lcreate(d *dotlDecoder, e *dotlEncoder) error {
+	fid, name, flags, mode, _ := d.u32(), d.str(), d.u32(), d.u32(), d.u32()
+	if d.err != nil {
+		return d.err
+	} else if err := checkName(name); err != nil {
+		return err
+	}
+
+	f, err := c.fid(fid)
+	if err != nil {
+		return err
+	}
+	defer f.unlock()
+
+	// Create and open the file. The handle now refers to the new file.
+	filename := f.path + "/" + name
+	var file *os.File
+	if err := c.fs.create(f.rootID, filename, false, func(name string) (err error) {
+		file, err = os.OpenFile(name, dotlOpenFlags(flags)|os.O_CREATE, dotlFileMode(mode))
+		return err
+	}); err != nil {
+		return err
+	}
+	f.path, f.file, f.flags = filename, file, flags
+
+	if err := c.fs.stat(&f.Aux); err != nil {
+		return err
+	}
+
+	e.qid(f.qid())
+	e.u32(0)
+	return nil
+}
+
+func (c *dotlConn) read(req *dotlReq, d *dotlDecoder, e *dotlEncoder) error {
+	fid, offset, count := d.u32(), d.u64(), d.u32()
+	if d.err != nil {
+		return d.err
+	}
+
+	f, err := c.fid(fid)
+	if err != nil {
+		return err
+	}
+	defer f.unlock()
+	if max := c.msize - dotlIOHdrSize; count > max {
+		count = max
+	}
+
+	// Read from an extended attribute, if one was walked to.
+	if f.xattr != nil {
+		var data []byte
+		if offset < uint64(len(f.xattr.data)) {
+			data = f.xattr.data[offset:]
+		}
+		if len(data) > int(count) {
+			data = data[:count]
+		}
+		e.u32(uint32(len(data)))
+		e.bytes(data)
+		return nil
+	} else if f.file == nil {
+		return syscall.EBADF
+	}
+
+	c.fs.addToReadset(f.rootID, f.path)
+
+	buf := make([]byte, count)
+	c.setFile(req, f.file)
+	n, err := f.file.ReadAt(buf, int64(offset))
+	if toErrno(err) == syscall.ESPIPE {
+		// Pipes & devices are read in order. These can block so can be canceled by a flush.
+		n, err = f.file.Read(buf)
+	}
+	c.setFile(req, nil)
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	e.u32(uint32(n))
+	e.bytes(buf[:n])
+	return nil
+}
+
+func (c *dotlConn) write(req *dotlReq, d *dotlDecoder, e *dotlEncoder) error {
+	fid, offset, count := d.u32(), d.u64(), d.u32()
+	data := d.next(int(count))
+	if d.err != nil {
+		return d.err
+	}
+
+	f, err := c.fid(fid)
+	if err != nil {
+		return err
+	}
+	defer f.unlock()
+
+	// Buffer writes to an extended attribute until the handle is clunked.
+	if x := f.xattr; x != nil {
+		if !x.create || offset+uint64(len(data)) > x.size {
+			return syscall.EINVAL
+		}
+		if end := int(offset) + len(data); end > len(x.data) {
+			x.data = append(x.data, make([]byte, end-len(x.data))...)
+		}
+		copy(x.data[offset:], data)
+		e.u32(uint32(len(data)))
+		return nil
+	} else if f.file == nil {
+		return syscall.EBADF
+	}
+
+	// Ensure the file can still be written and add to writeset.
+	if err := c.fs.checkWrite(f.rootID, f.path); err != nil {
+		return err
+	}
+	c.fs.addToWriteset(f.rootID, f.path, bake.WriteModify)
+
+	// Appends ignore the offset.
+	var n int
+	c.setFile(req, f.file)
+	if f.flags&dotlOAppend != 0 {
+		n, err = f.file.Write(data)
+	} else if n, err = f.file.WriteAt(data, int64(offset)); toErrno(err) == syscall.ESPIPE {
+		n, err = f.file.Write(data)
+	}
+	c.setFile(req, nil)
+	if err != nil {
+		return err
+	}
+
+	e.u32(uint32(n))
+	return nil
+}
+
+func (c *dotlConn) handleClunk(d *dotlDecoder) error {
+	fid := d.u32()
+	if d.err != nil {
+		return d.err
+	}
+
+	f, err := c.fid(fid)
+	if err != nil {
+		return err
+	}
+	defer f.unlock()
+
+	c.detach(fid)
+	return c.closeFid(f)
+}
+
+// closeFid closes a locked handle that has been removed from the connection.
+// Extended attributes written through the handle are saved at this point.
+func (c *dotlConn) closeFid(f *dotlFid) error {
+	if f.clunked {
+		return nil
+	}
+	f.clunked = true
+
+	c.fs.locks.release(f)
+	if f.file != nil {
+		f.file.Close()
+	}
+
+	// Save extended attribute. An empty attribute is removed.
+	if x := f.xattr; x != nil && x.create {
+		filename, err := c.fs.copyUp(f.rootID, f.path)
+		if err != nil {
+			return err
+		}
+
+		if x.size == 0 {
+			err = removexattr(filename, x.name)
+		} else if uint64(len(x.data)) != x.size {
+			err = syscall.EINVAL
+		} else {
+			err = setxattr(filename, x.name, x.data, x.flags)
+		}
+		if err != nil {
+			return err
+		}
+		c.fs.addToWriteset(f.rootID, f.path, bake.WriteChmod)
+	}
+
+	return nil
+}
+
+// remove deletes the file for a handle. The handle is clunked even if removal fails.
+func (c *dotlConn) remove(d *dotlDecoder) error {
+	fid := d.u32()
+	if d.err != nil {
+		return d.err
+	}
+
+	f, err := c.fid(fid)
+	if err != nil {
+		return err
+	}
+	defer f.unlock()
+
+	err = c.fs.remove(f.rootID, f.path)
+	c.detach(fid)
+	c.closeFid(f)
+	return err
+}
+
+func (c *dotlConn) statfs(d *dotlDecoder, e *dotlEncoder) error {
+	fid := d.u32()
+	if d.err != nil {
+		return d.err
+	}
+
+	f, err := c.fid(fid)
+	if err != nil {
+		return err
+	}
+	defer f.unlock()
+
+	st, err := statfs(c.fs.realpath(f.rootID, f.path))
+	if err != nil {
+		return err
+	}
+
+	e.u32(st.Type)
+	e.u32(st.Bsize)
+	e.u64(st.Blocks)
+	e.u64(st.Bfree)
+	e.u64(st.Bavail)
+	e.u64(st.Files)
+	e.u64(st.Ffree)
+	e.u64(st.Fsid)
+	e.u32(st.Namelen)
+	return nil
+}
+
+func (c *dotlConn) getattr(d *dotlDecoder, e *dotlEncoder) error {
+	fid, _ := d.u32(), d.u64()
+	if d.err != nil {
+		return d.err
+	}
+
+	f, err := c.fid(fid)
+	if err != nil {
+		return err
+	}
+	defer f.unlock()
+	if err := c.fs.stat(&f.Aux); err != nil {
+		return err
+	}
+
+	c.fs.addToStatset(f.rootID, f.path)
+
+	st, ok := f.st.Sys().(*syscall.Stat_t)
+	if !ok {
+		return syscall.EIO
+	}
+	atime, mtime, ctime := statTimes(st)
+
+	e.u64(dotlGetattrBasic)
+	e.qid(f.qid())
+	e.u32(uint32(st.Mode))
+	e.u32(st.Uid)
+	e.u32(st.Gid)
+	e.u64(uint64(st.Nlink))
+	e.u64(uint64(st.Rdev))
+	e.u64(uint64(st.Size))
+	e.u64(uint64(st.Blksize))
+	e.u64(uint64(st.Blocks))
+	e.timespec(atime)
+	e.timespec(mtime)
+	e.timespec(ctime)
+	e.u64(0) // btime
+	e.u64(0)
+	e.u64(0) // gen
+	e.u64(0) // data version
+	return nil
+}
+
+func (c *dotlConn) setattr(d *dotlDecoder) error {
+	fid, valid, mode, uid, gid, size := d.u32(), d.u32(), d.u32(), d.u32(), d.u32(), d.u64()
+	atime := time.Unix(int64(d.u64()), int64(d.u64()))
+	mtime := time.Unix(int64(d.u64()), int64(d.u64()))
+	if d.err != nil {
+		return d.err
+	}
+
+	f, err := c.fid(fid)
+	if err != nil {
+		return err
+	}
+	defer f.unlock()
+
+	// Ensure the file can be changed if any attributes are set.
+	// Changes are made to a copy in the root's private layer.
+	filename := f.path
+	if valid&(dotlSetattrMode|dotlSetattrUID|dotlSetattrGID|dotlSetattrSize|dotlSetattrAtime|dotlSetattrMtime) != 0 {
+		if err := c.fs.checkWrite(f.rootID, f.path); err != nil {
+			return err
+		} else if filename, err = c.fs.copyUp(f.rootID, f.path); err != nil {
+			return err
+		}
+	}
+
+	if valid&dotlSetattrMode != 0 {
+		if err := syscall.Chmod(filename, mode&07777); err != nil {
+			return err
+		}
+		c.fs.addToWriteset(f.rootID, f.path, bake.WriteChmod)
+	}
+
+	if valid&(dotlSetattrUID|dotlSetattrGID) != 0 {
+		u, g := -1, -1
+		if valid&dotlSetattrUID != 0 {
+			u = int(uid)
+		}
+		if valid&dotlSetattrGID != 0 {
+			g = int(gid)
+		}
+		if err := os.Lchown(filename, u, g); err != nil {
+			return err
+		}
+		c.fs.addToWriteset(f.rootID, f.path, bake.WriteChmod)
+	}
+
+	if valid&dotlSetattrSize != 0 {
+		if err := os.Truncate(filename, int64(size)); err != nil {
+			return err
+		}
+		c.fs.addToWriteset(f.rootID, f.path, bake.WriteModify)
+	}
+
+	// Times are set to the current time unless explicitly provided.
+	// If only one time is changing then the other is retained.
+	if valid&(dotlSetattrAtime|dotlSetattrMtime) != 0 {
+		if err := c.fs.stat(&f.Aux); err != nil {
+			return err
+		}
+		prevAtime, prevMtime, _ := statTimes(f.st.Sys().(*syscall.Stat_t))
+
+		now := time.Now()
+		switch {
+		case valid&dotlSetattrAtime == 0:
+			atime = time.Unix(prevAtime.Unix())
+		case valid&dotlSetattrAtimeSet == 0:
+			atime = now
+		}
+		switch {
+		case valid&dotlSetattrMtime == 0:
+			mtime = time.Unix(prevMtime.Unix())
+		case valid&dotlSetattrMtimeSet == 0:
+			mtime = now
+		}
+
+		if err := os.Chtimes(filename, atime, mtime); err != nil {
+			return err
+		}
+		c.fs.addToWriteset(f.rootID, f.path, bake.WriteChmod)
+	}
+
+	return nil
+}
+
+func (c *dotlConn) readdir(d *dotlDecoder, e *dotlEncoder) error {
+	fid, offset, count := d.u32(), d.u64(), d.u32()
+	if d.err != nil {
+		return d.err
+	}
+
+	f, err := c.fid(fid)
+	if err != nil {
+		return err
+	}
+	defer f.unlock()
+	if f.file == nil {
+		return syscall.EBADF
+	}
+	if max := c.msize - dotlIOHdrSize; count > max {
+		count = max
+	}
+
+	// Read the directory entries when starting from the beginning.
+	// The offset of each entry is its index in the listing plus one.
+	if offset == 0 || f.dirs == nil {
+		if err := f.readdir(c.fs); err != nil {
+			return err
+		}
+		c.fs.addToListset(f.rootID, f.path)
+	}
+
+	entries := &dotlEncoder{}
+	for i := offset; i < uint64(len(f.dirs)); i++ {
+		fi := f.dirs[i]
+
+		var ent dotlEncoder
+		ent.qid(newQid(fi))
+		ent.u64(i + 1)
+		ent.u8(direntType(fi.Mode()))
+		ent.str(fi.Name())
+		if len(entries.buf)+len(ent.buf) > int(count) {
+			break
+		}
+		entries.bytes(ent.buf)
+	}
+
+	e.u32(uint32(len(entries.buf)))
+	e.bytes(entries.buf)
+	return nil
+}
+
+// readdir reads the directory entries for the handle, including "." & "..".
+// The parent of the served path is reported as itself.
+func (f *dotlFid) readdir(fs *fileSystem) error {
+	dirs, err := fs.listDir(f.rootID, f.path)
+	if err != nil {
+		return err
+	}
+
+	self, err := os.Lstat(fs.realpath(f.rootID, f.path))
+	if err != nil {
+		return err
+	}
+	parent := self
+	if f.path != fs.path {
+		if parent, err = os.Lstat(fs.realpath(f.rootID, path.Dir(f.path))); err != nil {
+			return err
+		}
+	}
+
+	f.dirs = append([]os.FileInfo{
+		&namedFileInfo{FileInfo: self, name: "."},
+		&namedFileInfo{FileInfo: parent, name: ".."},
+	}, dirs...)
+	return nil
+}
+
+func (c *dotlConn) readlink(d *dotlDecoder, e *dotlEncoder) error {
+	fid := d.u32()
+	if d.err != nil {
+		return d.err
+	}
+
+	f, err := c.fid(fid)
+	if err != nil {
+		return err
+	}
+	defer f.unlock()
+
+	target, err := os.Readlink(c.fs.realpath(f.rootID, f.path))
+	if err != nil {
+		return err
+	}
+	c.fs.addToStatset(f.rootID, f.path)
+
+	e.str(target)
+	return nil
+}
+
+func (c *dotlConn) symlink(d *dotlDecoder, e *dotlEncoder) error {
+	fid, name, target, _ := d.u32(), d.str(), d.str(), d.u32()
+	if d.err != nil {
+		return d.err
+	}
+	return c.createChild(fid, name, false, e, func(name string) error {
+		return os.Symlink(target, name)
+	})
+}
+
+func (c *dotlConn) mknod(d *dotlDecoder, e *dotlEncoder) error {
+	fid, name, mode, major, minor, _ := d.u32(), d.str(), d.u32(), d.u32(), d.u32(), d.u32()
+	if d.err != nil {
+		return d.err
+	}
+	return c.createChild(fid, name, false, e, func(name string) error {
+		return syscall.Mknod(name, mode, mkdev(major, minor))
+	})
+}
+
+func (c *dotlConn) mkdir(d *dotlDecoder, e *dotlEncoder) error {
+	fid, name, mode, _ := d.u32(), d.str(), d.u32(), d.u32()
+	if d.err != nil {
+		return d.err
+	}
+	return c.createChild(fid, name, true, e, func(name string) error {
+		return os.Mkdir(name, dotlFileMode(mode))
+	})
+}
+
+// createChild calls fn with the path to create name at within the directory
+// of a handle and encodes the qid of the new file. Set dir if creating a directory.
+func (c *dotlConn) createChild(fid uint32, name string, dir bool, e *dotlEncoder, fn func(name string) error) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+
+	f, err := c.fid(fid)
+	if err != nil {
+		return err
+	}
+	defer f.unlock()
+
+	filename := f.path + "/" + name
+	if err := c.fs.create(f.rootID, filename, dir, fn); err != nil {
+		return err
+	}
+
+	st, err := os.Lstat(c.fs.realpath(f.rootID, filename))
+	if err != nil {
+		return err
+	}
+	e.qid(newQid(st))
+	return nil
+}
+
+func (c *dotlConn) link(d *dotlDecoder) error {
+	dfid, fid, name := d.u32(), d.u32(), d.str()
+	if d.err != nil {
+		return d.err
+	} else if err := checkName(name); err != nil {
+		return err
+	}
+
+	dir, f, unlock, err := c.fidPair(dfid, fid)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// The link target must be in the same layer as the new link.
+	src, err := c.fs.copyUp(f.rootID, f.path)
+	if err != nil {
+		return err
+	}
+
+	filename := dir.path + "/" + name
+	return c.fs.create(dir.rootID, filename, false, func(name string) error {
+		return os.Link(src, name)
+	})
+}
+
+func (c *dotlConn) rename(d *dotlDecoder) error {
+	fid, dfid, name := d.u32(), d.u32(), d.str()
+	if d.err != nil {
+		return d.err
+	} else if err := checkName(name); err != nil {
+		return err
+	}
+
+	f, dir, unlock, err := c.fidPair(fid, dfid)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if dir.rootID != f.rootID {
+		return syscall.EXDEV
+	}
+
+	return c.move(f.rootID, f.path, dir.path+"/"+name)
+}
+
+func (c *dotlConn) renameat(d *dotlDecoder) error {
+	olddirfid, oldname, newdirfid, newname := d.u32(), d.str(), d.u32(), d.str()
+	if d.err != nil {
+		return d.err
+	} else if err := checkName(oldname); err != nil {
+		return err
+	} else if err := checkName(newname); err != nil {
+		return err
+	}
+
+	olddir, newdir, unlock, err := c.fidPair(olddirfid, newdirfid)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if newdir.rootID != olddir.rootID {
+		return syscall.EXDEV
+	}
+
+	return c.move(olddir.rootID, olddir.path+"/"+oldname, newdir.path+"/"+newname)
+}
+
+// move renames oldpath to newpath within a root. Handles on the same root
+// referring to oldpath, or a path beneath it, are updated to the new location
+// when they are next used.
+func (c *dotlConn) move(rootID, oldpath, newpath string) error {
+	c.renameMu.Lock()
+	defer c.renameMu.Unlock()
+
+	if err := c.fs.rename(rootID, oldpath, newpath); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.logRename(dotlRename{rootID: rootID, oldpath: oldpath, newpath: newpath})
+	return nil
+}
+
+func (c *dotlConn) unlinkat(d *dotlDecoder) error {
+	fid, name, flags := d.u32(), d.str(), d.u32()
+	if d.err != nil {
+		return d.err
+	} else if err := checkName(name); err != nil {
+		return err
+	}
+
+	f, err := c.fid(fid)
+	if err != nil {
+		return err
+	}
+	defer f.unlock()
+
+	// Ensure the file type matches the requested removal.
+	filename := f.path + "/" + name
+	st, err := os.Lstat(c.fs.realpath(f.rootID, filename))
+	if err != nil {
+		return err
+	} else if flags&dotlAtRemoveDir != 0 && !st.IsDir() {
+		return syscall.ENOTDIR
+	} else if flags&dotlAtRemoveDir == 0 && st.IsDir() {
+		return syscall.EISDIR
+	}
+
+	return c.fs.remove(f.rootID, filename)
+}
+
+func (c *dotlConn) fsync(d *dotlDecoder) error {
+	fid := d.u32()
+	if d.err != nil {
+		return d.err
+	}
+
+	f, err := c.fid(fid)
+	if err != nil {
+		return err
+	}
+	defer f.unlock()
+	if f.file == nil {
+		return syscall.EBADF
+	}
+	return f.file.Sync()
+}
+
+func (c *dotlConn) lock(d *dotlDecoder, e *dotlEncoder) error {
+	fid, typ, _, start, length, procID, clientID := d.u32(), d.u8(), d.u32(), d.u64(), d.u64(), d.u32(), d.str()
+	if d.err != nil {
+		return d.err
+	}
+
+	f, err := c.fid(fid)
+	if err != nil {
+		return err
+	}
+	defer f.unlock()
+
+	// Blocking requests are retried by the client until they succeed.
+	l := newFileLock(f, typ, start, length, procID, clientID)
+	if c.fs.locks.set(f.path, l) {
+		e.u8(dotlLockSuccess)
+	} else {
+		e.u8(dotlLockBlocked)
+	}
+	return nil
+}
+
+func (c *dotlConn) getlock(d *dotlDecoder, e *dotlEncoder) error {
+	fid, typ, start, length, procID, clientID := d.u32(), d.u8(), d.u64(), d.u64(), d.u32(), d.str()
+	if d.err != nil {
+		return d.err
+	}
+
+	f, err := c.fid(fid)
+	if err != nil {
+		return err
+	}
+	defer f.unlock()
+
+	// Return the first conflicting lock or the requested lock as unlocked.
+	l := newFileLock(f, typ, start, length, procID, clientID)
+	if other := c.fs.locks.conflict(f.path, l); other != nil {
+		l = other
+	} else {
+		l.typ = dotlLockUnlock
+	}
+
+	e.u8(l.typ)
+	e.u64(l.start)
+	if l.end == math.MaxUint64 {
+		e.u64(0)
+	} else {
+		e.u64(l.end - l.start)
+	}
+	e.u32(l.procID)
+	e.str(l.clientID)
+	return nil
+}
+
+func (c *dotlConn) xattrwalk(d *dotlDecoder, e *dotlEncoder) error {
+	fid, newfid, name := d.u32(), d.u32(), d.str()
+	if d.err != nil {
+		return d.err
+	}
+
+	f, err := c.fid(fid)
+	if err != nil {
+		return err
+	}
+	defer f.unlock()
+	if newfid != fid && c.inUse(newfid) {
+		return syscall.EBADF
+	}
+
+	// An empty name lists all attribute names.
+	var data []byte
+	if name == "" {
+		data, err = listxattr(c.fs.realpath(f.rootID, f.path))
+	} else {
+		data, err = getxattr(c.fs.realpath(f.rootID, f.path), name)
+	}
+	if err != nil {
+		return err
+	}
+	c.fs.addToStatset(f.rootID, f.path)
+
+	x := &dotlXattr{name: name, data: data}
+	if newfid == fid {
+		f.xattr = x
+	} else if err := c.addFid(newfid, &dotlFid{Aux: Aux{rootID: f.rootID, path: f.path}, xattr: x}, f); err != nil {
+		return err
+	}
+
+	e.u64(uint64(len(data)))
+	return nil
+}
+
+func (c *dotlConn) xattrcreate(d *dotlDecoder) error {
+	fid, name, size, flags := d.u32(), d.str(), d.u64(), d.u32()
+	if d.err != nil {
+		return d.err
+	}
+
+	f, err := c.fid(fid)
+	if err != nil {
+		return err
+	}
+	defer f.unlock()
+	if size > uint64(dotlMaxMsize) {
+		return syscall.E2BIG
+	} else if err := c.fs.checkWrite(f.rootID, f.path); err != nil {
+		return err
+	}
+
+	// The attribute is set once all data is written and the handle is clunked.
+	f.xattr = &dotlXattr{name: name, size: size, flags: int(flags), create: true}
+	return nil
+}
+
+// dotlStatfs represents file system statistics returned by Rstatfs.
+type dotlStatfs struct {
+	Type    uint32
+	Bsize   uint32
+	Blocks  uint64
+	Bfree   uint64
+	Bavail  uint64
+	Files   uint64
+	Ffree   uint64
+	Fsid    uint64
+	Namelen uint32
+}
+
+// dotlOpenFlags converts Linux open flags to os.OpenFile() flags.
+func dotlOpenFlags(flags uint32) int {
+	var ret int
+	switch flags & dotlOAccmode {
+	case dotlOWronly:
+		ret = os.O_WRONLY
+	case dotlORdwr:
+		ret = os.O_RDWR
+	default:
+		ret = os.O_RDONLY
+	}
+
+	if flags&dotlOCreat != 0 {
+		ret |= os.O_CREATE
+	}
+	if flags&dotlOExcl != 0 {
+		ret |= os.O_EXCL
+	}
+	if flags&dotlOTrunc != 0 {
+		ret |= os.O_TRUNC
+	}
+	if flags&dotlOAppend != 0 {
+		ret |= os.O_APPEND
+	}
+	if flags&dotlOSync != 0 {
+		ret |= os.O_SYNC
+	}
+	return ret
+}
+
+// dotlFileMode converts a Linux mode to an os.FileMode.
+func dotlFileMode(mode uint32) os.FileMode {
+	m := os.FileMode(mode & 0777)
+	if mode&syscall.S_ISUID != 0 {
+		m |= os.ModeSetuid
+	}
+	if mode&syscall.S_ISGID != 0 {
+		m |= os.ModeSetgid
+	}
+	if mode&syscall.S_ISVTX != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
+
+// direntType returns the directory entry type for a file mode.
+func direntType(m os.FileMode) uint8 {
+	switch {
+	case m.IsDir():
+		return syscall.DT_DIR
+	case m&os.ModeSymlink != 0:
+		return syscall.DT_LNK
+	case m&os.ModeNamedPipe != 0:
+		return syscall.DT_FIFO
+	case m&os.ModeSocket != 0:
+		return syscall.DT_SOCK
+	case m&os.ModeCharDevice != 0:
+		return syscall.DT_CHR
+	case m&os.ModeDevice != 0:
+		return syscall.DT_BLK
+	default:
+		return syscall.DT_REG
+	}
+}
+
+// namedFileInfo overrides the name of an os.FileInfo.
+type namedFileInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (fi *namedFileInfo) Name() string { return fi.name }
+
+// dotlDecoder reads little-endian fields from a message body.
+// Reading past the end of the body sets err and returns zero values.
+type dotlDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *dotlDecoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	} else if n > len(d.buf) {
+		d.buf, d.err = nil, errShortMessage
+		return nil
+	}
+
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *dotlDecoder) u8() uint8 {
+	if b := d.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *dotlDecoder) u16() uint16 {
+	if b := d.next(2); b != nil {
+		return binary.LittleEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (d *dotlDecoder) u32() uint32 {
+	if b := d.next(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *dotlDecoder) u64() uint64 {
+	if b := d.next(8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (d *dotlDecoder) str() string { return string(d.next(int(d.u16()))) }
+
+// dotlEncoder appends little-endian fields to a message body.
+type dotlEncoder struct {
+	buf []byte
+}
+
+func (e *dotlEncoder) u8(v uint8) { e.buf = append(e.buf, v) }
+
+func (e *dotlEncoder) u16(v uint16) {
+	e.buf = append(e.buf, byte(v), byte(v>>8))
+}
+
+func (e *dotlEncoder) u32(v uint32) {
+	e.buf = append(e.buf, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func (e *dotlEncoder) u64(v uint64) {
+	e.u32(uint32(v))
+	e.u32(uint32(v >> 32))
+}
+
+func (e *dotlEncoder) str(s string) {
+	e.u16(uint16(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *dotlEncoder) bytes(b []byte) { e.buf = append(e.buf, b...) }
+
+func (e *dotlEncoder) qid(q *go9p.Qid) {
+	e.u8(q.Type)
+	e.u32(q.Version)
+	e.u64(q.Path)
+}
+
+func (e *dotlEncoder) timespec(ts syscall.Timespec) {
+	e.u64(uint64(ts.Sec))
+	e.u64(uint64(ts.Nsec))
+}
+
+// lockTable tracks byte-range locks requested by 9P2000.L clients.
+// Locks are tracked by the server since all files are opened by a single
+// process, so operating system locks would never conflict.
+type lockTable struct {
+	mu    sync.Mutex
+	locks map[string][]*fileLock // by path
+}
+
+// newLockTable returns a new instance of lockTable.
+func newLockTable() *lockTable {
+	return &lockTable{locks: make(map[string][]*fileLock)}
+}
+
+// fileLock represents a lock on the byte range [start, end) of a file.
+type fileLock struct {
+	typ        uint8
+	start, end uint64
+	procID     uint32
+	clientID   string
+	fid        *dotlFid // handle the lock was acquired through
+}
+
+// newFileLock returns a lock for a range from a client request.
+// A length of zero locks through the end of the file.
+func newFileLock(f *dotlFid, typ uint8, start, length uint64, procID uint32, clientID string) *fileLock {
+	end := uint64(math.MaxUint64)
+	if length != 0 && start+length > start {
+		end = start + length
+	}
+	return &fileLock{typ: typ, start: start, end: end, procID: procID, clientID: clientID, fid: f}
+}
+
+// sameOwner returns true if l and other were requested by the same client process.
+func (l *fileLock) sameOwner(other *fileLock) bool {
+	return l.procID == other.procID && l.clientID == other.clientID
+}
+
+// overlaps returns true if the ranges of l and other intersect.
+func (l *fileLock) overlaps(other *fileLock) bool {
+	return l.start < other.end && other.start < l.end
+}
+
+// set acquires or releases l on a path.
+// Returns false if the lock conflicts with a lock held by another owner.
+func (t *lockTable) set(path string, l *fileLock) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if l.typ != dotlLockUnlock && t.findConflict(path, l) != nil {
+		return false
+	}
+
+	// Remove the range from the owner's existing locks and add the new lock.
+	var locks []*fileLock
+	for _, other := range t.locks[path] {
+		if !other.sameOwner(l) || !other.overlaps(l) {
+			locks = append(locks, other)
+			continue
+		}
+
+		if other.start < l.start {
+			head := *other
+			head.end = l.start
+			locks = append(locks, &head)
+		}
+		if other.end > l.end {
+			tail := *other
+			tail.start = l.end
+			locks = append(locks, &tail)
+		}
+	}
+	if l.typ != dotlLockUnlock {
+		locks = append(locks, l)
+	}
+
+	if len(locks) == 0 {
+		delete(t.locks, path)
+	} else {
+		t.locks[path] = locks
+	}
+	return true
+}
+
+// conflict returns a lock held by another owner that prevents l from being acquired.
+func (t *lockTable) conflict(path string, l *fileLock) *fileLock {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.findConflict(path, l)
+}
+
+// findConflict returns a conflicting lock. The table must be locked by the caller.
+func (t *lockTable) findConflict(path string, l *fileLock) *fileLock {
+	for _, other := range t.locks[path] {
+		if other.sameOwner(l) || !other.overlaps(l) {
+			continue
+		} else if l.typ == dotlLockWrite || other.typ == dotlLockWrite {
+			return other
+		}
+	}
+	return nil
+}
+
+// release removes all locks acquired through a handle.
+func (t *lockTable) release(f *dotlFid) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for path, locks := range t.locks {
+		var other []*fileLock
+		for _, l := range locks {
+			if l.fid != f {
+				other = append(other, l)
+			}
+		}
+
+		if len(other) == 0 {
+			delete(t.locks, path)
+		} else {
+			t.locks[path] = other
+		}
+	}
+}
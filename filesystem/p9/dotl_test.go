@@ -0,0 +1,1019 @@
+package p9_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/flynn/bake"
+	"github.com/flynn/bake/filesystem/p9"
+)
+
+// Ensure that the server rejects protocol versions other than 9P2000.L.
+func TestDotl_Version_Unknown(t *testing.T) {
+	fs := OpenDotlFileSystem()
+	defer fs.Close()
+
+	c := MustDialDotl(fs)
+	defer c.Close()
+
+	r := c.MustRPC(100, NewDotlMsg().U32(8192).Str("9P2000.u"))
+	if msize, version := r.U32(), r.Str(); msize != 8192 || version != "unknown" {
+		t.Fatalf("unexpected version: %d %s", msize, version)
+	}
+}
+
+// Ensure that a file can be read and tracked.
+func TestDotl_Read(t *testing.T) {
+	fs := OpenDotlFileSystem()
+	defer fs.Close()
+	root := fs.CreateRoot()
+	c := MustAttachDotl(fs)
+	defer c.Close()
+
+	fs.MustWriteFile("foo/bar", []byte("data"), 0666)
+
+	// Open and read the file.
+	c.MustWalk(0, 1, "0000", "foo", "bar")
+	c.MustRPC(12, NewDotlMsg().U32(1).U32(uint32(os.O_RDONLY)))
+	if buf := c.MustRead(1, 0, 100); string(buf) != "data" {
+		t.Fatalf("unexpected data: %q", buf)
+	}
+
+	// Verify readset & writeset.
+	if a := root.ReadsetSlice(); !reflect.DeepEqual(a, []string{"/foo/bar"}) {
+		t.Fatalf("unexpected readset: %#v", a)
+	} else if a := root.WritesetSlice(); len(a) != 0 {
+		t.Fatalf("unexpected writeset: %#v", a)
+	}
+}
+
+// Ensure that a file can be created, written and tracked.
+func TestDotl_Lcreate(t *testing.T) {
+	fs := OpenDotlFileSystem()
+	defer fs.Close()
+	root := fs.CreateRoot()
+	c := MustAttachDotl(fs)
+	defer c.Close()
+
+	fs.MustMkdir("foo")
+
+	// Create and write the file.
+	c.MustWalk(0, 1, "0000", "foo")
+	c.MustRPC(14, NewDotlMsg().U32(1).Str("bar").U32(uint32(os.O_WRONLY)).U32(0644).U32(0))
+	c.MustRPC(118, NewDotlMsg().U32(1).U64(0).U32(4).Bytes([]byte("data")))
+	c.MustClunk(1)
+
+	// Commit changes and verify local file.
+	root.MustCommit(root.WritesetSlice()...)
+	if buf, err := ioutil.ReadFile(filepath.Join(fs.Path(), "foo", "bar")); err != nil {
+		t.Fatal(err)
+	} else if string(buf) != "data" {
+		t.Fatalf("unexpected data: %q", buf)
+	}
+
+	// Verify writes.
+	if a := WriteStrings(root.Writes()); !reflect.DeepEqual(a, []string{"create /foo/bar"}) {
+		t.Fatalf("unexpected writes: %#v", a)
+	}
+}
+
+// Ensure that walking to a missing file returns an error and is tracked.
+func TestDotl_Walk_Missing(t *testing.T) {
+	fs := OpenDotlFileSystem()
+	defer fs.Close()
+	root := fs.CreateRoot()
+	c := MustAttachDotl(fs)
+	defer c.Close()
+
+	fs.MustMkdir("foo")
+
+	// Walking to a missing file only returns the qids that were found.
+	r := c.MustRPC(110, NewDotlMsg().U32(0).U32(1).U16(3).Str("0000").Str("foo").Str("bar"))
+	if n := r.U16(); n != 2 {
+		t.Fatalf("unexpected qid count: %d", n)
+	}
+
+	// Walking a missing file directly returns ENOENT.
+	c.MustWalk(0, 1, "0000", "foo")
+	if _, err := c.RPC(110, NewDotlMsg().U32(1).U32(2).U16(1).Str("bar")); err != syscall.ENOENT {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Verify missset.
+	if a := root.MisssetSlice(); !reflect.DeepEqual(a, []string{"/foo/bar"}) {
+		t.Fatalf("unexpected missset: %#v", a)
+	}
+}
+
+// Ensure that file attributes can be read and tracked.
+func TestDotl_Getattr(t *testing.T) {
+	fs := OpenDotlFileSystem()
+	defer fs.Close()
+	root := fs.CreateRoot()
+	c := MustAttachDotl(fs)
+	defer c.Close()
+
+	fs.MustWriteFile("foo/bar", []byte("data"), 0640)
+
+	c.MustWalk(0, 1, "0000", "foo", "bar")
+	r := c.MustRPC(24, NewDotlMsg().U32(1).U64(0x7ff))
+	r.U64()         // valid
+	r.Bytes(13)     // qid
+	mode := r.U32() // mode
+	r.U32()         // uid
+	r.U32()         // gid
+	r.U64()         // nlink
+	r.U64()         // rdev
+	size := r.U64() // size
+	if mode != syscall.S_IFREG|0640 {
+		t.Fatalf("unexpected mode: %o", mode)
+	} else if size != 4 {
+		t.Fatalf("unexpected size: %d", size)
+	}
+
+	// Verify statset & readset.
+	if a := root.StatsetSlice(); !reflect.DeepEqual(a, []string{"/foo/bar"}) {
+		t.Fatalf("unexpected statset: %#v", a)
+	} else if a := root.ReadsetSlice(); len(a) != 0 {
+		t.Fatalf("unexpected readset: %#v", a)
+	}
+}
+
+// Ensure that file attributes can be changed and tracked.
+func TestDotl_Setattr(t *testing.T) {
+	fs := OpenDotlFileSystem()
+	defer fs.Close()
+	root := fs.CreateRoot()
+	c := MustAttachDotl(fs)
+	defer c.Close()
+
+	fs.MustWriteFile("foo/bar", []byte("data"), 0666)
+	fs.MustWriteFile("foo/baz", []byte("data"), 0666)
+
+	// Change mode of one file and truncate another.
+	c.MustWalk(0, 1, "0000", "foo", "bar")
+	c.MustRPC(26, NewDotlMsg().U32(1).U32(0x1).U32(0600).U32(0).U32(0).U64(0).U64(0).U64(0).U64(0).U64(0))
+	c.MustWalk(0, 2, "0000", "foo", "baz")
+	c.MustRPC(26, NewDotlMsg().U32(2).U32(0x8).U32(0).U32(0).U32(0).U64(2).U64(0).U64(0).U64(0).U64(0))
+
+	// Commit changes and verify local files.
+	root.MustCommit(root.WritesetSlice()...)
+	if fi, err := os.Stat(filepath.Join(fs.Path(), "foo", "bar")); err != nil {
+		t.Fatal(err)
+	} else if fi.Mode() != 0600 {
+		t.Fatalf("unexpected mode: %s", fi.Mode())
+	}
+	if fi, err := os.Stat(filepath.Join(fs.Path(), "foo", "baz")); err != nil {
+		t.Fatal(err)
+	} else if fi.Size() != 2 {
+		t.Fatalf("unexpected size: %d", fi.Size())
+	}
+
+	// Verify writes.
+	if a := WriteStrings(root.Writes()); !reflect.DeepEqual(a, []string{
+		"chmod /foo/bar",
+		"modify /foo/baz",
+	}) {
+		t.Fatalf("unexpected writes: %#v", a)
+	}
+}
+
+// Ensure that directory entries can be read with their types and tracked.
+func TestDotl_Readdir(t *testing.T) {
+	fs := OpenDotlFileSystem()
+	defer fs.Close()
+	root := fs.CreateRoot()
+	c := MustAttachDotl(fs)
+	defer c.Close()
+
+	fs.MustWriteFile("foo/bar", []byte("data"), 0666)
+	fs.MustMkdir("foo/baz")
+
+	// Open & read directory.
+	c.MustWalk(0, 1, "0000", "foo")
+	c.MustRPC(12, NewDotlMsg().U32(1).U32(uint32(os.O_RDONLY)))
+	r := c.MustRPC(40, NewDotlMsg().U32(1).U64(0).U32(8192))
+
+	var a []string
+	for r.U32(); len(r.buf) > 0; {
+		r.Bytes(13) // qid
+		r.U64()     // offset
+		typ, name := r.U8(), r.Str()
+		switch typ {
+		case syscall.DT_DIR:
+			a = append(a, name+"/")
+		default:
+			a = append(a, name)
+		}
+	}
+	if !reflect.DeepEqual(a, []string{"./", "../", "bar", "baz/"}) {
+		t.Fatalf("unexpected entries: %#v", a)
+	}
+
+	// Verify listset & readset.
+	if a := root.ListsetSlice(); !reflect.DeepEqual(a, []string{"/foo"}) {
+		t.Fatalf("unexpected listset: %#v", a)
+	} else if a := root.ReadsetSlice(); len(a) != 0 {
+		t.Fatalf("unexpected readset: %#v", a)
+	}
+}
+
+// Ensure that directories, symlinks and hard links can be created and tracked.
+func TestDotl_Mkdir_Symlink_Link(t *testing.T) {
+	fs := OpenDotlFileSystem()
+	defer fs.Close()
+	root := fs.CreateRoot()
+	c := MustAttachDotl(fs)
+	defer c.Close()
+
+	fs.MustWriteFile("foo/bar", []byte("data"), 0666)
+
+	c.MustWalk(0, 1, "0000", "foo")
+	c.MustWalk(0, 2, "0000", "foo", "bar")
+	c.MustRPC(72, NewDotlMsg().U32(1).Str("dir").U32(0755).U32(0))
+	c.MustRPC(16, NewDotlMsg().U32(1).Str("symlink").Str("bar").U32(0))
+	c.MustRPC(70, NewDotlMsg().U32(1).U32(2).Str("link"))
+
+	// Commit changes and verify local files.
+	root.MustCommit(root.WritesetSlice()...)
+	if fi, err := os.Stat(filepath.Join(fs.Path(), "foo", "dir")); err != nil {
+		t.Fatal(err)
+	} else if !fi.IsDir() {
+		t.Fatal("expected directory")
+	}
+	if target, err := os.Readlink(filepath.Join(fs.Path(), "foo", "symlink")); err != nil {
+		t.Fatal(err)
+	} else if target != "bar" {
+		t.Fatalf("unexpected target: %s", target)
+	}
+	if buf, err := ioutil.ReadFile(filepath.Join(fs.Path(), "foo", "link")); err != nil {
+		t.Fatal(err)
+	} else if string(buf) != "data" {
+		t.Fatalf("unexpected data: %q", buf)
+	}
+
+	// Verify writes.
+	if a := WriteStrings(root.Writes()); !reflect.DeepEqual(a, []string{
+		"create /foo/dir",
+		"create /foo/link",
+		"create /foo/symlink",
+	}) {
+		t.Fatalf("unexpected writes: %#v", a)
+	}
+}
+
+// Ensure that a file written to a temporary path and renamed is tracked at its final path.
+func TestDotl_Renameat(t *testing.T) {
+	fs := OpenDotlFileSystem()
+	defer fs.Close()
+	root := fs.CreateRoot()
+	c := MustAttachDotl(fs)
+	defer c.Close()
+
+	fs.MustMkdir("foo")
+
+	// Create temporary file and keep its handle open.
+	c.MustWalk(0, 1, "0000", "foo")
+	c.MustWalk(1, 2)
+	c.MustRPC(14, NewDotlMsg().U32(2).Str("tmp").U32(uint32(os.O_WRONLY)).U32(0644).U32(0))
+
+	// Rename the file and write through the existing handle.
+	c.MustRPC(74, NewDotlMsg().U32(1).Str("tmp").U32(1).Str("out"))
+	c.MustRPC(118, NewDotlMsg().U32(2).U64(0).U32(4).Bytes([]byte("data")))
+	c.MustClunk(2)
+
+	// Commit changes and verify local file.
+	root.MustCommit(root.WritesetSlice()...)
+	if buf, err := ioutil.ReadFile(filepath.Join(fs.Path(), "foo", "out")); err != nil {
+		t.Fatal(err)
+	} else if string(buf) != "data" {
+		t.Fatalf("unexpected data: %q", buf)
+	}
+
+	// Verify writes.
+	if a := WriteStrings(root.Writes()); !reflect.DeepEqual(a, []string{"create /foo/out"}) {
+		t.Fatalf("unexpected writes: %#v", a)
+	}
+}
+
+// Ensure renames only affect handles on the same root and can't cross roots.
+func TestDotl_Renameat_Roots(t *testing.T) {
+	fs := OpenDotlFileSystem()
+	defer fs.Close()
+	fs.CreateRoot()
+	fs.CreateRoot()
+	c := MustAttachDotl(fs)
+	defer c.Close()
+
+	fs.MustWriteFile("foo/tmp", []byte("data"), 0666)
+
+	c.MustWalk(0, 1, "0000", "foo")
+	c.MustWalk(0, 2, "0001", "foo")
+	c.MustWalk(0, 3, "0001", "foo", "tmp")
+
+	// Rename in the first root and verify the handle on the second root is unchanged.
+	c.MustRPC(74, NewDotlMsg().U32(1).Str("tmp").U32(1).Str("out"))
+	if _, err := c.RPC(24, NewDotlMsg().U32(3).U64(0x7ff)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Renaming between roots is not allowed.
+	if _, err := c.RPC(74, NewDotlMsg().U32(2).Str("tmp").U32(1).Str("tmp")); err != syscall.EXDEV {
+		t.Fatalf("unexpected error: %v", err)
+	} else if _, err := c.RPC(20, NewDotlMsg().U32(3).U32(1).Str("tmp")); err != syscall.EXDEV {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure that files and directories can be removed and tracked.
+func TestDotl_Unlinkat(t *testing.T) {
+	fs := OpenDotlFileSystem()
+	defer fs.Close()
+	root := fs.CreateRoot()
+	c := MustAttachDotl(fs)
+	defer c.Close()
+
+	fs.MustWriteFile("foo/bar", []byte("data"), 0666)
+	fs.MustMkdir("foo/baz")
+
+	c.MustWalk(0, 1, "0000", "foo")
+
+	// Removing with the wrong type is an error.
+	if _, err := c.RPC(76, NewDotlMsg().U32(1).Str("baz").U32(0)); err != syscall.EISDIR {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	c.MustRPC(76, NewDotlMsg().U32(1).Str("bar").U32(0))
+	c.MustRPC(76, NewDotlMsg().U32(1).Str("baz").U32(0x200))
+
+	// Verify writes.
+	if a := WriteStrings(root.Writes()); !reflect.DeepEqual(a, []string{
+		"remove /foo/bar",
+		"remove /foo/baz",
+	}) {
+		t.Fatalf("unexpected writes: %#v", a)
+	}
+}
+
+// Ensure writes outside the root's write policy are denied and tracked.
+func TestDotl_WritePolicy(t *testing.T) {
+	fs := OpenDotlFileSystem()
+	defer fs.Close()
+	root := fs.CreateRootWithPolicy(&bake.WritePolicy{Paths: []string{"bin/foo"}})
+	c := MustAttachDotl(fs)
+	defer c.Close()
+
+	fs.MustWriteFile("src/main.go", []byte("package main"), 0666)
+
+	// Creating the output and its parent directory is allowed.
+	c.MustWalk(0, 1, "0000")
+	c.MustRPC(72, NewDotlMsg().U32(1).Str("bin").U32(0755).U32(0))
+	c.MustWalk(1, 2, "bin")
+	c.MustRPC(14, NewDotlMsg().U32(2).Str("foo").U32(uint32(os.O_WRONLY)).U32(0644).U32(0))
+	c.MustClunk(2)
+
+	// Writing to inputs is denied.
+	c.MustWalk(1, 3, "src", "main.go")
+	if _, err := c.RPC(12, NewDotlMsg().U32(3).U32(uint32(os.O_WRONLY))); err != syscall.EPERM {
+		t.Fatalf("unexpected open error: %v", err)
+	} else if _, err := c.RPC(76, NewDotlMsg().U32(1).Str("src").U32(0x200)); err != syscall.EPERM {
+		t.Fatalf("unexpected unlinkat error: %v", err)
+	}
+
+	// Reading inputs is still allowed.
+	c.MustRPC(12, NewDotlMsg().U32(3).U32(uint32(os.O_RDONLY)))
+
+	// Verify denied paths and writes.
+	if a := root.DeniedsetSlice(); !reflect.DeepEqual(a, []string{"/src", "/src/main.go"}) {
+		t.Fatalf("unexpected deniedset: %#v", a)
+	} else if a := WriteStrings(root.Writes()); !reflect.DeepEqual(a, []string{"create /bin", "create /bin/foo"}) {
+		t.Fatalf("unexpected writes: %#v", a)
+	}
+}
+
+// Ensure names that aren't a single path element are rejected.
+func TestDotl_InvalidNames(t *testing.T) {
+	fs := OpenDotlFileSystem()
+	defer fs.Close()
+	root := fs.CreateRootWithPolicy(&bake.WritePolicy{Paths: []string{"bin/foo"}})
+	c := MustAttachDotl(fs)
+	defer c.Close()
+
+	fs.MustWriteFile("src/main.go", []byte("package main"), 0666)
+	fs.MustMkdir("bin")
+
+	c.MustWalk(0, 1, "0000", "bin")
+	for _, name := range []string{"", ".", "..", "../src/main.go", "foo/.."} {
+		if _, err := c.RPC(14, NewDotlMsg().U32(1).Str(name).U32(uint32(os.O_WRONLY)).U32(0644).U32(0)); err != syscall.EINVAL {
+			t.Fatalf("%q: unexpected lcreate error: %v", name, err)
+		} else if _, err := c.RPC(72, NewDotlMsg().U32(1).Str(name).U32(0755).U32(0)); err != syscall.EINVAL {
+			t.Fatalf("%q: unexpected mkdir error: %v", name, err)
+		} else if _, err := c.RPC(76, NewDotlMsg().U32(1).Str(name).U32(0)); err != syscall.EINVAL {
+			t.Fatalf("%q: unexpected unlinkat error: %v", name, err)
+		} else if _, err := c.RPC(74, NewDotlMsg().U32(1).Str("foo").U32(1).Str(name)); err != syscall.EINVAL {
+			t.Fatalf("%q: unexpected renameat error: %v", name, err)
+		}
+	}
+
+	// Walks may only move to the parent with "..".
+	if _, err := c.RPC(110, NewDotlMsg().U32(1).U32(2).U16(1).Str("../src")); err != syscall.EINVAL {
+		t.Fatalf("unexpected walk error: %v", err)
+	}
+	c.MustWalk(1, 2, "..", "src")
+
+	// Nothing was changed and nothing outside the policy was checked.
+	if a := WriteStrings(root.Writes()); len(a) != 0 {
+		t.Fatalf("unexpected writes: %#v", a)
+	} else if a := root.DeniedsetSlice(); len(a) != 0 {
+		t.Fatalf("unexpected deniedset: %#v", a)
+	}
+}
+
+// Ensure changes are made to a private layer until they are committed.
+func TestDotl_Overlay_Commit(t *testing.T) {
+	fs := OpenDotlFileSystem()
+	defer fs.Close()
+	root := fs.CreateRoot()
+	c := MustAttachDotl(fs)
+	defer c.Close()
+
+	fs.MustWriteFile("foo/bar", []byte("old"), 0666)
+	fs.MustWriteFile("foo/keep", []byte("keep"), 0666)
+
+	// Overwrite an existing file and create a temporary file.
+	c.MustWalk(0, 1, "0000", "foo", "bar")
+	c.MustRPC(12, NewDotlMsg().U32(1).U32(uint32(os.O_WRONLY|os.O_TRUNC)))
+	c.MustRPC(118, NewDotlMsg().U32(1).U64(0).U32(3).Bytes([]byte("new")))
+	c.MustClunk(1)
+	c.MustWalk(0, 2, "0000", "foo")
+	c.MustRPC(14, NewDotlMsg().U32(2).Str("tmp").U32(uint32(os.O_WRONLY)).U32(0644).U32(0))
+	c.MustClunk(2)
+
+	// Changes are visible through the root but not in the served directory.
+	c.MustWalk(0, 3, "0000", "foo", "bar")
+	c.MustRPC(12, NewDotlMsg().U32(3).U32(uint32(os.O_RDONLY)))
+	if buf := c.MustRead(3, 0, 100); string(buf) != "new" {
+		t.Fatalf("unexpected root data: %q", buf)
+	} else if buf := fs.MustReadFile("foo/bar"); string(buf) != "old" {
+		t.Fatalf("unexpected local data: %q", buf)
+	}
+
+	// Only the committed path is applied. Unchanged files are kept.
+	root.MustCommit("foo/bar")
+	if buf := fs.MustReadFile("foo/bar"); string(buf) != "new" {
+		t.Fatalf("unexpected committed data: %q", buf)
+	} else if buf := fs.MustReadFile("foo/keep"); string(buf) != "keep" {
+		t.Fatalf("unexpected unchanged data: %q", buf)
+	} else if _, err := os.Stat(filepath.Join(fs.Path(), "foo", "tmp")); !os.IsNotExist(err) {
+		t.Fatalf("expected uncommitted file to not exist: %v", err)
+	}
+}
+
+// Ensure removed and renamed paths are hidden in the private layer and applied on commit.
+func TestDotl_Overlay_RemoveRename(t *testing.T) {
+	fs := OpenDotlFileSystem()
+	defer fs.Close()
+	root := fs.CreateRoot()
+	c := MustAttachDotl(fs)
+	defer c.Close()
+
+	fs.MustWriteFile("foo/bar", []byte("data"), 0666)
+	fs.MustWriteFile("src/a/b", []byte("b"), 0666)
+
+	// Remove a file and move a directory tree.
+	c.MustWalk(0, 1, "0000")
+	c.MustWalk(1, 4, "foo")
+	c.MustRPC(76, NewDotlMsg().U32(4).Str("bar").U32(0))
+	c.MustClunk(4)
+	c.MustRPC(74, NewDotlMsg().U32(1).Str("src").U32(1).Str("dst"))
+
+	// Verify the root's view of the directory.
+	c.MustWalk(1, 2)
+	c.MustRPC(12, NewDotlMsg().U32(2).U32(uint32(os.O_RDONLY)))
+	if a := ReaddirNames(c.MustRPC(40, NewDotlMsg().U32(2).U64(0).U32(8192))); !reflect.DeepEqual(a, []string{".", "..", "dst", "foo"}) {
+		t.Fatalf("unexpected entries: %#v", a)
+	}
+	c.MustWalk(1, 3, "dst", "a", "b")
+	c.MustRPC(12, NewDotlMsg().U32(3).U32(uint32(os.O_RDONLY)))
+	if buf := c.MustRead(3, 0, 100); string(buf) != "b" {
+		t.Fatalf("unexpected moved data: %q", buf)
+	}
+
+	// Served directory is unchanged until committed.
+	if buf := fs.MustReadFile("foo/bar"); string(buf) != "data" {
+		t.Fatalf("unexpected local data: %q", buf)
+	}
+
+	root.MustCommit(root.WritesetSlice()...)
+	if _, err := os.Stat(filepath.Join(fs.Path(), "foo", "bar")); !os.IsNotExist(err) {
+		t.Fatalf("expected removed file to not exist: %v", err)
+	} else if _, err := os.Stat(filepath.Join(fs.Path(), "src")); !os.IsNotExist(err) {
+		t.Fatalf("expected moved directory to not exist: %v", err)
+	} else if buf := fs.MustReadFile("dst/a/b"); string(buf) != "b" {
+		t.Fatalf("unexpected committed data: %q", buf)
+	}
+}
+
+// Ensure releasing a root closes its handles and discards uncommitted changes.
+func TestDotl_Release(t *testing.T) {
+	fs := OpenDotlFileSystem()
+	defer fs.Close()
+	root := fs.CreateRoot()
+	other := fs.CreateRoot()
+	c := MustAttachDotl(fs)
+	defer c.Close()
+
+	fs.MustWriteFile("foo", []byte("data"), 0666)
+
+	// Open a file on each root and make an uncommitted change.
+	c.MustWalk(0, 1, "0000", "foo")
+	c.MustRPC(12, NewDotlMsg().U32(1).U32(uint32(os.O_RDWR)))
+	c.MustRPC(118, NewDotlMsg().U32(1).U64(0).U32(3).Bytes([]byte("new")))
+	c.MustWalk(0, 2, "0001", "foo")
+	c.MustRPC(12, NewDotlMsg().U32(2).U32(uint32(os.O_RDONLY)))
+
+	root.Release()
+
+	// Only the other root remains.
+	if a := fs.Roots(); len(a) != 1 || a[0].ID() != "0001" {
+		t.Fatalf("unexpected roots: %#v", a)
+	}
+
+	// Handles on the released root are closed and the root can't be walked to.
+	if _, err := c.RPC(116, NewDotlMsg().U32(1).U64(0).U32(100)); err != syscall.EBADF {
+		t.Fatalf("unexpected read error: %v", err)
+	} else if _, err := c.RPC(110, NewDotlMsg().U32(0).U32(3).U16(1).Str("0000")); err != syscall.ENOENT {
+		t.Fatalf("unexpected walk error: %v", err)
+	} else if buf := c.MustRead(2, 0, 100); string(buf) != "data" {
+		t.Fatalf("unexpected data on other root: %q", buf)
+	}
+
+	// Uncommitted changes are discarded.
+	if buf := fs.MustReadFile("foo"); string(buf) != "data" {
+		t.Fatalf("unexpected local data: %q", buf)
+	} else if _, err := os.Stat(filepath.Join(fs.Path(), ".bake")); !os.IsNotExist(err) {
+		t.Fatalf("expected private layers outside of served path: %v", err)
+	}
+
+	// Releasing again is a no-op.
+	root.Release()
+	other.Release()
+	if a := fs.Roots(); len(a) != 0 {
+		t.Fatalf("unexpected roots: %#v", a)
+	}
+}
+
+func TestDotl_WriteConflict(t *testing.T) {
+	fs := OpenDotlFileSystem()
+	defer fs.Close()
+	a := fs.CreateRootForTarget("A")
+	b := fs.CreateRootForTarget("B")
+	c := MustAttachDotl(fs)
+	defer c.Close()
+
+	// Creates a file or directory on a root using fid.
+	create := func(fid uint32, rootID, name string, dir bool) {
+		names := []string{rootID}
+		if parent := path.Dir(name); parent != "." {
+			names = append(names, strings.Split(parent, "/")...)
+		}
+		c.MustWalk(0, fid, names...)
+		if dir {
+			c.MustRPC(72, NewDotlMsg().U32(fid).Str(path.Base(name)).U32(0755).U32(0))
+		} else {
+			c.MustRPC(14, NewDotlMsg().U32(fid).Str(path.Base(name)).U32(uint32(os.O_WRONLY)).U32(0644).U32(0))
+		}
+		c.MustClunk(fid)
+	}
+
+	// Write to a shared directory and a shared file from both roots.
+	create(1, "0000", "bin", true)
+	create(2, "0001", "bin", true)
+	create(3, "0000", "bin/a", false)
+	create(4, "0001", "bin/b", false)
+	create(5, "0000", "bin/out", false)
+	create(6, "0001", "bin/out", false)
+
+	// Only the file written by both roots conflicts.
+	if x := a.ConflictsetSlice(); !reflect.DeepEqual(x, []string{"/bin/out"}) {
+		t.Fatalf("unexpected conflictset: %#v", x)
+	} else if x := b.ConflictsetSlice(); !reflect.DeepEqual(x, []string{"/bin/out"}) {
+		t.Fatalf("unexpected conflictset: %#v", x)
+	} else if x := a.ConflictTargets(); !reflect.DeepEqual(x, map[string][]string{"/bin/out": {"B"}}) {
+		t.Fatalf("unexpected conflict targets: %#v", x)
+	}
+
+	// Writes to paths changed by a released root still conflict.
+	a.Release()
+	create(7, "0001", "bin/a", false)
+	if x := b.ConflictsetSlice(); !reflect.DeepEqual(x, []string{"/bin/a", "/bin/out"}) {
+		t.Fatalf("unexpected conflictset: %#v", x)
+	} else if x := b.ConflictTargets(); !reflect.DeepEqual(x, map[string][]string{"/bin/a": {"A"}, "/bin/out": {"A"}}) {
+		t.Fatalf("unexpected conflict targets: %#v", x)
+	}
+
+	// Roots created after others are released don't conflict with them.
+	b.Release()
+	other := fs.CreateRoot()
+	create(8, "0002", "bin", true)
+	create(9, "0002", "bin/out", false)
+	if x := other.ConflictsetSlice(); len(x) != 0 {
+		t.Fatalf("unexpected conflictset: %#v", x)
+	}
+}
+
+// Ensure released roots are not kept alive by the peers they overlapped with.
+func TestDotl_WriteConflict_ReleasedPeer(t *testing.T) {
+	fs := OpenDotlFileSystem()
+	defer fs.Close()
+	b := fs.CreateRoot()
+	defer b.Release()
+
+	collected := make(chan struct{})
+	func() {
+		a := fs.FileSystem.CreateRoot("", nil).(*p9.FileSystemRoot)
+		runtime.SetFinalizer(a, func(*p9.FileSystemRoot) { close(collected) })
+		a.Release()
+	}()
+
+	for i := 0; i < 10; i++ {
+		runtime.GC()
+		select {
+		case <-collected:
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	t.Fatal("expected released root to be collected")
+}
+
+// Ensure a blocked request doesn't block other requests and can be flushed.
+func TestDotl_Flush(t *testing.T) {
+	fs := OpenDotlFileSystem()
+	defer fs.Close()
+	fs.CreateRoot()
+	c := MustAttachDotl(fs)
+	defer c.Close()
+	c.conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Hold the write end of a pipe open so reads block until data is written.
+	fifo := filepath.Join(fs.Path(), "pipe")
+	if err := syscall.Mkfifo(fifo, 0666); err != nil {
+		t.Fatal(err)
+	}
+	w, err := os.OpenFile(fifo, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	c.MustWalk(0, 1, "0000", "pipe")
+	c.MustWalk(0, 2, "0000")
+	c.MustRPC(12, NewDotlMsg().U32(1).U32(uint32(os.O_RDONLY)))
+
+	tag, err := c.Send(116, NewDotlMsg().U32(1).U64(0).U32(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Other requests are handled while the read is blocked.
+	if _, err := c.RPC(24, NewDotlMsg().U32(2).U64(0x7ff)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Flushing cancels the read. Only the flush is answered.
+	flushTag, err := c.Send(108, NewDotlMsg().U16(tag))
+	if err != nil {
+		t.Fatal(err)
+	} else if rtyp, rtag, _, err := c.Recv(); err != nil {
+		t.Fatal(err)
+	} else if rtyp != 109 || rtag != flushTag {
+		t.Fatalf("unexpected response: type=%d tag=%d", rtyp, rtag)
+	} else if _, err := c.RPC(24, NewDotlMsg().U32(2).U64(0x7ff)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure that byte-range locks conflict between client processes.
+func TestDotl_Lock(t *testing.T) {
+	fs := OpenDotlFileSystem()
+	defer fs.Close()
+	fs.CreateRoot()
+	c := MustAttachDotl(fs)
+	defer c.Close()
+
+	fs.MustWriteFile("foo/lock", nil, 0666)
+	c.MustWalk(0, 1, "0000", "foo", "lock")
+	c.MustWalk(0, 2, "0000", "foo", "lock")
+
+	// Acquire a write lock on the whole file from process 1.
+	if status := c.MustLock(1, 1, 0, 0, 1); status != 0 {
+		t.Fatalf("unexpected status: %d", status)
+	}
+
+	// Process 2 is blocked from a read lock but process 1 can downgrade its lock.
+	if status := c.MustLock(2, 0, 10, 10, 2); status != 1 {
+		t.Fatalf("unexpected status: %d", status)
+	} else if status := c.MustLock(1, 0, 0, 0, 1); status != 0 {
+		t.Fatalf("unexpected status: %d", status)
+	}
+
+	// Process 2 can share the read lock and see the owner of a conflicting lock.
+	if status := c.MustLock(2, 0, 10, 10, 2); status != 0 {
+		t.Fatalf("unexpected status: %d", status)
+	}
+	r := c.MustRPC(54, NewDotlMsg().U32(2).U8(1).U64(0).U64(0).U32(2).Str("client"))
+	if typ, start, length, procID := r.U8(), r.U64(), r.U64(), r.U32(); typ != 0 || start != 0 || length != 0 || procID != 1 {
+		t.Fatalf("unexpected lock: typ=%d start=%d length=%d proc=%d", typ, start, length, procID)
+	}
+
+	// Clunking process 1's handle releases its lock.
+	c.MustClunk(1)
+	if status := c.MustLock(2, 2, 10, 10, 2); status != 0 {
+		t.Fatalf("unexpected status: %d", status)
+	} else if status := c.MustLock(2, 1, 0, 0, 2); status != 0 {
+		t.Fatalf("unexpected status: %d", status)
+	}
+}
+
+// Ensure that the file system can be served over a private unix socket.
+func TestDotl_Transport_Unix(t *testing.T) {
+	fs := NewFileSystem()
+	fs.Protocol, fs.Transport = p9.ProtocolDotL, p9.TransportUnix
+	if err := fs.Open(); err != nil {
+		t.Fatal(err)
+	}
+	root := fs.CreateRoot()
+
+	// Verify the socket directory is only accessible by the current user.
+	addr := fs.Listener().Addr()
+	if addr.Network() != "unix" {
+		t.Fatalf("unexpected network: %s", addr.Network())
+	} else if fi, err := os.Stat(filepath.Dir(addr.String())); err != nil {
+		t.Fatal(err)
+	} else if fi.Mode().Perm() != 0700 {
+		t.Fatalf("unexpected socket directory mode: %s", fi.Mode())
+	}
+
+	// Read a file through the socket.
+	fs.MustWriteFile("foo", []byte("data"), 0666)
+	c := MustAttachDotl(fs)
+	c.MustWalk(0, 1, "0000", "foo")
+	c.MustRPC(12, NewDotlMsg().U32(1).U32(uint32(os.O_RDONLY)))
+	if buf := c.MustRead(1, 0, 100); string(buf) != "data" {
+		t.Fatalf("unexpected data: %q", buf)
+	}
+	c.Close()
+
+	if a := root.ReadsetSlice(); !reflect.DeepEqual(a, []string{"/foo"}) {
+		t.Fatalf("unexpected readset: %#v", a)
+	}
+
+	// Verify the socket is removed on close.
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Dir(addr.String())); !os.IsNotExist(err) {
+		t.Fatalf("expected socket directory to be removed: %v", err)
+	}
+}
+
+// Ensure that the file system can be served over a socket pair.
+func TestDotl_Transport_FD(t *testing.T) {
+	fs := NewFileSystem()
+	fs.Protocol, fs.Transport = p9.ProtocolDotL, p9.TransportFD
+	if err := fs.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	root := fs.CreateRoot()
+
+	// No listener is available for other processes to connect to.
+	if fs.Listener() != nil {
+		t.Fatal("unexpected listener")
+	}
+
+	// Connect through the client end of the socket pair.
+	conn, err := net.FileConn(fs.ClientFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &DotlClient{conn: conn}
+	defer c.Close()
+	c.MustRPC(100, NewDotlMsg().U32(8192).Str(p9.ProtocolDotL))
+	c.MustRPC(104, NewDotlMsg().U32(0).U32(^uint32(0)).Str("root").Str("/").U32(0))
+
+	// Create a directory through the socket pair.
+	c.MustWalk(0, 1, "0000")
+	c.MustRPC(72, NewDotlMsg().U32(1).Str("foo").U32(0755).U32(0))
+
+	if a := WriteStrings(root.Writes()); !reflect.DeepEqual(a, []string{"create /foo"}) {
+		t.Fatalf("unexpected writes: %#v", a)
+	}
+}
+
+// Ensure that opening with an unknown transport returns an error.
+func TestFileSystem_Open_ErrUnsupportedTransport(t *testing.T) {
+	fs := NewFileSystem()
+	defer os.RemoveAll(fs.Path())
+	fs.Transport = "carrier-pigeon"
+	if err := fs.Open(); err == nil || err.Error() != "unsupported transport: carrier-pigeon" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// OpenDotlFileSystem returns an open FileSystem serving 9P2000.L. Panic on error.
+func OpenDotlFileSystem() *FileSystem {
+	fs := NewFileSystem()
+	fs.Protocol = p9.ProtocolDotL
+	if err := fs.Open(); err != nil {
+		panic(err)
+	}
+	return fs
+}
+
+// DotlClient represents a minimal 9P2000.L client for testing.
+type DotlClient struct {
+	conn net.Conn
+	tag  uint16
+}
+
+// MustDialDotl returns a client connected to fs. Panic on error.
+func MustDialDotl(fs *FileSystem) *DotlClient {
+	addr := fs.Listener().Addr()
+	conn, err := net.Dial(addr.Network(), addr.String())
+	if err != nil {
+		panic(err)
+	}
+	return &DotlClient{conn: conn}
+}
+
+// MustAttachDotl returns a client connected to fs with fid 0 attached to the file system root.
+func MustAttachDotl(fs *FileSystem) *DotlClient {
+	c := MustDialDotl(fs)
+	c.MustRPC(100, NewDotlMsg().U32(8192).Str(p9.ProtocolDotL))
+	c.MustRPC(104, NewDotlMsg().U32(0).U32(^uint32(0)).Str("root").Str("/").U32(0))
+	return c
+}
+
+// Close closes the client connection.
+func (c *DotlClient) Close() error { return c.conn.Close() }
+
+// RPC sends a request and returns the response body.
+// Returns the error number if the server responds with an error.
+func (c *DotlClient) RPC(typ uint8, req *DotlMsg) (*DotlResp, error) {
+	tag, err := c.Send(typ, req)
+	if err != nil {
+		return nil, err
+	}
+
+	rtyp, rtag, r, err := c.Recv()
+	if err != nil {
+		return nil, err
+	} else if rtag != tag {
+		return nil, errors.New("unexpected tag")
+	} else if rtyp == 7 {
+		return nil, syscall.Errno(r.U32())
+	} else if rtyp != typ+1 {
+		return nil, errors.New("unexpected response type")
+	}
+	return r, nil
+}
+
+// Send writes a request without waiting for its response and returns its tag.
+func (c *DotlClient) Send(typ uint8, req *DotlMsg) (uint16, error) {
+	c.tag++
+	hdr := NewDotlMsg().U32(uint32(7 + len(req.buf))).U8(typ).U16(c.tag)
+	if _, err := c.conn.Write(append(hdr.buf, req.buf...)); err != nil {
+		return 0, err
+	}
+	return c.tag, nil
+}
+
+// Recv reads the next response and returns its type, tag & body.
+func (c *DotlClient) Recv() (uint8, uint16, *DotlResp, error) {
+	var buf [4]byte
+	if _, err := io.ReadFull(c.conn, buf[:]); err != nil {
+		return 0, 0, nil, err
+	}
+	body := make([]byte, binary.LittleEndian.Uint32(buf[:])-4)
+	if _, err := io.ReadFull(c.conn, body); err != nil {
+		return 0, 0, nil, err
+	}
+
+	r := &DotlResp{buf: body}
+	rtyp, tag := r.U8(), r.U16()
+	return rtyp, tag, r, nil
+}
+
+// MustRPC sends a request and returns the response body. Panic on error.
+func (c *DotlClient) MustRPC(typ uint8, req *DotlMsg) *DotlResp {
+	r, err := c.RPC(typ, req)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// MustWalk walks from fid to newfid through names. Panic on error.
+func (c *DotlClient) MustWalk(fid, newfid uint32, names ...string) {
+	m := NewDotlMsg().U32(fid).U32(newfid).U16(uint16(len(names)))
+	for _, name := range names {
+		m.Str(name)
+	}
+	if n := c.MustRPC(110, m).U16(); int(n) != len(names) {
+		panic("incomplete walk")
+	}
+}
+
+// MustRead reads count bytes from fid at offset. Panic on error.
+func (c *DotlClient) MustRead(fid uint32, offset uint64, count uint32) []byte {
+	r := c.MustRPC(116, NewDotlMsg().U32(fid).U64(offset).U32(count))
+	return r.Bytes(int(r.U32()))
+}
+
+// MustLock requests a lock through fid and returns the status. Panic on error.
+func (c *DotlClient) MustLock(fid uint32, typ uint8, start, length uint64, procID uint32) uint8 {
+	return c.MustRPC(52, NewDotlMsg().U32(fid).U8(typ).U32(0).U64(start).U64(length).U32(procID).Str("client")).U8()
+}
+
+// MustClunk releases fid. Panic on error.
+func (c *DotlClient) MustClunk(fid uint32) {
+	c.MustRPC(120, NewDotlMsg().U32(fid))
+}
+
+// ReaddirNames returns the entry names from an Rreaddir response.
+func ReaddirNames(r *DotlResp) []string {
+	var a []string
+	for r.U32(); len(r.buf) > 0; {
+		r.Bytes(13) // qid
+		r.U64()     // offset
+		r.U8()      // type
+		a = append(a, r.Str())
+	}
+	return a
+}
+
+// DotlMsg represents a request body built field by field.
+type DotlMsg struct {
+	buf []byte
+}
+
+// NewDotlMsg returns an empty message body.
+func NewDotlMsg() *DotlMsg { return &DotlMsg{} }
+
+func (m *DotlMsg) U8(v uint8) *DotlMsg { m.buf = append(m.buf, v); return m }
+
+func (m *DotlMsg) U16(v uint16) *DotlMsg {
+	m.buf = append(m.buf, byte(v), byte(v>>8))
+	return m
+}
+
+func (m *DotlMsg) U32(v uint32) *DotlMsg {
+	m.buf = append(m.buf, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+	return m
+}
+
+func (m *DotlMsg) U64(v uint64) *DotlMsg { return m.U32(uint32(v)).U32(uint32(v >> 32)) }
+
+func (m *DotlMsg) Str(s string) *DotlMsg {
+	m.U16(uint16(len(s)))
+	m.buf = append(m.buf, s...)
+	return m
+}
+
+func (m *DotlMsg) Bytes(b []byte) *DotlMsg { m.buf = append(m.buf, b...); return m }
+
+// DotlResp represents a response body read field by field.
+type DotlResp struct {
+	buf []byte
+}
+
+func (r *DotlResp) U8() uint8 { return r.Bytes(1)[0] }
+
+func (r *DotlResp) U16() uint16 { return binary.LittleEndian.Uint16(r.Bytes(2)) }
+
+func (r *DotlResp) U32() uint32 { return binary.LittleEndian.Uint32(r.Bytes(4)) }
+
+func (r *DotlResp) U64() uint64 { return binary.LittleEndian.Uint64(r.Bytes(8)) }
+
+func (r *DotlResp) Str() string { return string(r.Bytes(int(r.U16()))) }
+
+func (r *DotlResp) Bytes(n int) []byte {
+	v := bytes.Repeat(r.buf[:n], 1)
+	r.buf = r.buf[n:]
+	return v
+}
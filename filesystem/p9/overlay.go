@@ -0,0 +1,499 @@
+package p9
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// overlay represents a private, writable layer over the served directory.
+//
+// Files are copied to the upper directory before they are changed and new
+// files are only created in the upper directory. Reads fall through to the
+// lower directory for paths that haven't been changed. Removed paths are
+// tracked as whiteouts which hide the lower path and everything beneath it.
+//
+// All paths passed to an overlay are absolute paths within the lower directory.
+type overlay struct {
+	mu        sync.Mutex
+	lower     string
+	upper     string
+	whiteouts map[string]struct{}
+}
+
+// newOverlay returns a new overlay of upper on top of lower.
+func newOverlay(lower, upper string) *overlay {
+	return &overlay{
+		lower:     lower,
+		upper:     upper,
+		whiteouts: make(map[string]struct{}),
+	}
+}
+
+// rel returns filename relative to the lower directory.
+// The lower directory itself is returned as a blank string.
+func (o *overlay) rel(filename string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(filename, o.lower), "/")
+}
+
+// realpath returns the path of filename in the layer it should be read from.
+// Hidden paths are returned in the upper directory so they are not found.
+func (o *overlay) realpath(filename string) string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.lookup(o.rel(filename))
+}
+
+func (o *overlay) lookup(rel string) string {
+	if _, err := os.Lstat(o.upper + rel); err == nil || o.hidden(rel) {
+		return o.upper + rel
+	}
+	return o.lower + rel
+}
+
+// hidden returns true if rel or one of its parents has been removed from the lower directory.
+func (o *overlay) hidden(rel string) bool {
+	for {
+		if _, ok := o.whiteouts[rel]; ok {
+			return true
+		} else if rel == "" {
+			return false
+		}
+		rel = parentRel(rel)
+	}
+}
+
+// readDir returns the merged entries of the directory at filename, sorted by name.
+func (o *overlay) readDir(filename string) ([]os.FileInfo, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.readDirRel(o.rel(filename))
+}
+
+func (o *overlay) readDirRel(rel string) ([]os.FileInfo, error) {
+	// Entries are merged by name. Upper entries take precedence.
+	m := make(map[string]os.FileInfo)
+	if !o.hidden(rel) {
+		fis, err := readDirIfExists(o.lower + rel)
+		if err != nil {
+			return nil, err
+		}
+		for _, fi := range fis {
+			if !o.hidden(rel + "/" + fi.Name()) {
+				m[fi.Name()] = fi
+			}
+		}
+	}
+
+	fis, err := readDirIfExists(o.upper + rel)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range fis {
+		m[fi.Name()] = fi
+	}
+
+	// Ensure the path is a directory in its current layer.
+	if st, err := os.Lstat(o.lookup(rel)); err != nil {
+		return nil, err
+	} else if !st.IsDir() {
+		return nil, syscall.ENOTDIR
+	}
+
+	a := make([]os.FileInfo, 0, len(m))
+	for _, fi := range m {
+		a = append(a, fi)
+	}
+	sort.Sort(fileInfos(a))
+	return a, nil
+}
+
+// copyUp copies filename to the upper directory, if it's not there already,
+// so that it can be changed. Parent directories are copied as well.
+// Returns the path of the copy.
+func (o *overlay) copyUp(filename string) (string, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.copyUpRel(o.rel(filename))
+}
+
+func (o *overlay) copyUpRel(rel string) (string, error) {
+	upper := o.upper + rel
+	if _, err := os.Lstat(upper); err == nil {
+		return upper, nil
+	} else if !os.IsNotExist(err) {
+		return "", err
+	} else if o.hidden(rel) {
+		return "", syscall.ENOENT
+	}
+
+	lower := o.lower + rel
+	st, err := os.Lstat(lower)
+	if err != nil {
+		return "", err
+	}
+
+	// Copy parent directories first. The upper directory itself is created on first use.
+	if rel != "" {
+		if _, err := o.copyUpRel(parentRel(rel)); err != nil {
+			return "", err
+		}
+	} else if err := os.MkdirAll(path.Dir(upper), 0777); err != nil {
+		return "", err
+	}
+
+	switch {
+	case st.IsDir():
+		err = os.Mkdir(upper, st.Mode().Perm())
+	case st.Mode()&os.ModeSymlink != 0:
+		var target string
+		if target, err = os.Readlink(lower); err == nil {
+			err = os.Symlink(target, upper)
+		}
+		return upper, err
+	case st.Mode().IsRegular():
+		err = copyFile(lower, upper, st.Mode().Perm())
+	default:
+		return "", syscall.ENOTSUP
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// Retain the modification time so the copy is not seen as changed.
+	if err := os.Chtimes(upper, time.Now(), st.ModTime()); err != nil {
+		return "", err
+	}
+	return upper, nil
+}
+
+// copyUpTree copies the file or directory tree at rel to the upper directory.
+func (o *overlay) copyUpTree(rel string) (string, error) {
+	upper, err := o.copyUpRel(rel)
+	if err != nil {
+		return "", err
+	} else if st, err := os.Lstat(upper); err != nil {
+		return "", err
+	} else if !st.IsDir() {
+		return upper, nil
+	}
+
+	fis, err := o.readDirRel(rel)
+	if err != nil {
+		return "", err
+	}
+	for _, fi := range fis {
+		if _, err := o.copyUpTree(rel + "/" + fi.Name()); err != nil {
+			return "", err
+		}
+	}
+	return upper, nil
+}
+
+// prepare returns the path in the upper directory where filename can be created.
+// Existing files are copied so that the caller can open or replace them.
+func (o *overlay) prepare(filename string) (string, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	rel := o.rel(filename)
+	if _, err := os.Lstat(o.lookup(rel)); err == nil {
+		return o.copyUpRel(rel)
+	}
+
+	if _, err := o.copyUpRel(parentRel(rel)); err != nil {
+		return "", err
+	}
+	return o.upper + rel, nil
+}
+
+// remove removes filename from the overlay. Directories must be empty.
+func (o *overlay) remove(filename string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	rel := o.rel(filename)
+	st, err := os.Lstat(o.lookup(rel))
+	if err != nil {
+		return err
+	}
+
+	// Directories in the upper layer may be empty while the lower one is not.
+	if st.IsDir() {
+		if fis, err := o.readDirRel(rel); err != nil {
+			return err
+		} else if len(fis) > 0 {
+			return syscall.ENOTEMPTY
+		}
+	}
+
+	if err := os.Remove(o.upper + rel); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	o.whiteouts[rel] = struct{}{}
+	return nil
+}
+
+// rename moves oldpath to newpath within the overlay.
+func (o *overlay) rename(oldpath, newpath string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	oldrel, newrel := o.rel(oldpath), o.rel(newpath)
+	if strings.HasPrefix(newrel, oldrel+"/") {
+		return syscall.EINVAL
+	}
+
+	// Copy the entire source tree since its lower contents are hidden after the move.
+	src, err := o.copyUpTree(oldrel)
+	if err != nil {
+		return err
+	}
+
+	// Directories can only replace empty directories.
+	if st, err := os.Lstat(o.lookup(newrel)); err == nil && st.IsDir() {
+		if fis, err := o.readDirRel(newrel); err != nil {
+			return err
+		} else if len(fis) > 0 {
+			return syscall.ENOTEMPTY
+		}
+	}
+
+	// Copy the destination so the rename fails the same way it would on the lower directory.
+	dst, err := o.copyUpRel(newrel)
+	if os.IsNotExist(err) {
+		if _, err := o.copyUpRel(parentRel(newrel)); err != nil {
+			return err
+		}
+		dst = o.upper + newrel
+	} else if err != nil {
+		return err
+	}
+
+	if err := os.Rename(src, dst); err != nil {
+		return err
+	}
+
+	// Hide the source and anything previously beneath the destination.
+	o.whiteouts[oldrel] = struct{}{}
+	o.whiteouts[newrel] = struct{}{}
+	return nil
+}
+
+// commit moves filename from the upper directory to the lower directory.
+// Files are replaced atomically. Directories that exist in both layers are
+// merged so that unchanged lower files are kept. Removed paths are deleted.
+//
+// A merged directory is not committed atomically. If an entry beneath it
+// fails, the entries committed before it are kept.
+func (o *overlay) commit(filename string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.commitRel(o.rel(filename))
+}
+
+func (o *overlay) commitRel(rel string) error {
+	upper, lower := o.upper+rel, o.lower+rel
+
+	st, err := os.Lstat(upper)
+	if os.IsNotExist(err) {
+		// Unchanged paths are ignored.
+		if !o.hidden(rel) {
+			return nil
+		}
+		return os.RemoveAll(lower)
+	} else if err != nil {
+		return err
+	}
+
+	// Merge directories that replaced nothing in the lower directory.
+	if lst, err := os.Lstat(lower); err == nil && lst.IsDir() && st.IsDir() && !o.hidden(rel) {
+		if err := os.Chmod(lower, st.Mode().Perm()); err != nil {
+			return err
+		}
+		return o.commitChildren(rel)
+	}
+
+	// Ensure the parent exists so the path can be moved into place.
+	if rel != "" {
+		if err := os.MkdirAll(path.Dir(lower), 0777); err != nil {
+			return err
+		}
+	}
+
+	// Files are replaced atomically by rename. Nothing can be renamed over a
+	// non-empty directory so, when the upper entry is a directory or replaces
+	// a hidden lower directory, the old path is moved aside first and
+	// restored if the new one can't be moved into place.
+	var old string
+	if lst, err := os.Lstat(lower); err == nil && (st.IsDir() || (lst.IsDir() && o.hidden(rel))) {
+		old = fmt.Sprintf("%s.%d.old", lower, time.Now().UnixNano())
+		if err := os.Rename(lower, old); err != nil {
+			return err
+		}
+	}
+	if err := move(upper, lower); err != nil {
+		if old != "" {
+			os.Rename(old, lower)
+		}
+		return err
+	} else if old != "" {
+		os.RemoveAll(old)
+	}
+
+	// The lower path now reflects the upper layer.
+	for w := range o.whiteouts {
+		if w == rel || strings.HasPrefix(w, rel+"/") {
+			delete(o.whiteouts, w)
+		}
+	}
+	return nil
+}
+
+// commitChildren commits the changed entries beneath the directory at rel.
+func (o *overlay) commitChildren(rel string) error {
+	f, err := os.Open(o.upper + rel)
+	if err != nil {
+		return err
+	}
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	// Include removed entries which no longer exist in the upper directory.
+	for w := range o.whiteouts {
+		if w != "" && parentRel(w) == rel {
+			names = append(names, path.Base(w))
+		}
+	}
+
+	sort.Strings(names)
+	for i, name := range names {
+		if i > 0 && names[i-1] == name {
+			continue
+		} else if err := o.commitRel(rel + "/" + name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// move renames src to dst. The upper directory is usually on a different
+// device than the lower directory so, if a rename isn't possible, src is
+// copied next to dst and then renamed into place.
+func move(src, dst string) error {
+	err := rename(src, dst)
+	if e, ok := err.(*os.LinkError); !ok || e.Err != syscall.EXDEV {
+		return err
+	}
+
+	tmp := fmt.Sprintf("%s.%d.new", dst, time.Now().UnixNano())
+	if err := copyTree(src, tmp); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	} else if err := rename(tmp, dst); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	return os.RemoveAll(src)
+}
+
+// rename is used by move to rename files. Replaced by tests to simulate failures.
+var rename = os.Rename
+
+// copyTree copies the file, link or directory tree at src to a new path at dst.
+func copyTree(src, dst string) error {
+	st, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case st.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(target, dst)
+
+	case st.IsDir():
+		if err := os.Mkdir(dst, st.Mode().Perm()); err != nil {
+			return err
+		}
+
+		f, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		names, err := f.Readdirnames(-1)
+		f.Close()
+		if err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			if err := copyTree(path.Join(src, name), path.Join(dst, name)); err != nil {
+				return err
+			}
+		}
+		return os.Chmod(dst, st.Mode().Perm())
+
+	default:
+		return copyFile(src, dst, st.Mode().Perm())
+	}
+}
+
+// parentRel returns the parent of a relative overlay path.
+func parentRel(rel string) string {
+	if dir := path.Dir(rel); dir != "/" && dir != "." {
+		return dir
+	}
+	return ""
+}
+
+// copyFile copies the contents of src to a new file at dst.
+func copyFile(src, dst string, perm os.FileMode) error {
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	if _, err := io.Copy(w, r); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// readDirIfExists returns the entries of dir. Returns nil if dir doesn't exist.
+func readDirIfExists(dir string) ([]os.FileInfo, error) {
+	f, err := os.Open(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdir(-1)
+}
+
+// fileInfos represents a list of file info sortable by name.
+type fileInfos []os.FileInfo
+
+func (a fileInfos) Len() int           { return len(a) }
+func (a fileInfos) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a fileInfos) Less(i, j int) bool { return a[i].Name() < a[j].Name() }
@@ -0,0 +1,88 @@
+package p9
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// Ensure a directory is left unchanged if the upper layer can't be moved into place.
+func TestOverlay_Commit_MoveError(t *testing.T) {
+	base, err := ioutil.TempDir("", "p9-overlay-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+	lower, upper := filepath.Join(base, "lower"), filepath.Join(base, "upper")
+
+	for _, filename := range []string{filepath.Join(lower, "out", "keep"), filepath.Join(upper, "out", "new")} {
+		if err := os.MkdirAll(filepath.Dir(filename), 0777); err != nil {
+			t.Fatal(err)
+		} else if err := ioutil.WriteFile(filename, []byte("data"), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Simulate an upper layer on another device which fails to be copied into place.
+	defer func() { rename = os.Rename }()
+	rename = func(src, dst string) error {
+		if src == filepath.Join(upper, "out") {
+			return &os.LinkError{Op: "rename", Old: src, New: dst, Err: syscall.EXDEV}
+		}
+		return &os.LinkError{Op: "rename", Old: src, New: dst, Err: syscall.EIO}
+	}
+
+	o := newOverlay(lower, upper)
+	o.whiteouts["/out"] = struct{}{} // replace the lower directory instead of merging
+	if err := o.commit(filepath.Join(lower, "out")); err == nil {
+		t.Fatal("expected error")
+	}
+
+	// The original directory is restored and nothing is left behind.
+	if fis, err := ioutil.ReadDir(lower); err != nil {
+		t.Fatal(err)
+	} else if len(fis) != 1 || fis[0].Name() != "out" {
+		t.Fatalf("unexpected lower entries: %v", fis)
+	} else if buf, err := ioutil.ReadFile(filepath.Join(lower, "out", "keep")); err != nil || string(buf) != "data" {
+		t.Fatalf("unexpected original file: %q, %v", buf, err)
+	} else if fis, err := ioutil.ReadDir(filepath.Join(lower, "out")); err != nil || len(fis) != 1 {
+		t.Fatalf("unexpected entries: %v, %v", fis, err)
+	}
+}
+
+// Ensure a removed directory can be replaced by a file.
+func TestOverlay_Commit_ReplaceDirWithFile(t *testing.T) {
+	base, err := ioutil.TempDir("", "p9-overlay-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+	lower, upper := filepath.Join(base, "lower"), filepath.Join(base, "upper")
+
+	for _, filename := range []string{filepath.Join(lower, "out", "keep"), filepath.Join(upper, "out")} {
+		if err := os.MkdirAll(filepath.Dir(filename), 0777); err != nil {
+			t.Fatal(err)
+		} else if err := ioutil.WriteFile(filename, []byte("data"), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	o := newOverlay(lower, upper)
+	o.whiteouts["/out"] = struct{}{} // the directory was removed before the file was created
+	if err := o.commit(filepath.Join(lower, "out")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The file replaces the directory and nothing is left behind.
+	if fis, err := ioutil.ReadDir(lower); err != nil {
+		t.Fatal(err)
+	} else if len(fis) != 1 || fis[0].Name() != "out" || fis[0].IsDir() {
+		t.Fatalf("unexpected lower entries: %v", fis)
+	} else if buf, err := ioutil.ReadFile(filepath.Join(lower, "out")); err != nil || string(buf) != "data" {
+		t.Fatalf("unexpected file: %q, %v", buf, err)
+	} else if len(o.whiteouts) != 0 {
+		t.Fatalf("unexpected whiteouts: %v", o.whiteouts)
+	}
+}
@@ -3,6 +3,7 @@ package p9
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"os"
@@ -25,10 +26,41 @@ const Type = "9p"
 // DefaultAddr is the default address to listen on for the file system.
 const DefaultAddr = "127.0.0.1:0"
 
+// Protocol versions supported by the file system.
+const (
+	ProtocolDotU = "9P2000.u"
+	ProtocolDotL = "9P2000.L"
+)
+
+// DefaultProtocol is the protocol version served if one is not specified.
+const DefaultProtocol = ProtocolDotU
+
+// Transports used to connect the mount to the file system.
+const (
+	// Listens on Addr over TCP.
+	TransportTCP = "tcp"
+
+	// Listens on a unix socket in a directory only accessible by the current user.
+	TransportUnix = "unix"
+
+	// Serves a single connection over a socket pair. The client end is passed
+	// to the kernel on mount so no other process can connect.
+	TransportFD = "fd"
+)
+
+// DefaultTransport is the transport used if one is not specified.
+const DefaultTransport = TransportTCP
+
 func init() {
 	bake.RegisterFileSystem(Type, func(opt bake.FileSystemOptions) (bake.FileSystem, error) {
 		fs := NewFileSystem(opt.Path)
 		fs.MountPath = opt.MountPath
+		if opt.Protocol != "" {
+			fs.Protocol = opt.Protocol
+		}
+		if opt.Transport != "" {
+			fs.Transport = opt.Transport
+		}
 		return fs, nil
 	})
 }
@@ -39,6 +71,11 @@ type FileSystem struct {
 	srv go9p.Srv
 	ln  net.Listener
 
+	sockDir    string   // private directory for the unix transport
+	overlayDir string   // private directory holding the upper layer of each root
+	conn       net.Conn // server end of the fd transport
+	clientFile *os.File // client end of the fd transport
+
 	path string // Directory to serve
 
 	// Copies of the root path.
@@ -46,6 +83,12 @@ type FileSystem struct {
 	roots      map[string]*FileSystemRoot
 	nextRootID int
 
+	// Open 9P2000.L connections. Handles are closed when their root is released.
+	conns map[*dotlConn]struct{}
+
+	// Byte-range locks held by 9P2000.L clients.
+	locks *lockTable
+
 	closing chan struct{}
 	wg      sync.WaitGroup
 
@@ -53,6 +96,13 @@ type FileSystem struct {
 
 	// Directory to mount to.
 	MountPath string
+
+	// Protocol version to serve. Either ProtocolDotU or ProtocolDotL.
+	Protocol string
+
+	// Transport used to connect to the file system.
+	// Either TransportTCP, TransportUnix or TransportFD.
+	Transport string
 }
 
 // NewFileSystem returns a new instance of FileSystem.
@@ -66,15 +116,73 @@ func NewFileSystem(path string) *FileSystem {
 
 		path:    path,
 		roots:   make(map[string]*FileSystemRoot),
+		conns:   make(map[*dotlConn]struct{}),
+		locks:   newLockTable(),
 		closing: make(chan struct{}),
 
-		Addr: DefaultAddr,
+		Addr:      DefaultAddr,
+		Protocol:  DefaultProtocol,
+		Transport: DefaultTransport,
 	}
 }
 
 func (fs *FileSystem) Open() error {
+	// Validate options before listening.
+	if fs.Protocol != ProtocolDotU && fs.Protocol != ProtocolDotL {
+		return fmt.Errorf("unsupported protocol: %s", fs.Protocol)
+	} else if fs.Transport != TransportTCP && fs.Transport != TransportUnix && fs.Transport != TransportFD {
+		return fmt.Errorf("unsupported transport: %s", fs.Transport)
+	}
+
+	// Keep the private layers of roots outside the served path so they aren't
+	// seen by the project and aren't shared with other processes.
+	dir, err := ioutil.TempDir("", "bake-roots-")
+	if err != nil {
+		return err
+	}
+	fs.overlayDir = dir
+
+	// Attach filesystem to 9p server. 9P2000.L connections are served directly.
+	// This only panics if fs doesn't implement go9p.SrvReqOps.
+	if fs.Protocol == ProtocolDotU && !fs.srv.Start((*fileSystem)(fs)) {
+		panic("could not start file system")
+	}
+
+	// Begin serving connections.
+	if fs.Transport == TransportFD {
+		if err := fs.openSocketpair(); err != nil {
+			return err
+		}
+	} else if err := fs.listen(); err != nil {
+		return err
+	}
+
+	// Mount to mount path.
+	if fs.MountPath != "" {
+		if err := fs.mount(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// listen opens a listener for the tcp or unix transport and begins serving connections.
+func (fs *FileSystem) listen() error {
+	network, addr := "tcp", fs.Addr
+
+	// Create the socket in a new directory that only the current user can access.
+	if fs.Transport == TransportUnix {
+		dir, err := ioutil.TempDir("", "bake-9p-")
+		if err != nil {
+			return err
+		}
+		fs.sockDir = dir
+		network, addr = "unix", path.Join(dir, "9p.sock")
+	}
+
 	// Listen to bind address.
-	ln, err := net.Listen("tcp", fs.Addr)
+	ln, err := net.Listen(network, addr)
 	if err != nil {
 		return err
 	}
@@ -89,19 +197,30 @@ func (fs *FileSystem) Open() error {
 		}
 	}()
 
-	// Attach filesystem to 9p server.
-	// This only panics if fs doesn't implement go9p.SrvReqOps.
-	if !fs.srv.Start((*fileSystem)(fs)) {
-		panic("could not start file system")
+	return nil
+}
+
+// openSocketpair creates a connected pair of sockets for the fd transport and
+// begins serving the server end.
+func (fs *FileSystem) openSocketpair() error {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return err
 	}
+	fs.clientFile = os.NewFile(uintptr(fds[1]), "9p-client")
 
-	// Mount to mount path.
-	if fs.MountPath != "" {
-		if err := fs.mount(); err != nil {
-			return err
-		}
+	// Convert server end to a connection. This duplicates the descriptor.
+	f := os.NewFile(uintptr(fds[0]), "9p-server")
+	defer f.Close()
+
+	conn, err := net.FileConn(f)
+	if err != nil {
+		fs.clientFile.Close()
+		return err
 	}
+	fs.conn = conn
 
+	fs.serveConn(conn)
 	return nil
 }
 
@@ -114,6 +233,20 @@ func (fs *FileSystem) Close() error {
 	if fs.ln != nil {
 		fs.ln.Close()
 	}
+	if fs.sockDir != "" {
+		os.RemoveAll(fs.sockDir)
+	}
+	if fs.conn != nil {
+		fs.conn.Close()
+	}
+	if fs.clientFile != nil {
+		fs.clientFile.Close()
+	}
+
+	// Discard uncommitted changes.
+	if fs.overlayDir != "" {
+		os.RemoveAll(fs.overlayDir)
+	}
 
 	// Notify goroutines of closing and wait.
 	close(fs.closing)
@@ -126,8 +259,13 @@ func (fs *FileSystem) Close() error {
 func (fs *FileSystem) Path() string { return fs.path }
 
 // Listener returns the underlying listener. Available after Open().
+// Returns nil when using the fd transport.
 func (fs *FileSystem) Listener() net.Listener { return fs.ln }
 
+// ClientFile returns the client end of the fd transport. Available after Open().
+// This is passed to the kernel on mount. Returns nil for other transports.
+func (fs *FileSystem) ClientFile() *os.File { return fs.clientFile }
+
 // serve accepts and handles connections from the listener.
 func (fs *FileSystem) serve() error {
 	for {
@@ -135,12 +273,27 @@ func (fs *FileSystem) serve() error {
 		if err != nil {
 			return err
 		}
-		fs.srv.NewConn(c)
+		fs.serveConn(c)
+	}
+}
+
+// serveConn begins handling requests from c in the background.
+func (fs *FileSystem) serveConn(c net.Conn) {
+	if fs.Protocol == ProtocolDotL {
+		conn := newDotlConn((*fileSystem)(fs), c)
+		fs.mu.Lock()
+		fs.conns[conn] = struct{}{}
+		fs.mu.Unlock()
+		go conn.serve()
+		return
 	}
+	fs.srv.NewConn(c)
 }
 
 // CreateRoot returns a new copy of the root path of the file system.
-func (fs *FileSystem) CreateRoot() bake.FileSystemRoot {
+// Writes through the root are restricted to the paths allowed by policy.
+// Changes are made to a private layer until they are committed.
+func (fs *FileSystem) CreateRoot(target string, policy *bake.WritePolicy) bake.FileSystemRoot {
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 
@@ -150,6 +303,16 @@ func (fs *FileSystem) CreateRoot() bake.FileSystemRoot {
 
 	// Create root and add it to map.
 	root := NewFileSystemRoot(id, path.Join(fs.MountPath, id))
+	root.fs = fs
+	root.target = target
+	root.policy = policy
+	root.overlay = newOverlay(fs.path, path.Join(fs.overlayDir, id))
+
+	// Roots in use at the same time can conflict with each other.
+	for _, other := range fs.roots {
+		root.addPeer(other)
+		other.addPeer(root)
+	}
 	fs.roots[id] = root
 
 	return root
@@ -162,6 +325,47 @@ func (fs *FileSystem) Root(id string) *FileSystemRoot {
 	return fs.roots[id]
 }
 
+// Roots returns all roots that have not been released, sorted by id.
+func (fs *FileSystem) Roots() []*FileSystemRoot {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	a := make([]*FileSystemRoot, 0, len(fs.roots))
+	for _, root := range fs.roots {
+		a = append(a, root)
+	}
+	sort.Sort(roots(a))
+	return a
+}
+
+// releaseRoot removes root from the file system, closes its handles and
+// discards its uncommitted changes.
+func (fs *FileSystem) releaseRoot(root *FileSystemRoot) {
+	fs.mu.Lock()
+	delete(fs.roots, root.id)
+	conns := make([]*dotlConn, 0, len(fs.conns))
+	for c := range fs.conns {
+		conns = append(conns, c)
+	}
+	fs.mu.Unlock()
+
+	// Replace the root in its peers with a record of the paths it changed.
+	writes := root.writes()
+	for _, peer := range root.dropPeers() {
+		peer.removePeer(root, writes)
+	}
+
+	// Close handles after the root is removed so they can't be used to make changes.
+	for _, c := range conns {
+		c.releaseRoot(root.id)
+	}
+	root.closeHandles()
+
+	if root.overlay != nil {
+		os.RemoveAll(root.overlay.upper)
+	}
+}
+
 // Ensure fileSystem implements go9p.SrvReqOps.
 var _ go9p.SrvReqOps = (*fileSystem)(nil)
 
@@ -177,13 +381,306 @@ func (fs *fileSystem) addToReadset(rootID, filename string) {
 	root.AddToReadset(strings.TrimPrefix(filename, fs.path))
 }
 
-// addToWriteset adds s to the writeset.
-func (fs *fileSystem) addToWriteset(rootID, filename string) {
+// addToStatset adds s to the statset.
+func (fs *fileSystem) addToStatset(rootID, filename string) {
+	root := (*FileSystem)(fs).Root(rootID)
+	if root == nil {
+		return
+	}
+	root.AddToStatset(strings.TrimPrefix(filename, fs.path))
+}
+
+// addToListset adds s to the listset.
+func (fs *fileSystem) addToListset(rootID, filename string) {
 	root := (*FileSystem)(fs).Root(rootID)
 	if root == nil {
 		return
 	}
-	root.AddToWriteset(strings.TrimPrefix(filename, fs.path))
+	root.AddToListset(strings.TrimPrefix(filename, fs.path))
+}
+
+// addToMissset adds s to the missset.
+func (fs *fileSystem) addToMissset(rootID, filename string) {
+	root := (*FileSystem)(fs).Root(rootID)
+	if root == nil {
+		return
+	}
+	root.AddToMissset(strings.TrimPrefix(filename, fs.path))
+}
+
+// addToWriteset records a change of type op to filename in the writeset.
+func (fs *fileSystem) addToWriteset(rootID, filename string, op bake.WriteOp) {
+	root := (*FileSystem)(fs).Root(rootID)
+	if root == nil {
+		return
+	}
+	s := strings.TrimPrefix(filename, fs.path)
+	root.AddToWriteset(s, op)
+	root.checkConflict(s)
+}
+
+// addRenameToWriteset records a move from oldpath to newpath in the writeset.
+// replaced should be true if newpath existed before the rename.
+func (fs *fileSystem) addRenameToWriteset(rootID, oldpath, newpath string, replaced bool) {
+	root := (*FileSystem)(fs).Root(rootID)
+	if root == nil {
+		return
+	}
+	oldpath, newpath = strings.TrimPrefix(oldpath, fs.path), strings.TrimPrefix(newpath, fs.path)
+	root.AddRenameToWriteset(oldpath, newpath, replaced)
+	root.checkConflict(oldpath)
+	root.checkConflict(newpath)
+}
+
+// overlay returns the private layer of a root. Returns nil if the root has none.
+// Returns ENOENT if the root has been released.
+func (fs *fileSystem) overlay(rootID string) (*overlay, error) {
+	if rootID == "" {
+		return nil, nil
+	}
+
+	root := (*FileSystem)(fs).Root(rootID)
+	if root == nil {
+		return nil, syscall.ENOENT
+	}
+	return root.overlay, nil
+}
+
+// realpath returns the path that filename should be read from.
+func (fs *fileSystem) realpath(rootID, filename string) string {
+	if o, _ := fs.overlay(rootID); o != nil {
+		return o.realpath(filename)
+	}
+	return filename
+}
+
+// copyUp returns the path that filename should be changed at.
+// The file is copied to the root's private layer, if necessary.
+func (fs *fileSystem) copyUp(rootID, filename string) (string, error) {
+	if o, err := fs.overlay(rootID); err != nil {
+		return "", err
+	} else if o != nil {
+		return o.copyUp(filename)
+	}
+	return filename, nil
+}
+
+// prepare returns the path that filename should be created at.
+func (fs *fileSystem) prepare(rootID, filename string) (string, error) {
+	if o, err := fs.overlay(rootID); err != nil {
+		return "", err
+	} else if o != nil {
+		return o.prepare(filename)
+	}
+	return filename, nil
+}
+
+// stat updates the file info of a handle.
+// Returns ENOENT if the handle's root has been released.
+func (fs *fileSystem) stat(aux *Aux) error {
+	if _, err := fs.overlay(aux.rootID); err != nil {
+		return err
+	}
+
+	st, err := os.Lstat(fs.realpath(aux.rootID, aux.path))
+	if err != nil {
+		return err
+	}
+	aux.st = st
+	return nil
+}
+
+// openFile opens filename from the layer it should be read from.
+// Files opened for writing are copied to the root's private layer first.
+func (fs *fileSystem) openFile(rootID, filename string, flag int, perm os.FileMode) (*os.File, error) {
+	name := fs.realpath(rootID, filename)
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_TRUNC|os.O_APPEND|os.O_CREATE) != 0 {
+		var err error
+		if flag&os.O_CREATE != 0 {
+			name, err = fs.prepare(rootID, filename)
+		} else {
+			name, err = fs.copyUp(rootID, filename)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return os.OpenFile(name, flag, perm)
+}
+
+// listDir returns the entries of the directory at filename, sorted by name.
+func (fs *fileSystem) listDir(rootID, filename string) ([]os.FileInfo, error) {
+	if o, err := fs.overlay(rootID); err != nil {
+		return nil, err
+	} else if o != nil {
+		return o.readDir(filename)
+	}
+	return ioutil.ReadDir(filename)
+}
+
+// checkWrite returns EPERM if the root's write policy does not allow filename
+// to be changed. Denied paths are added to the deniedset.
+func (fs *fileSystem) checkWrite(rootID, filename string) error {
+	return fs.checkPolicy(rootID, filename, (*bake.WritePolicy).Allowed)
+}
+
+// checkMkdir returns EPERM if the root's write policy does not allow a
+// directory to be created at filename. Denied paths are added to the deniedset.
+func (fs *fileSystem) checkMkdir(rootID, filename string) error {
+	return fs.checkPolicy(rootID, filename, (*bake.WritePolicy).AllowedDir)
+}
+
+func (fs *fileSystem) checkPolicy(rootID, filename string, allowed func(*bake.WritePolicy, string) bool) error {
+	root := (*FileSystem)(fs).Root(rootID)
+	if root == nil {
+		return nil
+	}
+
+	// Paths created through the root, and new temporary files allowed by
+	// the policy, can also be changed.
+	s := strings.TrimPrefix(filename, fs.path)
+	if allowed(root.policy, s) || root.created(s) {
+		return nil
+	} else if root.policy.AllowedTemp(s) {
+		if _, err := os.Lstat(fs.realpath(rootID, filename)); os.IsNotExist(err) {
+			return nil
+		}
+	}
+	root.AddToDeniedset(s)
+	return syscall.EPERM
+}
+
+// walk returns a handle for the path found by walking names from aux and the
+// qid of each path segment found. Lookups of missing files are added to the missset.
+// Returns ENOENT if the first name cannot be found.
+func (fs *fileSystem) walk(aux *Aux, names []string) (*Aux, []go9p.Qid, error) {
+	naux := &Aux{rootID: aux.rootID, path: aux.path}
+	wqids := make([]go9p.Qid, 0, len(names))
+
+	for i, name := range names {
+		// If we have no root then the first segment is the root ID.
+		if naux.rootID == "" {
+			naux.rootID = name
+			if root := (*FileSystem)(fs).Root(naux.rootID); root == nil {
+				return nil, nil, syscall.ENOENT
+			}
+			wqids = append(wqids, *newRootQid(naux.rootID))
+			continue
+		}
+
+		// Otherwise we're already walking a root so continue to traverse the files.
+		// Parent lookups cannot move above the served path.
+		if name != ".." {
+			if err := checkName(name); err != nil {
+				return nil, nil, err
+			}
+		}
+		p := naux.path + "/" + name
+		if name == ".." {
+			if p = path.Dir(naux.path); len(p) < len(fs.path) {
+				p = fs.path
+			}
+		}
+
+		// Record lookups of files that don't exist so their creation can be detected.
+		st, err := os.Lstat(fs.realpath(naux.rootID, p))
+		if err != nil {
+			if os.IsNotExist(err) {
+				fs.addToMissset(naux.rootID, p)
+			}
+			if i == 0 {
+				return nil, nil, syscall.ENOENT
+			}
+			break
+		}
+
+		wqids = append(wqids, *newQid(st))
+		naux.path = p
+	}
+
+	return naux, wqids, nil
+}
+
+// create calls fn with the path to create filename at and records the change
+// in the writeset. Files that already existed are recorded as modified.
+// Set dir if creating a directory.
+func (fs *fileSystem) create(rootID, filename string, dir bool, fn func(name string) error) error {
+	if dir {
+		if err := fs.checkMkdir(rootID, filename); err != nil {
+			return err
+		}
+	} else if err := fs.checkWrite(rootID, filename); err != nil {
+		return err
+	}
+
+	_, err := os.Lstat(fs.realpath(rootID, filename))
+	exists := err == nil
+
+	name, err := fs.prepare(rootID, filename)
+	if err != nil {
+		return err
+	} else if err := fn(name); err != nil {
+		return err
+	}
+
+	if exists {
+		fs.addToWriteset(rootID, filename, bake.WriteModify)
+	} else {
+		fs.addToWriteset(rootID, filename, bake.WriteCreate)
+	}
+	return nil
+}
+
+// rename moves oldpath to newpath and records the change in the writeset.
+func (fs *fileSystem) rename(rootID, oldpath, newpath string) error {
+	// Renaming to the same path is a no-op.
+	if oldpath == newpath {
+		return nil
+	}
+
+	// Both paths are changed by the rename.
+	if err := fs.checkWrite(rootID, oldpath); err != nil {
+		return err
+	} else if err := fs.checkWrite(rootID, newpath); err != nil {
+		return err
+	}
+
+	_, err := os.Lstat(fs.realpath(rootID, newpath))
+	replaced := err == nil
+
+	if o, oerr := fs.overlay(rootID); oerr != nil {
+		err = oerr
+	} else if o != nil {
+		err = o.rename(oldpath, newpath)
+	} else {
+		err = os.Rename(oldpath, newpath)
+	}
+	if err != nil {
+		return err
+	}
+	fs.addRenameToWriteset(rootID, oldpath, newpath, replaced)
+	return nil
+}
+
+// remove deletes filename and records the removal in the writeset.
+func (fs *fileSystem) remove(rootID, filename string) error {
+	if err := fs.checkWrite(rootID, filename); err != nil {
+		return err
+	}
+
+	o, err := fs.overlay(rootID)
+	if err != nil {
+		return err
+	} else if o != nil {
+		err = o.remove(filename)
+	} else {
+		err = os.Remove(filename)
+	}
+	if err != nil {
+		return err
+	}
+	fs.addToWriteset(rootID, filename, bake.WriteRemove)
+	return nil
 }
 
 // split splits s into the root name and remaining filepath.
@@ -204,8 +701,8 @@ func (fs *fileSystem) Attach(req *go9p.SrvReq) {
 	}
 	req.Fid.Aux = aux
 
-	if err := aux.stat(); err != nil {
-		req.RespondError(err)
+	if err := fs.stat(aux); err != nil {
+		req.RespondError(toError(err))
 		return
 	}
 
@@ -217,49 +714,25 @@ func (fs *fileSystem) Flush(req *go9p.SrvReq) {}
 func (fs *fileSystem) Walk(req *go9p.SrvReq) {
 	// Stat the file.
 	aux := req.Fid.Aux.(*Aux)
-	if err := aux.stat(); err != nil {
-		req.RespondError(err)
+	if err := fs.stat(aux); err != nil {
+		req.RespondError(toError(err))
 		return
 	}
 
-	// Create a new file handle, if necessary.
-	if req.Newfid.Aux == nil {
-		req.Newfid.Aux = &Aux{rootID: aux.rootID}
+	naux, wqids, err := fs.walk(aux, req.Tc.Wname)
+	if err != nil {
+		req.RespondError(toError(err))
+		return
 	}
 
-	nfid := req.Newfid.Aux.(*Aux)
-	wqids := make([]go9p.Qid, 0, len(req.Tc.Wname))
-	newPath := aux.path
-
-	// Append actual files after the root.
-	for i, name := range req.Tc.Wname {
-		// If we have no root then the first segment is the root ID.
-		if nfid.rootID == "" {
-			nfid.rootID = name
-			if root := (*FileSystem)(fs).Root(nfid.rootID); root == nil {
-				req.RespondError(go9p.Enoent)
-				return
-			}
-			wqids = append(wqids, *newRootQid(nfid.rootID))
-			continue
-		}
-
-		// Otherwise we're already walking a root so continue to traverse the files.
-		p := newPath + "/" + name
-		st, err := os.Lstat(p)
-		if err != nil {
-			if i == 0 {
-				req.RespondError(go9p.Enoent)
-				return
-			}
-			break
-		}
-
-		wqids = append(wqids, *newQid(st))
-		newPath = p
+	// Create a new file handle, if necessary.
+	if req.Newfid.Aux == nil {
+		req.Newfid.Aux = naux
+	} else {
+		nfid := req.Newfid.Aux.(*Aux)
+		nfid.rootID, nfid.path = naux.rootID, naux.path
 	}
 
-	nfid.path = newPath
 	req.RespondRwalk(wqids)
 }
 
@@ -267,27 +740,41 @@ func (fs *fileSystem) Walk(req *go9p.SrvReq) {
 func (fs *fileSystem) Open(req *go9p.SrvReq) {
 	// Stat file handle.
 	aux := req.Fid.Aux.(*Aux)
-	if err := aux.stat(); err != nil {
-		req.RespondError(err)
+	if err := fs.stat(aux); err != nil {
+		req.RespondError(toError(err))
 		return
 	}
 
+	// Ensure the file can be changed if opening for write.
+	if req.Tc.Mode&3 == go9p.OWRITE || req.Tc.Mode&3 == go9p.ORDWR || req.Tc.Mode&go9p.OTRUNC != 0 {
+		if err := fs.checkWrite(aux.rootID, aux.path); err != nil {
+			req.RespondError(toError(err))
+			return
+		}
+	}
+
 	// Open local file handle.
-	file, err := os.OpenFile(aux.path, omode2uflags(req.Tc.Mode), 0)
+	file, err := fs.openFile(aux.rootID, aux.path, omode2uflags(req.Tc.Mode), 0)
 	if err != nil {
 		req.RespondError(toError(err))
 		return
 	}
 	aux.file = file
+	fs.addHandle(aux)
 
-	// Add to appropriate set.
-	if req.Tc.Mode&go9p.OREAD != 0 {
-		fs.addToReadset(aux.rootID, aux.path)
-	} else if req.Tc.Mode&go9p.OWRITE != 0 {
-		fs.addToWriteset(aux.rootID, aux.path)
-	} else if req.Tc.Mode&go9p.ORDWR != 0 {
+	// Add to appropriate set. Directory listings are tracked when read.
+	switch req.Tc.Mode & 3 {
+	case go9p.OREAD, go9p.OEXEC:
+		if !aux.st.IsDir() {
+			fs.addToReadset(aux.rootID, aux.path)
+		}
+	case go9p.ORDWR:
 		fs.addToReadset(aux.rootID, aux.path)
-		fs.addToWriteset(aux.rootID, aux.path)
+	}
+
+	// Opening with truncation modifies the file even if it's never written.
+	if req.Tc.Mode&go9p.OTRUNC != 0 {
+		fs.addToWriteset(aux.rootID, aux.path, bake.WriteModify)
 	}
 
 	req.RespondRopen(aux.qid(), 0)
@@ -296,24 +783,51 @@ func (fs *fileSystem) Open(req *go9p.SrvReq) {
 // Create creates a new file.
 func (fs *fileSystem) Create(req *go9p.SrvReq) {
 	aux := req.Fid.Aux.(*Aux)
-	if err := aux.stat(); err != nil {
-		req.RespondError(err)
+	if err := fs.stat(aux); err != nil {
+		req.RespondError(toError(err))
 		return
 	}
 
+	if err := checkName(req.Tc.Name); err != nil {
+		req.RespondError(toError(err))
+		return
+	}
 	path := aux.path + "/" + req.Tc.Name
 
-	var file *os.File
+	// Ensure the write policy allows the file to be created.
 	var err error
+	if req.Tc.Perm&go9p.DMDIR != 0 {
+		err = fs.checkMkdir(aux.rootID, path)
+	} else {
+		err = fs.checkWrite(aux.rootID, path)
+	}
+	if err != nil {
+		req.RespondError(toError(err))
+		return
+	}
+
+	// Determine if the file already exists so it's not recorded as new.
+	_, err = os.Lstat(fs.realpath(aux.rootID, path))
+	exists := err == nil
+
+	// Files are created in the root's private layer.
+	name, err := fs.prepare(aux.rootID, path)
+	if err != nil {
+		req.RespondError(toError(err))
+		return
+	}
+
+	var file *os.File
 	switch {
 	case req.Tc.Perm&go9p.DMDIR != 0:
-		err = os.Mkdir(path, os.FileMode(req.Tc.Perm&0777))
+		err = os.Mkdir(name, os.FileMode(req.Tc.Perm&0777))
 
 	case req.Tc.Perm&go9p.DMSYMLINK != 0:
-		err = os.Symlink(req.Tc.Ext, path)
+		err = os.Symlink(req.Tc.Ext, name)
 
 	case req.Tc.Perm&go9p.DMLINK != 0:
-		n, err := strconv.ParseUint(req.Tc.Ext, 10, 0)
+		var n uint64
+		n, err = strconv.ParseUint(req.Tc.Ext, 10, 0)
 		if err != nil {
 			break
 		}
@@ -324,7 +838,11 @@ func (fs *fileSystem) Create(req *go9p.SrvReq) {
 			return
 		}
 
-		err = os.Link(ofid.Aux.(*Aux).path, path)
+		var src string
+		oaux := ofid.Aux.(*Aux)
+		if src, err = fs.copyUp(oaux.rootID, oaux.path); err == nil {
+			err = os.Link(src, name)
+		}
 		ofid.DecRef()
 
 	case req.Tc.Perm&go9p.DMNAMEDPIPE != 0:
@@ -342,11 +860,12 @@ func (fs *fileSystem) Create(req *go9p.SrvReq) {
 				mode |= syscall.S_ISGID
 			}
 		}
-		file, err = os.OpenFile(path, omode2uflags(req.Tc.Mode)|os.O_CREATE, os.FileMode(mode))
+		file, err = os.OpenFile(name, omode2uflags(req.Tc.Mode)|os.O_CREATE, os.FileMode(mode))
 	}
 
-	if file == nil && err == nil {
-		file, err = os.OpenFile(path, omode2uflags(req.Tc.Mode), 0)
+	// Symlinks are not opened since their target may not exist.
+	if file == nil && err == nil && req.Tc.Perm&go9p.DMSYMLINK == 0 {
+		file, err = os.OpenFile(name, omode2uflags(req.Tc.Mode), 0)
 	}
 
 	if err != nil {
@@ -356,12 +875,19 @@ func (fs *fileSystem) Create(req *go9p.SrvReq) {
 
 	aux.path = path
 	aux.file = file
+	if file != nil {
+		fs.addHandle(aux)
+	}
 
-	// Save file to writeset.
-	fs.addToWriteset(aux.rootID, path)
+	// Save file to writeset. Creating over an existing file truncates it.
+	if exists {
+		fs.addToWriteset(aux.rootID, path, bake.WriteModify)
+	} else {
+		fs.addToWriteset(aux.rootID, path, bake.WriteCreate)
+	}
 
-	if err := aux.stat(); err != nil {
-		req.RespondError(err)
+	if err := fs.stat(aux); err != nil {
+		req.RespondError(toError(err))
 		return
 	}
 
@@ -371,19 +897,19 @@ func (fs *fileSystem) Create(req *go9p.SrvReq) {
 // Read reads data from a file handle.
 func (fs *fileSystem) Read(req *go9p.SrvReq) {
 	aux := req.Fid.Aux.(*Aux)
-	if err := aux.stat(); err != nil {
-		req.RespondError(err)
+	if err := fs.stat(aux); err != nil {
+		req.RespondError(toError(err))
 		return
 	}
 
-	// Add to readset.
-	fs.addToReadset(aux.rootID, aux.path)
-
 	go9p.InitRread(req.Rc, req.Tc.Count)
 	if aux.st.IsDir() {
+		fs.addToListset(aux.rootID, aux.path)
 		fs.readDir(req)
 		return
 	}
+
+	fs.addToReadset(aux.rootID, aux.path)
 	fs.readFile(req)
 }
 
@@ -392,22 +918,13 @@ func (fs *fileSystem) readDir(req *go9p.SrvReq) {
 
 	var n int
 	if req.Tc.Offset == 0 {
-		// If we got here, it was open. Can't really seek
-		// in most cases, just close and reopen it.
-		aux.file.Close()
-
-		file, err := os.OpenFile(aux.path, omode2uflags(req.Fid.Omode), 0)
+		// Entries are read from both layers of the root so the
+		// open handle cannot be used.
+		dirs, err := fs.listDir(aux.rootID, aux.path)
 		if err != nil {
 			req.RespondError(toError(err))
 			return
 		}
-		aux.file = file
-
-		dirs, e := aux.file.Readdir(-1)
-		if e != nil {
-			req.RespondError(toError(e))
-			return
-		}
 		aux.dirs = dirs
 
 		aux.dirents = nil
@@ -457,13 +974,17 @@ func (fs *fileSystem) readFile(req *go9p.SrvReq) {
 // Write writes data to a file.
 func (fs *fileSystem) Write(req *go9p.SrvReq) {
 	aux := req.Fid.Aux.(*Aux)
-	if err := aux.stat(); err != nil {
-		req.RespondError(err)
+	if err := fs.stat(aux); err != nil {
+		req.RespondError(toError(err))
 		return
 	}
 
-	// Add to writeset.
-	fs.addToWriteset(aux.rootID, aux.path)
+	// Ensure the file can still be written and add to writeset.
+	if err := fs.checkWrite(aux.rootID, aux.path); err != nil {
+		req.RespondError(toError(err))
+		return
+	}
+	fs.addToWriteset(aux.rootID, aux.path, bake.WriteModify)
 
 	n, err := aux.file.WriteAt(req.Tc.Data, int64(req.Tc.Offset))
 	if err != nil {
@@ -478,15 +999,12 @@ func (fs *fileSystem) Clunk(req *go9p.SrvReq) { req.RespondRclunk() }
 
 func (fs *fileSystem) Remove(req *go9p.SrvReq) {
 	aux := req.Fid.Aux.(*Aux)
-	if err := aux.stat(); err != nil {
-		req.RespondError(err)
+	if err := fs.stat(aux); err != nil {
+		req.RespondError(toError(err))
 		return
 	}
 
-	// Add to writeset.
-	fs.addToWriteset(aux.rootID, aux.path)
-
-	if err := os.Remove(aux.path); err != nil {
+	if err := fs.remove(aux.rootID, aux.path); err != nil {
 		req.RespondError(toError(err))
 		return
 	}
@@ -496,11 +1014,14 @@ func (fs *fileSystem) Remove(req *go9p.SrvReq) {
 
 func (fs *fileSystem) Stat(req *go9p.SrvReq) {
 	aux := req.Fid.Aux.(*Aux)
-	if err := aux.stat(); err != nil {
-		req.RespondError(err)
+	if err := fs.stat(aux); err != nil {
+		req.RespondError(toError(err))
 		return
 	}
 
+	// Add to statset. This includes symlink targets which are returned by stat.
+	fs.addToStatset(aux.rootID, aux.path)
+
 	st, err := new9pDir(aux.path, aux.st, req.Conn.Dotu, req.Conn.Srv.Upool)
 	if st == nil {
 		req.RespondError(err)
@@ -513,15 +1034,28 @@ func (fs *fileSystem) Stat(req *go9p.SrvReq) {
 // Wstat updates file info.
 func (fs *fileSystem) Wstat(req *go9p.SrvReq) {
 	aux := req.Fid.Aux.(*Aux)
-	if err := aux.stat(); err != nil {
-		req.RespondError(err)
+	if err := fs.stat(aux); err != nil {
+		req.RespondError(toError(err))
 		return
 	}
 
-	// Add to writeset.
-	fs.addToWriteset(aux.rootID, aux.path)
-
+	// Ensure the file can be changed if any fields are set.
+	// Changes are made to a copy in the root's private layer.
 	dir := &req.Tc.Dir
+	filename := aux.path
+	if isWstatChange(dir, req.Conn.Dotu) {
+		if err := fs.checkWrite(aux.rootID, aux.path); err != nil {
+			req.RespondError(toError(err))
+			return
+		}
+
+		var err error
+		if filename, err = fs.copyUp(aux.rootID, aux.path); err != nil {
+			req.RespondError(toError(err))
+			return
+		}
+	}
+
 	if dir.Mode != 0xFFFFFFFF {
 		mode := dir.Mode & 0777
 		if req.Conn.Dotu {
@@ -533,11 +1067,12 @@ func (fs *fileSystem) Wstat(req *go9p.SrvReq) {
 			}
 		}
 
-		err := os.Chmod(aux.path, os.FileMode(mode))
+		err := os.Chmod(filename, os.FileMode(mode))
 		if err != nil {
 			req.RespondError(toError(err))
 			return
 		}
+		fs.addToWriteset(aux.rootID, aux.path, bake.WriteChmod)
 	}
 
 	uid, gid := go9p.NOUID, go9p.NOUID
@@ -563,39 +1098,38 @@ func (fs *fileSystem) Wstat(req *go9p.SrvReq) {
 	}
 
 	if uid != go9p.NOUID || gid != go9p.NOUID {
-		err := os.Chown(aux.path, int(uid), int(gid))
+		err := os.Chown(filename, int(uid), int(gid))
 		if err != nil {
 			req.RespondError(toError(err))
 			return
 		}
+		fs.addToWriteset(aux.rootID, aux.path, bake.WriteChmod)
 	}
 
 	if dir.Name != "" {
-		// if first char is / it is relative to root, else relative to cwd.
-		var destpath string
-		if dir.Name[0] == '/' {
-			destpath = path.Join(fs.path, dir.Name)
-			fmt.Printf("/ results in %s\n", destpath)
-		} else {
-			auxdir, _ := path.Split(aux.path)
-			destpath = path.Join(auxdir, dir.Name)
-			fmt.Printf("rel  results in %s\n", destpath)
+		// Renames stay within the file's directory.
+		if err := checkName(dir.Name); err != nil {
+			req.RespondError(toError(err))
+			return
 		}
-		err := syscall.Rename(aux.path, destpath)
-		fmt.Printf("rename %s to %s gets %v\n", aux.path, destpath, err)
-		if err != nil {
+		auxdir, _ := path.Split(aux.path)
+		destpath := path.Join(auxdir, dir.Name)
+
+		if err := fs.rename(aux.rootID, aux.path, destpath); err != nil {
 			req.RespondError(toError(err))
 			return
 		}
 		aux.path = destpath
+		filename = fs.realpath(aux.rootID, destpath)
 	}
 
 	// Set file size, if specified.
 	if dir.Length != 0xFFFFFFFFFFFFFFFF {
-		if err := os.Truncate(aux.path, int64(dir.Length)); err != nil {
+		if err := os.Truncate(filename, int64(dir.Length)); err != nil {
 			req.RespondError(toError(err))
 			return
 		}
+		fs.addToWriteset(aux.rootID, aux.path, bake.WriteModify)
 	}
 
 	// If either mtime or atime need to be changed, then we must change both.
@@ -606,7 +1140,7 @@ func (fs *fileSystem) Wstat(req *go9p.SrvReq) {
 		mtimeChanged := (dir.Mtime == ^uint32(0))
 		atimeChanged := (dir.Atime == ^uint32(0))
 		if mtimeChanged || atimeChanged {
-			st, err := os.Stat(aux.path)
+			st, err := os.Stat(filename)
 			if err != nil {
 				req.RespondError(toError(err))
 				return
@@ -614,23 +1148,56 @@ func (fs *fileSystem) Wstat(req *go9p.SrvReq) {
 				mtime = st.ModTime()
 			}
 		}
-		if err := os.Chtimes(aux.path, atime, mtime); err != nil {
+		if err := os.Chtimes(filename, atime, mtime); err != nil {
 			req.RespondError(toError(err))
 			return
 		}
+		fs.addToWriteset(aux.rootID, aux.path, bake.WriteChmod)
 	}
 
 	req.RespondRwstat()
 }
 
+// isWstatChange returns true if dir changes any file info.
+// Fields set to all ones are left unchanged.
+func isWstatChange(dir *go9p.Dir, dotu bool) bool {
+	if dir.Mode != 0xFFFFFFFF || dir.Name != "" || dir.Length != 0xFFFFFFFFFFFFFFFF {
+		return true
+	} else if dir.Mtime != ^uint32(0) || dir.Atime != ^uint32(0) {
+		return true
+	} else if dotu {
+		return dir.Uidnum != go9p.NOUID || dir.Gidnum != go9p.NOUID
+	}
+	return dir.Uid != "" || dir.Gid != ""
+}
+
 func (fs *fileSystem) FidDestroy(fid *go9p.SrvFid) {
 	if fid.Aux == nil {
 		return
 	} else if aux := fid.Aux.(*Aux); aux.file != nil {
+		fs.removeHandle(aux)
 		aux.file.Close()
 	}
 }
 
+// addHandle tracks an open handle so it can be closed when its root is released.
+func (fs *fileSystem) addHandle(aux *Aux) {
+	if root := (*FileSystem)(fs).Root(aux.rootID); root != nil {
+		root.mu.Lock()
+		root.handles[aux] = struct{}{}
+		root.mu.Unlock()
+	}
+}
+
+// removeHandle stops tracking a handle.
+func (fs *fileSystem) removeHandle(aux *Aux) {
+	if root := (*FileSystem)(fs).Root(aux.rootID); root != nil {
+		root.mu.Lock()
+		delete(root.handles, aux)
+		root.mu.Unlock()
+	}
+}
+
 // func (fs *fileSystem) ConnOpened(conn *go9p.Conn) { println("conn open") }
 // func (fs *fileSystem) ConnClosed(conn *go9p.Conn) { println("conn closed") }
 
@@ -638,20 +1205,53 @@ func (fs *fileSystem) FidDestroy(fid *go9p.SrvFid) {
 // This is used for tracking read and write access.
 type FileSystemRoot struct {
 	mu   sync.Mutex
+	fs   *FileSystem
 	id   string
 	path string
 
+	// Name of the target the root was created for. Used to report conflicts.
+	target string
+
 	readset  map[string]struct{}
-	writeset map[string]struct{}
+	statset  map[string]struct{}
+	listset  map[string]struct{}
+	missset  map[string]struct{}
+	writeset *bake.Writeset
+
+	// Paths that can be written. Attempts to write elsewhere are tracked in the deniedset.
+	policy    *bake.WritePolicy
+	deniedset map[string]struct{}
+
+	// Roots in use at the same time as this root. Paths written by both are
+	// tracked in the conflictset along with the other roots' targets. Peers
+	// that have been released are dropped and only the paths they changed
+	// are kept, so they can't keep the released root's state alive.
+	peers       map[*FileSystemRoot]struct{}
+	peerWrites  map[string]*peerWrite
+	conflictset map[string][]string
+
+	// Private layer that changes are made to until committed.
+	overlay *overlay
+
+	// Open 9P2000.u handles.
+	handles map[*Aux]struct{}
 }
 
 // NewFileSystemRoot returns a new filesystem root identified by id.
 func NewFileSystemRoot(id, path string) *FileSystemRoot {
 	return &FileSystemRoot{
-		id:       id,
-		path:     path,
-		readset:  make(map[string]struct{}),
-		writeset: make(map[string]struct{}),
+		id:          id,
+		path:        path,
+		readset:     make(map[string]struct{}),
+		statset:     make(map[string]struct{}),
+		listset:     make(map[string]struct{}),
+		missset:     make(map[string]struct{}),
+		writeset:    bake.NewWriteset(),
+		deniedset:   make(map[string]struct{}),
+		peers:       make(map[*FileSystemRoot]struct{}),
+		peerWrites:  make(map[string]*peerWrite),
+		conflictset: make(map[string][]string),
+		handles:     make(map[*Aux]struct{}),
 	}
 }
 
@@ -672,13 +1272,7 @@ func (r *FileSystemRoot) Readset() map[string]struct{} {
 func (r *FileSystemRoot) ReadsetSlice() []string {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-
-	a := make([]string, 0, len(r.readset))
-	for k := range r.readset {
-		a = append(a, k)
-	}
-	sort.Strings(a)
-	return a
+	return setSlice(r.readset)
 }
 
 // AddToReadset adds s to the root's readset.
@@ -688,33 +1282,320 @@ func (r *FileSystemRoot) AddToReadset(s string) {
 	r.readset[s] = struct{}{}
 }
 
-// Writeset returns a set of files that have been written to the file system.
+// Statset returns a set of files whose metadata has been read from the file system.
+func (r *FileSystemRoot) Statset() map[string]struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return copySet(r.statset)
+}
+
+// StatsetSlice returns a slice of files whose metadata has been read from the file system.
+func (r *FileSystemRoot) StatsetSlice() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return setSlice(r.statset)
+}
+
+// AddToStatset adds s to the root's statset.
+func (r *FileSystemRoot) AddToStatset(s string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.statset[s] = struct{}{}
+}
+
+// Listset returns a set of directories that have been listed from the file system.
+func (r *FileSystemRoot) Listset() map[string]struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return copySet(r.listset)
+}
+
+// ListsetSlice returns a slice of directories that have been listed from the file system.
+func (r *FileSystemRoot) ListsetSlice() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return setSlice(r.listset)
+}
+
+// AddToListset adds s to the root's listset.
+func (r *FileSystemRoot) AddToListset(s string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.listset[s] = struct{}{}
+}
+
+// Missset returns a set of paths that were looked up but did not exist.
+func (r *FileSystemRoot) Missset() map[string]struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return copySet(r.missset)
+}
+
+// MisssetSlice returns a slice of paths that were looked up but did not exist.
+func (r *FileSystemRoot) MisssetSlice() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return setSlice(r.missset)
+}
+
+// AddToMissset adds s to the root's missset.
+func (r *FileSystemRoot) AddToMissset(s string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.missset[s] = struct{}{}
+}
+
+// Writeset returns a set of paths that have been changed on the file system.
+// This includes paths that have been removed or renamed away.
 func (r *FileSystemRoot) Writeset() map[string]struct{} {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	return copySet(r.writeset)
+	return r.writeset.Paths()
 }
 
-// WritesetSlice returns a slice of files that have been written from the file system.
+// WritesetSlice returns a sorted slice of paths that have been changed on the file system.
 func (r *FileSystemRoot) WritesetSlice() []string {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	return setSlice(r.writeset.Paths())
+}
 
-	a := make([]string, 0, len(r.writeset))
-	for k := range r.writeset {
-		a = append(a, k)
+// Writes returns the net change to each path in the writeset, sorted by path.
+func (r *FileSystemRoot) Writes() []*bake.Write {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.writeset.Writes()
+}
+
+// AddToWriteset records a change of type op to s in the root's writeset.
+// Changes are merged with earlier changes to s so only the final effect is kept.
+// Renames must be recorded with AddRenameToWriteset().
+func (r *FileSystemRoot) AddToWriteset(s string, op bake.WriteOp) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.writeset.Add(s, op)
+}
+
+// AddRenameToWriteset records a move from oldpath to newpath in the root's writeset.
+// replaced should be true if newpath existed before the rename.
+func (r *FileSystemRoot) AddRenameToWriteset(oldpath, newpath string, replaced bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.writeset.AddRename(oldpath, newpath, replaced)
+}
+
+// Release removes the root from its file system. Any handles open on the
+// root are closed and uncommitted changes are discarded. The root's tracked
+// sets remain available after release.
+func (r *FileSystemRoot) Release() {
+	if r.fs != nil {
+		r.fs.releaseRoot(r)
 	}
-	sort.Strings(a)
-	return a
 }
 
-// AddToWriteset adds s to the root's writeset.
-func (r *FileSystemRoot) AddToWriteset(s string) {
+// closeHandles closes all open 9P2000.u handles on the root.
+func (r *FileSystemRoot) closeHandles() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for aux := range r.handles {
+		aux.file.Close()
+		delete(r.handles, aux)
+	}
+}
+
+// Commit moves changes to paths from the root's private layer to the served
+// directory. Paths are relative to the served directory. Files are replaced
+// atomically and removed paths are deleted. Other changes are not applied.
+//
+// Commit is not atomic across paths. If committing one path fails, the paths
+// committed before it are kept and the rest are left in the private layer.
+func (r *FileSystemRoot) Commit(paths []string) error {
+	if r.overlay == nil {
+		return nil
+	}
+
+	for _, p := range paths {
+		if err := r.overlay.commit(path.Join(r.overlay.lower, path.Clean("/"+p))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Deniedset returns a set of paths that could not be changed because of the root's write policy.
+func (r *FileSystemRoot) Deniedset() map[string]struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return copySet(r.deniedset)
+}
+
+// DeniedsetSlice returns a slice of paths that could not be changed because of the root's write policy.
+func (r *FileSystemRoot) DeniedsetSlice() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return setSlice(r.deniedset)
+}
+
+// AddToDeniedset adds s to the root's deniedset.
+func (r *FileSystemRoot) AddToDeniedset(s string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.deniedset[s] = struct{}{}
+}
+
+// Conflictset returns a set of paths that were also changed through another root in use at the same time.
+func (r *FileSystemRoot) Conflictset() map[string]struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m := make(map[string]struct{}, len(r.conflictset))
+	for s := range r.conflictset {
+		m[s] = struct{}{}
+	}
+	return m
+}
+
+// ConflictsetSlice returns a slice of paths that were also changed through another root in use at the same time.
+func (r *FileSystemRoot) ConflictsetSlice() []string {
+	return setSlice(r.Conflictset())
+}
+
+// ConflictTargets returns the sorted targets of the other roots that changed each path in the conflictset.
+func (r *FileSystemRoot) ConflictTargets() map[string][]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m := make(map[string][]string, len(r.conflictset))
+	for s, targets := range r.conflictset {
+		m[s] = append([]string(nil), targets...)
+	}
+	return m
+}
+
+// AddToConflictset adds s to the root's conflictset as also changed through a root for target.
+func (r *FileSystemRoot) AddToConflictset(s, target string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.conflictset[s] = insertSorted(r.conflictset[s], target)
+}
+
+// addPeer records that other was in use at the same time as the root.
+func (r *FileSystemRoot) addPeer(other *FileSystemRoot) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.peers[other] = struct{}{}
+}
+
+// peerWrite represents a path changed through peers that have been released.
+type peerWrite struct {
+	dir     bool     // true if the path was a directory in every peer
+	targets []string // targets of the peers, sorted
+}
+
+// removePeer replaces a released peer with the paths it changed.
+func (r *FileSystemRoot) removePeer(other *FileSystemRoot, writes map[string]bool) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	r.writeset[s] = struct{}{}
+	if _, ok := r.peers[other]; !ok {
+		return
+	}
+	delete(r.peers, other)
+
+	for s, dir := range writes {
+		// A path is only merged if it was a directory in every peer that changed it.
+		w := r.peerWrites[s]
+		if w == nil {
+			w = &peerWrite{dir: true}
+			r.peerWrites[s] = w
+		}
+		w.dir = w.dir && dir
+		w.targets = insertSorted(w.targets, other.target)
+	}
+}
+
+// dropPeers clears and returns the root's peers.
+func (r *FileSystemRoot) dropPeers() []*FileSystemRoot {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	peers := make([]*FileSystemRoot, 0, len(r.peers))
+	for peer := range r.peers {
+		peers = append(peers, peer)
+	}
+	r.peers = make(map[*FileSystemRoot]struct{})
+	return peers
+}
+
+// writes returns the paths in the root's writeset mapped to whether each is a directory.
+func (r *FileSystemRoot) writes() map[string]bool {
+	r.mu.Lock()
+	paths := r.writeset.Paths()
+	r.mu.Unlock()
+
+	m := make(map[string]bool, len(paths))
+	for s := range paths {
+		m[s] = r.isDir(s)
+	}
+	return m
+}
+
+// checkConflict adds s to the conflictset of the root and of any peer that also changed s.
+// Directories changed by both roots are not conflicts since they are merged
+// on commit.
+func (r *FileSystemRoot) checkConflict(s string) {
+	r.mu.Lock()
+	peers := make([]*FileSystemRoot, 0, len(r.peers))
+	for peer := range r.peers {
+		peers = append(peers, peer)
+	}
+	var released *peerWrite
+	if w := r.peerWrites[s]; w != nil {
+		released = &peerWrite{dir: w.dir, targets: append([]string(nil), w.targets...)}
+	}
+	r.mu.Unlock()
+
+	dir := r.isDir(s)
+	if released != nil && !(dir && released.dir) {
+		for _, target := range released.targets {
+			r.AddToConflictset(s, target)
+		}
+	}
+	for _, peer := range peers {
+		if !peer.changed(s) || (dir && peer.isDir(s)) {
+			continue
+		}
+		r.AddToConflictset(s, peer.target)
+		peer.AddToConflictset(s, r.target)
+	}
+}
+
+// created returns true if s, or a parent directory, was created through the root.
+func (r *FileSystemRoot) created(s string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.writeset.Created(s)
+}
+
+// changed returns true if s is in the root's writeset.
+func (r *FileSystemRoot) changed(s string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.writeset.Contains(s)
+}
+
+// isDir returns true if s is a directory as seen through the root.
+func (r *FileSystemRoot) isDir(s string) bool {
+	if r.overlay == nil {
+		return false
+	}
+	st, err := os.Lstat(r.overlay.realpath(r.overlay.lower + s))
+	return err == nil && st.IsDir()
 }
 
+// roots represents a list of roots sortable by id.
+type roots []*FileSystemRoot
+
+func (a roots) Len() int           { return len(a) }
+func (a roots) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a roots) Less(i, j int) bool { return a[i].id < a[j].id }
+
 // Aux represents auxillary data for 9p file handles.
 type Aux struct {
 	rootID     string
@@ -730,16 +1611,6 @@ type Aux struct {
 // qid returns an qid identifier for aux.
 func (aux Aux) qid() *go9p.Qid { return newQid(aux.st) }
 
-func (aux *Aux) stat() *go9p.Error {
-	st, err := os.Lstat(aux.path)
-	if err != nil {
-		return toError(err)
-	}
-	aux.st = st
-
-	return nil
-}
-
 func new9pDir(path string, fi os.FileInfo, dotu bool, upool go9p.Users) (*go9p.Dir, error) {
 	// Retrieve underlying stat_t implementation.
 	stat, _ := fi.Sys().(*syscall.Stat_t)
@@ -937,11 +1808,25 @@ func lookupGroup(uid string) (uint32, *go9p.Error) {
 }
 
 func toError(err error) *go9p.Error {
-	ecode := uint32(go9p.EIO)
-	if e, ok := err.(syscall.Errno); ok {
-		ecode = uint32(e)
+	return &go9p.Error{Err: err.Error(), Errornum: uint32(toErrno(err))}
+}
+
+// toErrno returns the underlying system error number of err. Returns EIO if unknown.
+func toErrno(err error) syscall.Errno {
+	switch err := err.(type) {
+	case syscall.Errno:
+		return err
+	case *go9p.Error:
+		return syscall.Errno(err.Errornum)
+	case *os.PathError:
+		return toErrno(err.Err)
+	case *os.LinkError:
+		return toErrno(err.Err)
+	case *os.SyscallError:
+		return toErrno(err.Err)
+	default:
+		return syscall.EIO
 	}
-	return &go9p.Error{Err: err.Error(), Errornum: ecode}
 }
 
 // isTemporary returns true if the error has an IsTemporary function that returns true.
@@ -954,6 +1839,37 @@ func isTemporary(err error) bool {
 	return false
 }
 
+// setSlice returns a sorted slice of the keys in m.
+func setSlice(m map[string]struct{}) []string {
+	a := make([]string, 0, len(m))
+	for k := range m {
+		a = append(a, k)
+	}
+	sort.Strings(a)
+	return a
+}
+
+// checkName returns EINVAL if name, sent by a client, is not a single path
+// element. Names must not be empty, "." or "..", or contain a slash.
+func checkName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return syscall.EINVAL
+	}
+	return nil
+}
+
+// insertSorted returns a with s inserted in sorted order, if not already present.
+func insertSorted(a []string, s string) []string {
+	i := sort.SearchStrings(a, s)
+	if i < len(a) && a[i] == s {
+		return a
+	}
+	a = append(a, "")
+	copy(a[i+1:], a[i:])
+	a[i] = s
+	return a
+}
+
 // copySet returns a copy of m.
 func copySet(m map[string]struct{}) map[string]struct{} {
 	other := make(map[string]struct{}, len(m))
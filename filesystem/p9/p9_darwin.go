@@ -1,9 +1,46 @@
 package p9
 
-import "errors"
+import (
+	"errors"
+	"syscall"
+)
 
 // Mount mounts fs to the target path.
 func (fs *FileSystem) mount() error { return errors.New("not implemented") }
 
 // Unmount removes the mount from the target path.
 func (fs *FileSystem) unmount() error { return errors.New("not implemented") }
+
+// statTimes returns the access, modification & change times from st.
+func statTimes(st *syscall.Stat_t) (atime, mtime, ctime syscall.Timespec) {
+	return st.Atimespec, st.Mtimespec, st.Ctimespec
+}
+
+// statfs returns file system statistics for the file system containing path.
+func statfs(path string) (*dotlStatfs, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return nil, err
+	}
+
+	return &dotlStatfs{
+		Type:    st.Type,
+		Bsize:   st.Bsize,
+		Blocks:  st.Blocks,
+		Bfree:   st.Bfree,
+		Bavail:  st.Bavail,
+		Files:   st.Files,
+		Ffree:   st.Ffree,
+		Fsid:    uint64(uint32(st.Fsid.Val[0])) | uint64(uint32(st.Fsid.Val[1]))<<32,
+		Namelen: 255,
+	}, nil
+}
+
+// mkdev returns a device number from its major & minor numbers.
+func mkdev(major, minor uint32) int { return int(major<<24 | minor&0xffffff) }
+
+// Extended attributes are not supported on darwin.
+func getxattr(path, name string) ([]byte, error)               { return nil, syscall.EOPNOTSUPP }
+func listxattr(path string) ([]byte, error)                    { return nil, nil }
+func setxattr(path, name string, data []byte, flags int) error { return syscall.EOPNOTSUPP }
+func removexattr(path, name string) error                      { return syscall.EOPNOTSUPP }
@@ -8,12 +8,103 @@ import (
 
 // mount mounts fs to the mount path.
 func (fs *FileSystem) mount() error {
-	addr := fs.Listener().Addr().(*net.TCPAddr)
-	println(addr.String(), "/", fs.MountPath, "/", "9p", "/", fmt.Sprintf("trans=tcp,port=%d", addr.Port))
-	return syscall.Mount(addr.IP.String(), fs.MountPath, "9p", 0, fmt.Sprintf("trans=tcp,port=%d", addr.Port))
+	source, opts := "bake", ""
+	switch fs.Transport {
+	case TransportUnix:
+		source, opts = fs.Listener().Addr().String(), "trans=unix"
+	case TransportFD:
+		fd := fs.ClientFile().Fd()
+		opts = fmt.Sprintf("trans=fd,rfdno=%d,wfdno=%d", fd, fd)
+	default:
+		addr := fs.Listener().Addr().(*net.TCPAddr)
+		source, opts = addr.IP.String(), fmt.Sprintf("trans=tcp,port=%d", addr.Port)
+	}
+	opts += ",version=" + mountVersion(fs.Protocol)
+
+	return syscall.Mount(source, fs.MountPath, "9p", 0, opts)
 }
 
 // unmount removes the mount from the mount path.
 func (fs *FileSystem) unmount() error {
 	return syscall.Unmount(fs.MountPath, 0)
 }
+
+// mountVersion returns the v9fs version option for a protocol.
+func mountVersion(protocol string) string {
+	if protocol == ProtocolDotL {
+		return "9p2000.L"
+	}
+	return "9p2000.u"
+}
+
+// statTimes returns the access, modification & change times from st.
+func statTimes(st *syscall.Stat_t) (atime, mtime, ctime syscall.Timespec) {
+	return st.Atim, st.Mtim, st.Ctim
+}
+
+// statfs returns file system statistics for the file system containing path.
+func statfs(path string) (*dotlStatfs, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return nil, err
+	}
+
+	return &dotlStatfs{
+		Type:    uint32(st.Type),
+		Bsize:   uint32(st.Bsize),
+		Blocks:  st.Blocks,
+		Bfree:   st.Bfree,
+		Bavail:  st.Bavail,
+		Files:   st.Files,
+		Ffree:   st.Ffree,
+		Fsid:    uint64(uint32(st.Fsid.X__val[0])) | uint64(uint32(st.Fsid.X__val[1]))<<32,
+		Namelen: uint32(st.Namelen),
+	}, nil
+}
+
+// mkdev returns a device number from its major & minor numbers.
+func mkdev(major, minor uint32) int {
+	dev := uint64(minor&0xff) | uint64(major&0xfff)<<8
+	dev |= uint64(minor&^0xff)<<12 | uint64(major&^0xfff)<<32
+	return int(dev)
+}
+
+// getxattr returns the value of the extended attribute name on path.
+func getxattr(path, name string) ([]byte, error) {
+	sz, err := syscall.Getxattr(path, name, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, sz)
+	n, err := syscall.Getxattr(path, name, buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// listxattr returns the NUL-separated names of the extended attributes on path.
+func listxattr(path string) ([]byte, error) {
+	sz, err := syscall.Listxattr(path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, sz)
+	n, err := syscall.Listxattr(path, buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// setxattr sets the extended attribute name on path.
+func setxattr(path, name string, data []byte, flags int) error {
+	return syscall.Setxattr(path, name, data, flags)
+}
+
+// removexattr removes the extended attribute name from path.
+func removexattr(path, name string) error {
+	return syscall.Removexattr(path, name)
+}
@@ -9,6 +9,7 @@ import (
 	"reflect"
 	"testing"
 
+	"github.com/flynn/bake"
 	"github.com/flynn/bake/filesystem/p9"
 	"github.com/rminnich/go9p"
 )
@@ -49,6 +50,84 @@ func TestFileSystem_Read(t *testing.T) {
 	}
 }
 
+// Ensure that a file's metadata can be read and tracked separately from its contents.
+func TestFileSystem_Stat(t *testing.T) {
+	fs := OpenFileSystem()
+	defer fs.Close()
+	c := MustMountFS(fs)
+	defer c.Unmount()
+	root := fs.CreateRoot()
+
+	fs.MustWriteFile("foo/bar", []byte{0, 1, 2, 3}, 0666)
+
+	// Stat file through 9p.
+	if d, err := c.FStat("/0000/foo/bar"); err != nil {
+		t.Fatal(err)
+	} else if d.Length != 4 {
+		t.Fatalf("unexpected length: %d", d.Length)
+	}
+
+	// Verify statset & readset.
+	if a := root.StatsetSlice(); !reflect.DeepEqual(a, []string{"/foo/bar"}) {
+		t.Fatalf("unexpected statset: %#v", a)
+	} else if a := root.ReadsetSlice(); len(a) != 0 {
+		t.Fatalf("unexpected readset: %#v", a)
+	}
+}
+
+// Ensure that a directory listing is tracked separately from file reads.
+func TestFileSystem_ReadDir(t *testing.T) {
+	fs := OpenFileSystem()
+	defer fs.Close()
+	c := MustMountFS(fs)
+	defer c.Unmount()
+	root := fs.CreateRoot()
+
+	fs.MustWriteFile("foo/bar", []byte{0}, 0666)
+	fs.MustWriteFile("foo/baz", []byte{0}, 0666)
+
+	// List directory through 9p.
+	f, err := c.FOpen("/0000/foo", go9p.OREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if a, err := f.Readdir(0); err != nil {
+		t.Fatal(err)
+	} else if len(a) != 2 {
+		t.Fatalf("unexpected entries: %d", len(a))
+	}
+
+	// Verify listset & readset.
+	if a := root.ListsetSlice(); !reflect.DeepEqual(a, []string{"/foo"}) {
+		t.Fatalf("unexpected listset: %#v", a)
+	} else if a := root.ReadsetSlice(); len(a) != 0 {
+		t.Fatalf("unexpected readset: %#v", a)
+	}
+}
+
+// Ensure that lookups of files that don't exist are tracked.
+func TestFileSystem_Walk_Missing(t *testing.T) {
+	fs := OpenFileSystem()
+	defer fs.Close()
+	c := MustMountFS(fs)
+	defer c.Unmount()
+	root := fs.CreateRoot()
+
+	fs.MustWriteFile("foo/bar", []byte{0}, 0666)
+
+	// Open a file that doesn't exist through 9p.
+	if _, err := c.FOpen("/0000/foo/no_such_file", go9p.OREAD); err == nil {
+		t.Fatal("expected error")
+	}
+
+	// Verify missset.
+	if a := root.MisssetSlice(); !reflect.DeepEqual(a, []string{"/foo/no_such_file"}) {
+		t.Fatalf("unexpected missset: %#v", a)
+	}
+}
+
 // Ensure that a file can be written and tracked.
 func TestFileSystem_Write(t *testing.T) {
 	fs := OpenFileSystem()
@@ -76,7 +155,8 @@ func TestFileSystem_Write(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	// Read local file.
+	// Commit and read local file.
+	root.MustCommit(root.WritesetSlice()...)
 	if buf, err := ioutil.ReadFile(filepath.Join(fs.Path(), "foo", "bar")); err != nil {
 		t.Fatal(err)
 	} else if !bytes.Equal(buf, []byte{0, 1, 2, 3}) {
@@ -108,6 +188,332 @@ func TestFileSystem_Remove(t *testing.T) {
 	// Verify writeset.
 	if ws := root.WritesetSlice(); !reflect.DeepEqual(ws, []string{"/foo/bar"}) {
 		t.Fatalf("unexpected writeset: %#v", ws)
+	} else if a := WriteStrings(root.Writes()); !reflect.DeepEqual(a, []string{"remove /foo/bar"}) {
+		t.Fatalf("unexpected writes: %#v", a)
+	}
+}
+
+// Ensure that a file created and then removed is not tracked.
+func TestFileSystem_Remove_Created(t *testing.T) {
+	fs := OpenFileSystem()
+	defer fs.Close()
+	c := MustMountFS(fs)
+	defer c.Unmount()
+	root := fs.CreateRoot()
+
+	fs.MustMkdir("foo")
+
+	// Create and remove a temporary file through 9p.
+	if f, err := c.FCreate("/0000/foo/tmp", 0666, go9p.OWRITE); err != nil {
+		t.Fatal(err)
+	} else if err := f.Close(); err != nil {
+		t.Fatal(err)
+	} else if err := c.FRemove("/0000/foo/tmp"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Verify writeset.
+	if ws := root.WritesetSlice(); len(ws) != 0 {
+		t.Fatalf("unexpected writeset: %#v", ws)
+	}
+}
+
+// Ensure that a file written to a temporary path and renamed is tracked at its final path.
+func TestFileSystem_Rename_Created(t *testing.T) {
+	fs := OpenFileSystem()
+	defer fs.Close()
+	c := MustMountFS(fs)
+	defer c.Unmount()
+	root := fs.CreateRoot()
+
+	fs.MustMkdir("foo")
+
+	// Write temporary file through 9p.
+	f, err := c.FCreate("/0000/foo/tmp", 0666, go9p.OWRITE)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := f.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	} else if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rename temporary file into place.
+	MustRename(c, "/0000/foo/tmp", "out")
+
+	// Commit and verify file was moved.
+	root.MustCommit(root.WritesetSlice()...)
+	if buf, err := ioutil.ReadFile(filepath.Join(fs.Path(), "foo", "out")); err != nil {
+		t.Fatal(err)
+	} else if string(buf) != "data" {
+		t.Fatalf("unexpected data: %q", buf)
+	}
+
+	// Verify writes.
+	if ws := root.WritesetSlice(); !reflect.DeepEqual(ws, []string{"/foo/out"}) {
+		t.Fatalf("unexpected writeset: %#v", ws)
+	} else if a := WriteStrings(root.Writes()); !reflect.DeepEqual(a, []string{"create /foo/out"}) {
+		t.Fatalf("unexpected writes: %#v", a)
+	}
+}
+
+// Ensure that an existing file that is renamed is tracked at both paths.
+func TestFileSystem_Rename_Existing(t *testing.T) {
+	fs := OpenFileSystem()
+	defer fs.Close()
+	c := MustMountFS(fs)
+	defer c.Unmount()
+	root := fs.CreateRoot()
+
+	fs.MustWriteFile("foo/bar", []byte("data"), 0666)
+
+	// Rename file through 9p.
+	MustRename(c, "/0000/foo/bar", "baz")
+
+	// Verify writes.
+	if a := WriteStrings(root.Writes()); !reflect.DeepEqual(a, []string{
+		"remove /foo/bar",
+		"rename /foo/baz (from /foo/bar)",
+	}) {
+		t.Fatalf("unexpected writes: %#v", a)
+	}
+}
+
+// Ensure that renames to names outside of the file's directory are rejected.
+func TestFileSystem_Rename_InvalidName(t *testing.T) {
+	fs := OpenFileSystem()
+	defer fs.Close()
+	c := MustMountFS(fs)
+	defer c.Unmount()
+	root := fs.CreateRoot()
+
+	fs.MustWriteFile("foo/bar", []byte("data"), 0666)
+
+	for _, name := range []string{"/baz", "../baz", "../../baz", "..", "a/b"} {
+		fid, err := c.FWalk("/0000/foo/bar")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dir := NewWstatDir()
+		dir.Name = name
+		if err := c.Wstat(fid, dir); err == nil {
+			t.Fatalf("%s: expected error", name)
+		} else if e, ok := err.(*go9p.Error); !ok || e.Errornum != go9p.EINVAL {
+			t.Fatalf("%s: unexpected error: %#v", name, err)
+		}
+		c.Clunk(fid)
+	}
+
+	// Verify the file is unchanged.
+	if buf := fs.MustReadFile("foo/bar"); string(buf) != "data" {
+		t.Fatalf("unexpected data: %q", buf)
+	} else if a := root.Writes(); len(a) != 0 {
+		t.Fatalf("unexpected writes: %#v", WriteStrings(a))
+	}
+}
+
+// Ensure that a symlink can be created and tracked.
+func TestFileSystem_Create_Symlink(t *testing.T) {
+	fs := OpenFileSystem()
+	defer fs.Close()
+	c := MustMountFS(fs)
+	defer c.Unmount()
+	root := fs.CreateRoot()
+
+	fs.MustMkdir("foo")
+
+	// Create a dangling symlink through 9p.
+	fid, err := c.FWalk("/0000/foo")
+	if err != nil {
+		t.Fatal(err)
+	} else if err := c.Create(fid, "link", go9p.DMSYMLINK|0777, go9p.OREAD, "no_such_file"); err != nil {
+		t.Fatal(err)
+	} else if err := c.Clunk(fid); err != nil {
+		t.Fatal(err)
+	}
+
+	// Commit and verify symlink.
+	root.MustCommit(root.WritesetSlice()...)
+	if target, err := os.Readlink(filepath.Join(fs.Path(), "foo", "link")); err != nil {
+		t.Fatal(err)
+	} else if target != "no_such_file" {
+		t.Fatalf("unexpected target: %s", target)
+	}
+
+	// Verify writes.
+	if a := WriteStrings(root.Writes()); !reflect.DeepEqual(a, []string{"create /foo/link"}) {
+		t.Fatalf("unexpected writes: %#v", a)
+	}
+}
+
+// Ensure that mode and time changes are tracked separately from content changes.
+func TestFileSystem_Wstat_Chmod(t *testing.T) {
+	fs := OpenFileSystem()
+	defer fs.Close()
+	c := MustMountFS(fs)
+	defer c.Unmount()
+	root := fs.CreateRoot()
+
+	fs.MustWriteFile("foo/bar", []byte("data"), 0666)
+	fs.MustWriteFile("foo/baz", []byte("data"), 0666)
+
+	// Change mode of one file and the mtime of another.
+	dir := NewWstatDir()
+	dir.Mode = 0600
+	MustWstat(c, "/0000/foo/bar", dir)
+
+	dir = NewWstatDir()
+	dir.Mtime = 1000
+	MustWstat(c, "/0000/foo/baz", dir)
+
+	// Commit and verify mode.
+	root.MustCommit(root.WritesetSlice()...)
+	if fi, err := os.Stat(filepath.Join(fs.Path(), "foo", "bar")); err != nil {
+		t.Fatal(err)
+	} else if fi.Mode() != 0600 {
+		t.Fatalf("unexpected mode: %s", fi.Mode())
+	}
+
+	// Verify writes.
+	if a := WriteStrings(root.Writes()); !reflect.DeepEqual(a, []string{
+		"chmod /foo/bar",
+		"chmod /foo/baz",
+	}) {
+		t.Fatalf("unexpected writes: %#v", a)
+	}
+}
+
+// Ensure that truncating a file through wstat is tracked as a modification.
+func TestFileSystem_Wstat_Truncate(t *testing.T) {
+	fs := OpenFileSystem()
+	defer fs.Close()
+	c := MustMountFS(fs)
+	defer c.Unmount()
+	root := fs.CreateRoot()
+
+	fs.MustWriteFile("foo/bar", []byte("data"), 0666)
+
+	dir := NewWstatDir()
+	dir.Length = 2
+	MustWstat(c, "/0000/foo/bar", dir)
+
+	// Verify writes.
+	if a := WriteStrings(root.Writes()); !reflect.DeepEqual(a, []string{"modify /foo/bar"}) {
+		t.Fatalf("unexpected writes: %#v", a)
+	}
+}
+
+// Ensure that a wstat that changes nothing is not tracked.
+func TestFileSystem_Wstat_Sync(t *testing.T) {
+	fs := OpenFileSystem()
+	defer fs.Close()
+	c := MustMountFS(fs)
+	defer c.Unmount()
+	root := fs.CreateRoot()
+
+	fs.MustWriteFile("foo/bar", []byte("data"), 0666)
+	MustWstat(c, "/0000/foo/bar", NewWstatDir())
+
+	if ws := root.WritesetSlice(); len(ws) != 0 {
+		t.Fatalf("unexpected writeset: %#v", ws)
+	}
+}
+
+// Ensure that changes to a path are merged into their final effect.
+func TestFileSystemRoot_AddToWriteset(t *testing.T) {
+	for i, tt := range []struct {
+		fn  func(r *p9.FileSystemRoot)
+		exp []string
+	}{
+		// Modifying a created file is still a create.
+		{
+			fn: func(r *p9.FileSystemRoot) {
+				r.AddToWriteset("/a", bake.WriteCreate)
+				r.AddToWriteset("/a", bake.WriteModify)
+				r.AddToWriteset("/a", bake.WriteChmod)
+			},
+			exp: []string{"create /a"},
+		},
+
+		// Content & mode changes to an existing file are combined.
+		{
+			fn: func(r *p9.FileSystemRoot) {
+				r.AddToWriteset("/a", bake.WriteModify)
+				r.AddToWriteset("/a", bake.WriteChmod)
+			},
+			exp: []string{"modify|chmod /a"},
+		},
+
+		// Recreating a removed file is a modification.
+		{
+			fn: func(r *p9.FileSystemRoot) {
+				r.AddToWriteset("/a", bake.WriteRemove)
+				r.AddToWriteset("/a", bake.WriteCreate)
+			},
+			exp: []string{"modify /a"},
+		},
+
+		// Removing a modified file only records the removal.
+		{
+			fn: func(r *p9.FileSystemRoot) {
+				r.AddToWriteset("/a", bake.WriteModify)
+				r.AddToWriteset("/a", bake.WriteRemove)
+			},
+			exp: []string{"remove /a"},
+		},
+
+		// Renaming a created file over an existing file modifies it.
+		{
+			fn: func(r *p9.FileSystemRoot) {
+				r.AddToWriteset("/tmp", bake.WriteCreate)
+				r.AddRenameToWriteset("/tmp", "/a", true)
+			},
+			exp: []string{"modify /a"},
+		},
+
+		// Renames are tracked back to their original path.
+		{
+			fn: func(r *p9.FileSystemRoot) {
+				r.AddToWriteset("/a", bake.WriteModify)
+				r.AddRenameToWriteset("/a", "/b", false)
+				r.AddRenameToWriteset("/b", "/c", false)
+			},
+			exp: []string{"remove /a", "modify|rename /c (from /a)"},
+		},
+
+		// Moving a file back to its original path has no net effect.
+		{
+			fn: func(r *p9.FileSystemRoot) {
+				r.AddRenameToWriteset("/a", "/b", false)
+				r.AddRenameToWriteset("/b", "/a", false)
+			},
+			exp: []string{},
+		},
+
+		// Removing a renamed file only removes the original.
+		{
+			fn: func(r *p9.FileSystemRoot) {
+				r.AddRenameToWriteset("/a", "/b", false)
+				r.AddToWriteset("/b", bake.WriteRemove)
+			},
+			exp: []string{"remove /a"},
+		},
+
+		// Changes beneath a renamed directory move with it.
+		{
+			fn: func(r *p9.FileSystemRoot) {
+				r.AddToWriteset("/tmp", bake.WriteCreate)
+				r.AddToWriteset("/tmp/a", bake.WriteCreate)
+				r.AddRenameToWriteset("/tmp", "/out", false)
+			},
+			exp: []string{"create /out", "create /out/a"},
+		},
+	} {
+		r := p9.NewFileSystemRoot("0000", "")
+		tt.fn(r)
+		if a := WriteStrings(r.Writes()); !reflect.DeepEqual(a, tt.exp) {
+			t.Errorf("%d. unexpected writes: %#v", i, a)
+		}
 	}
 }
 
@@ -147,7 +553,16 @@ func (fs *FileSystem) Close() error {
 
 // CreateRoot creates a new root and wraps it in the test wrapper.
 func (fs *FileSystem) CreateRoot() *FileSystemRoot {
-	return &FileSystemRoot{fs.FileSystem.CreateRoot().(*p9.FileSystemRoot)}
+	return fs.CreateRootWithPolicy(nil)
+}
+
+func (fs *FileSystem) CreateRootWithPolicy(policy *bake.WritePolicy) *FileSystemRoot {
+	return &FileSystemRoot{fs.FileSystem.CreateRoot("", policy).(*p9.FileSystemRoot)}
+}
+
+// CreateRootForTarget creates a new root for a named target and wraps it in the test wrapper.
+func (fs *FileSystem) CreateRootForTarget(target string) *FileSystemRoot {
+	return &FileSystemRoot{fs.FileSystem.CreateRoot(target, nil).(*p9.FileSystemRoot)}
 }
 
 func (fs *FileSystem) MustWriteFile(filename string, data []byte, perm os.FileMode) {
@@ -160,18 +575,90 @@ func (fs *FileSystem) MustWriteFile(filename string, data []byte, perm os.FileMo
 	}
 }
 
+// MustReadFile reads a file from the served directory. Panic on error.
+func (fs *FileSystem) MustReadFile(filename string) []byte {
+	buf, err := ioutil.ReadFile(filepath.Join(fs.Path(), filename))
+	if err != nil {
+		panic(err)
+	}
+	return buf
+}
+
+// MustMkdir creates a directory within the file system. Panic on error.
+func (fs *FileSystem) MustMkdir(name string) {
+	if err := os.MkdirAll(filepath.Join(fs.Path(), name), 0777); err != nil {
+		panic(err)
+	}
+}
+
 // FileSystemRoot represents a test wrapper for p9.FileSystemRoot.
 type FileSystemRoot struct {
 	*p9.FileSystemRoot
 }
 
+// MustCommit commits changes to paths to the file system. Panic on error.
+func (r *FileSystemRoot) MustCommit(paths ...string) {
+	if err := r.Commit(paths); err != nil {
+		panic(err)
+	}
+}
+
 // MustMountFS mounts a client to fs. Panic on error.
 func MustMountFS(fs *FileSystem) *go9p.Clnt {
 	root := go9p.OsUsers.Uid2User(0)
-	clnt, err := go9p.Mount("tcp", fs.Listener().Addr().String(), "/", 8192, root)
+	addr := fs.Listener().Addr()
+	clnt, err := go9p.Mount(addr.Network(), addr.String(), "/", 8192, root)
 	if err != nil {
 		panic(err)
 	}
 	// clnt.Debuglevel = 1
 	return clnt
 }
+
+// MustWstat updates the file info for path through the client. Panic on error.
+func MustWstat(c *go9p.Clnt, path string, dir *go9p.Dir) {
+	fid, err := c.FWalk(path)
+	if err != nil {
+		panic(err)
+	}
+	defer c.Clunk(fid)
+
+	if err := c.Wstat(fid, dir); err != nil {
+		panic(err)
+	}
+}
+
+// MustRename renames the file at path to name within the same directory. Panic on error.
+func MustRename(c *go9p.Clnt, path, name string) {
+	dir := NewWstatDir()
+	dir.Name = name
+	MustWstat(c, path, dir)
+}
+
+// NewWstatDir returns a directory entry with all fields set to be left unchanged by wstat.
+func NewWstatDir() *go9p.Dir {
+	return &go9p.Dir{
+		Type:    0xFFFF,
+		Dev:     0xFFFFFFFF,
+		Qid:     go9p.Qid{Type: 0xFF, Version: 0xFFFFFFFF, Path: 0xFFFFFFFFFFFFFFFF},
+		Mode:    0xFFFFFFFF,
+		Atime:   0xFFFFFFFF,
+		Mtime:   0xFFFFFFFF,
+		Length:  0xFFFFFFFFFFFFFFFF,
+		Uidnum:  go9p.NOUID,
+		Gidnum:  go9p.NOUID,
+		Muidnum: go9p.NOUID,
+	}
+}
+
+// WriteStrings returns a string representation of each write.
+func WriteStrings(a []*bake.Write) []string {
+	other := make([]string, len(a))
+	for i, w := range a {
+		other[i] = w.Op.String() + " " + w.Path
+		if w.From != "" {
+			other[i] += " (from " + w.From + ")"
+		}
+	}
+	return other
+}
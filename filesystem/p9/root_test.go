@@ -0,0 +1,35 @@
+package p9
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/flynn/bake"
+)
+
+// Ensure conflicts with a released root name the released root's target.
+func TestFileSystemRoot_ConflictTargets_Released(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p9-root-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs := NewFileSystem(dir)
+	fs.overlayDir = dir
+	a := fs.CreateRoot("A", nil).(*FileSystemRoot)
+	b := fs.CreateRoot("B", nil).(*FileSystemRoot)
+	defer b.Release()
+
+	a.AddToWriteset("/bin/out", bake.WriteCreate)
+	a.checkConflict("/bin/out")
+	a.Release()
+
+	b.AddToWriteset("/bin/out", bake.WriteCreate)
+	b.checkConflict("/bin/out")
+	if x := b.ConflictTargets(); !reflect.DeepEqual(x, map[string][]string{"/bin/out": {"A"}}) {
+		t.Fatalf("unexpected conflict targets: %#v", x)
+	}
+}
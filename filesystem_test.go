@@ -0,0 +1,171 @@
+package bake_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/flynn/bake"
+)
+
+// Ensure write policies allow outputs and paths beneath them.
+func TestWritePolicy_Allowed(t *testing.T) {
+	p := bake.NewWritePolicy(&bake.Target{Name: "foo", Outputs: []string{"bin/foo", "out"}})
+	for _, tt := range []struct {
+		path    string
+		allowed bool
+	}{
+		{path: "bin/foo", allowed: true},
+		{path: "/bin/foo", allowed: true},
+		{path: "out/a/b", allowed: true},
+		{path: ".bake/tmp/x", allowed: false},
+		{path: "bin", allowed: false},
+		{path: "bin/foobar", allowed: false},
+		{path: "src/main.go", allowed: false},
+		{path: "bin/../src", allowed: false},
+	} {
+		if v := p.Allowed(tt.path); v != tt.allowed {
+			t.Errorf("%s: unexpected allowed: %v", tt.path, v)
+		}
+	}
+}
+
+// Ensure temporary files can only be created next to outputs.
+func TestWritePolicy_AllowedTemp(t *testing.T) {
+	p := &bake.WritePolicy{Paths: []string{"bin/foo"}}
+	if !p.AllowedTemp("bin/.foo.tmp") {
+		t.Fatal("expected sibling to be allowed")
+	} else if p.AllowedTemp("src/.foo.tmp") {
+		t.Fatal("expected unrelated directory to be denied")
+	} else if p.AllowedTemp(".foo.tmp") {
+		t.Fatal("expected parent directory to be denied")
+	}
+}
+
+// Ensure written paths outside of the policy are found.
+func TestWritePolicy_Unallowed(t *testing.T) {
+	p := &bake.WritePolicy{Paths: []string{"bin/foo"}}
+	if a := p.Unallowed([]*bake.Write{
+		{Path: "/bin", Op: bake.WriteCreate},
+		{Path: "/bin/foo", Op: bake.WriteCreate},
+		{Path: "/bin/foo.tmp", Op: bake.WriteCreate},
+	}); !reflect.DeepEqual(a, []string{"/bin/foo.tmp"}) {
+		t.Fatalf("unexpected paths: %#v", a)
+	}
+}
+
+// Ensure parent directories of outputs can be created.
+func TestWritePolicy_AllowedDir(t *testing.T) {
+	p := &bake.WritePolicy{Paths: []string{"bin/foo"}}
+	if !p.AllowedDir("bin") {
+		t.Fatal("expected parent directory to be allowed")
+	} else if !p.AllowedDir("/") {
+		t.Fatal("expected root to be allowed")
+	} else if p.AllowedDir("src") {
+		t.Fatal("expected unrelated directory to be denied")
+	}
+}
+
+// Ensure a nil policy allows all writes.
+func TestWritePolicy_Nil(t *testing.T) {
+	var p *bake.WritePolicy
+	if !p.Allowed("any/path") {
+		t.Fatal("expected nil policy to allow writes")
+	}
+}
+
+// Ensure phony targets can only write to their declared outputs.
+func TestNewWritePolicy_Phony(t *testing.T) {
+	if p := bake.NewWritePolicy(&bake.Target{Name: "clean", Phony: true}); p.Allowed("clean") || p.Allowed("bin/app") {
+		t.Fatalf("expected undeclared paths to be denied: %#v", p)
+	}
+
+	p := bake.NewWritePolicy(&bake.Target{Name: "clean", Phony: true, Outputs: []string{"bin"}})
+	if !p.Allowed("bin/app") {
+		t.Fatal("expected declared output to be allowed")
+	} else if p.Allowed("src/main.go") {
+		t.Fatal("expected undeclared path to be denied")
+	}
+}
+
+// Ensure that changes to a path are merged into their final effect.
+func TestWriteset(t *testing.T) {
+	for i, tt := range []struct {
+		fn  func(ws *bake.Writeset)
+		exp []string
+	}{
+		// Modifying a created file is still a create.
+		{
+			fn: func(ws *bake.Writeset) {
+				ws.Add("/a", bake.WriteCreate)
+				ws.Add("/a", bake.WriteModify)
+				ws.Add("/a", bake.WriteChmod)
+			},
+			exp: []string{"create /a"},
+		},
+
+		// Removing a created file has no net effect.
+		{
+			fn: func(ws *bake.Writeset) {
+				ws.Add("/a", bake.WriteCreate)
+				ws.Add("/a", bake.WriteRemove)
+			},
+			exp: []string{},
+		},
+
+		// Renaming a created file over an existing file modifies it.
+		{
+			fn: func(ws *bake.Writeset) {
+				ws.Add("/tmp", bake.WriteCreate)
+				ws.AddRename("/tmp", "/a", true)
+			},
+			exp: []string{"modify /a"},
+		},
+
+		// Renames are tracked back to their original path.
+		{
+			fn: func(ws *bake.Writeset) {
+				ws.Add("/a", bake.WriteModify)
+				ws.AddRename("/a", "/b", false)
+				ws.AddRename("/b", "/c", false)
+			},
+			exp: []string{"remove /a", "modify|rename /c (from /a)"},
+		},
+
+		// Moving a file back to its original path has no net effect.
+		{
+			fn: func(ws *bake.Writeset) {
+				ws.AddRename("/a", "/b", false)
+				ws.AddRename("/b", "/a", false)
+			},
+			exp: []string{},
+		},
+
+		// Changes beneath a renamed directory move with it.
+		{
+			fn: func(ws *bake.Writeset) {
+				ws.Add("/tmp", bake.WriteCreate)
+				ws.Add("/tmp/a", bake.WriteCreate)
+				ws.AddRename("/tmp", "/out", false)
+			},
+			exp: []string{"create /out", "create /out/a"},
+		},
+	} {
+		ws := bake.NewWriteset()
+		tt.fn(ws)
+		if a := WriteStrings(ws.Writes()); !reflect.DeepEqual(a, tt.exp) {
+			t.Errorf("%d. unexpected writes: %#v", i, a)
+		}
+	}
+}
+
+// WriteStrings returns a description of each write, such as "create /a".
+func WriteStrings(a []*bake.Write) []string {
+	other := make([]string, len(a))
+	for i, w := range a {
+		other[i] = w.Op.String() + " " + w.Path
+		if w.From != "" {
+			other[i] += " (from " + w.From + ")"
+		}
+	}
+	return other
+}
@@ -0,0 +1,843 @@
+// Package fstest implements an in-memory bake.FileSystem for testing builds
+// without mounting a file system.
+//
+// Files are read from a directory on the host but changes made through a
+// root are held in memory until they are committed. Commands are not run as
+// processes. Instead, scripts registered by command text make reads and
+// writes through the root so that tests can control exactly what each
+// command accesses. Built-in commands without a registered script are
+// emulated through the root.
+package fstest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/flynn/bake"
+)
+
+// Ensure types implement their interfaces.
+var (
+	_ bake.FileSystem     = (*FileSystem)(nil)
+	_ bake.FileSystemRoot = (*Root)(nil)
+	_ bake.Execer         = (*FileSystem)(nil)
+)
+
+// CommandFunc represents a script that runs in place of a command.
+type CommandFunc func(r *Root) error
+
+// FileSystem represents an in-memory file system over a host directory.
+// It also implements bake.Execer so it can run the scripts for a builder.
+type FileSystem struct {
+	mu    sync.Mutex
+	path  string
+	roots map[*Root]struct{}
+
+	// Scripts run in place of commands, keyed by command text. Exec commands
+	// are keyed by their arguments joined by spaces, shell commands by their
+	// source and built-in commands by their description.
+	Commands map[string]CommandFunc
+}
+
+// NewFileSystem returns a new file system that reads files from path.
+func NewFileSystem(path string) *FileSystem {
+	return &FileSystem{
+		path:     path,
+		roots:    make(map[*Root]struct{}),
+		Commands: make(map[string]CommandFunc),
+	}
+}
+
+func (fs *FileSystem) Open() error  { return nil }
+func (fs *FileSystem) Close() error { return nil }
+
+// Path returns the host directory that files are read from.
+func (fs *FileSystem) Path() string { return fs.path }
+
+// CreateRoot returns a new root for target that tracks file access.
+// Writes outside of policy are denied. A nil policy allows all writes.
+func (fs *FileSystem) CreateRoot(target string, policy *bake.WritePolicy) bake.FileSystemRoot {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	r := &Root{
+		fs:          fs,
+		target:      target,
+		policy:      policy,
+		files:       make(map[string]*file),
+		readset:     make(map[string]struct{}),
+		statset:     make(map[string]struct{}),
+		listset:     make(map[string]struct{}),
+		missset:     make(map[string]struct{}),
+		writeset:    bake.NewWriteset(),
+		deniedset:   make(map[string]struct{}),
+		peerWrites:  make(map[string][]string),
+		conflictset: make(map[string][]string),
+	}
+	fs.roots[r] = struct{}{}
+	return r
+}
+
+// Exec runs the script registered for the request's command. Built-in
+// commands without a script are emulated. Returns an error if no script is
+// registered for any other command.
+func (fs *FileSystem) Exec(req *bake.ExecRequest) error {
+	s := CommandString(req.Command)
+
+	fs.mu.Lock()
+	fn := fs.Commands[s]
+	fs.mu.Unlock()
+
+	if fn != nil {
+		return fn(req.Root.(*Root))
+	} else if cmd, ok := req.Command.(bake.NativeCommand); ok {
+		dir, err := filepath.Rel(req.Root.Path(), req.WorkDir)
+		if err != nil {
+			return err
+		}
+		return runNative(req.Root.(*Root), filepath.ToSlash(dir), cmd)
+	}
+	return fmt.Errorf("fstest: unknown command: %q", s)
+}
+
+// runNative emulates a built-in command through the root. Paths are relative to dir.
+func runNative(r *Root, dir string, cmd bake.NativeCommand) error {
+	switch cmd := cmd.(type) {
+	case *bake.CopyCommand:
+		return copyPath(r, path.Join(dir, cmd.Source), path.Join(dir, cmd.Dest))
+	case *bake.WriteCommand:
+		data, err := cmd.Data()
+		if err != nil {
+			return err
+		}
+		return r.WriteFile(path.Join(dir, cmd.Path), data)
+	case *bake.MkdirCommand:
+		return r.Mkdir(path.Join(dir, cmd.Path))
+	case *bake.SymlinkCommand:
+		return r.Symlink(cmd.Target, path.Join(dir, cmd.Path))
+	case *bake.RemoveCommand:
+		if err := removePath(r, path.Join(dir, cmd.Path)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	default:
+		return fmt.Errorf("fstest: unsupported command: %q", cmd.String())
+	}
+}
+
+// copyPath copies the file or directory tree at src to dst through the root.
+func copyPath(r *Root, src, dst string) error {
+	fi, err := r.Stat(src)
+	if err != nil {
+		return err
+	} else if fi.Mode()&os.ModeSymlink != 0 {
+		target, err := r.Readlink(src)
+		if err != nil {
+			return err
+		}
+		return r.Symlink(target, dst)
+	} else if !fi.IsDir() {
+		buf, err := r.ReadFile(src)
+		if err != nil {
+			return err
+		}
+		return r.WriteFile(dst, buf)
+	}
+
+	names, err := r.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := copyPath(r, path.Join(src, name), path.Join(dst, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removePath removes the file or directory tree at name through the root.
+func removePath(r *Root, name string) error {
+	fi, err := r.Stat(name)
+	if err != nil {
+		return err
+	} else if fi.IsDir() {
+		names, err := r.ReadDir(name)
+		if err != nil {
+			return err
+		}
+		for _, child := range names {
+			if err := removePath(r, path.Join(name, child)); err != nil {
+				return err
+			}
+		}
+	}
+	return r.Remove(name)
+}
+
+// checkConflict adds s to the conflictset of r and of any other root in use that changed s.
+// Paths changed by roots released while r was in use also conflict.
+func (fs *FileSystem) checkConflict(r *Root, s string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for _, target := range r.releasedWrites(s) {
+		r.addToConflictset(s, target)
+	}
+	for other := range fs.roots {
+		if other != r && other.changed(s) {
+			r.addToConflictset(s, other.target)
+			other.addToConflictset(s, r.target)
+		}
+	}
+}
+
+// releaseRoot removes r from the roots in use. The paths r changed are kept
+// by the other roots in use so later writes to them still conflict.
+func (fs *FileSystem) releaseRoot(r *Root) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	delete(fs.roots, r)
+
+	writes := r.Writeset()
+	for other := range fs.roots {
+		other.addPeerWrites(writes, r.target)
+	}
+}
+
+// CommandString returns the text used to register a script for cmd.
+func CommandString(cmd bake.Command) string {
+	switch cmd := cmd.(type) {
+	case *bake.ExecCommand:
+		return strings.Join(cmd.Args, " ")
+	case *bake.ShellCommand:
+		return cmd.Source
+	case bake.NativeCommand:
+		return cmd.String()
+	default:
+		panic(fmt.Sprintf("invalid command type: %T", cmd))
+	}
+}
+
+// Root represents a root of the file system that tracks file access.
+// Paths are relative to the project root and are tracked in the same
+// form as other file systems, such as "/bin/foo".
+type Root struct {
+	mu     sync.Mutex
+	fs     *FileSystem
+	target string
+	policy *bake.WritePolicy
+
+	// Files changed through the root. Removed files are nil.
+	files map[string]*file
+
+	readset   map[string]struct{}
+	statset   map[string]struct{}
+	listset   map[string]struct{}
+	missset   map[string]struct{}
+	writeset  *bake.Writeset
+	deniedset map[string]struct{}
+
+	// Targets of released roots that changed each path, and of the roots
+	// that changed each path in the conflictset.
+	peerWrites  map[string][]string
+	conflictset map[string][]string
+}
+
+// file represents the contents of a file changed through a root.
+// The data of a symbolic link is its target.
+type file struct {
+	data    []byte
+	mode    os.FileMode
+	modTime time.Time
+}
+
+// Path returns the host directory that files are read from.
+func (r *Root) Path() string { return r.fs.path }
+
+func (r *Root) Readset() map[string]struct{}   { return r.copySet(r.readset) }
+func (r *Root) Statset() map[string]struct{}   { return r.copySet(r.statset) }
+func (r *Root) Listset() map[string]struct{}   { return r.copySet(r.listset) }
+func (r *Root) Missset() map[string]struct{}   { return r.copySet(r.missset) }
+func (r *Root) Deniedset() map[string]struct{} { return r.copySet(r.deniedset) }
+
+// Writeset returns the paths changed through the root, including paths
+// that were removed or renamed away.
+func (r *Root) Writeset() map[string]struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.writeset.Paths()
+}
+
+// Writes returns the net change to each path in the writeset, sorted by path.
+func (r *Root) Writes() []*bake.Write {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.writeset.Writes()
+}
+
+// Conflictset returns the paths also changed through another root in use at the same time.
+func (r *Root) Conflictset() map[string]struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	m := make(map[string]struct{}, len(r.conflictset))
+	for k := range r.conflictset {
+		m[k] = struct{}{}
+	}
+	return m
+}
+
+// ConflictTargets returns the sorted targets of the other roots that changed each path in the conflictset.
+func (r *Root) ConflictTargets() map[string][]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	m := make(map[string][]string, len(r.conflictset))
+	for k, targets := range r.conflictset {
+		m[k] = append([]string(nil), targets...)
+	}
+	return m
+}
+
+// ReadFile returns the contents of a file and adds it to the readset.
+// Missing files are added to the missset. Symbolic links are followed.
+func (r *Root) ReadFile(name string) ([]byte, error) {
+	s := clean(name)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i := 0; ; i++ {
+		f, ok := r.files[s]
+		if !ok {
+			break
+		} else if f == nil {
+			r.missset[s] = struct{}{}
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		} else if f.mode.IsDir() {
+			return nil, &os.PathError{Op: "read", Path: name, Err: syscall.EISDIR}
+		} else if f.mode&os.ModeSymlink == 0 {
+			r.readset[s] = struct{}{}
+			return append([]byte(nil), f.data...), nil
+		} else if i == maxSymlinks {
+			return nil, &os.PathError{Op: "open", Path: name, Err: syscall.ELOOP}
+		}
+		s = resolve(s, string(f.data))
+	}
+
+	buf, err := ioutil.ReadFile(r.hostpath(s))
+	if os.IsNotExist(err) {
+		r.missset[s] = struct{}{}
+		return nil, err
+	} else if err != nil {
+		return nil, err
+	}
+	r.readset[s] = struct{}{}
+	return buf, nil
+}
+
+// Stat returns the file info of a file and adds it to the statset.
+// Missing files are added to the missset.
+func (r *Root) Stat(name string) (os.FileInfo, error) {
+	s := clean(name)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if f, ok := r.files[s]; ok {
+		if f == nil {
+			r.missset[s] = struct{}{}
+			return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+		}
+		r.statset[s] = struct{}{}
+		return &fileInfo{name: path.Base(s), size: int64(len(f.data)), mode: f.mode, modTime: f.modTime}, nil
+	}
+
+	fi, err := os.Lstat(r.hostpath(s))
+	if os.IsNotExist(err) && r.hasChildren(s) {
+		r.statset[s] = struct{}{}
+		return &fileInfo{name: path.Base(s), mode: os.ModeDir | 0777}, nil
+	} else if os.IsNotExist(err) {
+		r.missset[s] = struct{}{}
+		return nil, err
+	} else if err != nil {
+		return nil, err
+	}
+	r.statset[s] = struct{}{}
+	return fi, nil
+}
+
+// ReadDir returns the sorted names of the entries in a directory and adds it to the listset.
+// Missing directories are added to the missset.
+func (r *Root) ReadDir(name string) ([]string, error) {
+	s := clean(name)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	a, err := r.entries(s)
+	if os.IsNotExist(err) {
+		r.missset[s] = struct{}{}
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	} else if err != nil {
+		return nil, err
+	}
+	r.listset[s] = struct{}{}
+	return a, nil
+}
+
+// entries returns the sorted names in directory s without tracking the access.
+// The entries on the host are merged with files changed through the root.
+func (r *Root) entries(s string) ([]string, error) {
+	m := make(map[string]struct{})
+	fis, err := ioutil.ReadDir(r.hostpath(s))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	exists := err == nil
+	if f, ok := r.files[s]; ok {
+		exists = f != nil && f.mode.IsDir()
+		if !exists {
+			fis = nil
+		}
+	}
+	for _, fi := range fis {
+		m[fi.Name()] = struct{}{}
+	}
+
+	prefix := strings.TrimSuffix(s, "/") + "/"
+	for k, f := range r.files {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+
+		child := strings.SplitN(strings.TrimPrefix(k, prefix), "/", 2)
+		if f == nil && len(child) == 1 {
+			delete(m, child[0])
+		} else if f != nil {
+			m[child[0]] = struct{}{}
+			exists = true
+		}
+	}
+
+	if !exists {
+		return nil, os.ErrNotExist
+	}
+
+	a := make([]string, 0, len(m))
+	for k := range m {
+		a = append(a, k)
+	}
+	sort.Strings(a)
+	return a, nil
+}
+
+// WriteFile writes data to a file in memory and adds it to the writeset.
+// Returns a permission error if the root's write policy denies the write.
+func (r *Root) WriteFile(name string, data []byte) error {
+	s := clean(name)
+	if err := r.checkWrite(s, "write"); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.addToWriteset(s)
+	r.files[s] = &file{data: append([]byte(nil), data...), modTime: time.Now()}
+	r.mu.Unlock()
+
+	r.fs.checkConflict(r, s)
+	return nil
+}
+
+// Readlink returns the target of a symbolic link and adds it to the readset.
+// Missing files are added to the missset.
+func (r *Root) Readlink(name string) (string, error) {
+	s := clean(name)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if f, ok := r.files[s]; ok {
+		if f == nil {
+			r.missset[s] = struct{}{}
+			return "", &os.PathError{Op: "readlink", Path: name, Err: os.ErrNotExist}
+		} else if f.mode&os.ModeSymlink == 0 {
+			return "", &os.PathError{Op: "readlink", Path: name, Err: syscall.EINVAL}
+		}
+		r.readset[s] = struct{}{}
+		return string(f.data), nil
+	}
+
+	target, err := os.Readlink(r.hostpath(s))
+	if os.IsNotExist(err) {
+		r.missset[s] = struct{}{}
+		return "", err
+	} else if err != nil {
+		return "", err
+	}
+	r.readset[s] = struct{}{}
+	return target, nil
+}
+
+// Mkdir creates a directory in memory and adds it to the writeset.
+// Missing parents are implicit. An existing directory is left unchanged.
+// Returns a permission error if the root's write policy denies the write.
+func (r *Root) Mkdir(name string) error {
+	s := clean(name)
+	if fi, err := r.Stat(s); err == nil {
+		if fi.IsDir() {
+			return nil
+		}
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	} else if !os.IsNotExist(err) {
+		return err
+	} else if err := r.checkWrite(s, "mkdir"); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.files[s] = &file{mode: os.ModeDir | 0777, modTime: time.Now()}
+	r.writeset.Add(s, bake.WriteCreate)
+	r.mu.Unlock()
+
+	r.fs.checkConflict(r, s)
+	return nil
+}
+
+// Symlink creates a symbolic link to target in memory and adds it to the
+// writeset. An existing file is replaced but a directory is not.
+// Returns a permission error if the root's write policy denies the write.
+func (r *Root) Symlink(target, name string) error {
+	s := clean(name)
+	if fi, err := r.Stat(s); err == nil && fi.IsDir() {
+		return &os.PathError{Op: "symlink", Path: name, Err: syscall.EISDIR}
+	} else if err := r.checkWrite(s, "symlink"); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.addToWriteset(s)
+	r.files[s] = &file{data: []byte(target), mode: os.ModeSymlink | 0777, modTime: time.Now()}
+	r.mu.Unlock()
+
+	r.fs.checkConflict(r, s)
+	return nil
+}
+
+// Remove removes a file and adds it to the writeset.
+// Returns a permission error if the root's write policy denies the removal.
+func (r *Root) Remove(name string) error {
+	s := clean(name)
+	if err := r.checkWrite(s, "remove"); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	f, ok := r.files[s]
+	if !ok {
+		if _, err := os.Lstat(r.hostpath(s)); err != nil {
+			r.mu.Unlock()
+			return err
+		}
+	} else if f == nil {
+		r.mu.Unlock()
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	r.files[s] = nil
+	r.writeset.Add(s, bake.WriteRemove)
+	r.mu.Unlock()
+
+	r.fs.checkConflict(r, s)
+	return nil
+}
+
+// Rename moves a file or directory tree and adds both paths to the writeset.
+// An existing file at newname is replaced.
+// Returns a permission error if the root's write policy denies either path.
+func (r *Root) Rename(oldname, newname string) error {
+	oldpath, newpath := clean(oldname), clean(newname)
+	if oldpath == newpath {
+		return nil
+	} else if err := r.checkWrite(oldpath, "rename"); err != nil {
+		return err
+	} else if err := r.checkWrite(newpath, "rename"); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	if !r.exists(oldpath) {
+		r.mu.Unlock()
+		return &os.PathError{Op: "rename", Path: oldname, Err: os.ErrNotExist}
+	}
+	replaced := r.exists(newpath)
+
+	// Load the tree at the old path before clearing it so a directory moves
+	// with the files beneath it.
+	m := make(map[string]*file)
+	if err := r.load(oldpath, "", m); err != nil {
+		r.mu.Unlock()
+		return err
+	}
+	for rel := range m {
+		r.files[oldpath+rel] = nil
+	}
+	for rel, f := range m {
+		r.files[newpath+rel] = f
+	}
+	r.writeset.AddRename(oldpath, newpath, replaced)
+	r.mu.Unlock()
+
+	r.fs.checkConflict(r, oldpath)
+	r.fs.checkConflict(r, newpath)
+	return nil
+}
+
+// addToWriteset records a write to s as a create, or as a modification if s exists.
+func (r *Root) addToWriteset(s string) {
+	if r.exists(s) {
+		r.writeset.Add(s, bake.WriteModify)
+	} else {
+		r.writeset.Add(s, bake.WriteCreate)
+	}
+}
+
+// exists returns true if s exists as seen through the root.
+func (r *Root) exists(s string) bool {
+	if f, ok := r.files[s]; ok {
+		return f != nil
+	} else if _, err := os.Lstat(r.hostpath(s)); err == nil {
+		return true
+	}
+	return r.hasChildren(s)
+}
+
+// load adds the file at s+rel, and any files beneath it, to m keyed by rel.
+// Files are read from the host if they haven't been changed through the root.
+func (r *Root) load(s, rel string, m map[string]*file) error {
+	name := s + rel
+	f, ok := r.files[name]
+	if !ok {
+		fi, err := os.Lstat(r.hostpath(name))
+		if os.IsNotExist(err) && r.hasChildren(name) {
+			fi, err = &fileInfo{mode: os.ModeDir | 0777}, nil
+		}
+		if err != nil {
+			return err
+		}
+
+		f = &file{mode: fi.Mode() & (os.ModeType | os.ModePerm), modTime: fi.ModTime()}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(r.hostpath(name))
+			if err != nil {
+				return err
+			}
+			f.data = []byte(target)
+		} else if fi.Mode().IsRegular() {
+			if f.data, err = ioutil.ReadFile(r.hostpath(name)); err != nil {
+				return err
+			}
+		}
+	}
+	m[rel] = f
+
+	if !f.mode.IsDir() {
+		return nil
+	}
+	names, err := r.entries(name)
+	if err != nil {
+		return err
+	}
+	for _, child := range names {
+		if err := r.load(s, rel+"/"+child, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkWrite returns a permission error if the root's write policy does not
+// allow s to be changed. Paths created through the root, and new temporary
+// files allowed by the policy, can be changed. Denied paths are added to the
+// deniedset.
+func (r *Root) checkWrite(s, op string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.policy.Allowed(s) || r.writeset.Created(s) {
+		return nil
+	} else if r.policy.AllowedTemp(s) && !r.exists(s) {
+		return nil
+	}
+	r.deniedset[s] = struct{}{}
+	return &os.PathError{Op: op, Path: s, Err: os.ErrPermission}
+}
+
+// Commit writes changes to paths, and files beneath them, to the host directory.
+// Paths are relative to the project root. Other changes are not applied.
+func (r *Root) Commit(paths []string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, p := range paths {
+		s := clean(p)
+		for _, k := range r.changedPaths() {
+			if k != s && !strings.HasPrefix(k, s+"/") {
+				continue
+			}
+
+			if err := r.commitFile(k); err != nil {
+				return err
+			}
+			delete(r.files, k)
+		}
+	}
+	return nil
+}
+
+// commitFile writes the change to s to the host directory.
+func (r *Root) commitFile(s string) error {
+	f, hostpath := r.files[s], r.hostpath(s)
+	if f == nil {
+		return os.RemoveAll(hostpath)
+	} else if f.mode.IsDir() {
+		return os.MkdirAll(hostpath, 0777)
+	} else if err := os.MkdirAll(filepath.Dir(hostpath), 0777); err != nil {
+		return err
+	} else if f.mode&os.ModeSymlink != 0 {
+		if err := os.Remove(hostpath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return os.Symlink(string(f.data), hostpath)
+	}
+	return ioutil.WriteFile(hostpath, f.data, 0666)
+}
+
+// Release removes the root from the file system and discards uncommitted changes.
+func (r *Root) Release() {
+	r.fs.releaseRoot(r)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.files = make(map[string]*file)
+}
+
+// changedPaths returns the sorted paths of files changed through the root.
+func (r *Root) changedPaths() []string {
+	a := make([]string, 0, len(r.files))
+	for k := range r.files {
+		a = append(a, k)
+	}
+	sort.Strings(a)
+	return a
+}
+
+// hasChildren returns true if files beneath s were written through the root.
+// Parent directories of written files are implicit.
+func (r *Root) hasChildren(s string) bool {
+	prefix := strings.TrimSuffix(s, "/") + "/"
+	for k, f := range r.files {
+		if f != nil && strings.HasPrefix(k, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// changed returns true if s is in the root's writeset.
+func (r *Root) changed(s string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.writeset.Contains(s)
+}
+
+// addToConflictset adds s to the root's conflictset as also changed through a root for target.
+func (r *Root) addToConflictset(s, target string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.conflictset[s] = insertSorted(r.conflictset[s], target)
+}
+
+// addPeerWrites records the paths changed through a released root for target.
+func (r *Root) addPeerWrites(paths map[string]struct{}, target string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for s := range paths {
+		r.peerWrites[s] = insertSorted(r.peerWrites[s], target)
+	}
+}
+
+// releasedWrites returns the targets of released roots that changed s.
+func (r *Root) releasedWrites(s string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.peerWrites[s]...)
+}
+
+// hostpath returns the path of s in the host directory.
+func (r *Root) hostpath(s string) string {
+	return filepath.Join(r.fs.path, filepath.FromSlash(s))
+}
+
+// copySet returns a copy of one of the root's sets.
+func (r *Root) copySet(m map[string]struct{}) map[string]struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	other := make(map[string]struct{}, len(m))
+	for k := range m {
+		other[k] = struct{}{}
+	}
+	return other
+}
+
+// maxSymlinks is the number of symbolic links followed before a read fails.
+const maxSymlinks = 40
+
+// resolve returns the path of a link's target given the link's path s.
+// Absolute targets are relative to the project root like other paths.
+func resolve(s, target string) string {
+	if path.IsAbs(target) {
+		return clean(target)
+	}
+	return clean(path.Join(path.Dir(s), target))
+}
+
+// insertSorted returns a with s inserted in sorted order, if not already present.
+func insertSorted(a []string, s string) []string {
+	i := sort.SearchStrings(a, s)
+	if i < len(a) && a[i] == s {
+		return a
+	}
+	a = append(a, "")
+	copy(a[i+1:], a[i:])
+	a[i] = s
+	return a
+}
+
+// clean returns name relative to the project root in the form "/a/b".
+func clean(name string) string {
+	return path.Clean("/" + name)
+}
+
+// fileInfo represents the file info of a file changed through a root.
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) Mode() os.FileMode  { return fi.mode | 0666 }
+func (fi *fileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *fileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *fileInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,369 @@
+package fstest_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/flynn/bake"
+	"github.com/flynn/bake/fstest"
+)
+
+// Ensure reads through a root are tracked by type of access.
+func TestRoot_Read(t *testing.T) {
+	fs := NewFileSystem()
+	defer fs.Close()
+
+	MustWriteFile(filepath.Join(fs.Path(), "src/a"), []byte("A"))
+	MustWriteFile(filepath.Join(fs.Path(), "src/b"), []byte("B"))
+
+	r := fs.CreateRoot("", nil).(*fstest.Root)
+	if buf, err := r.ReadFile("src/a"); err != nil {
+		t.Fatal(err)
+	} else if string(buf) != "A" {
+		t.Fatalf("unexpected data: %q", buf)
+	} else if _, err := r.Stat("src/b"); err != nil {
+		t.Fatal(err)
+	} else if names, err := r.ReadDir("src"); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(names, []string{"a", "b"}) {
+		t.Fatalf("unexpected names: %#v", names)
+	} else if _, err := r.ReadFile("src/c"); !os.IsNotExist(err) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if a := SetSlice(r.Readset()); !reflect.DeepEqual(a, []string{"/src/a"}) {
+		t.Fatalf("unexpected readset: %#v", a)
+	} else if a := SetSlice(r.Statset()); !reflect.DeepEqual(a, []string{"/src/b"}) {
+		t.Fatalf("unexpected statset: %#v", a)
+	} else if a := SetSlice(r.Listset()); !reflect.DeepEqual(a, []string{"/src"}) {
+		t.Fatalf("unexpected listset: %#v", a)
+	} else if a := SetSlice(r.Missset()); !reflect.DeepEqual(a, []string{"/src/c"}) {
+		t.Fatalf("unexpected missset: %#v", a)
+	}
+}
+
+// Ensure writes are held in memory until they are committed.
+func TestRoot_Commit(t *testing.T) {
+	fs := NewFileSystem()
+	defer fs.Close()
+
+	MustWriteFile(filepath.Join(fs.Path(), "old"), []byte("x"))
+
+	r := fs.CreateRoot("", nil).(*fstest.Root)
+	if err := r.WriteFile("bin/foo", []byte("foo")); err != nil {
+		t.Fatal(err)
+	} else if err := r.WriteFile("tmp", []byte("tmp")); err != nil {
+		t.Fatal(err)
+	} else if err := r.Remove("old"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Changes are visible through the root but not on the host.
+	if buf, err := r.ReadFile("bin/foo"); err != nil || string(buf) != "foo" {
+		t.Fatalf("unexpected read: %q, %v", buf, err)
+	} else if names, err := r.ReadDir("/"); err != nil || !reflect.DeepEqual(names, []string{"bin", "tmp"}) {
+		t.Fatalf("unexpected names: %#v, %v", names, err)
+	} else if _, err := os.Stat(filepath.Join(fs.Path(), "bin/foo")); !os.IsNotExist(err) {
+		t.Fatalf("unexpected host file: %v", err)
+	}
+
+	// Only committed paths are applied.
+	if err := r.Commit([]string{"bin", "old"}); err != nil {
+		t.Fatal(err)
+	}
+	r.Release()
+
+	if buf := MustReadFile(filepath.Join(fs.Path(), "bin/foo")); string(buf) != "foo" {
+		t.Fatalf("unexpected data: %q", buf)
+	} else if _, err := os.Stat(filepath.Join(fs.Path(), "old")); !os.IsNotExist(err) {
+		t.Fatalf("expected removal: %v", err)
+	} else if _, err := os.Stat(filepath.Join(fs.Path(), "tmp")); !os.IsNotExist(err) {
+		t.Fatalf("unexpected uncommitted file: %v", err)
+	} else if a := SetSlice(r.Writeset()); !reflect.DeepEqual(a, []string{"/bin/foo", "/old", "/tmp"}) {
+		t.Fatalf("unexpected writeset: %#v", a)
+	}
+}
+
+// Ensure renames move files and directory trees and are tracked by their net effect.
+func TestRoot_Rename(t *testing.T) {
+	fs := NewFileSystem()
+	defer fs.Close()
+
+	MustWriteFile(filepath.Join(fs.Path(), "src/a"), []byte("A"))
+	MustWriteFile(filepath.Join(fs.Path(), "old"), []byte("x"))
+
+	r := fs.CreateRoot("", nil).(*fstest.Root)
+	if err := r.WriteFile("tmp", []byte("out")); err != nil {
+		t.Fatal(err)
+	} else if err := r.Rename("tmp", "out"); err != nil {
+		t.Fatal(err)
+	} else if err := r.Rename("src", "dst"); err != nil {
+		t.Fatal(err)
+	} else if err := r.Remove("old"); err != nil {
+		t.Fatal(err)
+	} else if err := r.Rename("missing", "x"); !os.IsNotExist(err) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Renamed files are visible at their new path only.
+	if buf, err := r.ReadFile("dst/a"); err != nil || string(buf) != "A" {
+		t.Fatalf("unexpected read: %q, %v", buf, err)
+	} else if _, err := r.Stat("src/a"); !os.IsNotExist(err) {
+		t.Fatalf("unexpected error: %v", err)
+	} else if names, err := r.ReadDir("/"); err != nil || !reflect.DeepEqual(names, []string{"dst", "out"}) {
+		t.Fatalf("unexpected names: %#v, %v", names, err)
+	}
+
+	if a := WriteStrings(r.Writes()); !reflect.DeepEqual(a, []string{
+		"rename /dst (from /src)",
+		"remove /old",
+		"create /out",
+		"remove /src",
+	}) {
+		t.Fatalf("unexpected writes: %#v", a)
+	}
+
+	// Committing both sides of a rename applies it to the host.
+	if err := r.Commit([]string{"src", "dst"}); err != nil {
+		t.Fatal(err)
+	} else if buf := MustReadFile(filepath.Join(fs.Path(), "dst/a")); string(buf) != "A" {
+		t.Fatalf("unexpected data: %q", buf)
+	} else if _, err := os.Stat(filepath.Join(fs.Path(), "src")); !os.IsNotExist(err) {
+		t.Fatalf("expected removal: %v", err)
+	}
+}
+
+// Ensure writes outside of the write policy are denied.
+func TestRoot_WritePolicy(t *testing.T) {
+	fs := NewFileSystem()
+	defer fs.Close()
+
+	r := fs.CreateRoot("", &bake.WritePolicy{Paths: []string{"bin/foo"}}).(*fstest.Root)
+	if err := r.WriteFile("bin/foo", nil); err != nil {
+		t.Fatal(err)
+	} else if err := r.WriteFile("src/main.go", nil); !os.IsPermission(err) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if a := SetSlice(r.Deniedset()); !reflect.DeepEqual(a, []string{"/src/main.go"}) {
+		t.Fatalf("unexpected deniedset: %#v", a)
+	} else if a := SetSlice(r.Writeset()); !reflect.DeepEqual(a, []string{"/bin/foo"}) {
+		t.Fatalf("unexpected writeset: %#v", a)
+	}
+}
+
+// Ensure files written through more than one root in use are conflicts.
+func TestRoot_Conflict(t *testing.T) {
+	fs := NewFileSystem()
+	defer fs.Close()
+
+	a := fs.CreateRoot("A", nil).(*fstest.Root)
+	b := fs.CreateRoot("B", nil).(*fstest.Root)
+	a.WriteFile("out", nil)
+	a.WriteFile("a", nil)
+	b.WriteFile("out", nil)
+
+	if x := SetSlice(a.Conflictset()); !reflect.DeepEqual(x, []string{"/out"}) {
+		t.Fatalf("unexpected conflictset: %#v", x)
+	} else if x := SetSlice(b.Conflictset()); !reflect.DeepEqual(x, []string{"/out"}) {
+		t.Fatalf("unexpected conflictset: %#v", x)
+	} else if x := a.ConflictTargets(); !reflect.DeepEqual(x, map[string][]string{"/out": {"B"}}) {
+		t.Fatalf("unexpected conflict targets: %#v", x)
+	}
+
+	// Writes to paths changed by a released root still conflict.
+	a.Release()
+	b.WriteFile("a", nil)
+	if x := b.ConflictTargets(); !reflect.DeepEqual(x, map[string][]string{"/a": {"A"}, "/out": {"A"}}) {
+		t.Fatalf("unexpected conflict targets: %#v", x)
+	}
+
+	// Roots created after others are released don't conflict with them.
+	b.Release()
+	c := fs.CreateRoot("C", nil).(*fstest.Root)
+	c.WriteFile("a", nil)
+	if x := SetSlice(c.Conflictset()); len(x) != 0 {
+		t.Fatalf("unexpected conflictset: %#v", x)
+	}
+}
+
+// Ensure commands run their registered scripts.
+func TestFileSystem_Exec(t *testing.T) {
+	fs := NewFileSystem()
+	defer fs.Close()
+
+	var root *fstest.Root
+	fs.Commands["go build"] = func(r *fstest.Root) error {
+		root = r
+		return nil
+	}
+
+	r := fs.CreateRoot("", nil)
+	if err := fs.Exec(&bake.ExecRequest{Command: &bake.ExecCommand{Args: []string{"go", "build"}}, Root: r}); err != nil {
+		t.Fatal(err)
+	} else if root != r {
+		t.Fatal("expected script to run on root")
+	}
+
+	if err := fs.Exec(&bake.ExecRequest{Command: &bake.ShellCommand{Source: "make"}, Root: r}); err == nil || err.Error() != `fstest: unknown command: "make"` {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure built-in commands without a script are emulated through the root.
+func TestFileSystem_Exec_Native(t *testing.T) {
+	fs := NewFileSystem()
+	defer fs.Close()
+
+	MustWriteFile(filepath.Join(fs.Path(), "sub", "static", "a.css"), []byte("A"))
+	MustWriteFile(filepath.Join(fs.Path(), "sub", "old.txt"), nil)
+
+	r := fs.CreateRoot("", nil)
+	for _, cmd := range []bake.Command{
+		&bake.CopyCommand{Source: "static", Dest: "out"},
+		&bake.WriteCommand{Path: "VERSION", Content: "v{{.v}}", Vars: map[string]string{"v": "1"}},
+		&bake.RemoveCommand{Path: "old.txt"},
+	} {
+		if err := fs.Exec(&bake.ExecRequest{Command: cmd, Root: r, WorkDir: filepath.Join(fs.Path(), "sub")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if x := SetSlice(r.Writeset()); !reflect.DeepEqual(x, []string{"/sub/VERSION", "/sub/old.txt", "/sub/out/a.css"}) {
+		t.Fatalf("unexpected writeset: %#v", x)
+	} else if buf, err := r.(*fstest.Root).ReadFile("sub/VERSION"); err != nil || string(buf) != "v1" {
+		t.Fatalf("unexpected data: %q, %v", buf, err)
+	}
+
+}
+
+// Ensure the mkdir and symlink commands are emulated through the root and committed to the host.
+func TestFileSystem_Exec_Native_MkdirSymlink(t *testing.T) {
+	fs := NewFileSystem()
+	defer fs.Close()
+
+	MustWriteFile(filepath.Join(fs.Path(), "sub", "a.txt"), []byte("A"))
+	MustWriteFile(filepath.Join(fs.Path(), "sub", "link"), []byte("old"))
+
+	r := fs.CreateRoot("", nil).(*fstest.Root)
+	for _, cmd := range []bake.Command{
+		&bake.MkdirCommand{Path: "out/empty"},
+		&bake.MkdirCommand{Path: "out/empty"},
+		&bake.SymlinkCommand{Target: "a.txt", Path: "link"},
+		&bake.SymlinkCommand{Target: "../a.txt", Path: "out/a"},
+	} {
+		if err := fs.Exec(&bake.ExecRequest{Command: cmd, Root: r, WorkDir: filepath.Join(fs.Path(), "sub")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Verify the resulting tree through the root.
+	if fi, err := r.Stat("sub/out/empty"); err != nil || !fi.IsDir() {
+		t.Fatalf("expected directory: %v", err)
+	} else if names, err := r.ReadDir("sub/out/empty"); err != nil || len(names) != 0 {
+		t.Fatalf("unexpected names: %#v, %v", names, err)
+	} else if names, err := r.ReadDir("sub/out"); err != nil || !reflect.DeepEqual(names, []string{"a", "empty"}) {
+		t.Fatalf("unexpected names: %#v, %v", names, err)
+	} else if fi, err := r.Stat("sub/link"); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Fatalf("expected symlink: %v", err)
+	} else if target, err := r.Readlink("sub/out/a"); err != nil || target != "../a.txt" {
+		t.Fatalf("unexpected target: %q, %v", target, err)
+	} else if buf, err := r.ReadFile("sub/link"); err != nil || string(buf) != "A" {
+		t.Fatalf("unexpected data: %q, %v", buf, err)
+	} else if buf, err := r.ReadFile("sub/out/a"); err != nil || string(buf) != "A" {
+		t.Fatalf("unexpected data: %q, %v", buf, err)
+	} else if x := SetSlice(r.Writeset()); !reflect.DeepEqual(x, []string{"/sub/link", "/sub/out/a", "/sub/out/empty"}) {
+		t.Fatalf("unexpected writeset: %#v", x)
+	}
+
+	// Copying a tree copies links rather than their targets.
+	if err := fs.Exec(&bake.ExecRequest{Command: &bake.CopyCommand{Source: "out", Dest: "copy"}, Root: r, WorkDir: filepath.Join(fs.Path(), "sub")}); err != nil {
+		t.Fatal(err)
+	} else if target, err := r.Readlink("sub/copy/a"); err != nil || target != "../a.txt" {
+		t.Fatalf("unexpected target: %q, %v", target, err)
+	}
+
+	// Creating a directory over a file fails.
+	if err := fs.Exec(&bake.ExecRequest{Command: &bake.MkdirCommand{Path: "a.txt"}, Root: r, WorkDir: filepath.Join(fs.Path(), "sub")}); !os.IsExist(err) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Verify the resulting tree on the host.
+	if err := r.Commit([]string{"sub"}); err != nil {
+		t.Fatal(err)
+	}
+	r.Release()
+
+	if fi, err := os.Lstat(filepath.Join(fs.Path(), "sub/out/empty")); err != nil || !fi.IsDir() {
+		t.Fatalf("expected directory: %v", err)
+	} else if target, err := os.Readlink(filepath.Join(fs.Path(), "sub/link")); err != nil || target != "a.txt" {
+		t.Fatalf("unexpected target: %q, %v", target, err)
+	} else if target, err := os.Readlink(filepath.Join(fs.Path(), "sub/copy/a")); err != nil || target != "../a.txt" {
+		t.Fatalf("unexpected target: %q, %v", target, err)
+	} else if buf := MustReadFile(filepath.Join(fs.Path(), "sub/out/a")); string(buf) != "A" {
+		t.Fatalf("unexpected data: %q", buf)
+	}
+}
+
+// FileSystem is a test wrapper for fstest.FileSystem.
+type FileSystem struct {
+	*fstest.FileSystem
+}
+
+// NewFileSystem returns a new instance of FileSystem over a temporary directory.
+func NewFileSystem() *FileSystem {
+	path, err := ioutil.TempDir("", "bake-fstest-")
+	if err != nil {
+		panic(err)
+	}
+	return &FileSystem{FileSystem: fstest.NewFileSystem(path)}
+}
+
+// Close removes the underlying directory.
+func (fs *FileSystem) Close() error {
+	return os.RemoveAll(fs.Path())
+}
+
+// MustWriteFile writes data to filename, creating parent directories. Panic on error.
+func MustWriteFile(filename string, data []byte) {
+	if err := os.MkdirAll(filepath.Dir(filename), 0777); err != nil {
+		panic(err)
+	} else if err := ioutil.WriteFile(filename, data, 0666); err != nil {
+		panic(err)
+	}
+}
+
+// MustReadFile returns the contents of filename. Panic on error.
+func MustReadFile(filename string) []byte {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		panic(err)
+	}
+	return buf
+}
+
+// SetSlice returns the sorted keys of a set.
+func SetSlice(m map[string]struct{}) []string {
+	a := make([]string, 0, len(m))
+	for k := range m {
+		a = append(a, k)
+	}
+	sort.Strings(a)
+	return a
+}
+
+// WriteStrings returns a description of each write, such as "create /a".
+func WriteStrings(a []*bake.Write) []string {
+	other := make([]string, len(a))
+	for i, w := range a {
+		other[i] = w.Op.String() + " " + w.Path
+		if w.From != "" {
+			other[i] += " (from " + w.From + ")"
+		}
+	}
+	return other
+}
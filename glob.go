@@ -0,0 +1,101 @@
+package bake
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Shopify/go-lua"
+)
+
+// glob returns tables of the files matching a pattern relative to the
+// Bakefile's directory, sorted by path, and of the same paths without their
+// extensions. Every directory listed is recorded as read by the Bakefile.
+//
+// Directories named in DefaultIgnore are not searched. Patterns in ignore
+// files only apply to walking for Bakefiles, not to globs.
+func (p *Parser) glob(l *lua.State) int {
+	pattern := lua.CheckString(l, 1)
+
+	segments := strings.Split(path.Clean(pattern), "/")
+	if path.IsAbs(pattern) || segments[0] == ".." {
+		return p.raise(l, fmt.Errorf("%s: foreach: pattern outside project root: %q", p.location(l), pattern))
+	} else if _, err := path.Match(pattern, ""); err != nil {
+		return p.raise(l, fmt.Errorf("%s: foreach: %s: %q", p.location(l), err, pattern))
+	}
+
+	// A trailing "**" matches every file beneath the directory.
+	if segments[len(segments)-1] == "**" {
+		segments = append(segments, "*")
+	}
+
+	var matches []string
+	if err := p.globDir(".", segments, &matches); err != nil {
+		return p.raise(l, fmt.Errorf("%s: foreach: %s", p.location(l), err))
+	}
+	sort.Strings(matches)
+
+	l.CreateTable(len(matches), 0)
+	for i, match := range matches {
+		l.PushString(match)
+		l.RawSetInt(-2, i+1)
+	}
+	l.CreateTable(len(matches), 0)
+	for i, match := range matches {
+		l.PushString(strings.TrimSuffix(match, path.Ext(match)))
+		l.RawSetInt(-2, i+1)
+	}
+	return 2
+}
+
+// globDir appends the files within rel, a directory relative to the
+// Bakefile's directory, that match the pattern segments. Symlinked
+// directories are only followed by segments that aren't "**".
+func (p *Parser) globDir(rel string, segments []string, matches *[]string) error {
+	dir := path.Join(filepath.ToSlash(p.path), rel)
+	p.track(dir)
+
+	fis, err := readdir(filepath.Join(p.base, filepath.FromSlash(dir)))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// Match the remaining segments in this directory and every subdirectory.
+	if segments[0] == "**" {
+		if err := p.globDir(rel, segments[1:], matches); err != nil {
+			return err
+		}
+		for _, fi := range fis {
+			if !fi.IsDir() || defaultIgnored(fi.Name()) {
+				continue
+			}
+			if err := p.globDir(path.Join(rel, fi.Name()), segments, matches); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, fi := range fis {
+		if matched, _ := path.Match(segments[0], fi.Name()); !matched {
+			continue
+		}
+
+		name, isDir := path.Join(rel, fi.Name()), isDirInfo(filepath.Join(p.base, filepath.FromSlash(dir)), fi)
+		if len(segments) == 1 {
+			if !isDir {
+				*matches = append(*matches, name)
+			}
+		} else if isDir && !defaultIgnored(fi.Name()) {
+			if err := p.globDir(name, segments[1:], matches); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package bake
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"strings"
+)
+
+// IgnoreFile is the name of the file listing paths the parser should not walk.
+// Patterns use gitignore syntax and are relative to the directory containing the file.
+const IgnoreFile = ".bakeignore"
+
+// ignorePattern represents a single line of an ignore file.
+type ignorePattern struct {
+	dir      string   // directory containing the ignore file, relative to the project root
+	segments []string // slash separated glob segments. "**" matches any number of segments
+	negate   bool     // re-includes paths excluded by earlier patterns
+	dirOnly  bool     // only matches directories
+	anchored bool     // matches relative to dir instead of at any depth
+}
+
+// readIgnoreFile returns the patterns in the ignore file at filename.
+// dir is the directory containing the file, relative to the project root.
+// Returns an error satisfying os.IsNotExist() if the file doesn't exist.
+func readIgnoreFile(filename, dir string) ([]*ignorePattern, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var a []*ignorePattern
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if p := parseIgnorePattern(scanner.Text(), dir); p != nil {
+			a = append(a, p)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// parseIgnorePattern parses a line of an ignore file.
+// Returns nil for blank lines and comments.
+func parseIgnorePattern(line, dir string) *ignorePattern {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil
+	}
+
+	p := &ignorePattern{dir: path.Clean(dir)}
+	if p.dir == "." {
+		p.dir = ""
+	}
+
+	// Leading "!" negates the pattern. Escaped characters are matched literally.
+	if strings.HasPrefix(line, "!") {
+		p.negate, line = true, line[1:]
+	} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+		line = line[1:]
+	}
+
+	// Trailing slash only matches directories.
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly, line = true, strings.TrimRight(line, "/")
+	}
+
+	// Patterns containing a slash are relative to the ignore file's directory.
+	if strings.Contains(line, "/") {
+		p.anchored, line = true, strings.TrimPrefix(line, "/")
+	}
+
+	if line == "" {
+		return nil
+	}
+	p.segments = strings.Split(line, "/")
+	return p
+}
+
+// match returns true if the pattern matches rel, a path relative to the project root.
+func (p *ignorePattern) match(rel string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+
+	// Only paths beneath the ignore file's directory can match.
+	if p.dir != "" {
+		if !strings.HasPrefix(rel, p.dir+"/") {
+			return false
+		}
+		rel = strings.TrimPrefix(rel, p.dir+"/")
+	}
+
+	if !p.anchored {
+		return matchSegments(p.segments, []string{path.Base(rel)})
+	}
+	return matchSegments(p.segments, strings.Split(rel, "/"))
+}
+
+// matchSegments returns true if the glob segments in pattern match the path segments in a.
+func matchSegments(pattern, a []string) bool {
+	if len(pattern) == 0 {
+		return len(a) == 0
+	}
+
+	// "**" matches zero or more segments.
+	if pattern[0] == "**" {
+		for i := 0; i <= len(a); i++ {
+			if matchSegments(pattern[1:], a[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(a) == 0 {
+		return false
+	} else if matched, _ := path.Match(pattern[0], a[0]); !matched {
+		return false
+	}
+	return matchSegments(pattern[1:], a[1:])
+}
+
+// ignorePatterns represents an ordered list of ignore patterns.
+// Later patterns take precedence over earlier ones.
+type ignorePatterns []*ignorePattern
+
+// match returns true if rel is ignored.
+func (a ignorePatterns) match(rel string, isDir bool) bool {
+	var ignored bool
+	for _, p := range a {
+		if p.match(rel, isDir) {
+			ignored = !p.negate
+		}
+	}
+	return ignored
+}
@@ -11,6 +11,11 @@ It is generated from these files:
 It has these top-level messages:
 	TargetSnapshot
 	FileSnapshot
+	ParseCache
+	BakefileCache
+	SourceHash
+	Target
+	Command
 */
 package internal
 
@@ -25,6 +30,10 @@ type TargetSnapshot struct {
 	Name             *string         `protobuf:"bytes,1,req" json:"Name,omitempty"`
 	Hash             *string         `protobuf:"bytes,2,req" json:"Hash,omitempty"`
 	Inputs           []*FileSnapshot `protobuf:"bytes,3,rep" json:"Inputs,omitempty"`
+	Outputs          []string        `protobuf:"bytes,4,rep" json:"Outputs,omitempty"`
+	BuildTime        *int64          `protobuf:"varint,5,opt" json:"BuildTime,omitempty"`
+	Ignore           []string        `protobuf:"bytes,6,rep" json:"Ignore,omitempty"`
+	DeclaredOutputs  []string        `protobuf:"bytes,7,rep" json:"DeclaredOutputs,omitempty"`
 	XXX_unrecognized []byte          `json:"-"`
 }
 
@@ -53,10 +62,39 @@ func (m *TargetSnapshot) GetInputs() []*FileSnapshot {
 	return nil
 }
 
+func (m *TargetSnapshot) GetOutputs() []string {
+	if m != nil {
+		return m.Outputs
+	}
+	return nil
+}
+
+func (m *TargetSnapshot) GetBuildTime() int64 {
+	if m != nil && m.BuildTime != nil {
+		return *m.BuildTime
+	}
+	return 0
+}
+
+func (m *TargetSnapshot) GetIgnore() []string {
+	if m != nil {
+		return m.Ignore
+	}
+	return nil
+}
+
+func (m *TargetSnapshot) GetDeclaredOutputs() []string {
+	if m != nil {
+		return m.DeclaredOutputs
+	}
+	return nil
+}
+
 type FileSnapshot struct {
 	Name             *string `protobuf:"bytes,1,req" json:"Name,omitempty"`
 	Hash             *string `protobuf:"bytes,2,req" json:"Hash,omitempty"`
 	Content          *string `protobuf:"bytes,3,req" json:"Content,omitempty"`
+	Kind             *int32  `protobuf:"varint,4,opt" json:"Kind,omitempty"`
 	XXX_unrecognized []byte  `json:"-"`
 }
 
@@ -85,5 +123,220 @@ func (m *FileSnapshot) GetContent() string {
 	return ""
 }
 
+func (m *FileSnapshot) GetKind() int32 {
+	if m != nil && m.Kind != nil {
+		return *m.Kind
+	}
+	return 0
+}
+
+type ParseCache struct {
+	Version          *string          `protobuf:"bytes,1,req" json:"Version,omitempty"`
+	Bakefiles        []*BakefileCache `protobuf:"bytes,2,rep" json:"Bakefiles,omitempty"`
+	XXX_unrecognized []byte           `json:"-"`
+}
+
+func (m *ParseCache) Reset()         { *m = ParseCache{} }
+func (m *ParseCache) String() string { return proto.CompactTextString(m) }
+func (*ParseCache) ProtoMessage()    {}
+
+func (m *ParseCache) GetVersion() string {
+	if m != nil && m.Version != nil {
+		return *m.Version
+	}
+	return ""
+}
+
+func (m *ParseCache) GetBakefiles() []*BakefileCache {
+	if m != nil {
+		return m.Bakefiles
+	}
+	return nil
+}
+
+type BakefileCache struct {
+	Path             *string       `protobuf:"bytes,1,req" json:"Path,omitempty"`
+	Sources          []*SourceHash `protobuf:"bytes,2,rep" json:"Sources,omitempty"`
+	Targets          []*Target     `protobuf:"bytes,3,rep" json:"Targets,omitempty"`
+	XXX_unrecognized []byte        `json:"-"`
+}
+
+func (m *BakefileCache) Reset()         { *m = BakefileCache{} }
+func (m *BakefileCache) String() string { return proto.CompactTextString(m) }
+func (*BakefileCache) ProtoMessage()    {}
+
+func (m *BakefileCache) GetPath() string {
+	if m != nil && m.Path != nil {
+		return *m.Path
+	}
+	return ""
+}
+
+func (m *BakefileCache) GetSources() []*SourceHash {
+	if m != nil {
+		return m.Sources
+	}
+	return nil
+}
+
+func (m *BakefileCache) GetTargets() []*Target {
+	if m != nil {
+		return m.Targets
+	}
+	return nil
+}
+
+type SourceHash struct {
+	Name             *string `protobuf:"bytes,1,req" json:"Name,omitempty"`
+	Hash             *string `protobuf:"bytes,2,req" json:"Hash,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *SourceHash) Reset()         { *m = SourceHash{} }
+func (m *SourceHash) String() string { return proto.CompactTextString(m) }
+func (*SourceHash) ProtoMessage()    {}
+
+func (m *SourceHash) GetName() string {
+	if m != nil && m.Name != nil {
+		return *m.Name
+	}
+	return ""
+}
+
+func (m *SourceHash) GetHash() string {
+	if m != nil && m.Hash != nil {
+		return *m.Hash
+	}
+	return ""
+}
+
+type Target struct {
+	Name             *string    `protobuf:"bytes,1,req" json:"Name,omitempty"`
+	Phony            *bool      `protobuf:"varint,2,opt" json:"Phony,omitempty"`
+	Title            *string    `protobuf:"bytes,3,opt" json:"Title,omitempty"`
+	WorkDir          *string    `protobuf:"bytes,4,opt" json:"WorkDir,omitempty"`
+	Commands         []*Command `protobuf:"bytes,5,rep" json:"Commands,omitempty"`
+	Dependencies     []string   `protobuf:"bytes,6,rep" json:"Dependencies,omitempty"`
+	Outputs          []string   `protobuf:"bytes,7,rep" json:"Outputs,omitempty"`
+	Inputs           []string   `protobuf:"bytes,8,rep" json:"Inputs,omitempty"`
+	Ignore           []string   `protobuf:"bytes,9,rep" json:"Ignore,omitempty"`
+	File             *string    `protobuf:"bytes,10,opt" json:"File,omitempty"`
+	Line             *int64     `protobuf:"varint,11,opt" json:"Line,omitempty"`
+	XXX_unrecognized []byte     `json:"-"`
+}
+
+func (m *Target) Reset()         { *m = Target{} }
+func (m *Target) String() string { return proto.CompactTextString(m) }
+func (*Target) ProtoMessage()    {}
+
+func (m *Target) GetName() string {
+	if m != nil && m.Name != nil {
+		return *m.Name
+	}
+	return ""
+}
+
+func (m *Target) GetPhony() bool {
+	if m != nil && m.Phony != nil {
+		return *m.Phony
+	}
+	return false
+}
+
+func (m *Target) GetTitle() string {
+	if m != nil && m.Title != nil {
+		return *m.Title
+	}
+	return ""
+}
+
+func (m *Target) GetWorkDir() string {
+	if m != nil && m.WorkDir != nil {
+		return *m.WorkDir
+	}
+	return ""
+}
+
+func (m *Target) GetCommands() []*Command {
+	if m != nil {
+		return m.Commands
+	}
+	return nil
+}
+
+func (m *Target) GetDependencies() []string {
+	if m != nil {
+		return m.Dependencies
+	}
+	return nil
+}
+
+func (m *Target) GetOutputs() []string {
+	if m != nil {
+		return m.Outputs
+	}
+	return nil
+}
+
+func (m *Target) GetInputs() []string {
+	if m != nil {
+		return m.Inputs
+	}
+	return nil
+}
+
+func (m *Target) GetIgnore() []string {
+	if m != nil {
+		return m.Ignore
+	}
+	return nil
+}
+
+func (m *Target) GetFile() string {
+	if m != nil && m.File != nil {
+		return *m.File
+	}
+	return ""
+}
+
+func (m *Target) GetLine() int64 {
+	if m != nil && m.Line != nil {
+		return *m.Line
+	}
+	return 0
+}
+
+type Command struct {
+	Type             *string  `protobuf:"bytes,1,req" json:"Type,omitempty"`
+	Args             []string `protobuf:"bytes,2,rep" json:"Args,omitempty"`
+	Source           *string  `protobuf:"bytes,3,opt" json:"Source,omitempty"`
+	XXX_unrecognized []byte   `json:"-"`
+}
+
+func (m *Command) Reset()         { *m = Command{} }
+func (m *Command) String() string { return proto.CompactTextString(m) }
+func (*Command) ProtoMessage()    {}
+
+func (m *Command) GetType() string {
+	if m != nil && m.Type != nil {
+		return *m.Type
+	}
+	return ""
+}
+
+func (m *Command) GetArgs() []string {
+	if m != nil {
+		return m.Args
+	}
+	return nil
+}
+
+func (m *Command) GetSource() string {
+	if m != nil && m.Source != nil {
+		return *m.Source
+	}
+	return ""
+}
+
 func init() {
 }
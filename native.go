@@ -0,0 +1,312 @@
+package bake
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/Shopify/go-lua"
+)
+
+// NativeCommand represents a command that runs in-process instead of
+// starting a process. Paths are relative to the target's working directory.
+type NativeCommand interface {
+	Command
+
+	// Runs the command against dir, the target's working directory within
+	// its file system root, so file access is tracked like any other command.
+	Run(dir string) error
+
+	// Returns a description of the command shown to users.
+	String() string
+}
+
+// CopyCommand represents a command that copies a file or directory tree.
+// Symbolic links are copied as links.
+type CopyCommand struct {
+	Source string
+	Dest   string
+}
+
+func (*CopyCommand) command() {}
+
+// String returns a description of the command.
+func (c *CopyCommand) String() string { return fmt.Sprintf("copy %s %s", c.Source, c.Dest) }
+
+// Run copies the source to the destination within dir.
+func (c *CopyCommand) Run(dir string) error {
+	return copyPath(filepath.Join(dir, c.Source), filepath.Join(dir, c.Dest))
+}
+
+// copyPath copies the file, link or directory tree at src to dst.
+func copyPath(src, dst string) error {
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return err
+	} else if err := os.MkdirAll(filepath.Dir(dst), 0777); err != nil {
+		return err
+	}
+
+	switch {
+	case fi.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		return symlink(target, dst)
+
+	case fi.IsDir():
+		if err := os.MkdirAll(dst, fi.Mode().Perm()); err != nil {
+			return err
+		}
+
+		fis, err := readdir(src)
+		if err != nil {
+			return err
+		}
+		for _, fi := range fis {
+			if err := copyPath(filepath.Join(src, fi.Name()), filepath.Join(dst, fi.Name())); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	default:
+		return copyFile(src, dst, fi.Mode().Perm())
+	}
+}
+
+// copyFile copies the contents of the file at src to a file at dst with the given mode.
+func copyFile(src, dst string, mode os.FileMode) error {
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	if _, err := io.Copy(w, r); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// WriteCommand represents a command that writes a file.
+// If Vars is set then Content is executed as a text/template with Vars as its data.
+type WriteCommand struct {
+	Path    string
+	Content string
+	Vars    map[string]string
+}
+
+func (*WriteCommand) command() {}
+
+// String returns a description of the command.
+func (c *WriteCommand) String() string {
+	if c.Vars == nil {
+		return fmt.Sprintf("write %s", c.Path)
+	}
+	return fmt.Sprintf("template %s", c.Path)
+}
+
+// Run writes the file within dir.
+func (c *WriteCommand) Run(dir string) error {
+	data, err := c.Data()
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, c.Path)
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0666)
+}
+
+// Data returns the contents of the file, executing the template if Vars is set.
+func (c *WriteCommand) Data() ([]byte, error) {
+	if c.Vars == nil {
+		return []byte(c.Content), nil
+	}
+
+	tmpl, err := template.New(c.Path).Option("missingkey=error").Parse(c.Content)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, c.Vars); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// MkdirCommand represents a command that creates a directory and any missing parents.
+type MkdirCommand struct {
+	Path string
+}
+
+func (*MkdirCommand) command() {}
+
+// String returns a description of the command.
+func (c *MkdirCommand) String() string { return fmt.Sprintf("mkdir %s", c.Path) }
+
+// Run creates the directory within dir.
+func (c *MkdirCommand) Run(dir string) error {
+	return os.MkdirAll(filepath.Join(dir, c.Path), 0777)
+}
+
+// SymlinkCommand represents a command that creates a symbolic link at Path
+// pointing to Target. An existing file at Path is replaced.
+type SymlinkCommand struct {
+	Target string
+	Path   string
+}
+
+func (*SymlinkCommand) command() {}
+
+// String returns a description of the command.
+func (c *SymlinkCommand) String() string { return fmt.Sprintf("symlink %s %s", c.Target, c.Path) }
+
+// Run creates the link within dir.
+func (c *SymlinkCommand) Run(dir string) error {
+	path := filepath.Join(dir, c.Path)
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+	return symlink(c.Target, path)
+}
+
+// symlink creates a link at path to target, replacing any existing file.
+func symlink(target, path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Symlink(target, path)
+}
+
+// RemoveCommand represents a command that removes a file or directory tree.
+// Removing a path that doesn't exist is not an error.
+type RemoveCommand struct {
+	Path string
+}
+
+func (*RemoveCommand) command() {}
+
+// String returns a description of the command.
+func (c *RemoveCommand) String() string { return fmt.Sprintf("remove %s", c.Path) }
+
+// Run removes the path within dir.
+func (c *RemoveCommand) Run(dir string) error {
+	return os.RemoveAll(filepath.Join(dir, c.Path))
+}
+
+// varsSlice returns the keys and values of vars as a flat list, sorted by key.
+func varsSlice(vars map[string]string) []string {
+	keys := make([]string, 0, len(vars))
+	for k := range vars {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	a := make([]string, 0, len(vars)*2)
+	for _, k := range keys {
+		a = append(a, k, vars[k])
+	}
+	return a
+}
+
+// varsMap returns a map from a flat list of keys and values.
+func varsMap(a []string) map[string]string {
+	m := make(map[string]string, len(a)/2)
+	for i := 0; i+1 < len(a); i += 2 {
+		m[a[i]] = a[i+1]
+	}
+	return m
+}
+
+// addNative appends a built-in command to the current target.
+func (p *Parser) addNative(l *lua.State, name string, cmd NativeCommand) int {
+	if p.target == nil {
+		return p.raise(l, fmt.Errorf("%s: bake.%s: must be called within a target", p.location(l), name))
+	}
+	p.target.Commands = append(p.target.Commands, cmd)
+	return 0
+}
+
+// checkNativePath returns the string argument at index i, raising an error if
+// it is absolute or resolves outside the project root from the target's directory.
+func (p *Parser) checkNativePath(l *lua.State, name string, i int) string {
+	s := lua.CheckString(l, i)
+
+	rel := path.Join(filepath.ToSlash(p.path), s)
+	if path.IsAbs(s) || rel == ".." || strings.HasPrefix(rel, "../") {
+		p.raise(l, fmt.Errorf("%s: bake.%s: path outside project root: %q", p.location(l), name, s))
+	}
+	return s
+}
+
+// copy appends a "copy" command to the current target.
+func (p *Parser) copy(l *lua.State) int {
+	src, dst := p.checkNativePath(l, "copy", 1), p.checkNativePath(l, "copy", 2)
+	return p.addNative(l, "copy", &CopyCommand{Source: src, Dest: dst})
+}
+
+// write appends a "write" command to the current target.
+func (p *Parser) write(l *lua.State) int {
+	filename := p.checkNativePath(l, "write", 1)
+	return p.addNative(l, "write", &WriteCommand{Path: filename, Content: lua.CheckString(l, 2)})
+}
+
+// template appends a "write" command to the current target that executes
+// its content as a text/template with a table of string variables.
+func (p *Parser) template(l *lua.State) int {
+	filename := p.checkNativePath(l, "template", 1)
+	cmd := &WriteCommand{Path: filename, Content: lua.CheckString(l, 2), Vars: make(map[string]string)}
+
+	if !l.IsNoneOrNil(3) {
+		lua.CheckType(l, 3, lua.TypeTable)
+		for l.PushNil(); l.Next(3); l.Pop(1) {
+			if l.TypeOf(-2) != lua.TypeString {
+				return p.raise(l, fmt.Errorf("%s: bake.template: variable names must be strings", p.location(l)))
+			}
+			key, _ := l.ToString(-2)
+			value, ok := l.ToString(-1)
+			if !ok {
+				return p.raise(l, fmt.Errorf("%s: bake.template: variable %q must be a string", p.location(l), key))
+			}
+			cmd.Vars[key] = value
+		}
+	}
+
+	return p.addNative(l, "template", cmd)
+}
+
+// mkdir appends a "mkdir" command to the current target.
+func (p *Parser) mkdir(l *lua.State) int {
+	return p.addNative(l, "mkdir", &MkdirCommand{Path: p.checkNativePath(l, "mkdir", 1)})
+}
+
+// symlink appends a "symlink" command to the current target.
+// The link target is not checked since it is resolved relative to the link.
+func (p *Parser) symlink(l *lua.State) int {
+	target := lua.CheckString(l, 1)
+	return p.addNative(l, "symlink", &SymlinkCommand{Target: target, Path: p.checkNativePath(l, "symlink", 2)})
+}
+
+// remove appends a "remove" command to the current target.
+func (p *Parser) remove(l *lua.State) int {
+	return p.addNative(l, "remove", &RemoveCommand{Path: p.checkNativePath(l, "remove", 1)})
+}
@@ -0,0 +1,145 @@
+package bake_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/flynn/bake"
+)
+
+// Ensure copying a directory copies its files, modes and links.
+func TestCopyCommand_Run_Tree(t *testing.T) {
+	path := MustTempDir()
+	defer MustRemoveAll(path)
+
+	MustWriteFile(filepath.Join(path, "src", "a.txt"), []byte("A"))
+	MustWriteFile(filepath.Join(path, "src", "sub", "run.sh"), []byte("#!/bin/sh"))
+	if err := os.Chmod(filepath.Join(path, "src", "sub", "run.sh"), 0755); err != nil {
+		t.Fatal(err)
+	} else if err := os.Symlink("a.txt", filepath.Join(path, "src", "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := (&bake.CopyCommand{Source: "src", Dest: "out/dst"}).Run(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if buf := MustReadFile(filepath.Join(path, "out", "dst", "a.txt")); string(buf) != "A" {
+		t.Fatalf("unexpected data: %q", buf)
+	} else if fi, err := os.Stat(filepath.Join(path, "out", "dst", "sub", "run.sh")); err != nil {
+		t.Fatal(err)
+	} else if fi.Mode().Perm() != 0755 {
+		t.Fatalf("unexpected mode: %s", fi.Mode())
+	} else if target, err := os.Readlink(filepath.Join(path, "out", "dst", "link")); err != nil || target != "a.txt" {
+		t.Fatalf("unexpected link: %q, %v", target, err)
+	}
+}
+
+// Ensure templates are executed with their variables.
+func TestWriteCommand_Run_Template(t *testing.T) {
+	path := MustTempDir()
+	defer MustRemoveAll(path)
+
+	cmd := &bake.WriteCommand{Path: "gen/version.go", Content: "const Version = {{.version}}\n", Vars: map[string]string{"version": `"1.0"`}}
+	if err := cmd.Run(path); err != nil {
+		t.Fatal(err)
+	} else if buf := MustReadFile(filepath.Join(path, "gen", "version.go")); string(buf) != "const Version = \"1.0\"\n" {
+		t.Fatalf("unexpected data: %q", buf)
+	}
+
+	// Missing variables are an error instead of writing "<no value>".
+	cmd.Vars = map[string]string{}
+	if err := cmd.Run(path); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// Ensure directories and links can be created and removed.
+func TestNativeCommand_Run_MkdirSymlinkRemove(t *testing.T) {
+	path := MustTempDir()
+	defer MustRemoveAll(path)
+
+	for _, cmd := range []bake.NativeCommand{
+		&bake.MkdirCommand{Path: "a/b"},
+		&bake.SymlinkCommand{Target: "b", Path: "a/c"},
+		&bake.SymlinkCommand{Target: "b", Path: "a/c"}, // replaces existing link
+		&bake.RemoveCommand{Path: "a/b"},
+		&bake.RemoveCommand{Path: "missing"},
+	} {
+		if err := cmd.Run(path); err != nil {
+			t.Fatalf("%s: %s", cmd, err)
+		}
+	}
+
+	fis, err := ioutil.ReadDir(filepath.Join(path, "a"))
+	if err != nil {
+		t.Fatal(err)
+	} else if len(fis) != 1 || fis[0].Name() != "c" || fis[0].Mode()&os.ModeSymlink == 0 {
+		t.Fatalf("unexpected files: %#v", fis)
+	}
+}
+
+// Ensure built-in commands are added to targets and stored in the parse cache.
+func TestParser_Parse_Native(t *testing.T) {
+	path := MustTempDir()
+	defer MustRemoveAll(path)
+	cachePath := filepath.Join(MustTempDir(), "cache")
+	defer MustRemoveAll(filepath.Dir(cachePath))
+
+	MustWriteFile(filepath.Join(path, "sub", "Bakefile.lua"), []byte(`
+target("out", function()
+	bake.mkdir("out")
+	bake.copy("static", "out/static")
+	bake.write("out/VERSION", "1.0")
+	bake.template("out/index.html", "<h1>{{.title}}</h1>", { title = "Home" })
+	bake.symlink("index.html", "out/default.html")
+	bake.remove("out/tmp")
+end)
+`))
+
+	exp := []bake.Command{
+		&bake.MkdirCommand{Path: "out"},
+		&bake.CopyCommand{Source: "static", Dest: "out/static"},
+		&bake.WriteCommand{Path: "out/VERSION", Content: "1.0"},
+		&bake.WriteCommand{Path: "out/index.html", Content: "<h1>{{.title}}</h1>", Vars: map[string]string{"title": "Home"}},
+		&bake.SymlinkCommand{Target: "index.html", Path: "out/default.html"},
+		&bake.RemoveCommand{Path: "out/tmp"},
+	}
+
+	for i := 0; i < 2; i++ {
+		p := MustParseCached(path, cachePath)
+		if len(p.Evaluated) != 1-i {
+			t.Fatalf("%d. unexpected evaluated: %#v", i, p.Evaluated)
+		} else if target := p.Package.Target("sub/out"); target == nil {
+			t.Fatalf("%d. expected target", i)
+		} else if !reflect.DeepEqual(target.Commands, exp) {
+			t.Fatalf("%d. unexpected commands: %#v", i, target.Commands)
+		}
+	}
+}
+
+// Ensure built-in commands report invalid use.
+func TestParser_Parse_Native_Err(t *testing.T) {
+	for _, tt := range []struct {
+		source string
+		err    string
+	}{
+		{source: `bake.write("a", "")`, err: `sub/Bakefile.lua:1: bake.write: must be called within a target`},
+		{source: `target("t", function() bake.copy("a", "../../b") end)`, err: `sub/Bakefile.lua:1: bake.copy: path outside project root: "../../b"`},
+		{source: `target("t", function() bake.remove("/etc") end)`, err: `sub/Bakefile.lua:1: bake.remove: path outside project root: "/etc"`},
+		{source: `target("t", function() bake.template("a", "", { 1 }) end)`, err: `sub/Bakefile.lua:1: bake.template: variable names must be strings`},
+	} {
+		func() {
+			path := MustTempDir()
+			defer MustRemoveAll(path)
+
+			MustWriteFile(filepath.Join(path, "sub", "Bakefile.lua"), []byte(tt.source))
+			if err := bake.NewParser().ParseDir(path); err == nil || err.Error() != tt.err {
+				t.Errorf("%s: unexpected error: %v", tt.source, err)
+			}
+		}()
+	}
+}
@@ -5,10 +5,13 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/Shopify/go-lua"
 	"github.com/flynn/bake/assets"
+	"github.com/flynn/bake/internal"
 )
 
 //go:generate go-bindata -ignore=assets/assets.go -o assets/assets.go -pkg assets -prefix assets/ assets
@@ -20,49 +23,189 @@ type Parser struct {
 
 	base string // root directory
 	path string // working directory passed to targets
+	file string // Bakefile being parsed, relative to the root directory
+	err  error  // error raised from a built-in function
+
+	frame lua.Frame // function run by call()
+	line  int       // line being run by frame
+
+	ignores ignorePatterns      // patterns from ignore files in the directories being walked
+	visited map[string]struct{} // resolved directories already walked
+	links   []string            // symlinks to directories within the project, not walked
+	root    string              // resolved project root being walked
+
+	hermetic bool // restricts the standard libraries available to Bakefiles
+	rules    int  // number of rule functions stored in the Lua registry
+	globals  bool // a Bakefile set global variables so the cache is no longer used
+
+	modules map[string][]string // files loaded by each required module, including itself
+	loading []*moduleLoad       // modules being loaded, innermost last
+	sources map[string]struct{} // files loaded by the Bakefile being parsed
 
 	// Package being built by the parser.
 	// It is incrementally added to on every parse.
 	Package *Package
+
+	// If set, targets of unchanged Bakefiles are read from the cache instead
+	// of evaluating the Bakefile. Entries are added for every Bakefile parsed.
+	// The cache is not used by projects that opt out of hermetic parsing
+	// since their Bakefiles can read files that aren't tracked.
+	//
+	// Later Bakefiles may depend on global variables set by an earlier one,
+	// so once a Bakefile sets globals it and every Bakefile evaluated after
+	// it are left out of the cache. Globals aren't shared between Bakefiles
+	// evaluated concurrently so this only applies to serial parses.
+	Cache *ParseCache
+
+	// Bakefiles evaluated by the parser, relative to the root directory.
+	// Bakefiles whose targets were read from the cache are not included.
+	Evaluated []string
+
+	// Problems found while walking that don't stop the parse, such as a
+	// directory with more than one Bakefile.
+	Warnings []string
+
+	// Number of Bakefiles evaluated concurrently, each in a separate Lua
+	// state. Bakefiles are evaluated serially in a single state if less
+	// than two. Bakefiles should not depend on global variables set by
+	// other Bakefiles when evaluated concurrently.
+	Parallelism int
 }
 
 // NewParser returns a new instance of Parser.
 func NewParser() *Parser {
 	p := &Parser{
 		state:   lua.NewState(),
+		modules: make(map[string][]string),
 		Package: &Package{},
 	}
 	p.init()
 	return p
 }
 
+// BakefileNames are the file names parsed in each directory, in order of precedence.
+// Only the first one found in a directory is parsed.
+var BakefileNames = []string{"Bakefile.lua", "Bakefile"}
+
+// LibraryDir is the directory, relative to the project root, that modules
+// passed to require() are loaded from. For example, require("rules/go")
+// loads ".bake/rules/go.lua".
+const LibraryDir = ".bake"
+
+// DefaultIgnore are directory names that are never walked by the parser.
+var DefaultIgnore = []string{".git", ".bake"}
+
 // ParseDir recursively parses all bakefiles in a directory tree.
 // If a directory contains a Bakefile then it is parsed and added to the package.
 // All targets and their names are relative from path.
+//
+// Paths matching the patterns in a directory's .bakeignore file are not
+// walked. Symlinked directories are followed unless they resolve to a
+// directory within the project or to a directory that has already been
+// walked. Directories within the project are only walked through their real
+// path so a symlink to an ignored directory is reported in Warnings and its
+// Bakefiles are not parsed.
+//
+// Bakefiles are evaluated in walk order: a directory's Bakefile first, then
+// its subdirectories sorted by name. If Parallelism is greater than one then
+// Bakefiles are evaluated concurrently but merged in the same order.
 func (p *Parser) ParseDir(path string) error {
-	return p.parseDir(path, "")
+	p.visited = make(map[string]struct{})
+	defer func() { p.ignores, p.visited, p.links, p.root, p.globals = nil, nil, nil, "", false }()
+
+	// Restrict the standard libraries unless the project opts out.
+	config, err := ReadConfig(path)
+	if err != nil {
+		return err
+	}
+	p.sandbox(config.Hermetic)
+
+	// Symlinks are compared against the real path of the project root.
+	if p.root, err = filepath.EvalSymlinks(path); err != nil {
+		return err
+	}
+
+	// Find all Bakefiles first. Bakefiles found before a walk error are
+	// still parsed so errors are returned in the same order as they occur.
+	var files []string
+	walkErr := p.walkDir(path, "", &files)
+	if walkErr == nil {
+		p.warnUnwalkedLinks(path)
+	}
+
+	if p.Parallelism > 1 {
+		err = p.parseFilesParallel(path, files)
+	} else {
+		err = p.parseFiles(path, files)
+	}
+	if err != nil {
+		return err
+	}
+	return walkErr
 }
 
-func (p *Parser) parseDir(base, path string) error {
-	// Parse Bakefile in this directory first.
-	if err := p.parseFile(base, filepath.Join(path, "Bakefile.lua")); os.IsNotExist(err) {
+// walkDir appends the paths of the Bakefiles within path to files.
+func (p *Parser) walkDir(base, path string, files *[]string) error {
+	dir := filepath.Join(base, path)
+
+	// Skip directories that have already been walked, such as through a symlink loop.
+	realpath, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	} else if _, ok := p.visited[realpath]; ok {
+		return nil
+	}
+	p.visited[realpath] = struct{}{}
+
+	// Add ignore patterns for this directory tree. They're removed once the tree is walked.
+	n := len(p.ignores)
+	defer func() { p.ignores = p.ignores[:n] }()
+	if a, err := readIgnoreFile(filepath.Join(dir, IgnoreFile), filepath.ToSlash(path)); os.IsNotExist(err) {
 		// nop
 	} else if err != nil {
 		return err
+	} else {
+		p.ignores = append(p.ignores, a...)
+	}
+
+	// Add the Bakefile in this directory first.
+	// Bakefiles with a lower precedence are reported and skipped.
+	var found string
+	for _, name := range BakefileNames {
+		filename := filepath.Join(path, name)
+		if p.ignores.match(filepath.ToSlash(filename), false) {
+			continue
+		}
+
+		if _, err := os.Stat(filepath.Join(base, filename)); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		} else if found != "" {
+			p.Warnings = append(p.Warnings, fmt.Sprintf("%s: ignored, %s takes precedence", filepath.ToSlash(filename), filepath.ToSlash(found)))
+			continue
+		}
+		*files = append(*files, filename)
+		found = filename
 	}
 
 	// Read all files in path.
-	fis, err := readdir(filepath.Join(base, path))
+	fis, err := readdir(dir)
 	if err != nil {
 		return err
 	}
 
-	// Recursively parse each directory.
+	// Recursively walk each directory that isn't ignored. Symlinks to
+	// directories within the project are skipped and checked once the walk
+	// is finished since their targets may be ignored.
 	for _, fi := range fis {
-		if !fi.IsDir() {
+		if !isDirInfo(dir, fi) || p.ignored(path, fi.Name()) {
+			continue
+		} else if fi.Mode()&os.ModeSymlink != 0 && p.withinRoot(filepath.Join(dir, fi.Name())) {
+			p.links = append(p.links, filepath.Join(path, fi.Name()))
 			continue
 		}
-		if err := p.parseDir(base, filepath.Join(path, fi.Name())); err != nil {
+		if err := p.walkDir(base, filepath.Join(path, fi.Name()), files); err != nil {
 			return err
 		}
 	}
@@ -70,6 +213,290 @@ func (p *Parser) parseDir(base, path string) error {
 	return nil
 }
 
+// parseFiles parses each Bakefile in order using the parser's Lua state.
+func (p *Parser) parseFiles(base string, files []string) error {
+	for _, path := range files {
+		if err := p.parseBakefile(base, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseFilesParallel evaluates Bakefiles across a pool of parsers, each with
+// its own Lua state. Results are merged in order so the package and any
+// error returned match a serial parse.
+func (p *Parser) parseFilesParallel(base string, files []string) error {
+	// Read unchanged Bakefiles from the cache. Only the rest are evaluated.
+	results := make([]*parseResult, len(files))
+	var pending []*parseResult
+	for i, path := range files {
+		r := &parseResult{path: path, done: make(chan struct{})}
+		results[i] = r
+
+		if p.useCache() {
+			if r.entry, r.err = p.Cache.lookup(base, filepath.ToSlash(path)); r.err != nil || r.entry != nil {
+				close(r.done)
+				continue
+			}
+		}
+		pending = append(pending, r)
+	}
+
+	// Evaluate the remaining Bakefiles on a pool of workers.
+	ch, closing := make(chan *parseResult), make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < p.Parallelism && i < len(pending); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := NewParser()
+			w.sandbox(p.hermetic)
+			for r := range ch {
+				w.evaluate(base, r)
+				close(r.done)
+			}
+		}()
+	}
+	go func() {
+		defer close(ch)
+		for _, r := range pending {
+			select {
+			case ch <- r:
+			case <-closing:
+				return
+			}
+		}
+	}()
+	defer func() { close(closing); wg.Wait() }()
+
+	// Merge results in order, stopping at the first error.
+	for _, r := range results {
+		<-r.done
+		if err := p.merge(base, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// evaluate parses the Bakefile for r into an empty package.
+func (p *Parser) evaluate(base string, r *parseResult) {
+	p.Package = &Package{}
+	p.saveGlobals()
+	if r.err = p.parseFile(base, r.path); r.err != nil {
+		return
+	}
+	r.globals = p.globalsChanged()
+	r.targets, r.rules, r.sources = p.Package.Targets, p.Package.Rules, p.Package.Sources[filepath.ToSlash(r.path)]
+}
+
+// merge adds the targets from a Bakefile evaluated by another parser.
+func (p *Parser) merge(base string, r *parseResult) error {
+	file := filepath.ToSlash(r.path)
+	if r.err != nil {
+		return r.err
+	} else if r.entry != nil {
+		return p.addCached(file, r.entry)
+	}
+
+	n := len(p.Package.Targets)
+	for _, t := range r.targets {
+		if err := p.Package.AddTarget(t); err != nil {
+			return err
+		}
+	}
+	p.Package.Rules = append(p.Package.Rules, r.rules...)
+	p.addSources(file, r.sources)
+	p.Evaluated = append(p.Evaluated, file)
+
+	if r.globals {
+		p.globals = true
+	}
+	if len(r.rules) > 0 || r.globals {
+		return nil
+	}
+	return p.putCache(base, file, p.Package.Targets[n:])
+}
+
+// parseResult represents a Bakefile parsed by a worker in a parallel parse.
+type parseResult struct {
+	path    string
+	done    chan struct{} // closed when the result is ready
+	entry   *internal.BakefileCache
+	targets []*Target
+	rules   []*Rule
+	sources []string
+	globals bool // set global variables
+	err     error
+}
+
+// withinRoot returns true if filename resolves to a path within the project root.
+func (p *Parser) withinRoot(filename string) bool {
+	realpath, err := filepath.EvalSymlinks(filename)
+	if err != nil {
+		return false
+	}
+	return isWithin(p.root, realpath)
+}
+
+// isWithin returns true if path is root or a path under it.
+func isWithin(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// warnUnwalkedLinks adds a warning for each skipped symlink within base whose
+// target was not walked, such as one matching an ignore pattern.
+func (p *Parser) warnUnwalkedLinks(base string) {
+	for _, link := range p.links {
+		realpath, err := filepath.EvalSymlinks(filepath.Join(base, link))
+		if err != nil {
+			continue
+		} else if _, ok := p.visited[realpath]; ok {
+			continue
+		}
+
+		target, _ := filepath.Rel(p.root, realpath)
+		p.Warnings = append(p.Warnings, fmt.Sprintf("%s: not walked, links to ignored directory %s", filepath.ToSlash(link), filepath.ToSlash(target)))
+	}
+}
+
+// ignored returns true if the directory name within path should not be walked.
+func (p *Parser) ignored(path, name string) bool {
+	return defaultIgnored(name) || p.ignores.match(filepath.ToSlash(filepath.Join(path, name)), true)
+}
+
+// defaultIgnored returns true if the directory name is in DefaultIgnore.
+func defaultIgnored(name string) bool {
+	for _, s := range DefaultIgnore {
+		if name == s {
+			return true
+		}
+	}
+	return false
+}
+
+// parseBakefile adds the targets defined by the Bakefile at path to the package.
+// Targets are read from the cache if none of the files read while the Bakefile
+// was last evaluated have changed.
+func (p *Parser) parseBakefile(base, path string) error {
+	if !p.useCache() {
+		return p.parseFile(base, path)
+	}
+
+	file := filepath.ToSlash(path)
+	if e, err := p.Cache.lookup(base, file); err != nil {
+		return err
+	} else if e != nil {
+		return p.addCached(file, e)
+	}
+
+	n, rules := len(p.Package.Targets), len(p.Package.Rules)
+	p.saveGlobals()
+	if err := p.parseFile(base, path); err != nil {
+		return err
+	}
+
+	// Stop using the cache if later Bakefiles could read globals set by this one.
+	if p.globalsChanged() {
+		p.globals = true
+		return nil
+	}
+
+	// Rules call back into the Lua state so Bakefiles defining them can't be cached.
+	if len(p.Package.Rules) > rules {
+		return nil
+	}
+	return p.putCache(base, file, p.Package.Targets[n:])
+}
+
+// useCache returns true if the cache is set, Bakefiles are hermetic and no
+// Bakefile has set global variables.
+func (p *Parser) useCache() bool {
+	return p.Cache != nil && p.hermetic && !p.globals
+}
+
+// saveGlobals stores a copy of the global table in the registry so changes
+// made by a Bakefile can be found by globalsChanged.
+func (p *Parser) saveGlobals() {
+	l := p.state
+	l.NewTable()
+	l.PushGlobalTable()
+	for l.PushNil(); l.Next(-2); {
+		l.PushValue(-2)
+		l.Insert(-2)
+		l.RawSet(-5)
+	}
+	l.Pop(1)
+	l.SetField(lua.RegistryIndex, "__bake_globals")
+}
+
+// globalsChanged returns true if a global variable was set, changed or
+// removed since the last call to saveGlobals.
+func (p *Parser) globalsChanged() bool {
+	l := p.state
+	l.Field(lua.RegistryIndex, "__bake_globals")
+	l.PushGlobalTable()
+	defer l.Pop(2)
+
+	// Compare each table against the other so removed globals are found too.
+	for _, pair := range [][2]int{{-1, -2}, {-2, -1}} {
+		t, other := l.AbsIndex(pair[0]), l.AbsIndex(pair[1])
+		for l.PushNil(); l.Next(t); l.Pop(1) {
+			l.PushValue(-2)
+			l.RawGet(other)
+			equal := l.RawEqual(-1, -2)
+			l.Pop(1)
+			if !equal {
+				l.Pop(2)
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// addCached adds the targets of a Bakefile read from the cache to the package.
+func (p *Parser) addCached(file string, e *internal.BakefileCache) error {
+	for _, pb := range e.GetTargets() {
+		t, err := decodeTarget(pb)
+		if err != nil {
+			return err
+		} else if err := p.Package.AddTarget(t); err != nil {
+			return err
+		}
+	}
+	p.addSources(file, sourceNames(e))
+	p.Cache.put(file, e)
+	return nil
+}
+
+// putCache adds an entry for an evaluated Bakefile to the cache, if set.
+// Bakefiles with targets that can't be encoded are evaluated on every parse.
+func (p *Parser) putCache(base, file string, targets []*Target) error {
+	if !p.useCache() {
+		return nil
+	}
+
+	e, err := newBakefileCache(base, file, p.Package.Sources[file], targets)
+	if _, ok := err.(*UnsupportedCommandError); ok {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	p.Cache.put(file, e)
+	return nil
+}
+
+// addSources records the files read while parsing the Bakefile at file.
+func (p *Parser) addSources(file string, sources []string) {
+	if p.Package.Sources == nil {
+		p.Package.Sources = make(map[string][]string)
+	}
+	p.Package.Sources[file] = sources
+}
+
 // parseFile parses a file at path.
 func (p *Parser) parseFile(base, path string) error {
 	// Open file for reading.
@@ -81,25 +508,33 @@ func (p *Parser) parseFile(base, path string) error {
 
 	// Set the current working directory for all targets created.
 	// Reset after parsing file or on error.
-	p.base, p.path = base, filepath.Dir(path)
-	defer func() { p.base, p.path = "", "" }()
+	p.base, p.path, p.file = base, filepath.Dir(path), filepath.ToSlash(path)
+	p.sources = map[string]struct{}{p.file: {}, ConfigFile: {}}
+	defer func() { p.base, p.path, p.file, p.err, p.sources, p.loading = "", "", "", nil, nil, nil }()
 
 	// Load script into state.
-	if err := p.state.Load(f, path, ""); err != nil {
+	if err := p.state.Load(f, p.file, ""); err != nil {
 		return fmt.Errorf("%s: %s", path, err)
 	}
 
-	// Execute script.
-	if err := p.state.ProtectedCall(0, 0, 0); err != nil {
+	// Execute script. Errors raised by built-in functions are returned as is.
+	if err := p.call(0); p.err != nil {
+		return p.err
+	} else if err != nil {
 		return err
 	}
 
+	// Record every file read by the Bakefile.
+	p.addSources(p.file, stringSetSlice(p.sources))
+	p.Evaluated = append(p.Evaluated, p.file)
+
 	return nil
 }
 
 func (p *Parser) init() {
-	// Import standard library.
+	// Import standard library. Restricted by default until the project config is read.
 	lua.OpenLibraries(p.state)
+	p.saveBase()
 
 	// Load bake libraries.
 	for _, name := range []string{
@@ -118,10 +553,34 @@ func (p *Parser) init() {
 	// Add built-in functions.
 	p.state.Register("__bake_begin_target", p.beginTarget)
 	p.state.Register("__bake_end_target", p.endTarget)
+	p.state.Register("__bake_add_rule", p.addRule)
+	p.state.Register("__bake_glob", p.glob)
 	p.state.Register("__bake_set_title", p.setTitle)
 	p.state.Register("exec", p.exec)
 	p.state.Register("sh", p.sh)
 	p.state.Register("depends", p.depends)
+	p.state.Register("inputs", p.inputs)
+	p.state.Register("outputs", p.outputs)
+	p.state.Register("ignore", p.ignore)
+	p.state.Register("require", p.require)
+
+	// Add tracked file access and built-in commands to the bake library.
+	p.state.Global("bake")
+	for name, fn := range map[string]lua.Function{
+		"read":     p.read,
+		"copy":     p.copy,
+		"write":    p.write,
+		"template": p.template,
+		"mkdir":    p.mkdir,
+		"symlink":  p.symlink,
+		"remove":   p.remove,
+	} {
+		p.state.PushGoFunction(fn)
+		p.state.SetField(-2, name)
+	}
+	p.state.Pop(1)
+
+	p.sandbox(true)
 }
 
 // beginTarget initializes a target on the package.
@@ -141,6 +600,7 @@ func (p *Parser) beginTarget(l *lua.State) int {
 		Phony:        phony,
 		WorkDir:      p.path,
 		Dependencies: make([]string, len(dependencies)),
+		Location:     p.location(l),
 	}
 
 	// Copy dependencies with prepended path.
@@ -151,10 +611,172 @@ func (p *Parser) beginTarget(l *lua.State) int {
 	return 0
 }
 
+// addRule adds a pattern rule to the package if the name contains a "%" stem.
+// The rule's function is called with the stem whenever a target is created
+// from the rule. Returns false for names without a stem.
+func (p *Parser) addRule(l *lua.State) int {
+	name := lua.CheckString(l, 1)
+	dependencies, _ := l.ToUserData(2).(luaDependencies)
+	if !strings.Contains(name, "%") {
+		l.PushBoolean(false)
+		return 1
+	} else if strings.Count(name, "%") > 1 {
+		return p.raise(l, fmt.Errorf("%s: rule %q must contain a single %%", p.location(l), name))
+	}
+
+	// Mark as "phony" if it starts with an at-sign.
+	var phony bool
+	if strings.HasPrefix(name, "@") {
+		name = strings.TrimPrefix(name, "@")
+		phony = true
+	}
+
+	r := &Rule{
+		Name:         path.Join(p.path, name),
+		Phony:        phony,
+		Dependencies: make([]string, len(dependencies)),
+		Location:     p.location(l),
+	}
+	for i := range dependencies {
+		r.Dependencies[i] = path.Join(p.path, dependencies[i])
+	}
+
+	// Store the function in the registry so it can be called after parsing.
+	id := -1
+	if l.IsFunction(3) {
+		p.rules++
+		id = p.rules
+		lua.SubTable(l, lua.RegistryIndex, "__bake_rules")
+		l.PushValue(3)
+		l.RawSetInt(-2, id)
+		l.Pop(1)
+	}
+	r.Instantiate = p.ruleFunc(r, id, p.base, p.path, p.file)
+
+	p.Package.Rules = append(p.Package.Rules, r)
+	l.PushBoolean(true)
+	return 1
+}
+
+// ruleFunc returns a function that creates a target from r by calling the
+// rule's function, stored in the registry as id, with the stem. The rule's
+// Bakefile is treated as the one being parsed while the function runs.
+// Each "%" in the target's dependencies, inputs and outputs is replaced by the stem.
+func (p *Parser) ruleFunc(r *Rule, id int, base, dir, file string) func(stem string) (*Target, error) {
+	return func(stem string) (*Target, error) {
+		p.base, p.path, p.file, p.sources = base, dir, file, make(map[string]struct{})
+		defer func() { p.base, p.path, p.file, p.err, p.sources, p.target = "", "", "", nil, nil, nil }()
+
+		p.target = &Target{
+			Name:         strings.Replace(r.Name, "%", stem, 1),
+			Phony:        r.Phony,
+			WorkDir:      dir,
+			Dependencies: make([]string, len(r.Dependencies)),
+			Location:     r.Location,
+		}
+		for i, dep := range r.Dependencies {
+			p.target.Dependencies[i] = strings.Replace(dep, "%", stem, -1)
+		}
+
+		if id != -1 {
+			l := p.state
+			lua.SubTable(l, lua.RegistryIndex, "__bake_rules")
+			l.RawGetInt(-1, id)
+			l.Remove(-2)
+			l.PushString(stem)
+			if err := p.call(1); p.err != nil {
+				return nil, p.err
+			} else if err != nil {
+				return nil, err
+			}
+		}
+
+		t := p.target
+		for i, input := range t.Inputs {
+			t.Inputs[i] = strings.Replace(input, "%", stem, -1)
+		}
+		for i, output := range t.Outputs {
+			t.Outputs[i] = strings.Replace(output, "%", stem, -1)
+		}
+		return t, nil
+	}
+}
+
 // endTarget finalizes the current target and adds it to the package.
+// Raises an error if the target conflicts with one already defined.
 func (p *Parser) endTarget(l *lua.State) int {
-	p.Package.Targets = append(p.Package.Targets, p.target)
+	t := p.target
 	p.target = nil
+	if err := p.Package.AddTarget(t); err != nil {
+		return p.raise(l, err)
+	}
+	return 0
+}
+
+// location returns the line in the Bakefile being parsed that the running
+// built-in function was called from. Calls made through helper functions,
+// such as target() itself, are attributed to the top-level statement of the
+// Bakefile that called them.
+func (p *Parser) location(l *lua.State) Location {
+	loc := Location{File: p.file}
+	for level := 1; ; level++ {
+		frame, ok := lua.Stack(l, level)
+		if !ok {
+			return loc
+		}
+
+		ar, ok := lua.Info(l, "Sl", frame)
+		if !ok || ar.Source != p.file {
+			continue
+		} else if frame == p.frame {
+			loc.Line = p.line
+		} else if ar.CurrentLine > 0 {
+			loc.Line = ar.CurrentLine
+		}
+	}
+}
+
+// call calls the function on the stack with nargs arguments, tracking the
+// line being run by it. The line reported by lua.Info for a calling function
+// is that of the instruction after the call so instructions are counted
+// instead. Only the called function's own instructions are looked up.
+// The error value is popped from the stack if the call fails.
+func (p *Parser) call(nargs int) error {
+	lua.SetDebugHook(p.state, p.trace, lua.MaskCount, 1)
+	defer func() {
+		lua.SetDebugHook(p.state, nil, 0, 0)
+		p.frame, p.line = nil, 0
+	}()
+
+	if err := p.state.ProtectedCall(nargs, 0, 0); err != nil {
+		p.state.Pop(1)
+		return err
+	}
+	return nil
+}
+
+// trace records the line about to be run by the function called by call().
+// Its frame is running when the first instruction is counted.
+func (p *Parser) trace(l *lua.State, _ lua.Debug) {
+	frame, ok := lua.Stack(l, 0)
+	if !ok {
+		return
+	} else if p.frame == nil {
+		p.frame = frame
+	}
+
+	if frame == p.frame {
+		if ar, ok := lua.Info(l, "l", frame); ok {
+			p.line = ar.CurrentLine
+		}
+	}
+}
+
+// raise stops the script and causes the parse to return err.
+func (p *Parser) raise(l *lua.State, err error) int {
+	p.err = err
+	l.PushString(err.Error())
+	l.Error()
 	return 0
 }
 
@@ -184,6 +806,30 @@ func (p *Parser) setTitle(l *lua.State) int {
 	return 0
 }
 
+// inputs appends files or directories to the current target's declared inputs.
+func (p *Parser) inputs(l *lua.State) int {
+	for i, n := 1, l.Top(); i <= n; i++ {
+		p.target.Inputs = append(p.target.Inputs, path.Join(p.path, lua.CheckString(l, i)))
+	}
+	return 0
+}
+
+// outputs appends files or directories to the current target's declared outputs.
+func (p *Parser) outputs(l *lua.State) int {
+	for i, n := 1, l.Top(); i <= n; i++ {
+		p.target.Outputs = append(p.target.Outputs, path.Join(p.path, lua.CheckString(l, i)))
+	}
+	return 0
+}
+
+// ignore appends patterns to exclude from the current target's directory inputs.
+func (p *Parser) ignore(l *lua.State) int {
+	for i, n := 1, l.Top(); i <= n; i++ {
+		p.target.Ignore = append(p.target.Ignore, lua.CheckString(l, i))
+	}
+	return 0
+}
+
 // depends returns a list of strings as dependencies.
 func (p *Parser) depends(l *lua.State) int {
 	dependencies := make(luaDependencies, 0)
@@ -195,15 +841,141 @@ func (p *Parser) depends(l *lua.State) int {
 	return 1
 }
 
+// require loads a module from the library directory and returns its value.
+// Modules are only executed once. Later calls return the cached value but
+// still record the module's files as loaded by the current Bakefile.
+func (p *Parser) require(l *lua.State) int {
+	name := lua.CheckString(l, 1)
+
+	files, ok := p.modules[name]
+	if !ok {
+		var err error
+		if files, err = p.loadModule(l, name); err != nil {
+			return p.raise(l, err)
+		}
+	}
+
+	// Add the module's files to the module being loaded or to the Bakefile.
+	p.track(files...)
+
+	l.Field(lua.RegistryIndex, "_LOADED")
+	l.Field(-1, name)
+	return 1
+}
+
+// track records files as read by the module being loaded or, outside of
+// a module, by the Bakefile being parsed.
+func (p *Parser) track(files ...string) {
+	sources := p.sources
+	if n := len(p.loading); n > 0 {
+		sources = p.loading[n-1].files
+	}
+	for _, file := range files {
+		sources[file] = struct{}{}
+	}
+}
+
+// loadModule executes the module's file and stores its value in the state's
+// loaded table. Returns the files loaded by the module, including itself.
+func (p *Parser) loadModule(l *lua.State, name string) ([]string, error) {
+	if name == "" || path.IsAbs(name) || path.Clean(name) != name || name == ".." || strings.HasPrefix(name, "../") {
+		return nil, fmt.Errorf("%s: invalid module name: %q", p.location(l), name)
+	}
+	for _, m := range p.loading {
+		if m.name == name {
+			return nil, fmt.Errorf("%s: require cycle: %s", p.location(l), p.requireChain(name))
+		}
+	}
+
+	file := path.Join(LibraryDir, name+".lua")
+	f, err := os.Open(filepath.Join(p.base, filepath.FromSlash(file)))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s: module not found: %q (%s)", p.location(l), name, file)
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// Load the module by file name so its errors are reported as "file:line".
+	if err := l.Load(f, "@"+file, ""); err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+
+	// Execute the module while collecting the modules it requires.
+	// Errors raised by built-in functions, or nested requires, are returned as is.
+	m := &moduleLoad{name: name, files: map[string]struct{}{file: {}}}
+	p.loading = append(p.loading, m)
+	err = l.ProtectedCall(0, 1, 0)
+	p.loading = p.loading[:len(p.loading)-1]
+	if err != nil {
+		l.Pop(1)
+		if p.err != nil {
+			return nil, p.err
+		}
+		return nil, fmt.Errorf("%s: require %q: %s", p.location(l), name, err)
+	}
+
+	// Modules that return nothing are stored as true, like the standard require().
+	if l.IsNil(-1) {
+		l.Pop(1)
+		l.PushBoolean(true)
+	}
+	lua.SubTable(l, lua.RegistryIndex, "_LOADED")
+	l.Insert(-2)
+	l.SetField(-2, name)
+	l.Pop(1)
+
+	files := stringSetSlice(m.files)
+	p.modules[name] = files
+	return files, nil
+}
+
+// requireChain returns the names of the modules being loaded, ending with name.
+func (p *Parser) requireChain(name string) string {
+	a := make([]string, 0, len(p.loading)+1)
+	for _, m := range p.loading {
+		a = append(a, m.name)
+	}
+	return strings.Join(append(a, name), " -> ")
+}
+
+// moduleLoad represents a module being executed by require().
+type moduleLoad struct {
+	name  string
+	files map[string]struct{}
+}
+
 // luaDependencies represents a list of dependency names.
 type luaDependencies []string
 
-// readdir returns a slice of all files in path.
+// isDirInfo returns true if fi, an entry of dir, is a directory or a symlink to one.
+func isDirInfo(dir string, fi os.FileInfo) bool {
+	if fi.Mode()&os.ModeSymlink == 0 {
+		return fi.IsDir()
+	}
+	st, err := os.Stat(filepath.Join(dir, fi.Name()))
+	return err == nil && st.IsDir()
+}
+
+// readdir returns a slice of all files in path, sorted by name.
 func readdir(path string) ([]os.FileInfo, error) {
 	f, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
-	return f.Readdir(0)
+
+	fis, err := f.Readdir(0)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(fileInfosByName(fis))
+	return fis, nil
 }
+
+// fileInfosByName represents a list of file infos sortable by name.
+type fileInfosByName []os.FileInfo
+
+func (a fileInfosByName) Len() int           { return len(a) }
+func (a fileInfosByName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a fileInfosByName) Less(i, j int) bool { return a[i].Name() < a[j].Name() }
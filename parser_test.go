@@ -1,6 +1,7 @@
 package bake_test
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -67,6 +68,566 @@ target("bin/flynn-host", depends("A", "B"), function() end)
 	}
 }
 
+// Ensure a target can be parsed with declared inputs and ignore patterns.
+func TestParser_Parse_Inputs(t *testing.T) {
+	path := MustTempDir()
+	defer MustRemoveAll(path)
+
+	MustWriteFile(filepath.Join(path, "sub", "Bakefile.lua"), []byte(`
+target("image", function()
+	inputs("ctx", "VERSION")
+	ignore("*.tmp", ".git")
+end)
+`))
+
+	// Parse directory.
+	p := bake.NewParser()
+	if err := p.ParseDir(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// Verify inputs are relative to the project root.
+	target := p.Package.Target("sub/image")
+	if target == nil {
+		t.Fatal("expected target")
+	} else if !reflect.DeepEqual(target.Inputs, []string{"sub/ctx", "sub/VERSION"}) {
+		t.Fatalf("unexpected inputs: %v", target.Inputs)
+	} else if !reflect.DeepEqual(target.Ignore, []string{"*.tmp", ".git"}) {
+		t.Fatalf("unexpected ignore: %v", target.Ignore)
+	}
+}
+
+// Ensure declared outputs are relative to the project root and find their target.
+func TestParser_Parse_Outputs(t *testing.T) {
+	path := MustTempDir()
+	defer MustRemoveAll(path)
+
+	MustWriteFile(filepath.Join(path, "sub", "Bakefile.lua"), []byte(`
+target("app", function()
+	outputs("bin/app", "bin/app.map")
+end)
+`))
+
+	// Parse directory.
+	p := bake.NewParser()
+	if err := p.ParseDir(path); err != nil {
+		t.Fatal(err)
+	}
+
+	target := p.Package.Target("sub/app")
+	if target == nil {
+		t.Fatal("expected target")
+	} else if !reflect.DeepEqual(target.Outputs, []string{"sub/bin/app", "sub/bin/app.map"}) {
+		t.Fatalf("unexpected outputs: %v", target.Outputs)
+	} else if !reflect.DeepEqual(target.OutputFiles(), target.Outputs) {
+		t.Fatalf("unexpected output files: %v", target.OutputFiles())
+	} else if p.Package.Target("sub/bin/app.map") != target {
+		t.Fatal("expected target by output")
+	}
+}
+
+// Ensure a plain Bakefile is parsed and Bakefile.lua takes precedence over it with a warning.
+func TestParser_Parse_BakefileNames(t *testing.T) {
+	path := MustTempDir()
+	defer MustRemoveAll(path)
+
+	MustWriteFile(filepath.Join(path, "a", "Bakefile"), []byte(`target("plain")`))
+	MustWriteFile(filepath.Join(path, "b", "Bakefile"), []byte(`target("plain")`))
+	MustWriteFile(filepath.Join(path, "b", "Bakefile.lua"), []byte(`target("lua")`))
+
+	p := bake.NewParser()
+	if err := p.ParseDir(path); err != nil {
+		t.Fatal(err)
+	} else if a := p.Package.TargetNames(); !reflect.DeepEqual(a, []string{"a/plain", "b/lua"}) {
+		t.Fatalf("unexpected targets: %v", a)
+	} else if !reflect.DeepEqual(p.Warnings, []string{"b/Bakefile: ignored, b/Bakefile.lua takes precedence"}) {
+		t.Fatalf("unexpected warnings: %#v", p.Warnings)
+	}
+}
+
+// Ensure paths matching .bakeignore patterns are not walked.
+func TestParser_Parse_BakeIgnore(t *testing.T) {
+	path := MustTempDir()
+	defer MustRemoveAll(path)
+
+	MustWriteFile(filepath.Join(path, ".bakeignore"), []byte(`
+# Third-party code.
+vendor/
+/build
+**/fixtures/**
+!keep
+`))
+	MustWriteFile(filepath.Join(path, "sub", ".bakeignore"), []byte("gen\n"))
+	for _, dir := range []string{
+		"app",
+		"vendor/x",
+		"lib/vendor",
+		"build",
+		"lib/build",
+		"lib/fixtures/y",
+		"sub/gen",
+		"gen",
+		".git",
+	} {
+		MustWriteFile(filepath.Join(path, dir, "Bakefile.lua"), []byte(`target("t")`))
+	}
+
+	p := bake.NewParser()
+	if err := p.ParseDir(path); err != nil {
+		t.Fatal(err)
+	} else if a := p.Package.TargetNames(); !reflect.DeepEqual(a, []string{"app/t", "gen/t", "lib/build/t"}) {
+		t.Fatalf("unexpected targets: %v", a)
+	}
+}
+
+// Ensure symlinked directories are parsed once by their real path, even if they form a loop.
+func TestParser_Parse_Symlink(t *testing.T) {
+	path := MustTempDir()
+	defer MustRemoveAll(path)
+
+	MustWriteFile(filepath.Join(path, "shared", "Bakefile.lua"), []byte(`target("t")`))
+	if err := os.Symlink(filepath.Join(path, "shared"), filepath.Join(path, "link")); err != nil {
+		t.Fatal(err)
+	} else if err := os.Symlink(path, filepath.Join(path, "shared", "loop")); err != nil {
+		t.Fatal(err)
+	} else if err := os.Symlink(filepath.Join(path, "missing"), filepath.Join(path, "broken")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Directories outside the project are walked through the link.
+	external := MustTempDir()
+	defer MustRemoveAll(external)
+	MustWriteFile(filepath.Join(external, "Bakefile.lua"), []byte(`target("t")`))
+	if err := os.Symlink(external, filepath.Join(path, "external")); err != nil {
+		t.Fatal(err)
+	}
+
+	p := bake.NewParser()
+	if err := p.ParseDir(path); err != nil {
+		t.Fatal(err)
+	} else if a := p.Package.TargetNames(); !reflect.DeepEqual(a, []string{"external/t", "shared/t"}) {
+		t.Fatalf("unexpected targets: %v", a)
+	}
+}
+
+// Ensure symlinks to ignored directories within the project are reported.
+func TestParser_Parse_Symlink_Ignored(t *testing.T) {
+	path := MustTempDir()
+	defer MustRemoveAll(path)
+
+	MustWriteFile(filepath.Join(path, ".bakeignore"), []byte("vendor/\n"))
+	MustWriteFile(filepath.Join(path, "vendor", "lib", "Bakefile.lua"), []byte(`target("t")`))
+	if err := os.Symlink(filepath.Join(path, "vendor", "lib"), filepath.Join(path, "lib")); err != nil {
+		t.Fatal(err)
+	}
+
+	p := bake.NewParser()
+	if err := p.ParseDir(path); err != nil {
+		t.Fatal(err)
+	} else if a := p.Package.TargetNames(); len(a) != 0 {
+		t.Fatalf("unexpected targets: %v", a)
+	} else if !reflect.DeepEqual(p.Warnings, []string{"lib: not walked, links to ignored directory vendor/lib"}) {
+		t.Fatalf("unexpected warnings: %#v", p.Warnings)
+	}
+}
+
+// Ensure targets record the Bakefile line they're defined on, including
+// targets defined through Lua helper functions.
+func TestParser_Parse_Location(t *testing.T) {
+	path := MustTempDir()
+	defer MustRemoveAll(path)
+
+	MustWriteFile(filepath.Join(path, "sub", "Bakefile"), []byte(`
+function binary(name)
+	target(name, function() end)
+end
+
+target("a", function()
+	exec "run.sh"
+end)
+binary("b")
+`))
+
+	p := bake.NewParser()
+	if err := p.ParseDir(path); err != nil {
+		t.Fatal(err)
+	} else if loc := p.Package.Target("sub/a").Location; loc != (bake.Location{File: "sub/Bakefile", Line: 6}) {
+		t.Fatalf("unexpected location: %s", loc)
+	} else if loc := p.Package.Target("sub/b").Location; loc != (bake.Location{File: "sub/Bakefile", Line: 9}) {
+		t.Fatalf("unexpected location: %s", loc)
+	}
+}
+
+// Ensure targets with the same name return an error citing both definitions.
+func TestParser_Parse_ErrDuplicateTarget(t *testing.T) {
+	path := MustTempDir()
+	defer MustRemoveAll(path)
+
+	MustWriteFile(filepath.Join(path, "Bakefile.lua"), []byte(`
+target("sub/a")
+`))
+	MustWriteFile(filepath.Join(path, "sub", "Bakefile.lua"), []byte(`
+target("b")
+target("@a")
+`))
+
+	p := bake.NewParser()
+	if err := p.ParseDir(path); err == nil || err.Error() != `sub/Bakefile.lua:3: duplicate target "sub/a", previously defined at Bakefile.lua:2` {
+		t.Fatalf("unexpected error: %v", err)
+	} else if _, ok := err.(*bake.DuplicateTargetError); !ok {
+		t.Fatalf("unexpected error type: %T", err)
+	}
+}
+
+// Ensure modules are required from the library directory, executed once and
+// tracked for every Bakefile that loads them.
+func TestParser_Parse_Require(t *testing.T) {
+	path := MustTempDir()
+	defer MustRemoveAll(path)
+
+	MustWriteFile(filepath.Join(path, ".bake", "rules", "go.lua"), []byte(`
+local util = require("rules/util")
+loads = (loads or 0) + 1
+return {
+	binary = function(name)
+		target(util.prefix .. name, function() exec("go", "build") end)
+	end,
+}
+`))
+	MustWriteFile(filepath.Join(path, ".bake", "rules", "util.lua"), []byte(`return { prefix = "bin/" }`))
+	MustWriteFile(filepath.Join(path, "Bakefile.lua"), []byte(`
+local rules = require("rules/go")
+rules.binary("a")
+`))
+	MustWriteFile(filepath.Join(path, "sub", "Bakefile.lua"), []byte(`
+require("rules/go").binary("b")
+if loads ~= 1 then error("module loaded more than once") end
+`))
+	MustWriteFile(filepath.Join(path, "other", "Bakefile.lua"), []byte(`target("c")`))
+
+	p := bake.NewParser()
+	if err := p.ParseDir(path); err != nil {
+		t.Fatal(err)
+	} else if a := p.Package.TargetNames(); !reflect.DeepEqual(a, []string{"bin/a", "other/c", "sub/bin/b"}) {
+		t.Fatalf("unexpected targets: %#v", a)
+	} else if loc := p.Package.Target("sub/bin/b").Location; loc != (bake.Location{File: "sub/Bakefile.lua", Line: 2}) {
+		t.Fatalf("unexpected location: %s", loc)
+	}
+
+	if !reflect.DeepEqual(p.Package.Sources, map[string][]string{
+		"Bakefile.lua":       {".bake/config", ".bake/rules/go.lua", ".bake/rules/util.lua", "Bakefile.lua"},
+		"sub/Bakefile.lua":   {".bake/config", ".bake/rules/go.lua", ".bake/rules/util.lua", "sub/Bakefile.lua"},
+		"other/Bakefile.lua": {".bake/config", "other/Bakefile.lua"},
+	}) {
+		t.Fatalf("unexpected sources: %#v", p.Package.Sources)
+	}
+}
+
+// Ensure requiring missing modules, invalid names and cycles return errors.
+func TestParser_Parse_ErrRequire(t *testing.T) {
+	for _, tt := range []struct {
+		source string
+		err    string
+	}{
+		{source: `require("missing")`, err: `Bakefile.lua:1: module not found: "missing" (.bake/missing.lua)`},
+		{source: `require("../x")`, err: `Bakefile.lua:1: invalid module name: "../x"`},
+		{source: `require("a")`, err: `Bakefile.lua:1: require cycle: a -> b -> a`},
+		{source: `require("c")`, err: `Bakefile.lua:1: require "c": runtime error: .bake/c.lua:2: attempt to call a nil value`},
+	} {
+		func() {
+			path := MustTempDir()
+			defer MustRemoveAll(path)
+
+			MustWriteFile(filepath.Join(path, ".bake", "a.lua"), []byte(`require("b")`))
+			MustWriteFile(filepath.Join(path, ".bake", "b.lua"), []byte(`require("a")`))
+			MustWriteFile(filepath.Join(path, ".bake", "c.lua"), []byte("local x = 1\nmissing()\n"))
+			MustWriteFile(filepath.Join(path, "Bakefile.lua"), []byte(tt.source))
+
+			if err := bake.NewParser().ParseDir(path); err == nil || err.Error() != tt.err {
+				t.Errorf("%s: unexpected error: %v", tt.source, err)
+			}
+		}()
+	}
+}
+
+// Ensure Bakefiles are parsed in walk order, sorted by directory name.
+func TestParser_Parse_Order(t *testing.T) {
+	path := MustTempDir()
+	defer MustRemoveAll(path)
+
+	for _, dir := range []string{"c", "a/y", "a", "a/x", "b", ""} {
+		MustWriteFile(filepath.Join(path, dir, "Bakefile.lua"), []byte(`target("t")`))
+	}
+
+	p := bake.NewParser()
+	if err := p.ParseDir(path); err != nil {
+		t.Fatal(err)
+	} else if a := targetNames(p.Package.Targets); !reflect.DeepEqual(a, []string{"t", "a/t", "a/x/t", "a/y/t", "b/t", "c/t"}) {
+		t.Fatalf("unexpected targets: %#v", a)
+	}
+}
+
+// Ensure a parallel parse produces the same package as a serial parse.
+func TestParser_Parse_Parallel(t *testing.T) {
+	path := MustTempDir()
+	defer MustRemoveAll(path)
+	MustWriteBakefileTree(path, 5, 20)
+
+	serial := bake.NewParser()
+	if err := serial.ParseDir(path); err != nil {
+		t.Fatal(err)
+	}
+
+	parallel := bake.NewParser()
+	parallel.Parallelism = 4
+	if err := parallel.ParseDir(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if a, b := targetNames(parallel.Package.Targets), targetNames(serial.Package.Targets); len(a) != 301 || !reflect.DeepEqual(a, b) {
+		t.Fatalf("unexpected targets: %d, %d", len(a), len(b))
+	} else if !reflect.DeepEqual(parallel.Package.Targets, serial.Package.Targets) {
+		t.Fatal("package mismatch")
+	} else if !reflect.DeepEqual(parallel.Package.Sources, serial.Package.Sources) {
+		t.Fatal("sources mismatch")
+	} else if !reflect.DeepEqual(parallel.Evaluated, serial.Evaluated) {
+		t.Fatal("evaluated mismatch")
+	}
+}
+
+// Ensure a parallel parse returns the same error as a serial parse.
+func TestParser_Parse_Parallel_Err(t *testing.T) {
+	for _, files := range []map[string]string{
+		// Error raised by Lua in a later Bakefile than a duplicate target.
+		{"a/Bakefile.lua": `target("t")`, "a/t/Bakefile.lua": `target("../t")`, "b/Bakefile.lua": `error("boom")`},
+		// Duplicate target in a later Bakefile than a Lua error.
+		{"a/Bakefile.lua": `error("boom")`, "b/Bakefile.lua": `target("t")`, "b/t/Bakefile.lua": `target("../t")`},
+	} {
+		func() {
+			path := MustTempDir()
+			defer MustRemoveAll(path)
+			for name, data := range files {
+				MustWriteFile(filepath.Join(path, name), []byte(data))
+			}
+
+			serial := bake.NewParser()
+			parallel := bake.NewParser()
+			parallel.Parallelism = 4
+			if err, exp := parallel.ParseDir(path), serial.ParseDir(path); exp == nil {
+				t.Fatal("expected error")
+			} else if err == nil || err.Error() != exp.Error() {
+				t.Fatalf("unexpected error: %v, expected %v", err, exp)
+			}
+		}()
+	}
+}
+
+// Ensure pattern rules are called with the stem when a target is created.
+func TestParser_Parse_Rule(t *testing.T) {
+	path := MustTempDir()
+	defer MustRemoveAll(path)
+
+	MustWriteFile(filepath.Join(path, "proto", "Bakefile.lua"), []byte(`
+target("%.pb.go", depends("%.proto"), function(stem)
+	inputs("%.proto")
+	outputs("%.pb.go", "%_grpc.pb.go")
+	exec("protoc", "--go_out=.", stem .. ".proto")
+end)
+
+target("@%-lint", depends("%.pb.go"))
+`))
+
+	p := bake.NewParser()
+	if err := p.ParseDir(path); err != nil {
+		t.Fatal(err)
+	} else if len(p.Package.Targets) != 0 || len(p.Package.Rules) != 2 {
+		t.Fatalf("unexpected package: %d targets, %d rules", len(p.Package.Targets), len(p.Package.Rules))
+	} else if r := p.Package.Rules[0]; r.Name != "proto/%.pb.go" || !reflect.DeepEqual(r.Dependencies, []string{"proto/%.proto"}) || r.Location.Line != 2 {
+		t.Fatalf("unexpected rule: %#v", r)
+	}
+
+	// Create a target through the phony rule's dependency.
+	target, err := p.Package.InstantiateRule("proto/api-lint")
+	if err != nil {
+		t.Fatal(err)
+	} else if !target.Phony || !reflect.DeepEqual(target.Dependencies, []string{"proto/api.pb.go"}) {
+		t.Fatalf("unexpected target: %#v", target)
+	}
+
+	target, err = p.Package.InstantiateRule("proto/api.pb.go")
+	if err != nil {
+		t.Fatal(err)
+	} else if target.Name != "proto/api.pb.go" || target.WorkDir != "proto" || target.Location != (bake.Location{File: "proto/Bakefile.lua", Line: 2}) {
+		t.Fatalf("unexpected target: %#v", target)
+	} else if !reflect.DeepEqual(target.Dependencies, []string{"proto/api.proto"}) || !reflect.DeepEqual(target.Inputs, []string{"proto/api.proto"}) {
+		t.Fatalf("unexpected dependencies: %#v, %#v", target.Dependencies, target.Inputs)
+	} else if !reflect.DeepEqual(target.Outputs, []string{"proto/api.pb.go", "proto/api_grpc.pb.go"}) {
+		t.Fatalf("unexpected outputs: %#v", target.Outputs)
+	} else if !reflect.DeepEqual(target.Commands, []bake.Command{&bake.ExecCommand{Args: []string{"protoc", "--go_out=.", "api.proto"}}}) {
+		t.Fatalf("unexpected commands: %#v", target.Commands)
+	} else if p.Package.Target("proto/api.pb.go") != target {
+		t.Fatal("expected target added to package")
+	}
+
+	// Names not matching a rule don't create targets.
+	if target, err := p.Package.InstantiateRule("proto/api.go"); err != nil || target != nil {
+		t.Fatalf("unexpected target: %#v, %v", target, err)
+	}
+}
+
+// Ensure errors raised by a rule's function are returned when it's instantiated.
+func TestParser_Parse_Rule_Err(t *testing.T) {
+	path := MustTempDir()
+	defer MustRemoveAll(path)
+
+	MustWriteFile(filepath.Join(path, "Bakefile.lua"), []byte(`
+target("%.o", function(stem)
+	os.execute("cc " .. stem)
+end)
+`))
+
+	p := bake.NewParser()
+	p.Parallelism = 2
+	if err := p.ParseDir(path); err != nil {
+		t.Fatal(err)
+	} else if _, err := p.Package.InstantiateRule("main.o"); err == nil || err.Error() != `Bakefile.lua:3: forbidden call to os.execute: Bakefiles are hermetic (set "hermetic = false" in .bake/config to allow)` {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure foreach defines a target for each matching file.
+func TestParser_Parse_Foreach(t *testing.T) {
+	path := MustTempDir()
+	defer MustRemoveAll(path)
+
+	for _, name := range []string{"a.proto", "b.proto", "c.go", "sub/d.proto", "sub/deep/e.proto", ".git/f.proto"} {
+		MustWriteFile(filepath.Join(path, "proto", name), nil)
+	}
+	MustWriteFile(filepath.Join(path, "proto", "Bakefile.lua"), []byte(`
+foreach("*.proto", function(path, name)
+	target(name .. ".pb.go", function()
+		exec("protoc", path)
+	end)
+end)
+
+foreach("**/*.proto", function(path, name)
+	target("@lint/" .. name)
+end)
+`))
+
+	p := bake.NewParser()
+	if err := p.ParseDir(path); err != nil {
+		t.Fatal(err)
+	} else if a := targetNames(p.Package.Targets); !reflect.DeepEqual(a, []string{
+		"proto/a.pb.go", "proto/b.pb.go",
+		"proto/lint/a", "proto/lint/b", "proto/lint/sub/d", "proto/lint/sub/deep/e",
+	}) {
+		t.Fatalf("unexpected targets: %#v", a)
+	} else if cmds := p.Package.Target("proto/b.pb.go").Commands; !reflect.DeepEqual(cmds, []bake.Command{&bake.ExecCommand{Args: []string{"protoc", "b.proto"}}}) {
+		t.Fatalf("unexpected commands: %#v", cmds)
+	} else if a := p.Package.Sources["proto/Bakefile.lua"]; !reflect.DeepEqual(a, []string{".bake/config", "proto", "proto/Bakefile.lua", "proto/sub", "proto/sub/deep"}) {
+		t.Fatalf("unexpected sources: %#v", a)
+	}
+}
+
+// Ensure adding a file matched by foreach causes the Bakefile to be parsed again.
+func TestParser_Parse_Foreach_Cache(t *testing.T) {
+	path := MustTempDir()
+	defer MustRemoveAll(path)
+	cachePath := filepath.Join(MustTempDir(), "cache")
+	defer MustRemoveAll(filepath.Dir(cachePath))
+
+	MustWriteFile(filepath.Join(path, "cmd", "a", "main.go"), nil)
+	MustWriteFile(filepath.Join(path, "Bakefile.lua"), []byte(`
+foreach("cmd/*/main.go", function(path)
+	target("bin/" .. string.sub(path, 5, -9))
+end)
+`))
+
+	if p := MustParseCached(path, cachePath); !reflect.DeepEqual(p.Package.TargetNames(), []string{"bin/a"}) {
+		t.Fatalf("unexpected targets: %#v", p.Package.TargetNames())
+	} else if p := MustParseCached(path, cachePath); len(p.Evaluated) != 0 {
+		t.Fatalf("unexpected evaluated: %#v", p.Evaluated)
+	}
+
+	MustWriteFile(filepath.Join(path, "cmd", "b", "main.go"), nil)
+	if p := MustParseCached(path, cachePath); !reflect.DeepEqual(p.Package.TargetNames(), []string{"bin/a", "bin/b"}) {
+		t.Fatalf("unexpected targets: %#v", p.Package.TargetNames())
+	}
+}
+
+// Ensure foreach patterns can't match files outside of the project root.
+func TestParser_Parse_Foreach_ErrOutsideRoot(t *testing.T) {
+	path := MustTempDir()
+	defer MustRemoveAll(path)
+
+	MustWriteFile(filepath.Join(path, "Bakefile.lua"), []byte(`foreach("../*", function() end)`))
+	if err := bake.NewParser().ParseDir(path); err == nil || err.Error() != `Bakefile.lua:1: foreach: pattern outside project root: "../*"` {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Benchmarks parsing a tree of 1000 Bakefiles.
+func BenchmarkParser_ParseDir_1000_Serial(b *testing.B)     { benchmarkParserParseDir(b, 1) }
+func BenchmarkParser_ParseDir_1000_Parallel2(b *testing.B)  { benchmarkParserParseDir(b, 2) }
+func BenchmarkParser_ParseDir_1000_Parallel4(b *testing.B)  { benchmarkParserParseDir(b, 4) }
+func BenchmarkParser_ParseDir_1000_Parallel8(b *testing.B)  { benchmarkParserParseDir(b, 8) }
+func BenchmarkParser_ParseDir_1000_Parallel16(b *testing.B) { benchmarkParserParseDir(b, 16) }
+
+func benchmarkParserParseDir(b *testing.B, parallelism int) {
+	path := MustTempDir()
+	defer MustRemoveAll(path)
+	MustWriteBakefileTree(path, 10, 100)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		p := bake.NewParser()
+		p.Parallelism = parallelism
+		if err := p.ParseDir(path); err != nil {
+			b.Fatal(err)
+		} else if len(p.Package.Targets) != 3001 {
+			b.Fatalf("unexpected target count: %d", len(p.Package.Targets))
+		}
+	}
+}
+
+// MustWriteBakefileTree writes a root Bakefile and n*m Bakefiles in m
+// directories within each of n directories. Each nested Bakefile defines a
+// binary, a test and a generated file. Panic on error.
+func MustWriteBakefileTree(path string, n, m int) {
+	MustWriteFile(filepath.Join(path, "Bakefile.lua"), []byte(`target("@all", depends("**/bin"))`))
+	for i := 0; i < n; i++ {
+		for j := 0; j < m; j++ {
+			MustWriteFile(filepath.Join(path, fmt.Sprintf("pkg%d/cmd%d", i, j), "Bakefile.lua"), []byte(`
+local name = "bin"
+target(name, depends("gen.go"), function()
+	inputs("src")
+	exec("go", "build", "-o", name, "./src")
+end)
+
+target("@test", depends(name), function()
+	for i = 1, 10 do
+		sh("go test ./src/" .. i)
+	end
+end)
+
+target("gen.go", function()
+	exec("go", "generate")
+end)
+`))
+		}
+	}
+}
+
+// targetNames returns the names of targets in order.
+func targetNames(targets []*bake.Target) []string {
+	a := make([]string, len(targets))
+	for i, t := range targets {
+		a[i] = t.Name
+	}
+	return a
+}
+
 // MustTempDir returns a path to a temporary directory. Panic on error.
 func MustTempDir() string {
 	path, err := ioutil.TempDir("", "bake-")
@@ -92,3 +653,12 @@ func MustWriteFile(filename string, data []byte) {
 		panic(err)
 	}
 }
+
+// MustReadFile returns the contents of filename. Panic on error.
+func MustReadFile(filename string) []byte {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		panic(err)
+	}
+	return buf
+}
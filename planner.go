@@ -5,10 +5,19 @@ package bake
 type Planner struct {
 	pkg *Package
 
-	builds map[string]*Build
+	builds   map[string]*Build
+	planning map[*Target]struct{} // targets whose dependencies are being planned
 
 	// Used to determine dirty targets since last build.
 	Snapshot *Snapshot
+
+	// If true, all targets are built even if they are not dirty.
+	Force bool
+
+	// If true, targets depend on any target whose outputs they read during
+	// their last recorded build, in addition to their declared dependencies.
+	// Requires a snapshot.
+	InferDependencies bool
 }
 
 // NewPlanner returns a new instance of Planner.
@@ -20,7 +29,8 @@ func NewPlanner(pkg *Package) *Planner {
 func (p *Planner) Plan(patterns []string) (*Build, error) {
 	// Create a lookup of builds by target so dependencies share references.
 	p.builds = make(map[string]*Build)
-	defer func() { p.builds = nil }()
+	p.planning = make(map[*Target]struct{})
+	defer func() { p.builds, p.planning = nil, nil }()
 
 	dependencies, err := p.planMatches(patterns)
 	if err != nil {
@@ -47,8 +57,9 @@ func (p *Planner) planMatches(patterns []string) ([]*Build, error) {
 }
 
 // planMatch plans all targets matching a pattern.
+// Targets are created from pattern rules for names no target produces.
 func (p *Planner) planMatch(pattern string) ([]*Build, error) {
-	targets, err := p.pkg.MatchTargets(pattern)
+	targets, err := p.pkg.ResolveTargets(pattern)
 	if err != nil {
 		return nil, err
 	}
@@ -73,14 +84,27 @@ func (p *Planner) planTarget(t *Target) (*Build, error) {
 		return b, nil
 	}
 
+	// Track targets being planned so inferred dependencies can't create a cycle.
+	p.planning[t] = struct{}{}
+	defer delete(p.planning, t)
+
 	// Find dependent builds and changed inputs.
 	dependencies, err := p.planMatches(t.Dependencies)
 	if err != nil {
 		return nil, err
 	}
 
+	// Add builds for targets whose outputs were read in the last build.
+	if p.InferDependencies && p.Snapshot != nil {
+		inferred, err := p.planInferred(t)
+		if err != nil {
+			return nil, err
+		}
+		dependencies = Builds(append(dependencies, inferred...)).dedupe()
+	}
+
 	// If there are no dependencies then check if target changed or its files are dirty.
-	if len(dependencies) == 0 && p.Snapshot != nil {
+	if len(dependencies) == 0 && p.Snapshot != nil && !p.Force {
 		if dirty, err := p.Snapshot.IsTargetDirty(t); err != nil {
 			return nil, err
 		} else if !dirty {
@@ -97,3 +121,35 @@ func (p *Planner) planTarget(t *Target) (*Build, error) {
 
 	return b, nil
 }
+
+// planInferred plans the targets whose outputs t read during its last
+// recorded build but which t does not depend on.
+func (p *Planner) planInferred(t *Target) ([]*Build, error) {
+	info, err := p.Snapshot.Target(t.Name)
+	if err == ErrSnapshotTargetNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, len(info.Inputs))
+	for i, in := range info.Inputs {
+		names[i] = in.Name
+	}
+
+	var builds []*Build
+	for _, d := range FindUndeclaredDependencies(p.pkg, t, &Readset{Contents: names}) {
+		if _, ok := p.planning[d.Dependency]; ok {
+			continue
+		}
+
+		b, err := p.planTarget(d.Dependency)
+		if err != nil {
+			return nil, err
+		} else if b == nil {
+			continue
+		}
+		builds = append(builds, b)
+	}
+	return builds, nil
+}
@@ -72,3 +72,124 @@ func TestPlanner_Plan_NoChange(t *testing.T) {
 }
 
 */
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/flynn/bake"
+)
+
+// Ensure the planner schedules targets whose outputs were read in the last build.
+func TestPlanner_Plan_InferDependencies(t *testing.T) {
+	ss := NewSnapshot()
+	defer ss.Close()
+
+	pkg := &bake.Package{
+		Targets: []*bake.Target{
+			{Name: "A"},
+			{Name: "B"},
+		},
+	}
+
+	// Record A reading the output of B.
+	MustWriteFile(filepath.Join(ss.Root(), "B"), []byte("0"))
+	if err := ss.AddTarget(pkg.Targets[0], &bake.Readset{Contents: []string{"/B"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A is clean and doesn't depend on B without inference.
+	p := bake.NewPlanner(pkg)
+	p.Snapshot = ss.Snapshot
+	if b, err := p.Plan([]string{"A"}); err != nil {
+		t.Fatal(err)
+	} else if len(b.Dependencies()) != 0 {
+		t.Fatalf("unexpected dependencies: %d", len(b.Dependencies()))
+	}
+
+	// B is scheduled before A with inference.
+	p.InferDependencies = true
+	b, err := p.Plan([]string{"A"})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(b.Dependencies()) != 1 || b.Dependencies()[0].Name() != "A" {
+		t.Fatalf("unexpected builds: %#v", b.Dependencies())
+	} else if deps := b.Dependencies()[0].Dependencies(); len(deps) != 1 || deps[0].Name() != "B" {
+		t.Fatalf("unexpected dependencies: %#v", deps)
+	}
+}
+
+// Ensure inferred dependencies that form a cycle are ignored.
+func TestPlanner_Plan_InferDependencies_Cycle(t *testing.T) {
+	ss := NewSnapshot()
+	defer ss.Close()
+
+	pkg := &bake.Package{
+		Targets: []*bake.Target{
+			{Name: "A"},
+			{Name: "B"},
+		},
+	}
+
+	// Record each target reading the output of the other.
+	MustWriteFile(filepath.Join(ss.Root(), "A"), []byte("0"))
+	MustWriteFile(filepath.Join(ss.Root(), "B"), []byte("0"))
+	if err := ss.AddTarget(pkg.Targets[0], &bake.Readset{Contents: []string{"/B"}}); err != nil {
+		t.Fatal(err)
+	} else if err := ss.AddTarget(pkg.Targets[1], &bake.Readset{Contents: []string{"/A"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	p := bake.NewPlanner(pkg)
+	p.Snapshot = ss.Snapshot
+	p.Force = true
+	p.InferDependencies = true
+	b, err := p.Plan([]string{"A"})
+	if err != nil {
+		t.Fatal(err)
+	} else if deps := b.Dependencies()[0].Dependencies(); len(deps) != 1 || deps[0].Name() != "B" {
+		t.Fatalf("unexpected dependencies: %#v", deps)
+	} else if len(deps[0].Dependencies()) != 0 {
+		t.Fatalf("unexpected cycle: %#v", deps[0].Dependencies())
+	}
+}
+
+// Ensure targets are created from pattern rules for names no target produces.
+func TestPlanner_Plan_Rule(t *testing.T) {
+	var stems []string
+	rule := &bake.Rule{
+		Name:         "gen/%.pb.go",
+		Dependencies: []string{"proto/%.proto"},
+		Instantiate: func(stem string) (*bake.Target, error) {
+			stems = append(stems, stem)
+			return &bake.Target{Name: "gen/" + stem + ".pb.go", Dependencies: []string{"proto/" + stem + ".proto"}}, nil
+		},
+	}
+	pkg := &bake.Package{
+		Targets: []*bake.Target{
+			{Name: "bin/app", Dependencies: []string{"gen/a.pb.go", "gen/b.pb.go"}},
+			{Name: "proto/a.proto", Phony: true},
+			{Name: "proto/b.proto", Phony: true},
+		},
+		Rules: []*bake.Rule{rule},
+	}
+
+	b, err := bake.NewPlanner(pkg).Plan([]string{"bin/app"})
+	if err != nil {
+		t.Fatal(err)
+	} else if deps := b.Dependencies()[0].Dependencies(); len(deps) != 2 || deps[0].Name() != "gen/a.pb.go" || deps[1].Name() != "gen/b.pb.go" {
+		t.Fatalf("unexpected dependencies: %#v", deps)
+	} else if deps := deps[0].Dependencies(); len(deps) != 1 || deps[0].Name() != "proto/a.proto" {
+		t.Fatalf("unexpected rule dependencies: %#v", deps)
+	} else if !reflect.DeepEqual(stems, []string{"a", "b"}) {
+		t.Fatalf("unexpected stems: %#v", stems)
+	}
+
+	// Created targets are added to the package and reused by later plans.
+	if _, err := bake.NewPlanner(pkg).Plan([]string{"gen/a.pb.go", "gen/*.go"}); err != nil {
+		t.Fatal(err)
+	} else if len(stems) != 2 || len(pkg.Targets) != 5 {
+		t.Fatalf("unexpected instantiation: %#v, %d", stems, len(pkg.Targets))
+	}
+}
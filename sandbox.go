@@ -0,0 +1,148 @@
+package bake
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/Shopify/go-lua"
+)
+
+// allowedLibraryFunctions are the library functions available to hermetic
+// Bakefiles. They can't run commands, change files, read untracked files or
+// depend on the current time.
+var allowedLibraryFunctions = map[string][]string{
+	"os":    {"difftime"},
+	"debug": {"traceback"},
+}
+
+// forbiddenFunctions are the functions replaced with ones that stop the parse
+// when Bakefiles are hermetic. Library functions not listed here or in
+// allowedLibraryFunctions are removed.
+var forbiddenFunctions = map[string][]string{
+	"_G":    {"dofile", "loadfile"},
+	"io":    {"close", "flush", "input", "lines", "open", "output", "popen", "read", "tmpfile", "type", "write"},
+	"os":    {"clock", "date", "execute", "exit", "getenv", "remove", "rename", "setlocale", "time", "tmpname"},
+	"debug": {"debug", "gethook", "getinfo", "getlocal", "getmetatable", "getregistry", "getupvalue", "getuservalue", "sethook", "setlocal", "setmetatable", "setupvalue", "setuservalue", "upvalueid", "upvaluejoin"},
+}
+
+// sandbox restricts the standard libraries available to Bakefiles if
+// hermetic is true. Otherwise the full libraries are restored.
+//
+// The package library is also hidden from hermetic Bakefiles since its
+// loaded table holds the unrestricted libraries.
+func (p *Parser) sandbox(hermetic bool) {
+	l := p.state
+	p.hermetic = hermetic
+
+	// Restore unrestricted globals saved when the state was initialized.
+	if !hermetic {
+		for _, name := range forbiddenFunctions["_G"] {
+			l.Field(lua.RegistryIndex, "__bake_base")
+			l.Field(-1, name)
+			l.SetGlobal(name)
+			l.Pop(1)
+		}
+		for _, name := range []string{"io", "os", "debug", "package"} {
+			l.Field(lua.RegistryIndex, "_LOADED")
+			l.Field(-1, name)
+			l.SetGlobal(name)
+			l.Pop(1)
+		}
+		return
+	}
+
+	for _, name := range forbiddenFunctions["_G"] {
+		l.PushGoFunction(p.forbidden(name))
+		l.SetGlobal(name)
+	}
+
+	// Replace libraries with tables holding only the allowed functions.
+	for _, lib := range []string{"io", "os", "debug"} {
+		l.NewTable()
+		l.Field(lua.RegistryIndex, "_LOADED")
+		l.Field(-1, lib)
+		for _, name := range allowedLibraryFunctions[lib] {
+			l.Field(-1, name)
+			l.SetField(-4, name)
+		}
+		l.Pop(2)
+
+		for _, name := range forbiddenFunctions[lib] {
+			l.PushGoFunction(p.forbidden(lib + "." + name))
+			l.SetField(-2, name)
+		}
+		l.SetGlobal(lib)
+	}
+
+	l.PushNil()
+	l.SetGlobal("package")
+}
+
+// saveBase stores the unrestricted base functions so they can be restored
+// after the state has been sandboxed.
+func (p *Parser) saveBase() {
+	l := p.state
+	l.NewTable()
+	for _, name := range forbiddenFunctions["_G"] {
+		l.Global(name)
+		l.SetField(-2, name)
+	}
+	l.SetField(lua.RegistryIndex, "__bake_base")
+}
+
+// forbidden returns a function that stops the parse when called.
+func (p *Parser) forbidden(name string) lua.Function {
+	return func(l *lua.State) int {
+		return p.raise(l, &ForbiddenCallError{Location: p.location(l), Name: name})
+	}
+}
+
+// ForbiddenCallError is returned when a hermetic Bakefile calls a restricted function.
+type ForbiddenCallError struct {
+	Location Location
+	Name     string // function name, such as "os.execute"
+}
+
+// Error returns the error message.
+func (e *ForbiddenCallError) Error() string {
+	return fmt.Sprintf("%s: forbidden call to %s: Bakefiles are hermetic (set \"hermetic = false\" in %s to allow)", e.Location, e.Name, ConfigFile)
+}
+
+// read returns the contents of a file relative to the Bakefile's directory.
+// Returns nil if the file doesn't exist. The file is recorded as read by the
+// Bakefile so changes to it cause the Bakefile to be parsed again.
+func (p *Parser) read(l *lua.State) int {
+	name := lua.CheckString(l, 1)
+
+	rel := path.Join(filepath.ToSlash(p.path), path.Clean(name))
+	if path.IsAbs(name) || rel == ".." || strings.HasPrefix(rel, "../") {
+		return p.raise(l, fmt.Errorf("%s: bake.read: path outside project root: %q", p.location(l), name))
+	}
+
+	// Resolve symlinks so a link inside the project can't expose files outside it.
+	filename := filepath.Join(p.base, filepath.FromSlash(rel))
+	if realpath, err := filepath.EvalSymlinks(filename); err == nil {
+		root, err := filepath.EvalSymlinks(p.base)
+		if err != nil {
+			return p.raise(l, fmt.Errorf("%s: bake.read: %s", p.location(l), err))
+		} else if !isWithin(root, realpath) {
+			return p.raise(l, fmt.Errorf("%s: bake.read: path outside project root: %q", p.location(l), name))
+		}
+	}
+	p.track(rel)
+
+	buf, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		l.PushNil()
+		return 1
+	} else if err != nil {
+		return p.raise(l, fmt.Errorf("%s: bake.read: %s", p.location(l), err))
+	}
+
+	l.PushString(string(buf))
+	return 1
+}
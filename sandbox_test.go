@@ -0,0 +1,179 @@
+package bake_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/flynn/bake"
+)
+
+// Ensure hermetic Bakefiles report the restricted function they called.
+func TestParser_Parse_Hermetic(t *testing.T) {
+	for _, tt := range []struct {
+		source string
+		err    string
+	}{
+		{source: "\nos.execute('make')", err: `Bakefile.lua:2: forbidden call to os.execute: Bakefiles are hermetic (set "hermetic = false" in .bake/config to allow)`},
+		{source: `target("t", function() io.popen("ls") end)`, err: `Bakefile.lua:1: forbidden call to io.popen: Bakefiles are hermetic (set "hermetic = false" in .bake/config to allow)`},
+		{source: `local f = io.open("x")`, err: `Bakefile.lua:1: forbidden call to io.open: Bakefiles are hermetic (set "hermetic = false" in .bake/config to allow)`},
+		{source: `local t = os.time()`, err: `Bakefile.lua:1: forbidden call to os.time: Bakefiles are hermetic (set "hermetic = false" in .bake/config to allow)`},
+		{source: `local d = os.date("%Y")`, err: `Bakefile.lua:1: forbidden call to os.date: Bakefiles are hermetic (set "hermetic = false" in .bake/config to allow)`},
+		{source: `local c = os.clock()`, err: `Bakefile.lua:1: forbidden call to os.clock: Bakefiles are hermetic (set "hermetic = false" in .bake/config to allow)`},
+		{source: `dofile("x.lua")`, err: `Bakefile.lua:1: forbidden call to dofile: Bakefiles are hermetic (set "hermetic = false" in .bake/config to allow)`},
+		{source: `require("helper").env()`, err: `Bakefile.lua:1: forbidden call to os.getenv: Bakefiles are hermetic (set "hermetic = false" in .bake/config to allow)`},
+	} {
+		func() {
+			path := MustTempDir()
+			defer MustRemoveAll(path)
+
+			MustWriteFile(filepath.Join(path, ".bake", "helper.lua"), []byte(`return { env = function() return os.getenv("HOME") end }`))
+			MustWriteFile(filepath.Join(path, "Bakefile.lua"), []byte(tt.source))
+
+			err := bake.NewParser().ParseDir(path)
+			if _, ok := err.(*bake.ForbiddenCallError); !ok || err.Error() != tt.err {
+				t.Errorf("%s: unexpected error: %v", tt.source, err)
+			}
+		}()
+	}
+}
+
+// Ensure hermetic Bakefiles can use the safe parts of the restricted libraries
+// but can't reach the unrestricted libraries.
+func TestParser_Parse_Hermetic_Allowed(t *testing.T) {
+	path := MustTempDir()
+	defer MustRemoveAll(path)
+
+	MustWriteFile(filepath.Join(path, "Bakefile.lua"), []byte(`
+assert(package == nil)
+assert(io.stdout == nil)
+target(string.format("%d", os.difftime(10, 4)))
+`))
+
+	p := bake.NewParser()
+	if err := p.ParseDir(path); err != nil {
+		t.Fatal(err)
+	} else if p.Package.Target("6") == nil {
+		t.Fatalf("unexpected targets: %#v", p.Package.TargetNames())
+	}
+}
+
+// Ensure projects can opt out of hermetic parsing.
+func TestParser_Parse_Unrestricted(t *testing.T) {
+	path := MustTempDir()
+	defer MustRemoveAll(path)
+
+	MustWriteFile(filepath.Join(path, ".bake", "config"), []byte("# Allow reading the environment.\nhermetic = false\n"))
+	MustWriteFile(filepath.Join(path, "Bakefile.lua"), []byte(`
+assert(package.loaded.os == os)
+target(type(os.getenv("HOME")))
+`))
+	MustWriteFile(filepath.Join(path, "sub", "Bakefile.lua"), []byte(`target(type(io.open))`))
+
+	p := bake.NewParser()
+	p.Parallelism = 2
+	if err := p.ParseDir(path); err != nil {
+		t.Fatal(err)
+	} else if a := p.Package.TargetNames(); !reflect.DeepEqual(a, []string{"string", "sub/function"}) {
+		t.Fatalf("unexpected targets: %#v", a)
+	}
+}
+
+// Ensure files read through bake.read() are recorded and invalidate the cache.
+func TestParser_Parse_Read(t *testing.T) {
+	path := MustTempDir()
+	defer MustRemoveAll(path)
+	cachePath := filepath.Join(MustTempDir(), "cache")
+	defer MustRemoveAll(filepath.Dir(cachePath))
+
+	MustWriteFile(filepath.Join(path, "sub", "targets.txt"), []byte("a"))
+	MustWriteFile(filepath.Join(path, "sub", "Bakefile.lua"), []byte(`
+target(bake.read("targets.txt"))
+if bake.read("missing.txt") then target("present") end
+`))
+
+	p := MustParseCached(path, cachePath)
+	if a := p.Package.TargetNames(); !reflect.DeepEqual(a, []string{"sub/a"}) {
+		t.Fatalf("unexpected targets: %#v", a)
+	} else if a := p.Package.Sources["sub/Bakefile.lua"]; !reflect.DeepEqual(a, []string{".bake/config", "sub/Bakefile.lua", "sub/missing.txt", "sub/targets.txt"}) {
+		t.Fatalf("unexpected sources: %#v", a)
+	}
+
+	MustWriteFile(filepath.Join(path, "sub", "targets.txt"), []byte("c"))
+	p = MustParseCached(path, cachePath)
+	if a := p.Package.TargetNames(); !reflect.DeepEqual(a, []string{"sub/c"}) {
+		t.Fatalf("unexpected targets: %#v", a)
+	}
+
+	// Creating a file that was missing also invalidates the cache.
+	MustWriteFile(filepath.Join(path, "sub", "missing.txt"), nil)
+	if p = MustParseCached(path, cachePath); len(p.Evaluated) != 1 {
+		t.Fatalf("unexpected evaluated: %#v", p.Evaluated)
+	} else if a := p.Package.TargetNames(); !reflect.DeepEqual(a, []string{"sub/c", "sub/present"}) {
+		t.Fatalf("unexpected targets: %#v", a)
+	}
+}
+
+// Ensure files outside of the project root can't be read.
+func TestParser_Parse_Read_ErrOutsideRoot(t *testing.T) {
+	path := MustTempDir()
+	defer MustRemoveAll(path)
+
+	MustWriteFile(filepath.Join(path, "sub", "Bakefile.lua"), []byte(`bake.read("../../etc/passwd")`))
+	if err := bake.NewParser().ParseDir(path); err == nil || err.Error() != `sub/Bakefile.lua:1: bake.read: path outside project root: "../../etc/passwd"` {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure absolute paths and paths resolving to the parent can't be read.
+func TestParser_Parse_Read_ErrOutsideRoot_Abs(t *testing.T) {
+	for _, name := range []string{"/etc/passwd", "..", "sub/../../x"} {
+		path := MustTempDir()
+		defer MustRemoveAll(path)
+
+		MustWriteFile(filepath.Join(path, "Bakefile.lua"), []byte(fmt.Sprintf(`bake.read(%q)`, name)))
+		if err := bake.NewParser().ParseDir(path); err == nil || err.Error() != fmt.Sprintf(`Bakefile.lua:1: bake.read: path outside project root: %q`, name) {
+			t.Fatalf("%s: unexpected error: %v", name, err)
+		}
+	}
+}
+
+// Ensure symlinks that resolve outside of the project root can't be read.
+func TestParser_Parse_Read_ErrOutsideRoot_Symlink(t *testing.T) {
+	path, outside := MustTempDir(), MustTempDir()
+	defer MustRemoveAll(path)
+	defer MustRemoveAll(outside)
+
+	MustWriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"))
+	if err := os.Symlink(outside, filepath.Join(path, "ext")); err != nil {
+		t.Fatal(err)
+	}
+	MustWriteFile(filepath.Join(path, "Bakefile.lua"), []byte(`bake.read("ext/secret.txt")`))
+	if err := bake.NewParser().ParseDir(path); err == nil || err.Error() != `Bakefile.lua:1: bake.read: path outside project root: "ext/secret.txt"` {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure invalid config files return an error.
+func TestReadConfig_Err(t *testing.T) {
+	for _, tt := range []struct {
+		data string
+		err  string
+	}{
+		{data: "hermetic", err: ".bake/config:1: expected name = value"},
+		{data: "\nhermetic = maybe", err: `.bake/config:2: invalid hermetic value: "maybe"`},
+		{data: "strict = true", err: `.bake/config:1: unknown setting: "strict"`},
+	} {
+		func() {
+			path := MustTempDir()
+			defer MustRemoveAll(path)
+
+			MustWriteFile(filepath.Join(path, ".bake", "config"), []byte(tt.data))
+			if _, err := bake.ReadConfig(path); err == nil || err.Error() != tt.err {
+				t.Errorf("%q: unexpected error: %v", tt.data, err)
+			}
+		}()
+	}
+}
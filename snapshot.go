@@ -10,6 +10,8 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
+	"time"
 
 	"github.com/flynn/bake/internal"
 	"github.com/gogo/protobuf/proto"
@@ -43,18 +45,27 @@ func (ss *Snapshot) Root() string { return ss.root }
 //
 // If the target already exists then it is merged with the existing record.
 // The file dependencies of target are checked for changes and updated if needed.
-func (ss *Snapshot) AddTarget(t *Target, inputs []string) error {
-	// Create and stat input files.
-	files, err := newFileSnapshots(ss.root, inputs)
+// A nil readset records only the target's declared inputs.
+func (ss *Snapshot) AddTarget(t *Target, rs *Readset) error {
+	if rs == nil {
+		rs = &Readset{}
+	}
+
+	// Create and stat files read during the build and the target's declared inputs.
+	files, err := newFileSnapshots(ss.root, rs, t.Inputs, t.Ignore)
 	if err != nil {
 		return err
 	}
 
 	// Add target with current input file state.
 	ts := &targetSnapshot{
-		name:   t.Name,
-		hash:   hashTarget(t),
-		inputs: files,
+		name:      t.Name,
+		hash:      hashTarget(t),
+		inputs:    files,
+		outputs:   t.OutputFiles(),
+		declared:  t.Outputs,
+		ignore:    t.Ignore,
+		buildTime: time.Now().UnixNano(),
 	}
 
 	// Write to file.
@@ -81,7 +92,7 @@ func (ss *Snapshot) IsTargetDirty(t *Target) (bool, error) {
 	}
 
 	// Check if any input files or directories have changed.
-	dirty, err := fileSnapshots(ts.inputs).isDirty(ss.root)
+	dirty, err := fileSnapshots(ts.inputs).isDirty(ss.root, ts.ignore)
 	if err != nil {
 		return false, err
 	}
@@ -89,6 +100,111 @@ func (ss *Snapshot) IsTargetDirty(t *Target) (bool, error) {
 	return dirty, nil
 }
 
+// TargetNames returns a sorted list of all target names recorded in the snapshot.
+func (ss *Snapshot) TargetNames() ([]string, error) {
+	var a []string
+	if err := filepath.Walk(ss.path, func(path string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		} else if fi.IsDir() {
+			return nil
+		}
+
+		name, err := filepath.Rel(ss.path, path)
+		if err != nil {
+			return err
+		}
+		a = append(a, filepath.ToSlash(name))
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	sort.Strings(a)
+	return a, nil
+}
+
+// Target returns the recorded state of a target from its last build.
+func (ss *Snapshot) Target(name string) (*TargetInfo, error) {
+	ts, err := ss.readTarget(name)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &TargetInfo{
+		Name:     ts.name,
+		Hash:     ts.hash,
+		Outputs:  ts.outputs,
+		Declared: ts.declared,
+		Ignore:   ts.ignore,
+	}
+	if ts.buildTime != 0 {
+		info.BuildTime = time.Unix(0, ts.buildTime).UTC()
+	}
+	for _, f := range ts.inputs {
+		info.Inputs = append(info.Inputs, &InputInfo{
+			Name:    f.name,
+			Kind:    fileKindNames[f.kind],
+			Hash:    f.hash,
+			Content: f.content,
+		})
+	}
+	return info, nil
+}
+
+// IsInputDirty returns true if an input of a target returned by Target() has since changed.
+func (ss *Snapshot) IsInputDirty(t *TargetInfo, in *InputInfo) (bool, error) {
+	f := &fileSnapshot{name: in.Name, kind: fileKindValues[in.Kind], hash: in.Hash, content: in.Content}
+	return f.isDirty(ss.root, t.Ignore)
+}
+
+// OrphanedTargets returns a sorted list of recorded target names that no longer exist in pkg.
+// Targets that a pattern rule in pkg can create are not orphaned.
+func (ss *Snapshot) OrphanedTargets(pkg *Package) ([]string, error) {
+	names, err := ss.TargetNames()
+	if err != nil {
+		return nil, err
+	}
+
+	// Build a set of current target names.
+	set := make(map[string]struct{}, len(pkg.Targets))
+	for _, t := range pkg.Targets {
+		set[t.Name] = struct{}{}
+	}
+
+	var a []string
+	for _, name := range names {
+		if _, ok := set[name]; ok || pkg.matchRule(name) {
+			continue
+		}
+		a = append(a, name)
+	}
+	return a, nil
+}
+
+// RemoveTarget deletes a target's record from the snapshot.
+// Parent directories left empty by the removal are also deleted.
+func (ss *Snapshot) RemoveTarget(name string) error {
+	path := filepath.Join(ss.path, name)
+	if err := os.Remove(path); os.IsNotExist(err) {
+		return ErrSnapshotTargetNotFound
+	} else if err != nil {
+		return err
+	}
+
+	// Remove empty parent directories up to the snapshot path.
+	root := filepath.Clean(ss.path)
+	for dir := filepath.Dir(path); dir != root && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		if err := os.Remove(dir); err != nil {
+			break
+		}
+	}
+
+	return nil
+}
+
 // readTarget reads a target snapshot from within the snapshot and unmarshals it.
 func (ss *Snapshot) readTarget(name string) (*targetSnapshot, error) {
 	// Create target filename relative to snapshot path.
@@ -135,55 +251,172 @@ func (ss *Snapshot) writeTarget(t *targetSnapshot) error {
 	return nil
 }
 
+// TargetInfo represents the recorded state of a target in a snapshot.
+type TargetInfo struct {
+	Name      string       `json:"name"`
+	Hash      string       `json:"hash"`
+	BuildTime time.Time    `json:"buildTime"`
+	Inputs    []*InputInfo `json:"inputs"`
+	Outputs   []string     `json:"outputs"`
+	Declared  []string     `json:"declared,omitempty"` // outputs declared by the Bakefile
+	Ignore    []string     `json:"ignore,omitempty"`
+}
+
+// InputInfo represents the recorded state of a target's input file.
+type InputInfo struct {
+	Name    string `json:"name"`
+	Kind    string `json:"kind"`    // "content", "tree", "stat", "list" or "missing"
+	Hash    string `json:"hash"`    // metadata hash
+	Content string `json:"content"` // content or tree hash, blank for read directories
+}
+
 // targetSnapshot represents the state of a target.
 type targetSnapshot struct {
-	name   string
-	hash   string
-	inputs []*fileSnapshot
+	name      string
+	hash      string
+	inputs    []*fileSnapshot
+	outputs   []string
+	declared  []string
+	ignore    []string
+	buildTime int64
 }
 
 // encodeTargetSnapshot encodes a snapshot target into a protobuf object.
 func encodeTargetSnapshot(t *targetSnapshot) *internal.TargetSnapshot {
 	return &internal.TargetSnapshot{
-		Name:   proto.String(t.name),
-		Hash:   proto.String(t.hash),
-		Inputs: encodeFileSnapshots(t.inputs),
+		Name:            proto.String(t.name),
+		Hash:            proto.String(t.hash),
+		Inputs:          encodeFileSnapshots(t.inputs),
+		Outputs:         t.outputs,
+		DeclaredOutputs: t.declared,
+		Ignore:          t.ignore,
+		BuildTime:       proto.Int64(t.buildTime),
 	}
 }
 
 // decodeTargetSnapshot decodes a snapshot target from a protobuf object.
 func decodeTargetSnapshot(pb *internal.TargetSnapshot) *targetSnapshot {
 	return &targetSnapshot{
-		name:   pb.GetName(),
-		hash:   pb.GetHash(),
-		inputs: decodeFileSnapshots(pb.GetInputs()),
+		name:      pb.GetName(),
+		hash:      pb.GetHash(),
+		inputs:    decodeFileSnapshots(pb.GetInputs()),
+		outputs:   pb.GetOutputs(),
+		declared:  pb.GetDeclaredOutputs(),
+		ignore:    pb.GetIgnore(),
+		buildTime: pb.GetBuildTime(),
 	}
 }
 
+// File snapshot kinds determine how an input is checked for changes.
+const (
+	fileKindContent = 0 // file info and contents
+	fileKindTree    = 1 // recursive hash of a directory tree
+	fileKindStat    = 2 // file metadata only
+	fileKindList    = 3 // directory entry names
+	fileKindMissing = 4 // file must continue to not exist
+)
+
+// fileKindNames maps file snapshot kinds to display names.
+var fileKindNames = map[int]string{
+	fileKindContent: "content",
+	fileKindTree:    "tree",
+	fileKindStat:    "stat",
+	fileKindList:    "list",
+	fileKindMissing: "missing",
+}
+
+// fileKindValues maps display names to file snapshot kinds.
+var fileKindValues = map[string]int{
+	"content": fileKindContent,
+	"tree":    fileKindTree,
+	"stat":    fileKindStat,
+	"list":    fileKindList,
+	"missing": fileKindMissing,
+}
+
+// fileKindPriority orders kinds by the strength of their check.
+// When a file is accessed in multiple ways only the strongest check is kept.
+var fileKindPriority = map[int]int{
+	fileKindMissing: 0,
+	fileKindStat:    1,
+	fileKindList:    2,
+	fileKindContent: 3,
+	fileKindTree:    4,
+}
+
 // fileSnapshot represents the state of a file dependency for a target.
 type fileSnapshot struct {
 	name    string
+	kind    int
 	hash    string
 	content string
 }
 
 // newFileSnapshot returns a new instance of fileSnapshot for a filename.
-func newFileSnapshot(path, name string) (*fileSnapshot, error) {
-	hash, err := hashFileInfo(filepath.Join(path, name))
+// Directories of kind fileKindTree are hashed recursively, excluding files matching ignore.
+// Returns an error satisfying os.IsNotExist() if a file of kind fileKindMissing exists.
+func newFileSnapshot(path, name string, kind int, ignore []string) (*fileSnapshot, error) {
+	f := &fileSnapshot{name: name, kind: kind}
+
+	// Missing files only record that they don't exist.
+	if kind == fileKindMissing {
+		if _, err := os.Lstat(filepath.Join(path, name)); err == nil {
+			return nil, &os.PathError{Op: "lstat", Path: name, Err: os.ErrNotExist}
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+		return f, nil
+	}
+
+	hash, err := f.hashInfo(path)
 	if err != nil {
 		return nil, err
 	}
-	content, err := hashFileContent(filepath.Join(path, name))
-	if err != nil {
+	f.hash = hash
+
+	if f.content, err = f.hashContent(path, ignore); err != nil {
 		return nil, err
 	}
-	return &fileSnapshot{name: name, hash: hash, content: content}, nil
+	return f, nil
+}
+
+// hashInfo returns the hash of the file's metadata based on its kind.
+// Trees don't include their entry names since ignored entries are only
+// excluded from the tree's content hash.
+func (f *fileSnapshot) hashInfo(path string) (string, error) {
+	if f.kind == fileKindStat || f.kind == fileKindTree {
+		return hashFileStat(filepath.Join(path, f.name))
+	}
+	return hashFileInfo(filepath.Join(path, f.name))
+}
+
+// hashContent returns the hash of the file's contents based on its kind.
+// Metadata-only kinds always return a blank hash.
+func (f *fileSnapshot) hashContent(path string, ignore []string) (string, error) {
+	switch f.kind {
+	case fileKindTree:
+		return hashTree(filepath.Join(path, f.name), ignore)
+	case fileKindStat, fileKindList:
+		return "", nil
+	default:
+		return hashFileContent(filepath.Join(path, f.name))
+	}
 }
 
 // isDirty returns true if the hash of the file has changed or the file was deleted.
-func (f *fileSnapshot) isDirty(path string) (bool, error) {
+// Missing files are dirty once they exist.
+func (f *fileSnapshot) isDirty(path string, ignore []string) (bool, error) {
+	if f.kind == fileKindMissing {
+		if _, err := os.Lstat(filepath.Join(path, f.name)); os.IsNotExist(err) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
 	// Check for differences in file info first.
-	if h, err := hashFileInfo(filepath.Join(path, f.name)); os.IsNotExist(err) {
+	if h, err := f.hashInfo(path); os.IsNotExist(err) {
 		return true, nil
 	} else if err != nil {
 		return false, err
@@ -192,7 +425,7 @@ func (f *fileSnapshot) isDirty(path string) (bool, error) {
 	}
 
 	// If info is the same then compare a hash of the contents.
-	if h, err := hashFileContent(filepath.Join(path, f.name)); err != nil {
+	if h, err := f.hashContent(path, ignore); err != nil {
 		return false, err
 	} else if f.content != h {
 		return true, nil
@@ -207,6 +440,7 @@ func encodeFileSnapshot(f *fileSnapshot) *internal.FileSnapshot {
 		Name:    proto.String(f.name),
 		Hash:    proto.String(f.hash),
 		Content: proto.String(f.content),
+		Kind:    proto.Int32(int32(f.kind)),
 	}
 }
 
@@ -214,6 +448,7 @@ func encodeFileSnapshot(f *fileSnapshot) *internal.FileSnapshot {
 func decodeFileSnapshot(pb *internal.FileSnapshot) *fileSnapshot {
 	return &fileSnapshot{
 		name:    pb.GetName(),
+		kind:    int(pb.GetKind()),
 		hash:    pb.GetHash(),
 		content: pb.GetContent(),
 	}
@@ -223,15 +458,71 @@ func decodeFileSnapshot(pb *internal.FileSnapshot) *fileSnapshot {
 type fileSnapshots []*fileSnapshot
 
 // newFileSnapshots returns a slice of stat'd snapshot files.
-func newFileSnapshots(path string, names []string) ([]*fileSnapshot, error) {
+//
+// Files in the readset are snapshotted based on how they were accessed. If a
+// file was accessed in multiple ways then only the strongest check is kept.
+// Directories in declared are hashed recursively and files within them
+// matching ignore are excluded from the snapshot.
+func newFileSnapshots(path string, rs *Readset, declared, ignore []string) ([]*fileSnapshot, error) {
+	// Determine the kind of each file by its cleaned name.
+	type entry struct {
+		name string
+		kind int
+	}
+	m := make(map[string]entry)
+	add := func(names []string, kind int) {
+		for _, name := range names {
+			key := cleanInputName(name)
+			if e, ok := m[key]; ok && fileKindPriority[e.kind] >= fileKindPriority[kind] {
+				continue
+			}
+			m[key] = entry{name: name, kind: kind}
+		}
+	}
+
+	// Add accessed files. Files ignored within a declared directory are skipped.
+	for _, a := range []struct {
+		names []string
+		kind  int
+	}{
+		{rs.Misses, fileKindMissing},
+		{rs.Stats, fileKindStat},
+		{rs.Listings, fileKindList},
+		{rs.Contents, fileKindContent},
+	} {
+		var names []string
+		for _, name := range a.names {
+			if !isIgnoredInput(name, declared, ignore) {
+				names = append(names, name)
+			}
+		}
+		add(names, a.kind)
+	}
+
+	// Declared inputs are always kept. Directories are hashed as trees.
+	for _, name := range declared {
+		kind := fileKindContent
+		if isDir(filepath.Join(path, name)) {
+			kind = fileKindTree
+		}
+		m[cleanInputName(name)] = entry{name: name, kind: kind}
+	}
+
 	// Sort filenames for consistency.
+	kinds := make(map[string]int, len(m))
+	names := make([]string, 0, len(m))
+	for _, e := range m {
+		kinds[e.name] = e.kind
+		names = append(names, e.name)
+	}
 	sort.Strings(names)
 
 	// Build list of snapshot files with current stats.
 	// Ignore files that have been deleted. They are likely temporary files.
+	// Missing files that now exist were likely created by the target itself.
 	a := make([]*fileSnapshot, 0, len(names))
 	for _, name := range names {
-		f, err := newFileSnapshot(path, name)
+		f, err := newFileSnapshot(path, name, kinds[name], ignore)
 		if os.IsNotExist(err) {
 			continue
 		} else if err != nil {
@@ -243,9 +534,9 @@ func newFileSnapshots(path string, names []string) ([]*fileSnapshot, error) {
 }
 
 // isDirty returns true after finding the first dirty file.
-func (a fileSnapshots) isDirty(path string) (bool, error) {
+func (a fileSnapshots) isDirty(path string, ignore []string) (bool, error) {
 	for _, f := range a {
-		v, err := f.isDirty(path)
+		v, err := f.isDirty(path, ignore)
 		if err != nil {
 			return false, err
 		} else if v {
@@ -278,6 +569,14 @@ func hashTarget(t *Target) string {
 	h := sha256.New()
 	writeStrings(h, t.Dependencies)
 
+	// Only include declared inputs when set so existing target hashes are unchanged.
+	if len(t.Inputs) > 0 || len(t.Ignore) > 0 {
+		h.Write([]byte("inputs"))
+		writeStrings(h, t.Inputs)
+		h.Write([]byte("ignore"))
+		writeStrings(h, t.Ignore)
+	}
+
 	for _, c := range t.Commands {
 		switch c := c.(type) {
 		case *ExecCommand:
@@ -286,6 +585,26 @@ func hashTarget(t *Target) string {
 		case *ShellCommand:
 			h.Write([]byte("shell"))
 			h.Write([]byte(c.Source))
+		case *CopyCommand:
+			h.Write([]byte("copy"))
+			writeStrings(h, []string{c.Source, c.Dest})
+		case *WriteCommand:
+			if c.Vars == nil {
+				h.Write([]byte("write"))
+				writeStrings(h, []string{c.Path, c.Content})
+			} else {
+				h.Write([]byte("template"))
+				writeStrings(h, append([]string{c.Path, c.Content}, varsSlice(c.Vars)...))
+			}
+		case *MkdirCommand:
+			h.Write([]byte("mkdir"))
+			writeStrings(h, []string{c.Path})
+		case *SymlinkCommand:
+			h.Write([]byte("symlink"))
+			writeStrings(h, []string{c.Target, c.Path})
+		case *RemoveCommand:
+			h.Write([]byte("remove"))
+			writeStrings(h, []string{c.Path})
 		default:
 			panic("unreachable")
 		}
@@ -371,6 +690,167 @@ func hashFileContent(path string) (string, error) {
 	return fmt.Sprintf("%64x", h.Sum(nil)), nil
 }
 
+// hashFileStat generates a hash for a file's metadata without following symbolic links.
+// Regular files are hashed using their mode, mtime & size. Directories are hashed
+// using only their mode and symbolic links also include their target.
+func hashFileStat(path string) (string, error) {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	h.Write(u32tob(uint32(fi.Mode())))
+
+	switch {
+	case fi.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(path)
+		if err != nil {
+			return "", err
+		}
+		h.Write([]byte(target))
+
+	case !fi.IsDir():
+		h.Write(u64tob(uint64(fi.ModTime().UnixNano())))
+		h.Write(u64tob(uint64(fi.Size())))
+	}
+
+	return fmt.Sprintf("%64x", h.Sum(nil)), nil
+}
+
+// hashTree generates a Merkle hash for a file or directory tree.
+// Each directory's hash is derived from the names, modes & hashes of its
+// entries so a change anywhere within the tree changes the root hash.
+// Files whose path relative to the root matches ignore are excluded.
+func hashTree(path string, ignore []string) (string, error) {
+	sum, err := hashTreeEntry(path, "", ignore)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%64x", sum), nil
+}
+
+// hashTreeEntry returns the hash of the entry at rel within root.
+func hashTreeEntry(root, rel string, ignore []string) ([]byte, error) {
+	path := filepath.Join(root, rel)
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+	h.Write(u32tob(uint32(fi.Mode())))
+
+	switch {
+	case fi.Mode()&os.ModeSymlink != 0:
+		// Hash the link itself instead of following it.
+		target, err := os.Readlink(path)
+		if err != nil {
+			return nil, err
+		}
+		h.Write([]byte(target))
+
+	case fi.IsDir():
+		names, err := readdirnames(path)
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			childRel := filepath.Join(rel, name)
+			if matchIgnore(childRel, ignore) {
+				continue
+			}
+
+			// Skip files removed since the directory was read.
+			sum, err := hashTreeEntry(root, childRel, ignore)
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+
+			writeStrings(h, []string{name})
+			h.Write(sum)
+		}
+
+	case fi.Mode().IsRegular():
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		if _, err := io.Copy(h, f); err != nil {
+			return nil, err
+		}
+	}
+
+	return h.Sum(nil), nil
+}
+
+// matchIgnore returns true if the relative path rel matches any pattern.
+// Patterns containing a slash match against the full path. Otherwise they
+// match against each path segment so ignored directories exclude their contents.
+func matchIgnore(rel string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if strings.Contains(pattern, "/") {
+			if matched, _ := filepath.Match(pattern, rel); matched {
+				return true
+			}
+			continue
+		}
+
+		for _, segment := range strings.Split(rel, "/") {
+			if matched, _ := filepath.Match(pattern, segment); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isIgnoredInput returns true if name is within a declared directory and matches ignore.
+func isIgnoredInput(name string, declared, ignore []string) bool {
+	if len(ignore) == 0 {
+		return false
+	}
+
+	name = cleanInputName(name)
+	for _, dir := range declared {
+		dir = cleanInputName(dir)
+		if dir == "." {
+			return matchIgnore(name, ignore)
+		} else if strings.HasPrefix(name, dir+"/") {
+			return matchIgnore(strings.TrimPrefix(name, dir+"/"), ignore)
+		}
+	}
+	return false
+}
+
+// cleanInputName returns name relative to the project root in a canonical form.
+// File system readsets use a leading slash while declared inputs do not.
+func cleanInputName(name string) string {
+	return filepath.Clean(strings.TrimPrefix(name, "/"))
+}
+
+// isDir returns true if path exists and is a directory.
+func isDir(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.IsDir()
+}
+
+// readdirnames returns the names of all files in a directory.
+func readdirnames(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdirnames(0)
+}
+
 // writeStrings writes a null terminated strings to h.
 func writeStrings(w io.Writer, a []string) {
 	for _, s := range a {
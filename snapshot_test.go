@@ -4,6 +4,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 	"testing"
 	"time"
 
@@ -60,6 +61,25 @@ func TestSnapshot_IsTargetDirty_Commands(t *testing.T) {
 	}
 }
 
+// Ensures that a target is marked as dirty if a template's variables change.
+func TestSnapshot_IsTargetDirty_TemplateVars(t *testing.T) {
+	ss := NewSnapshot()
+	defer ss.Close()
+
+	cmd := &bake.WriteCommand{Path: "VERSION", Content: "{{.v}}", Vars: map[string]string{"v": "1"}}
+	target := &bake.Target{Name: "T", Commands: []bake.Command{cmd}}
+	if err := ss.AddTarget(target, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd.Vars["v"] = "2"
+	if dirty, err := ss.IsTargetDirty(target); err != nil {
+		t.Fatal(err)
+	} else if !dirty {
+		t.Fatal("expected dirty")
+	}
+}
+
 // Ensures that a target is marked as dirty if its files change.
 func TestSnapshot_IsTargetDirty_Files(t *testing.T) {
 	t.Parallel()
@@ -72,7 +92,7 @@ func TestSnapshot_IsTargetDirty_Files(t *testing.T) {
 	MustWriteFile(filepath.Join(ss.Root(), "b"), []byte("1"))
 
 	// Add target with input files.
-	if err := ss.AddTarget(&bake.Target{Name: "T"}, []string{"a", "b"}); err != nil {
+	if err := ss.AddTarget(&bake.Target{Name: "T"}, &bake.Readset{Contents: []string{"a", "b"}}); err != nil {
 		t.Fatal(err)
 	}
 
@@ -108,7 +128,7 @@ func TestSnapshot_IsTargetDirty_Dirs(t *testing.T) {
 	MustWriteFile(filepath.Join(ss.Root(), "a/b"), []byte("0"))
 
 	// Add target with input files.
-	if err := ss.AddTarget(&bake.Target{Name: "T"}, []string{"a"}); err != nil {
+	if err := ss.AddTarget(&bake.Target{Name: "T"}, &bake.Readset{Contents: []string{"a"}}); err != nil {
 		t.Fatal(err)
 	}
 
@@ -126,6 +146,308 @@ func TestSnapshot_IsTargetDirty_Dirs(t *testing.T) {
 	}
 }
 
+// Ensures that a target is marked as dirty if a file that was missing during the build now exists.
+func TestSnapshot_IsTargetDirty_Missing(t *testing.T) {
+	ss := NewSnapshot()
+	defer ss.Close()
+
+	// Add target that probed for a file that didn't exist.
+	if err := ss.AddTarget(&bake.Target{Name: "T"}, &bake.Readset{Misses: []string{"/a"}}); err != nil {
+		t.Fatal(err)
+	}
+	if dirty, err := ss.IsTargetDirty(&bake.Target{Name: "T"}); err != nil {
+		t.Fatal(err)
+	} else if dirty {
+		t.Fatal("expected not dirty")
+	}
+
+	// Create the file and verify it's dirty.
+	MustWriteFile(filepath.Join(ss.Root(), "a"), []byte("0"))
+	if dirty, err := ss.IsTargetDirty(&bake.Target{Name: "T"}); err != nil {
+		t.Fatal(err)
+	} else if !dirty {
+		t.Fatal("expected dirty")
+	}
+}
+
+// Ensures that a file whose metadata was read is only dirty when its metadata changes.
+func TestSnapshot_IsTargetDirty_Stat(t *testing.T) {
+	ss := NewSnapshot()
+	defer ss.Close()
+
+	MustWriteFile(filepath.Join(ss.Root(), "a"), []byte("0"))
+	MustWriteFile(filepath.Join(ss.Root(), "dir/b"), []byte("0"))
+	if err := ss.AddTarget(&bake.Target{Name: "T"}, &bake.Readset{Stats: []string{"/a", "/dir"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Adding a file to a stat'd directory doesn't change its metadata.
+	MustWriteFile(filepath.Join(ss.Root(), "dir/c"), []byte("0"))
+	if dirty, err := ss.IsTargetDirty(&bake.Target{Name: "T"}); err != nil {
+		t.Fatal(err)
+	} else if dirty {
+		t.Fatal("expected not dirty")
+	}
+
+	// Changing a stat'd file's size does.
+	MustWriteFile(filepath.Join(ss.Root(), "a"), []byte("00"))
+	if dirty, err := ss.IsTargetDirty(&bake.Target{Name: "T"}); err != nil {
+		t.Fatal(err)
+	} else if !dirty {
+		t.Fatal("expected dirty")
+	}
+}
+
+// Ensures that a listed directory is dirty when its entries change but not their contents.
+func TestSnapshot_IsTargetDirty_Listing(t *testing.T) {
+	ss := NewSnapshot()
+	defer ss.Close()
+
+	MustWriteFile(filepath.Join(ss.Root(), "dir/a"), []byte("0"))
+	if err := ss.AddTarget(&bake.Target{Name: "T"}, &bake.Readset{Listings: []string{"/dir"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Changing an entry's contents doesn't affect the listing.
+	MustWriteFile(filepath.Join(ss.Root(), "dir/a"), []byte("00"))
+	if dirty, err := ss.IsTargetDirty(&bake.Target{Name: "T"}); err != nil {
+		t.Fatal(err)
+	} else if dirty {
+		t.Fatal("expected not dirty")
+	}
+
+	// Adding an entry does.
+	MustWriteFile(filepath.Join(ss.Root(), "dir/b"), []byte("0"))
+	if dirty, err := ss.IsTargetDirty(&bake.Target{Name: "T"}); err != nil {
+		t.Fatal(err)
+	} else if !dirty {
+		t.Fatal("expected dirty")
+	}
+}
+
+// Ensures that only the strongest check is kept for a file accessed in multiple ways.
+func TestSnapshot_AddTarget_MultipleAccess(t *testing.T) {
+	ss := NewSnapshot()
+	defer ss.Close()
+
+	MustWriteFile(filepath.Join(ss.Root(), "a"), []byte("0"))
+	MustWriteFile(filepath.Join(ss.Root(), "b"), []byte("0"))
+	if err := ss.AddTarget(&bake.Target{Name: "T"}, &bake.Readset{
+		Contents: []string{"/a"},
+		Stats:    []string{"/a", "/b"},
+		Misses:   []string{"/b", "/c"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := ss.Target("T")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var a []string
+	for _, in := range info.Inputs {
+		a = append(a, in.Name+":"+in.Kind)
+	}
+	if !reflect.DeepEqual(a, []string{"/a:content", "/b:stat", "/c:missing"}) {
+		t.Fatalf("unexpected inputs: %v", a)
+	}
+}
+
+// Ensures that a target is marked as dirty if a file changes anywhere within a declared directory input.
+func TestSnapshot_IsTargetDirty_Tree(t *testing.T) {
+	ss := NewSnapshot()
+	defer ss.Close()
+
+	// Create a nested directory tree.
+	MustWriteFile(filepath.Join(ss.Root(), "ctx/a/b/c"), []byte("0"))
+	MustWriteFile(filepath.Join(ss.Root(), "ctx/a/b/d.tmp"), []byte("0"))
+
+	// Add target that declares the directory with no files read.
+	target := &bake.Target{Name: "T", Inputs: []string{"ctx"}, Ignore: []string{"*.tmp"}}
+	if err := ss.AddTarget(target, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Update an ignored file and verify it's not dirty.
+	// Sizes change so mtime resolution doesn't matter.
+	MustWriteFile(filepath.Join(ss.Root(), "ctx/a/b/d.tmp"), []byte("00"))
+	if dirty, err := ss.IsTargetDirty(target); err != nil {
+		t.Fatal(err)
+	} else if dirty {
+		t.Fatal("expected not dirty")
+	}
+
+	// Update a nested file and verify it's dirty.
+	MustWriteFile(filepath.Join(ss.Root(), "ctx/a/b/c"), []byte("00"))
+	if dirty, err := ss.IsTargetDirty(target); err != nil {
+		t.Fatal(err)
+	} else if !dirty {
+		t.Fatal("expected dirty")
+	}
+}
+
+// Ensures that read files matching ignore patterns within declared directories are not recorded.
+func TestSnapshot_AddTarget_Ignore(t *testing.T) {
+	ss := NewSnapshot()
+	defer ss.Close()
+
+	MustWriteFile(filepath.Join(ss.Root(), "ctx/.git/index"), []byte("0"))
+	MustWriteFile(filepath.Join(ss.Root(), "ctx/main.go"), []byte("0"))
+	MustWriteFile(filepath.Join(ss.Root(), "other/.git/index"), []byte("0"))
+
+	target := &bake.Target{Name: "T", Inputs: []string{"ctx"}, Ignore: []string{".git"}}
+	if err := ss.AddTarget(target, &bake.Readset{Contents: []string{"/ctx", "/ctx/.git/index", "/ctx/main.go", "/other/.git/index"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := ss.Target("T")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names, kinds []string
+	for _, in := range info.Inputs {
+		names, kinds = append(names, in.Name), append(kinds, in.Kind)
+	}
+	if !reflect.DeepEqual(names, []string{"/ctx/main.go", "/other/.git/index", "ctx"}) {
+		t.Fatalf("unexpected names: %v", names)
+	} else if !reflect.DeepEqual(kinds, []string{"content", "content", "tree"}) {
+		t.Fatalf("unexpected kinds: %v", kinds)
+	}
+}
+
+// Ensure files matching ignore patterns anywhere within a declared directory don't make it dirty.
+func TestSnapshot_IsTargetDirty_IgnoredTree(t *testing.T) {
+	ss := NewSnapshot()
+	defer ss.Close()
+
+	MustWriteFile(filepath.Join(ss.Root(), "ctx/main.go"), []byte("0"))
+	MustWriteFile(filepath.Join(ss.Root(), "ctx/sub/a.go"), []byte("0"))
+
+	target := &bake.Target{Name: "T", Inputs: []string{"ctx"}, Ignore: []string{"*.log"}}
+	if err := ss.AddTarget(target, &bake.Readset{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Add ignored files at the top level and beneath a subdirectory.
+	MustWriteFile(filepath.Join(ss.Root(), "ctx/x.log"), []byte("0"))
+	MustWriteFile(filepath.Join(ss.Root(), "ctx/sub/x.log"), []byte("0"))
+	if dirty, err := ss.IsTargetDirty(target); err != nil {
+		t.Fatal(err)
+	} else if dirty {
+		t.Fatal("expected clean")
+	}
+
+	// Add a file that isn't ignored.
+	MustWriteFile(filepath.Join(ss.Root(), "ctx/x.go"), []byte("0"))
+	if dirty, err := ss.IsTargetDirty(target); err != nil {
+		t.Fatal(err)
+	} else if !dirty {
+		t.Fatal("expected dirty")
+	}
+}
+
+// Ensure a target's recorded state can be read and its inputs checked.
+func TestSnapshot_Target(t *testing.T) {
+	ss := NewSnapshot()
+	defer ss.Close()
+
+	MustWriteFile(filepath.Join(ss.Root(), "a"), []byte("0"))
+	if err := ss.AddTarget(&bake.Target{Name: "T"}, &bake.Readset{Contents: []string{"a"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := ss.Target("T")
+	if err != nil {
+		t.Fatal(err)
+	} else if info.Name != "T" {
+		t.Fatalf("unexpected name: %s", info.Name)
+	} else if info.BuildTime.IsZero() {
+		t.Fatal("expected build time")
+	} else if len(info.Inputs) != 1 || info.Inputs[0].Name != "a" || info.Inputs[0].Content == "" {
+		t.Fatalf("unexpected inputs: %#v", info.Inputs)
+	} else if !reflect.DeepEqual(info.Outputs, []string{"T"}) || info.Declared != nil {
+		t.Fatalf("unexpected outputs: %#v, %#v", info.Outputs, info.Declared)
+	}
+
+	// Verify input is clean until it is removed.
+	if dirty, err := ss.IsInputDirty(info, info.Inputs[0]); err != nil {
+		t.Fatal(err)
+	} else if dirty {
+		t.Fatal("expected clean")
+	}
+
+	MustRemoveAll(filepath.Join(ss.Root(), "a"))
+	if dirty, err := ss.IsInputDirty(info, info.Inputs[0]); err != nil {
+		t.Fatal(err)
+	} else if !dirty {
+		t.Fatal("expected dirty")
+	}
+}
+
+// Ensure targets that no longer exist in a package can be found and removed.
+func TestSnapshot_OrphanedTargets(t *testing.T) {
+	ss := NewSnapshot()
+	defer ss.Close()
+
+	// Record targets from a previous build.
+	for _, target := range []*bake.Target{
+		{Name: "bin/a"},
+		{Name: "bin/b"},
+		{Name: "clean", Phony: true},
+	} {
+		if err := ss.AddTarget(target, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only "bin/a" still exists in the package.
+	pkg := &bake.Package{Targets: []*bake.Target{{Name: "bin/a"}}}
+	if a, err := ss.OrphanedTargets(pkg); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(a, []string{"bin/b", "clean"}) {
+		t.Fatalf("unexpected orphans: %v", a)
+	}
+
+	// Targets created by a pattern rule are not orphaned.
+	pkg.Rules = []*bake.Rule{{Name: "bin/%"}}
+	if a, err := ss.OrphanedTargets(pkg); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(a, []string{"clean"}) {
+		t.Fatalf("unexpected orphans: %v", a)
+	}
+
+	// Verify recorded outputs of orphans.
+	if info, err := ss.Target("bin/b"); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(info.Outputs, []string{"bin/b"}) {
+		t.Fatalf("unexpected outputs: %v", info.Outputs)
+	}
+
+	// Remove orphans and verify only "bin/a" remains.
+	if err := ss.RemoveTarget("bin/b"); err != nil {
+		t.Fatal(err)
+	} else if err := ss.RemoveTarget("clean"); err != nil {
+		t.Fatal(err)
+	}
+	if a, err := ss.TargetNames(); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(a, []string{"bin/a"}) {
+		t.Fatalf("unexpected names: %v", a)
+	}
+}
+
+// Ensure removing a target that doesn't exist returns an error.
+func TestSnapshot_RemoveTarget_ErrSnapshotTargetNotFound(t *testing.T) {
+	ss := NewSnapshot()
+	defer ss.Close()
+
+	if err := ss.RemoveTarget("no_such_target"); err != bake.ErrSnapshotTargetNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
 // Snapshot represents a test wrapper for bake.Snapshot.
 type Snapshot struct {
 	*bake.Snapshot
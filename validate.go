@@ -0,0 +1,166 @@
+package bake
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Validate checks that every dependency of every target resolves to at least
+// one target in the package, creating targets from pattern rules as needed.
+// Returns a *ValidationError listing the dependencies that don't resolve.
+//
+// Warnings are returned for non-phony targets that depend on phony targets.
+// Phony targets don't produce files so the dependency usually only orders
+// the build, and it may be a sign the wrong target was referenced.
+func (p *Package) Validate() (warnings []string, err error) {
+	var errs []error
+	for i := 0; i < len(p.Targets); i++ {
+		t := p.Targets[i]
+		for _, pattern := range t.Dependencies {
+			targets, err := p.ResolveTargets(pattern)
+			if err != nil {
+				errs = append(errs, &UnknownDependencyError{Target: t, Dependency: pattern, Err: err})
+				continue
+			} else if len(targets) == 0 {
+				errs = append(errs, &UnknownDependencyError{Target: t, Dependency: pattern, Suggestions: p.suggest(pattern)})
+				continue
+			}
+
+			if t.Phony {
+				continue
+			}
+			for _, dep := range targets {
+				if dep.Phony {
+					warnings = append(warnings, fmt.Sprintf("%s: target %q depends on phony target %q", t.Location, t.Name, dep.Name))
+				}
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return warnings, &ValidationError{Errors: errs}
+	}
+	return warnings, nil
+}
+
+// suggest returns up to three target names or outputs similar to name, most similar first.
+func (p *Package) suggest(name string) []string {
+	// Allow roughly one edit for every three characters.
+	max := len(name) / 3
+	if max < 1 {
+		max = 1
+	}
+
+	seen := make(map[string]struct{})
+	var a suggestions
+	for _, t := range p.Targets {
+		for _, candidate := range append([]string{t.Name}, t.Outputs...) {
+			if _, ok := seen[candidate]; ok {
+				continue
+			}
+			seen[candidate] = struct{}{}
+
+			if d := levenshtein(name, candidate); d <= max {
+				a = append(a, suggestion{name: candidate, distance: d})
+			}
+		}
+	}
+	sort.Sort(a)
+
+	var names []string
+	for i := 0; i < len(a) && i < 3; i++ {
+		names = append(names, a[i].name)
+	}
+	return names
+}
+
+// UnknownDependencyError is returned when a dependency matches no target or output.
+type UnknownDependencyError struct {
+	Target      *Target
+	Dependency  string
+	Suggestions []string
+	Err         error // set if the dependency is an invalid pattern
+}
+
+// Error returns the error message.
+func (e *UnknownDependencyError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: target %q depends on %q: %s", e.Target.Location, e.Target.Name, e.Dependency, e.Err)
+	}
+
+	msg := fmt.Sprintf("%s: target %q depends on %q, which matches no target or output", e.Target.Location, e.Target.Name, e.Dependency)
+	if len(e.Suggestions) > 0 {
+		quoted := make([]string, len(e.Suggestions))
+		for i, s := range e.Suggestions {
+			quoted[i] = fmt.Sprintf("%q", s)
+		}
+		msg += fmt.Sprintf(" (did you mean %s?)", strings.Join(quoted, " or "))
+	}
+	return msg
+}
+
+// ValidationError is returned when a package contains invalid references.
+type ValidationError struct {
+	Errors []error
+}
+
+// Error returns the messages of all errors, one per line.
+func (e *ValidationError) Error() string {
+	a := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		a[i] = err.Error()
+	}
+	return strings.Join(a, "\n")
+}
+
+// levenshtein returns the number of single character edits to change a into b.
+func levenshtein(a, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = minInt(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
+
+// minInt returns the smallest of a list of integers.
+func minInt(a ...int) int {
+	m := a[0]
+	for _, v := range a[1:] {
+		if v < m {
+			m = v
+		}
+	}
+	return m
+}
+
+// suggestion represents a candidate name and its distance from a misspelled name.
+type suggestion struct {
+	name     string
+	distance int
+}
+
+// suggestions represents a list of suggestions sortable by distance, then name.
+type suggestions []suggestion
+
+func (a suggestions) Len() int      { return len(a) }
+func (a suggestions) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a suggestions) Less(i, j int) bool {
+	if a[i].distance != a[j].distance {
+		return a[i].distance < a[j].distance
+	}
+	return a[i].name < a[j].name
+}
@@ -0,0 +1,104 @@
+package bake_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/flynn/bake"
+)
+
+// Ensure a package with resolvable dependencies is valid.
+func TestPackage_Validate(t *testing.T) {
+	pkg := &bake.Package{
+		Targets: []*bake.Target{
+			{Name: "bin/app", Outputs: []string{"bin/app"}},
+			{Name: "test", Phony: true, Dependencies: []string{"bin/app"}},
+			{Name: "all", Phony: true, Dependencies: []string{"test", "bin/*"}},
+		},
+	}
+	if warnings, err := pkg.Validate(); err != nil {
+		t.Fatal(err)
+	} else if len(warnings) != 0 {
+		t.Fatalf("unexpected warnings: %#v", warnings)
+	}
+}
+
+// Ensure dependencies that match nothing are reported with suggestions.
+func TestPackage_Validate_ErrUnknownDependency(t *testing.T) {
+	pkg := &bake.Package{
+		Targets: []*bake.Target{
+			{Name: "bin/app", Outputs: []string{"bin/app"}},
+			{Name: "bin/api", Outputs: []string{"bin/api"}},
+			{Name: "test", Phony: true, Dependencies: []string{"bin/ap", "vendor"}, Location: bake.Location{File: "Bakefile.lua", Line: 3}},
+		},
+	}
+
+	_, err := pkg.Validate()
+	verr, ok := err.(*bake.ValidationError)
+	if !ok {
+		t.Fatalf("unexpected error: %#v", err)
+	} else if len(verr.Errors) != 2 {
+		t.Fatalf("unexpected error count: %d", len(verr.Errors))
+	}
+
+	if e := verr.Errors[0].(*bake.UnknownDependencyError); !reflect.DeepEqual(e.Suggestions, []string{"bin/api", "bin/app"}) {
+		t.Fatalf("unexpected suggestions: %#v", e.Suggestions)
+	} else if e.Error() != `Bakefile.lua:3: target "test" depends on "bin/ap", which matches no target or output (did you mean "bin/api" or "bin/app"?)` {
+		t.Fatalf("unexpected message: %s", e.Error())
+	}
+
+	if e := verr.Errors[1].(*bake.UnknownDependencyError); len(e.Suggestions) != 0 {
+		t.Fatalf("unexpected suggestions: %#v", e.Suggestions)
+	} else if e.Error() != `Bakefile.lua:3: target "test" depends on "vendor", which matches no target or output` {
+		t.Fatalf("unexpected message: %s", e.Error())
+	}
+}
+
+// Ensure invalid dependency patterns are reported.
+func TestPackage_Validate_ErrBadPattern(t *testing.T) {
+	pkg := &bake.Package{
+		Targets: []*bake.Target{
+			{Name: "test", Dependencies: []string{"bin/["}},
+		},
+	}
+	if _, err := pkg.Validate(); err == nil {
+		t.Fatal("expected error")
+	} else if e := err.(*bake.ValidationError).Errors[0].(*bake.UnknownDependencyError); e.Err == nil {
+		t.Fatalf("expected pattern error: %#v", e)
+	}
+}
+
+// Ensure non-phony targets depending on phony targets produce a warning.
+func TestPackage_Validate_PhonyWarning(t *testing.T) {
+	pkg := &bake.Package{
+		Targets: []*bake.Target{
+			{Name: "generate", Phony: true},
+			{Name: "bin/app", Outputs: []string{"bin/app"}, Dependencies: []string{"generate"}},
+		},
+	}
+	if warnings, err := pkg.Validate(); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(warnings, []string{`-: target "bin/app" depends on phony target "generate"`}) {
+		t.Fatalf("unexpected warnings: %#v", warnings)
+	}
+}
+
+// Ensure dependencies matching a pattern rule are valid.
+func TestPackage_Validate_Rule(t *testing.T) {
+	pkg := &bake.Package{
+		Targets: []*bake.Target{
+			{Name: "bin/app", Dependencies: []string{"gen/a.pb.go"}},
+		},
+		Rules: []*bake.Rule{{
+			Name: "gen/%.pb.go",
+			Instantiate: func(stem string) (*bake.Target, error) {
+				return &bake.Target{Name: "gen/" + stem + ".pb.go", Dependencies: []string{"proto/" + stem + ".proto"}}, nil
+			},
+		}},
+	}
+
+	// The created target is validated as well.
+	if _, err := pkg.Validate(); err == nil || err.Error() != `-: target "gen/a.pb.go" depends on "proto/a.proto", which matches no target or output` {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}